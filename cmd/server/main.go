@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	logrus "github.com/sirupsen/logrus"
 	"github.com/yutopp/go-rtmp"
 
+	"tokuly-live-rtmp-server/pkg/admin"
 	"tokuly-live-rtmp-server/pkg/archive"
+	"tokuly-live-rtmp-server/pkg/certs"
 	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/drm"
+	"tokuly-live-rtmp-server/pkg/events"
+	"tokuly-live-rtmp-server/pkg/hls"
+	"tokuly-live-rtmp-server/pkg/httpflv"
+	"tokuly-live-rtmp-server/pkg/logging"
 	rtmpsrv "tokuly-live-rtmp-server/pkg/rtmp"
 	"tokuly-live-rtmp-server/pkg/policy"
 	"tokuly-live-rtmp-server/pkg/storage"
@@ -18,13 +30,26 @@ import (
 
 func main() {
 	cfg := config.Load()
+	logger, err := logging.Setup(cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		log.Fatalf("invalid log config: %v", err)
+	}
 
 	st := storage.New(cfg.Storage.RootDir, cfg.Storage.RewindRoot, cfg.Storage.EnableRewind)
 	manager := rtmpsrv.NewStreamManager(cfg.Limits.MaxConcurrentStreams, st, 30*time.Second)
 
-	pol := &policy.HTTPPolicy{
+	encoder, err := policy.NewEncoder(cfg.Auth.RequestEncoding)
+	if err != nil {
+		logger.Fatalf("invalid auth config: %v", err)
+	}
+	httpPolicy := &policy.HTTPPolicy{
 		AuthURL:       cfg.Auth.AuthURL,
 		StreamEndURL:  cfg.Auth.StreamEndURL,
+		PlaybackAuthURL: cfg.Auth.PlaybackAuthURL,
+		VideoInfoURL:     cfg.Auth.VideoInfoURL,
+		ArchiveStatusURL: cfg.Auth.ArchiveStatusURL,
+		Encoder:          encoder,
+		FieldNames:       cfg.Auth.FieldNames,
 		APIKey:        cfg.Auth.APIKey,
 		Version:       cfg.Auth.Version,
 		Timeout:       cfg.Auth.AuthTimeout,
@@ -38,23 +63,41 @@ func main() {
 			AllowNoAudio:         cfg.Policy.AllowNoAudio,
 			OnGOPTooLong:         cfg.Policy.OnGOPTooLong,
 			RequireAACLC:         cfg.Policy.RequireAACLC,
-			RejectIfVideoNotH264: cfg.Policy.RejectIfVideoNotH264,
-			RejectIfAudioNotAAC:  cfg.Policy.RejectIfAudioNotAAC,
+			AllowedVideoCodecs:   cfg.Policy.AllowedVideoCodecs,
+			AllowedAudioCodecs:   cfg.Policy.AllowedAudioCodecs,
 		},
 	}
-	archiveManager := archive.NewManager(cfg.Archive, pol, cfg.Policy.AllowNoAudio)
+	var pol policy.Policy = httpPolicy
+	if cfg.Auth.KeyFile != "" {
+		filePolicy, err := policy.NewFilePolicy(cfg.Auth.KeyFile, httpPolicy.Config)
+		if err != nil {
+			logger.Fatalf("failed to load key file: %v", err)
+		}
+		filePolicy.Watch(cfg.Auth.KeyFileReloadInterval)
+		pol = filePolicy
+		if cfg.Auth.KeyFileFallback {
+			pol = &policy.CompositePolicy{File: filePolicy, Fallback: httpPolicy}
+		}
+	} else if cfg.Auth.AuthURL == "" && !cfg.DebugRTMP {
+		logger.Warn("no auth url or key file configured; every stream key is accepted")
+	}
+	dispatcher, err := events.NewDispatcher(cfg.Webhooks)
+	if err != nil {
+		logger.Fatalf("webhook setup error: %v", err)
+	}
+	dispatcher.Start()
+	archiveManager := archive.NewManager(cfg.Archive, pol, cfg.Policy.AllowNoAudio, dispatcher)
 
 	listener, err := net.Listen("tcp", cfg.RTMP.ListenAddr)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logger.Fatalf("failed to listen: %v", err)
 	}
-	log.Printf("rtmp listening on %s", cfg.RTMP.ListenAddr)
+	logger.Infof("rtmp listening on %s", cfg.RTMP.ListenAddr)
 
-	logger := logrus.New()
-	server := rtmp.NewServer(&rtmp.ServerConfig{
+	serverConfig := &rtmp.ServerConfig{
 		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
-			h := rtmpsrv.NewHandler(cfg, pol, st, manager, archiveManager, conn)
-			return conn, &rtmp.ConnConfig{
+			h := rtmpsrv.NewHandler(cfg, pol, st, manager, archiveManager, dispatcher, conn, logrus.NewEntry(logger))
+			return h.Conn(), &rtmp.ConnConfig{
 				Handler: h,
 				ControlState: rtmp.StreamControlStateConfig{
 					DefaultBandwidthWindowSize: 6 * 1024 * 1024 / 8,
@@ -62,9 +105,131 @@ func main() {
 				Logger: logger,
 			}
 		},
-	})
+	}
 
+	if cfg.RTMP.TLSListenAddr != "" {
+		tlsListener, err := listenTLS(cfg.RTMP)
+		if err != nil {
+			logger.Fatalf("failed to listen rtmps: %v", err)
+		}
+		logger.Infof("rtmps listening on %s", cfg.RTMP.TLSListenAddr)
+		tlsServer := rtmp.NewServer(serverConfig)
+		go func() {
+			if err := tlsServer.Serve(tlsListener); err != nil {
+				logger.Fatalf("rtmps server error: %v", err)
+			}
+		}()
+	}
+
+	keys, err := keyServer(cfg, pol)
+	if err != nil {
+		logger.Fatalf("invalid encryption config: %v", err)
+	}
+
+	if cfg.HTTP.ListenAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(httpflv.Prefix, httpflv.NewServer(cfg.HTTP, manager, pol))
+		if keys != nil {
+			mux.Handle(keys.Prefix, keys)
+		}
+		origin := hls.NewOrigin(hls.OriginConfig{
+			LivePrefix:   cfg.HTTP.HLSPrefix,
+			RewindPrefix: cfg.HTTP.RewindPrefix,
+			AllowOrigin:  cfg.HTTP.AllowOrigin,
+			InitFilename: cfg.HLS.InitFilename,
+		}, st)
+		if cfg.HTTP.HLSPrefix != "" {
+			mux.Handle(cfg.HTTP.HLSPrefix, origin)
+		}
+		if cfg.HTTP.RewindPrefix != "" {
+			mux.Handle(cfg.HTTP.RewindPrefix, origin)
+		}
+		httpServer := &http.Server{
+			Addr:              cfg.HTTP.ListenAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		logger.Infof("http listening on %s", cfg.HTTP.ListenAddr)
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil {
+				logger.Fatalf("http server error: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Admin.ListenAddr == "" && cfg.Admin.MetricsPath != "" {
+		logger.Info("metrics disabled: they are served on the admin listener, set ADMIN_ADDR")
+	}
+	if cfg.Admin.ListenAddr != "" {
+		if cfg.Admin.Token == "" {
+			logger.Fatalf("admin api needs ADMIN_TOKEN")
+		}
+		adminServer := &http.Server{
+			Addr:              cfg.Admin.ListenAddr,
+			Handler:           admin.NewServer(cfg.Admin, manager, archiveManager),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		logger.Infof("admin listening on %s", cfg.Admin.ListenAddr)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				logger.Fatalf("admin server error: %v", err)
+			}
+		}()
+	}
+
+	server := rtmp.NewServer(serverConfig)
 	if err := server.Serve(listener); err != nil {
-		log.Fatalf("server error: %v", err)
+		logger.Fatalf("server error: %v", err)
+	}
+}
+
+// keyServer serves file provider keys at the path KeyURITemplate renders.
+// It fails when the template points players at a path nothing serves.
+func keyServer(cfg config.Config, pol policy.Policy) (*drm.KeyServer, error) {
+	tmpl := cfg.Encryption.KeyURITemplate
+	if !cfg.Encryption.Enable || !strings.HasPrefix(tmpl, "/") {
+		return nil, nil
+	}
+	if cfg.Encryption.Provider == "http" {
+		return nil, fmt.Errorf("key uri template %q is local but keys come from the key service; set KEY_URI_TEMPLATE to where it serves them", tmpl)
+	}
+	prefix, ok := drm.KeyServerPrefix(tmpl)
+	if !ok {
+		return nil, fmt.Errorf("key uri template %q must end in {stream}/{kid} or {stream}/{period} to be served", tmpl)
+	}
+	if cfg.HTTP.ListenAddr == "" {
+		return nil, fmt.Errorf("key uri template %q needs HTTP_ADDR to be served", tmpl)
+	}
+	return &drm.KeyServer{
+		Prefix:      prefix,
+		Provider:    &drm.FileProvider{Dir: cfg.Encryption.KeyDir},
+		AllowOrigin: cfg.HTTP.AllowOrigin,
+		Authorize: func(ctx context.Context, streamName, token, remoteIP string) bool {
+			allowed, err := policy.AllowPlayback(ctx, pol, streamName, token, remoteIP)
+			if err != nil {
+				logging.FromContext(ctx).WithError(err).WithField(logging.FieldStreamName, streamName).Warn("key auth error")
+			}
+			return allowed
+		},
+	}, nil
+}
+
+func listenTLS(cfg config.RTMPConfig) (net.Listener, error) {
+	if len(cfg.TLSCertFiles) == 0 || len(cfg.TLSCertFiles) != len(cfg.TLSKeyFiles) {
+		return nil, fmt.Errorf("rtmps needs matching cert and key files")
+	}
+	pairs := make([]certs.Pair, 0, len(cfg.TLSCertFiles))
+	for i := range cfg.TLSCertFiles {
+		pairs = append(pairs, certs.Pair{CertFile: cfg.TLSCertFiles[i], KeyFile: cfg.TLSKeyFiles[i]})
+	}
+	store, err := certs.NewStore(pairs)
+	if err != nil {
+		return nil, err
+	}
+	store.Watch(cfg.TLSReloadInterval)
+	inner, err := net.Listen("tcp", cfg.TLSListenAddr)
+	if err != nil {
+		return nil, err
 	}
+	return tls.NewListener(inner, store.TLSConfig()), nil
 }
@@ -0,0 +1,125 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/archive"
+	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/logging"
+	rtmpsrv "tokuly-live-rtmp-server/pkg/rtmp"
+)
+
+// Server is the admin API:
+//
+//	GET    /sessions                    list live sessions
+//	GET    /sessions/{stream}           one session
+//	DELETE /sessions/{stream}           disconnect the publisher
+//	POST   /archives/{stream}/finalize  end a pending reconnect grace
+//	GET    {MetricsPath}                Prometheus metrics
+//
+// Sessions are addressed by stream name; stream keys never leave the server.
+type Server struct {
+	cfg     config.AdminConfig
+	manager *rtmpsrv.StreamManager
+	archive *archive.Manager
+	mux     *http.ServeMux
+}
+
+func NewServer(cfg config.AdminConfig, manager *rtmpsrv.StreamManager, archiveManager *archive.Manager) *Server {
+	s := &Server{cfg: cfg, manager: manager, archive: archiveManager, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /sessions", s.listSessions)
+	s.mux.HandleFunc("GET /sessions/{stream}", s.getSession)
+	s.mux.HandleFunc("DELETE /sessions/{stream}", s.disconnectSession)
+	s.mux.HandleFunc("POST /archives/{stream}/finalize", s.finalizeArchive)
+	if cfg.MetricsPath != "" {
+		s.mux.Handle("GET "+cfg.MetricsPath, promhttp.Handler())
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.cfg.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := s.manager.Sessions()
+	infos := make([]rtmpsrv.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StreamName < infos[j].StreamName })
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) {
+	session := s.manager.LookupByName(r.PathValue("stream"))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, session.Info())
+}
+
+func (s *Server) disconnectSession(w http.ResponseWriter, r *http.Request) {
+	session := s.manager.LookupByName(r.PathValue("stream"))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	auditLog(r, session.StreamName, "disconnect").Info("admin action")
+	session.Disconnect()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) finalizeArchive(w http.ResponseWriter, r *http.Request) {
+	streamName := r.PathValue("stream")
+	if err := s.archive.CancelGrace(streamName); err != nil {
+		if errors.Is(err, archive.ErrNoPendingGrace) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, streamName, "archive_finalize").Info("admin action")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Default().WithError(err).Warn("admin response error")
+	}
+}
+
+// auditLog is the entry recording an admin action taken on a stream.
+func auditLog(r *http.Request, streamName, action string) *logrus.Entry {
+	return logging.FromContext(r.Context()).WithFields(logrus.Fields{
+		logging.FieldStreamName: streamName,
+		"remote_addr":           r.RemoteAddr,
+		"action":                action,
+	})
+}
@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"tokuly-live-rtmp-server/pkg/archive"
+	"tokuly-live-rtmp-server/pkg/config"
+	rtmpsrv "tokuly-live-rtmp-server/pkg/rtmp"
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+const testToken = "admin-secret"
+
+func newTestServer(t *testing.T) (*Server, *rtmpsrv.StreamManager) {
+	t.Helper()
+	manager := rtmpsrv.NewStreamManager(0, nil, 0)
+	archiveManager := archive.NewManager(config.ArchiveConfig{Enable: true}, nil, false, nil)
+	return NewServer(config.AdminConfig{Token: testToken, MetricsPath: "/metrics"}, manager, archiveManager), manager
+}
+
+func serve(s *Server, method, target, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = "192.0.2.10:40000"
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerStatus(t *testing.T) {
+	s, _ := newTestServer(t)
+	bearer := "Bearer " + testToken
+	for _, tc := range []struct {
+		name          string
+		method        string
+		target        string
+		authorization string
+		want          int
+	}{
+		{"missing token", http.MethodGet, "/sessions", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/sessions", "Bearer wrong", http.StatusUnauthorized},
+		{"token without scheme", http.MethodGet, "/sessions", testToken, http.StatusUnauthorized},
+		{"metrics need the token", http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/sessions", bearer, http.StatusOK},
+		{"unknown session", http.MethodGet, "/sessions/nobody", bearer, http.StatusNotFound},
+		{"disconnect unknown session", http.MethodDelete, "/sessions/nobody", bearer, http.StatusNotFound},
+		{"finalize without grace", http.MethodPost, "/archives/nobody/finalize", bearer, http.StatusConflict},
+		{"metrics", http.MethodGet, "/metrics", bearer, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(s, tc.method, tc.target, tc.authorization)
+			if rec.Code != tc.want {
+				t.Fatalf("%s %s = %d, want %d: %s", tc.method, tc.target, rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestDisconnectIsAudited(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	s, manager := newTestServer(t)
+	st := storage.New(t.TempDir(), "", false)
+	session := rtmpsrv.NewSession(config.DefaultConfig(), nil, st, nil, nil, "session-1", "key-1", "studio", "live", "198.51.100.1", "", false, logrus.NewEntry(logrus.New()))
+	disconnected := false
+	session.SetDisconnect(func() { disconnected = true })
+	if err := manager.Register(session); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(s, http.MethodDelete, "/sessions/studio", "Bearer "+testToken)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if !disconnected {
+		t.Fatal("publisher was not disconnected")
+	}
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("no audit log entry")
+	}
+	for field, want := range map[string]string{"stream_name": "studio", "remote_addr": "192.0.2.10:40000", "action": "disconnect"} {
+		if got := entry.Data[field]; got != want {
+			t.Errorf("audit %s = %v, want %q", field, got, want)
+		}
+	}
+}
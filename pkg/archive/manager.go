@@ -2,9 +2,9 @@ package archive
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,21 +13,47 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/events"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metrics"
 	"tokuly-live-rtmp-server/pkg/policy"
+	"tokuly-live-rtmp-server/pkg/storage"
 )
 
 var ErrArchiveBusy = errors.New("archive busy")
 var ErrArchiveActive = errors.New("archive already active")
+var ErrNoPendingGrace = errors.New("archive has no pending reconnect grace")
+
+// Archive states reported by State.
+const (
+	StateNone       = ""
+	StateActive     = "active"
+	StateGrace      = "grace"
+	StateFinalizing = "finalizing"
+	StateConverting = "converting"
+	StateDone       = "done"
+)
 
 type Manager struct {
 	mu           sync.Mutex
 	cfg          config.ArchiveConfig
 	policy       policy.Policy
 	allowNoAudio bool
+	events       *events.Dispatcher
 	states       map[string]*ArchiveState
 }
 
+// Publisher describes the session feeding an archive: the labels of its
+// conversion metrics, its logger and the source of its events.
+type Publisher struct {
+	Metrics metrics.Stream
+	Log     *logrus.Entry
+	Event   events.Source
+}
+
 type ArchiveState struct {
 	streamName string
 	recordDir  string
@@ -40,13 +66,24 @@ type ArchiveState struct {
 	finalizing bool
 	converting bool
 	timer      *time.Timer
+	keyIDs     []string
+	publisher  Publisher
+}
+
+// archiveMetadata is written next to the recording so the key IDs used for
+// the live and rewind output can be found later.
+type archiveMetadata struct {
+	StreamName string   `json:"stream_name"`
+	StartUTC   string   `json:"start_utc"`
+	KeyIDs     []string `json:"key_ids"`
 }
 
-func NewManager(cfg config.ArchiveConfig, pol policy.Policy, allowNoAudio bool) *Manager {
+func NewManager(cfg config.ArchiveConfig, pol policy.Policy, allowNoAudio bool, dispatcher *events.Dispatcher) *Manager {
 	return &Manager{
 		cfg:          cfg,
 		policy:       pol,
 		allowNoAudio: allowNoAudio,
+		events:       dispatcher,
 		states:       make(map[string]*ArchiveState),
 	}
 }
@@ -74,10 +111,14 @@ func (m *Manager) CanPublish(streamName string) error {
 	return nil
 }
 
-func (m *Manager) Start(streamName string, bitrate int64) (*Recorder, error) {
+// Start opens or resumes the archive of a stream for publisher.
+func (m *Manager) Start(streamName string, bitrate int64, publisher Publisher) (*Recorder, error) {
 	if !m.Enabled() || streamName == "" {
 		return nil, nil
 	}
+	if publisher.Log == nil {
+		publisher.Log = logging.Default()
+	}
 	m.mu.Lock()
 	state := m.states[streamName]
 	if state != nil {
@@ -96,6 +137,7 @@ func (m *Manager) Start(streamName string, bitrate int64) (*Recorder, error) {
 			}
 			state.closing = false
 			state.active = true
+			state.publisher = publisher
 			rec := state.recorder
 			m.mu.Unlock()
 			if rec != nil {
@@ -139,6 +181,7 @@ func (m *Manager) Start(streamName string, bitrate int64) (*Recorder, error) {
 		MaxDurationLow:      m.cfg.MaxDurationLow,
 		MaxSizeHighBytes:    m.cfg.MaxSizeHighBytes,
 		AllowNoAudio:        m.allowNoAudio,
+		Log:                 publisher.Log,
 	}, recordPath)
 	if err != nil {
 		m.mu.Unlock()
@@ -154,12 +197,52 @@ func (m *Manager) Start(streamName string, bitrate int64) (*Recorder, error) {
 		startTime:  start,
 		recorder:   recorder,
 		active:     true,
+		publisher:  publisher,
 	}
 	m.states[streamName] = state
 	m.mu.Unlock()
+	m.emit(events.ArchiveStarted, publisher, "", map[string]interface{}{"start": start.Format(time.RFC3339)})
 	return recorder, nil
 }
 
+// RecordKeyID adds an encryption key ID to the metadata of the stream's
+// current archive.
+func (m *Manager) RecordKeyID(streamName, keyID string) {
+	if !m.Enabled() || streamName == "" || keyID == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.states[streamName]
+	if state == nil || state.recordDir == "" {
+		return
+	}
+	for _, id := range state.keyIDs {
+		if id == keyID {
+			return
+		}
+	}
+	state.keyIDs = append(state.keyIDs, keyID)
+	if err := m.writeMetadataLocked(state); err != nil {
+		state.publisher.Log.WithError(err).Error("archive metadata error")
+	}
+}
+
+func (m *Manager) writeMetadataLocked(state *ArchiveState) error {
+	if m.cfg.MetadataFilename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(archiveMetadata{
+		StreamName: state.streamName,
+		StartUTC:   state.startTime.UTC().Format("20060102T150405Z"),
+		KeyIDs:     state.keyIDs,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(filepath.Join(state.recordDir, m.cfg.MetadataFilename), data)
+}
+
 func (m *Manager) EndSession(streamName string) {
 	if !m.Enabled() || streamName == "" {
 		return
@@ -195,6 +278,51 @@ func (m *Manager) EndSession(streamName string) {
 	}
 }
 
+// State reports where the stream's archive is in its lifecycle.
+func (m *Manager) State(streamName string) string {
+	if !m.Enabled() || streamName == "" {
+		return StateNone
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.states[streamName]
+	switch {
+	case state == nil:
+		return StateNone
+	case state.converting:
+		return StateConverting
+	case state.finalizing:
+		return StateFinalizing
+	case state.closing:
+		return StateGrace
+	case state.active:
+		return StateActive
+	default:
+		return StateDone
+	}
+}
+
+// CancelGrace stops waiting for the publisher to reconnect and finalizes the
+// archive now instead of when the reconnect grace runs out.
+func (m *Manager) CancelGrace(streamName string) error {
+	if !m.Enabled() || streamName == "" {
+		return ErrNoPendingGrace
+	}
+	m.mu.Lock()
+	state := m.states[streamName]
+	if state == nil || !state.closing || state.finalizing || state.converting {
+		m.mu.Unlock()
+		return ErrNoPendingGrace
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	m.mu.Unlock()
+	go m.finalize(streamName)
+	return nil
+}
+
 func (m *Manager) finalize(streamName string) {
 	if !m.Enabled() || streamName == "" {
 		return
@@ -203,6 +331,7 @@ func (m *Manager) finalize(streamName string) {
 		recorder   *Recorder
 		recordPath string
 		hlsDir     string
+		publisher  Publisher
 	)
 	m.mu.Lock()
 	state := m.states[streamName]
@@ -219,6 +348,7 @@ func (m *Manager) finalize(streamName string) {
 	recorder = state.recorder
 	recordPath = state.recordPath
 	hlsDir = state.hlsDir
+	publisher = state.publisher
 	m.mu.Unlock()
 
 	if recorder != nil {
@@ -234,12 +364,22 @@ func (m *Manager) finalize(streamName string) {
 	state.converting = true
 	m.mu.Unlock()
 
+	convertStart := time.Now()
 	err := m.convertToHLS(recordPath, hlsDir)
+	convertSeconds := time.Since(convertStart).Seconds()
+	log := publisher.Log
+	outcome := metrics.OutcomeOK
 	if err != nil {
-		log.Printf("archive convert error: stream=%s err=%v", streamName, err)
+		outcome = metrics.OutcomeError
+		log.WithError(err).Error("archive convert error")
+		m.emit(events.ArchiveFailed, publisher, err.Error(), nil)
+	} else {
+		log.Info("archive converted")
+		m.emit(events.ArchiveFinalized, publisher, "", map[string]interface{}{"conversion_seconds": convertSeconds})
 	}
-	if notifyErr := m.notifyArchiveStatus(streamName, err == nil); notifyErr != nil {
-		log.Printf("archive status notify error: stream=%s err=%v", streamName, notifyErr)
+	metrics.ObserveArchiveConversion(publisher.Metrics, outcome, convertSeconds)
+	if notifyErr := m.notifyArchiveStatus(logging.NewContext(context.Background(), log), streamName, err == nil); notifyErr != nil {
+		log.WithError(notifyErr).Warn("archive status notify error")
 	}
 
 	m.mu.Lock()
@@ -258,12 +398,12 @@ func (m *Manager) removeDirsLocked(state *ArchiveState) {
 	}
 	if state.recordDir != "" {
 		if err := os.RemoveAll(state.recordDir); err != nil {
-			log.Printf("archive cleanup error: dir=%s err=%v", state.recordDir, err)
+			state.publisher.Log.WithError(err).WithField("dir", state.recordDir).Warn("archive cleanup error")
 		}
 	}
 	if state.hlsDir != "" {
 		if err := os.RemoveAll(state.hlsDir); err != nil {
-			log.Printf("archive cleanup error: dir=%s err=%v", state.hlsDir, err)
+			state.publisher.Log.WithError(err).WithField("dir", state.hlsDir).Warn("archive cleanup error")
 		}
 	}
 }
@@ -316,11 +456,10 @@ func (m *Manager) convertToHLS(recordPath, hlsDir string) error {
 	return nil
 }
 
-func (m *Manager) notifyArchiveStatus(streamName string, ok bool) error {
+func (m *Manager) notifyArchiveStatus(ctx context.Context, streamName string, ok bool) error {
 	if m.policy == nil {
 		return nil
 	}
-	ctx := context.Background()
 	return m.policy.NotifyArchiveStatus(ctx, streamName, ok)
 }
 
@@ -344,3 +483,12 @@ func formatSeconds(d time.Duration) string {
 	}
 	return strconv.FormatFloat(seconds, 'f', -1, 64)
 }
+
+func (m *Manager) emit(typ events.Type, publisher Publisher, reason string, data map[string]interface{}) {
+	m.events.Emit(events.Event{
+		Type:   typ,
+		Source: publisher.Event,
+		Reason: reason,
+		Data:   data,
+	})
+}
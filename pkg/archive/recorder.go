@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/sirupsen/logrus"
 
+	"tokuly-live-rtmp-server/pkg/logging"
 	"tokuly-live-rtmp-server/pkg/util"
 )
 
@@ -22,6 +23,8 @@ type RecorderConfig struct {
 	MaxDurationLow      time.Duration
 	MaxSizeHighBytes    int64
 	AllowNoAudio        bool
+	// Log is the logger of the session that opened the archive.
+	Log *logrus.Entry
 }
 
 type Recorder struct {
@@ -53,8 +56,8 @@ type Recorder struct {
 	videoID uint32
 	audioID uint32
 
-	avcConfig util.AVCConfig
-	aacConfig util.AACConfig
+	videoConfig util.VideoConfig
+	audioConfig util.AudioConfig
 
 	initWritten bool
 	ignoreAudio bool
@@ -104,6 +107,9 @@ func NewRecorder(cfg RecorderConfig, path string) (*Recorder, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Log == nil {
+		cfg.Log = logging.Default()
+	}
 	rec := &Recorder{
 		cfg:                cfg,
 		path:               path,
@@ -138,22 +144,22 @@ func (r *Recorder) SetBitrate(bitrate int64) {
 	r.maxSizeBytes = r.cfg.MaxSizeHighBytes
 }
 
-func (r *Recorder) UpdateVideoConfig(cfg util.AVCConfig) error {
+func (r *Recorder) UpdateVideoConfig(cfg util.VideoConfig) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if r.initWritten && !util.EqualAVCConfig(r.avcConfig, cfg) {
+	if r.initWritten && !util.EqualVideoConfig(r.videoConfig, cfg) {
 		if r.sessions > 1 {
 			return ErrAppendNotPossible
 		}
 		r.markFailed("video config changed")
 		return nil
 	}
-	r.avcConfig = cfg
+	r.videoConfig = cfg
 	r.videoState.sampleIsVideo = true
 	return r.maybeWriteInit()
 }
 
-func (r *Recorder) UpdateAudioConfig(cfg util.AACConfig) error {
+func (r *Recorder) UpdateAudioConfig(cfg util.AudioConfig) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.initWritten {
@@ -164,7 +170,7 @@ func (r *Recorder) UpdateAudioConfig(cfg util.AACConfig) error {
 			r.ignoreAudio = true
 			return nil
 		}
-		if !equalAACConfig(r.aacConfig, cfg) {
+		if !util.EqualAudioConfig(r.audioConfig, cfg) {
 			if r.sessions > 1 {
 				return ErrAppendNotPossible
 			}
@@ -172,14 +178,14 @@ func (r *Recorder) UpdateAudioConfig(cfg util.AACConfig) error {
 			return nil
 		}
 	}
-	r.aacConfig = cfg
-	if cfg.SampleRate <= 0 {
+	r.audioConfig = cfg
+	if cfg.SampleRate() <= 0 {
 		r.audioTS = 0
 		r.audioState.defaultDurMS = 20
 		return r.maybeWriteInit()
 	}
-	r.audioTS = uint32(cfg.SampleRate)
-	r.audioState.defaultDurMS = int64((1024.0 * 1000.0) / float64(cfg.SampleRate))
+	r.audioTS = uint32(cfg.SampleRate())
+	r.audioState.defaultDurMS = int64(float64(cfg.FrameSamples()) * 1000.0 / float64(cfg.SampleRate()))
 	if r.audioState.defaultDurMS == 0 {
 		r.audioState.defaultDurMS = 20
 	}
@@ -406,31 +412,27 @@ func (r *Recorder) maybeWriteInit() error {
 	if r.initWritten {
 		return nil
 	}
-	if len(r.avcConfig.SPS) == 0 || len(r.avcConfig.PPS) == 0 {
+	if !r.videoConfig.Ready() {
 		return nil
 	}
-	if !r.cfg.AllowNoAudio && r.aacConfig.SampleRate == 0 {
+	if !r.cfg.AllowNoAudio && r.audioConfig.SampleRate() == 0 {
 		return nil
 	}
 	init := mp4.CreateEmptyInit()
 	videoTrak := addEmptyTrack(init, r.videoTS, "video", "und")
-	if err := videoTrak.SetAVCDescriptor("avc1", r.avcConfig.SPS, r.avcConfig.PPS, true); err != nil {
+	if err := util.SetVideoDescriptor(videoTrak, r.videoConfig); err != nil {
 		return err
 	}
 	r.videoID = videoTrak.Tkhd.TrackID
 	r.videoState.trackID = r.videoID
 	r.videoState.timescale = r.videoTS
 	r.videoState.defaultDurMS = 33
-	if r.aacConfig.SampleRate > 0 {
-		r.audioTS = uint32(r.aacConfig.SampleRate)
+	if r.audioConfig.SampleRate() > 0 {
+		r.audioTS = uint32(r.audioConfig.SampleRate())
 		audioTrak := addEmptyTrack(init, r.audioTS, "audio", "und")
-		esds := mp4.CreateEsdsBox(r.aacConfig.ASC)
-		channels := r.aacConfig.Channels
-		if channels == 0 {
-			channels = 2
+		if err := util.AddAudioDescriptor(audioTrak, r.audioConfig); err != nil {
+			return err
 		}
-		mp4a := mp4.CreateAudioSampleEntryBox("mp4a", uint16(channels), 16, uint16(r.aacConfig.SampleRate), esds)
-		audioTrak.Mdia.Minf.Stbl.Stsd.AddChild(mp4a)
 		r.audioID = audioTrak.Tkhd.TrackID
 		r.audioState.trackID = r.audioID
 		r.audioState.timescale = r.audioTS
@@ -499,7 +501,7 @@ func (r *Recorder) markFailed(reason string) {
 	}
 	r.failed = true
 	r.stopped = true
-	log.Printf("archive recorder stopped: %s", reason)
+	r.cfg.Log.WithField("reason", reason).Warn("archive recorder stopped")
 }
 
 func addEmptyTrack(initSeg *mp4.InitSegment, timeScale uint32, mediaType, language string) *mp4.TrakBox {
@@ -566,10 +568,3 @@ func maxInt64(a, b int64) int64 {
 	}
 	return b
 }
-
-func equalAACConfig(a, b util.AACConfig) bool {
-	if a.SampleRate != b.SampleRate || a.Channels != b.Channels || a.ObjectType != b.ObjectType {
-		return false
-	}
-	return bytes.Equal(a.ASC, b.ASC)
-}
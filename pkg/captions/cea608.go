@@ -0,0 +1,323 @@
+package captions
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	rows    = 15
+	columns = 32
+)
+
+type captionMode int
+
+const (
+	modePopOn captionMode = iota
+	modeRollUp
+	modePaintOn
+)
+
+// Cue is a caption shown from StartMS until EndMS.
+type Cue struct {
+	StartMS int64
+	EndMS   int64
+	Text    string
+}
+
+type screen [rows][columns]rune
+
+type pendingPairs struct {
+	ptsMS int64
+	pairs []byte
+}
+
+// Decoder turns the CEA-608 field 1 pairs of a video stream into cues for
+// channel CC1. It handles pop-on, roll-up and paint-on captions; styling
+// and positions within a row are dropped.
+type Decoder struct {
+	mode     captionMode
+	rollRows int
+	text     bool
+	channel  int
+	lastCtrl [2]byte
+
+	displayed    screen
+	nonDisplayed screen
+	row          int
+	col          int
+
+	shown      string
+	shownSince int64
+	cues       []Cue
+
+	// Pairs are sent in decode order but shown in presentation order.
+	pending []pendingPairs
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{channel: 1, row: rows - 1}
+}
+
+// Add queues the field 1 pairs of a sample. Pairs are decoded once no
+// earlier presentation time can follow, which is when dtsMS passes them.
+func (d *Decoder) Add(dtsMS, ptsMS int64, pairs []byte) {
+	if len(pairs) > 0 {
+		d.pending = append(d.pending, pendingPairs{ptsMS: ptsMS, pairs: pairs})
+	}
+	d.decodeUntil(dtsMS + 1)
+}
+
+// Cut returns the cues shown before ms. A caption still on screen is split
+// there and carries on into the next cut.
+func (d *Decoder) Cut(ms int64) []Cue {
+	d.decodeUntil(ms)
+	if d.shown != "" && ms > d.shownSince {
+		d.cues = append(d.cues, Cue{StartMS: d.shownSince, EndMS: ms, Text: d.shown})
+		d.shownSince = ms
+	}
+	cues := d.cues
+	d.cues = nil
+	return cues
+}
+
+// Reset drops any caption state, for a discontinuity in the stream.
+func (d *Decoder) Reset() {
+	*d = *NewDecoder()
+}
+
+func (d *Decoder) decodeUntil(ms int64) {
+	sort.SliceStable(d.pending, func(i, j int) bool { return d.pending[i].ptsMS < d.pending[j].ptsMS })
+	n := 0
+	for ; n < len(d.pending) && d.pending[n].ptsMS < ms; n++ {
+		p := d.pending[n]
+		for i := 0; i+1 < len(p.pairs); i += 2 {
+			d.decodePair(p.pairs[i]&0x7f, p.pairs[i+1]&0x7f)
+		}
+		d.update(p.ptsMS)
+	}
+	d.pending = d.pending[n:]
+}
+
+// update starts a new cue when the displayed text changed at ms.
+func (d *Decoder) update(ms int64) {
+	text := d.displayed.text()
+	if text == d.shown {
+		return
+	}
+	if d.shown != "" && ms > d.shownSince {
+		d.cues = append(d.cues, Cue{StartMS: d.shownSince, EndMS: ms, Text: d.shown})
+	}
+	d.shown = text
+	d.shownSince = ms
+}
+
+func (d *Decoder) decodePair(b1, b2 byte) {
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+	if b1 >= 0x10 && b1 <= 0x1f {
+		// Control codes are sent twice in a row; the repeat is dropped.
+		if d.lastCtrl == [2]byte{b1, b2} {
+			d.lastCtrl = [2]byte{}
+			return
+		}
+		d.lastCtrl = [2]byte{b1, b2}
+		d.control(b1, b2)
+		return
+	}
+	d.lastCtrl = [2]byte{}
+	if b1 < 0x20 || d.channel != 1 || d.text {
+		return
+	}
+	d.writeChar(basicChar(b1))
+	if b2 >= 0x20 {
+		d.writeChar(basicChar(b2))
+	}
+}
+
+func (d *Decoder) control(b1, b2 byte) {
+	d.channel = 1
+	if b1&0x08 != 0 {
+		d.channel = 2
+		return
+	}
+	if b2 < 0x20 {
+		return
+	}
+	switch {
+	case b2 >= 0x40:
+		d.preambleAddress(b1, b2)
+	case (b1 == 0x14 || b1 == 0x15) && b2 <= 0x2f:
+		d.command(b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		d.col = min(d.col+int(b2-0x20), columns-1)
+	case b1 == 0x11 && b2 <= 0x2f:
+		// Mid-row style codes take up a space.
+		d.writeChar(' ')
+	case b1 == 0x11:
+		d.writeChar(specialChars[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 <= 0x3f:
+		// Extended characters replace the fallback sent before them.
+		if d.col > 0 {
+			d.col--
+		}
+		if b1 == 0x12 {
+			d.writeChar(extendedChars1[b2-0x20])
+		} else {
+			d.writeChar(extendedChars2[b2-0x20])
+		}
+	}
+}
+
+// preamble address codes set the row and indent of the text that follows.
+var preambleRows = map[byte][2]int{
+	0x11: {1, 2}, 0x12: {3, 4}, 0x15: {5, 6}, 0x16: {7, 8},
+	0x17: {9, 10}, 0x10: {11, 11}, 0x13: {12, 13}, 0x14: {14, 15},
+}
+
+func (d *Decoder) preambleAddress(b1, b2 byte) {
+	r, ok := preambleRows[b1]
+	if !ok {
+		return
+	}
+	row := r[0]
+	if b2&0x20 != 0 {
+		row = r[1]
+	}
+	row--
+	if d.mode == modeRollUp && row != d.row {
+		// The roll-up window moves with its base row.
+		top := max(row-d.rollRows+1, 0)
+		var moved screen
+		for i := 0; i < d.rollRows && row-i >= top && d.row-i >= 0; i++ {
+			moved[row-i] = d.displayed[d.row-i]
+		}
+		d.displayed = moved
+	}
+	d.row = row
+	d.col = 0
+	if b2&0x10 != 0 {
+		d.col = int((b2&0x0e)>>1) * 4
+	}
+}
+
+func (d *Decoder) command(b2 byte) {
+	switch b2 {
+	case 0x20: // RCL, resume caption loading
+		d.mode = modePopOn
+		d.text = false
+	case 0x21: // BS
+		if d.col > 0 {
+			d.col--
+			d.memory()[d.row][d.col] = 0
+		}
+	case 0x24: // DER, delete to end of row
+		mem := d.memory()
+		for c := d.col; c < columns; c++ {
+			mem[d.row][c] = 0
+		}
+	case 0x25, 0x26, 0x27: // RU2-RU4
+		if d.mode != modeRollUp {
+			d.displayed = screen{}
+			d.nonDisplayed = screen{}
+		}
+		d.mode = modeRollUp
+		d.rollRows = int(b2-0x25) + 2
+		d.text = false
+		d.col = 0
+	case 0x29: // RDC, resume direct captioning
+		d.mode = modePaintOn
+		d.text = false
+	case 0x2a, 0x2b: // TR, RTD
+		d.text = true
+	case 0x2c: // EDM
+		d.displayed = screen{}
+	case 0x2d: // CR
+		if d.mode == modeRollUp {
+			d.rollUp()
+		}
+	case 0x2e: // ENM
+		d.nonDisplayed = screen{}
+	case 0x2f: // EOC
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+		d.mode = modePopOn
+	}
+}
+
+func (d *Decoder) rollUp() {
+	top := max(d.row-d.rollRows+1, 0)
+	for r := 0; r < top; r++ {
+		d.displayed[r] = [columns]rune{}
+	}
+	for r := top; r < d.row; r++ {
+		d.displayed[r] = d.displayed[r+1]
+	}
+	d.displayed[d.row] = [columns]rune{}
+	d.col = 0
+}
+
+// memory is where text goes: pop-on captions are built off screen.
+func (d *Decoder) memory() *screen {
+	if d.mode == modePopOn {
+		return &d.nonDisplayed
+	}
+	return &d.displayed
+}
+
+func (d *Decoder) writeChar(r rune) {
+	mem := d.memory()
+	mem[d.row][d.col] = r
+	if d.col < columns-1 {
+		d.col++
+	}
+}
+
+func (s *screen) text() string {
+	var lines []string
+	for _, row := range s {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row[:])))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// basicChar maps a standard character; CEA-608 replaces some ASCII codes.
+func basicChar(b byte) rune {
+	switch b {
+	case 0x2a:
+		return 'á'
+	case 0x5c:
+		return 'é'
+	case 0x5e:
+		return 'í'
+	case 0x5f:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7b:
+		return 'ç'
+	case 0x7c:
+		return '÷'
+	case 0x7d:
+		return 'Ñ'
+	case 0x7e:
+		return 'ñ'
+	case 0x7f:
+		return '█'
+	}
+	return rune(b)
+}
+
+var (
+	specialChars   = []rune("®°½¿™¢£♪à èâêîôû")
+	extendedChars1 = []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»")
+	extendedChars2 = []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘")
+)
@@ -0,0 +1,131 @@
+package captions
+
+import (
+	"reflect"
+	"testing"
+)
+
+// pairs608 is the field 1 content of one sample presented at ms.
+type pairs608 struct {
+	ms    int64
+	pairs []byte
+}
+
+// withParity sets odd parity on each byte, as encoders send them.
+func withParity(pairs []byte) []byte {
+	out := make([]byte, len(pairs))
+	for i, b := range pairs {
+		ones := 0
+		for v := b; v != 0; v >>= 1 {
+			ones += int(v & 1)
+		}
+		if ones%2 == 0 {
+			b |= 0x80
+		}
+		out[i] = b
+	}
+	return out
+}
+
+func TestDecoder(t *testing.T) {
+	var (
+		rcl = []byte{0x14, 0x20}
+		enm = []byte{0x14, 0x2e}
+		eoc = []byte{0x14, 0x2f}
+		edm = []byte{0x14, 0x2c}
+		ru2 = []byte{0x14, 0x25}
+		cr  = []byte{0x14, 0x2d}
+		// Row 15, column 0.
+		pac15 = []byte{0x14, 0x70}
+	)
+	twice := func(code []byte) []byte { return append(append([]byte(nil), code...), code...) }
+	for _, tc := range []struct {
+		name    string
+		samples []pairs608
+		cutMS   int64
+		want    []Cue
+	}{
+		{
+			name: "pop-on",
+			samples: []pairs608{
+				{0, twice(rcl)},
+				{33, twice(enm)},
+				{66, twice(pac15)},
+				{100, []byte("HELLO ")},
+				// Nothing shows until EOC swaps the memories.
+				{1000, twice(eoc)},
+				{2000, twice(rcl)},
+				{2033, twice(pac15)},
+				{2066, []byte("BYE\x00")},
+				{2500, twice(eoc)},
+				{3000, twice(edm)},
+			},
+			cutMS: 4000,
+			want: []Cue{
+				{StartMS: 1000, EndMS: 2500, Text: "HELLO"},
+				{StartMS: 2500, EndMS: 3000, Text: "BYE"},
+			},
+		},
+		{
+			name: "roll-up",
+			samples: []pairs608{
+				{0, twice(ru2)},
+				{33, twice(pac15)},
+				{66, []byte("ONE\x00")},
+				{1000, twice(cr)},
+				{1033, []byte("TWO\x00")},
+				// Two rows: the third line pushes the first out.
+				{2000, twice(cr)},
+				{2033, []byte("THREE\x00")},
+			},
+			cutMS: 3000,
+			want: []Cue{
+				{StartMS: 66, EndMS: 1033, Text: "ONE"},
+				{StartMS: 1033, EndMS: 2000, Text: "ONE\nTWO"},
+				{StartMS: 2000, EndMS: 2033, Text: "TWO"},
+				{StartMS: 2033, EndMS: 3000, Text: "TWO\nTHREE"},
+			},
+		},
+		{
+			name: "caption still on screen is cut",
+			samples: []pairs608{
+				{0, twice(ru2)},
+				{33, append(twice(pac15), "LIVE"...)},
+			},
+			cutMS: 2000,
+			want:  []Cue{{StartMS: 33, EndMS: 2000, Text: "LIVE"}},
+		},
+		{
+			name: "channel 2 ignored",
+			samples: []pairs608{
+				{0, twice([]byte{0x1c, 0x25})},
+				{33, []byte("CC2\x00")},
+			},
+			cutMS: 2000,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder()
+			for _, s := range tc.samples {
+				d.Add(s.ms, s.ms, withParity(s.pairs))
+			}
+			if got := d.Cut(tc.cutMS); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("cues = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecoderPresentationOrder(t *testing.T) {
+	// EOC arrives in decode order before the frame that presents the text
+	// is decoded, but is shown at its own, later presentation time.
+	d := NewDecoder()
+	d.Add(0, 0, withParity([]byte{0x14, 0x20, 0x14, 0x20, 0x14, 0x70, 0x14, 0x70, 'H', 'I'}))
+	d.Add(33, 100, withParity([]byte{0x14, 0x2f, 0x14, 0x2f}))
+	d.Add(66, 66, nil)
+	d.Add(100, 133, withParity([]byte{0x14, 0x2c, 0x14, 0x2c}))
+	want := []Cue{{StartMS: 100, EndMS: 133, Text: "HI"}}
+	if got := d.Cut(1000); !reflect.DeepEqual(got, want) {
+		t.Fatalf("cues = %+v, want %+v", got, want)
+	}
+}
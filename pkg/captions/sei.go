@@ -0,0 +1,112 @@
+package captions
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/sei"
+
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+const (
+	seiUserDataRegistered = 4
+
+	ccType608Field1  = 0
+	ccType608Field2  = 1
+	ccTypeDTVCCStart = 3
+)
+
+// Data is the closed caption content of one video sample.
+type Data struct {
+	// Field1 and Field2 hold CEA-608 byte pairs, parity bits included.
+	// Field 1 carries CC1/CC2, field 2 CC3/CC4.
+	Field1 []byte
+	Field2 []byte
+	// DTVCC is set when the sample starts a CEA-708 caption packet.
+	DTVCC bool
+}
+
+// Has608 reports whether the sample carries any CEA-608 pairs.
+func (d Data) Has608() bool {
+	return len(d.Field1) > 0 || len(d.Field2) > 0
+}
+
+// Extract returns the ATSC A/53 (GA94) caption data carried in the SEI NAL
+// units of a length-prefixed H.264 or HEVC sample.
+func Extract(codec string, sample []byte) Data {
+	var out Data
+	var headerLen int
+	switch codec {
+	case util.VideoCodecH264:
+		headerLen = 1
+	case util.VideoCodecHEVC:
+		headerLen = 2
+	default:
+		return out
+	}
+	nalus, err := avc.GetNalusFromSample(sample)
+	if err != nil {
+		return out
+	}
+	for _, nalu := range nalus {
+		if len(nalu) <= headerLen || !isSEI(codec, nalu) {
+			continue
+		}
+		msgs, err := sei.ExtractSEIData(bytes.NewReader(nalu[headerLen:]))
+		if err != nil && !errors.Is(err, sei.ErrRbspTrailingBitsMissing) {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Type() == seiUserDataRegistered {
+				parseCCData(msg.Payload(), &out)
+			}
+		}
+	}
+	return out
+}
+
+// isSEI reports whether nalu is an H.264 SEI or an HEVC prefix SEI.
+func isSEI(codec string, nalu []byte) bool {
+	if codec == util.VideoCodecHEVC {
+		return (nalu[0]>>1)&0x3f == 39
+	}
+	return nalu[0]&0x1f == 6
+}
+
+// parseCCData reads cc_data() from an itu_t_t35 payload: country code 0xB5,
+// provider 0x0031, user identifier "GA94" and user data type 3.
+func parseCCData(payload []byte, out *Data) {
+	if len(payload) < 10 || payload[0] != 0xb5 || payload[1] != 0x00 || payload[2] != 0x31 ||
+		string(payload[3:7]) != "GA94" || payload[7] != 0x03 {
+		return
+	}
+	if payload[8]&0x40 == 0 {
+		// process_cc_data_flag
+		return
+	}
+	count := int(payload[8] & 0x1f)
+	data := payload[10:]
+	for i := 0; i < count && len(data) >= 3; i++ {
+		valid := data[0]&0x04 != 0
+		ccType := data[0] & 0x03
+		b1, b2 := data[1], data[2]
+		data = data[3:]
+		if !valid {
+			continue
+		}
+		if ccType <= ccType608Field2 && b1&0x7f == 0 && b2&0x7f == 0 {
+			// Null padding, sent by some encoders with no captions at all.
+			continue
+		}
+		switch ccType {
+		case ccType608Field1:
+			out.Field1 = append(out.Field1, b1, b2)
+		case ccType608Field2:
+			out.Field2 = append(out.Field2, b1, b2)
+		case ccTypeDTVCCStart:
+			out.DTVCC = true
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package captions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+// ga94 builds an itu_t_t35 GA94 cc_data() payload from cc triplets.
+func ga94(triplets ...[]byte) []byte {
+	payload := []byte{0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40 | byte(len(triplets)), 0xff}
+	for _, t := range triplets {
+		payload = append(payload, t...)
+	}
+	return append(payload, 0xff)
+}
+
+// escape inserts emulation prevention bytes into an RBSP.
+func escape(rbsp []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// seiNALU builds a SEI NAL unit from messages of (type, payload).
+func seiNALU(header []byte, msgs ...[]byte) []byte {
+	var rbsp []byte
+	for i := 0; i+1 < len(msgs); i += 2 {
+		rbsp = append(rbsp, msgs[i][0], byte(len(msgs[i+1])))
+		rbsp = append(rbsp, msgs[i+1]...)
+	}
+	rbsp = append(rbsp, 0x80)
+	return append(append([]byte(nil), header...), escape(rbsp)...)
+}
+
+func sample(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nalu)))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+func TestExtract(t *testing.T) {
+	// A user_data_unregistered message first, whose UUID needs emulation
+	// prevention; the caption message after it is only found if the
+	// escapes are removed.
+	unregistered := append([]byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x11}, bytes.Repeat([]byte{0x22}, 8)...)
+	unregistered = append(unregistered, "x264"...)
+	captions := ga94(
+		[]byte{0xfc, 0x94, 0x20}, // field 1: RCL
+		[]byte{0xfc, 0x80, 0x80}, // field 1 null padding
+		[]byte{0xfd, 0x80, 0x80}, // field 2 null padding
+		[]byte{0xfd, 0x15, 0x2c}, // field 2 pair
+		[]byte{0xf8, 0xc8, 0xc5}, // not valid
+		[]byte{0xff, 0x02, 0x21}, // DTVCC packet start
+		[]byte{0xfc, 0xc8, 0xc5}, // field 1: "HE"
+	)
+	slice := []byte{0x65, 0x88, 0x84, 0x00}
+	for _, tc := range []struct {
+		name   string
+		codec  string
+		sample []byte
+		want   Data
+	}{
+		{
+			name:   "h264",
+			codec:  util.VideoCodecH264,
+			sample: sample(seiNALU([]byte{0x06}, []byte{5}, unregistered, []byte{4}, captions), slice),
+			want:   Data{Field1: []byte{0x94, 0x20, 0xc8, 0xc5}, Field2: []byte{0x15, 0x2c}, DTVCC: true},
+		},
+		{
+			name:   "hevc prefix sei",
+			codec:  util.VideoCodecHEVC,
+			sample: sample(seiNALU([]byte{0x4e, 0x01}, []byte{4}, captions)),
+			want:   Data{Field1: []byte{0x94, 0x20, 0xc8, 0xc5}, Field2: []byte{0x15, 0x2c}, DTVCC: true},
+		},
+		{
+			name:   "only null padding",
+			codec:  util.VideoCodecH264,
+			sample: sample(seiNALU([]byte{0x06}, []byte{4}, ga94([]byte{0xfc, 0x80, 0x80}, []byte{0xfd, 0x00, 0x00}))),
+		},
+		{
+			name:   "other provider",
+			codec:  util.VideoCodecH264,
+			sample: sample(seiNALU([]byte{0x06}, []byte{4}, append([]byte{0xb5, 0x00, 0x2f}, captions[3:]...))),
+		},
+		{
+			name:   "truncated",
+			codec:  util.VideoCodecH264,
+			sample: sample(seiNALU([]byte{0x06}, []byte{4}, captions))[:20],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Extract(tc.codec, tc.sample)
+			if !bytes.Equal(got.Field1, tc.want.Field1) || !bytes.Equal(got.Field2, tc.want.Field2) || got.DTVCC != tc.want.DTVCC {
+				t.Fatalf("Extract = %+v, want %+v", got, tc.want)
+			}
+			if got.Has608() != (len(tc.want.Field1)+len(tc.want.Field2) > 0) {
+				t.Fatalf("Has608 = %v", got.Has608())
+			}
+		})
+	}
+}
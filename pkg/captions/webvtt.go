@@ -0,0 +1,30 @@
+package captions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WebVTT renders cues as an HLS WebVTT segment. Cue times are on the
+// stream timeline, which starts at mpegtsOffset in 90 kHz media time.
+func WebVTT(cues []Cue, mpegtsOffset uint64) []byte {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	b.WriteString(fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", mpegtsOffset))
+	for _, cue := range cues {
+		b.WriteString("\n")
+		b.WriteString(fmt.Sprintf("%s --> %s\n", vttTime(cue.StartMS), vttTime(cue.EndMS)))
+		b.WriteString(vttEscaper.Replace(cue.Text))
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func vttTime(ms int64) string {
+	if ms < 0 {
+		ms = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
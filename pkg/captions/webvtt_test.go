@@ -0,0 +1,21 @@
+package captions
+
+import "testing"
+
+func TestWebVTT(t *testing.T) {
+	got := string(WebVTT([]Cue{
+		{StartMS: 1000, EndMS: 3661001, Text: "ONE\nTWO"},
+		{StartMS: -5, EndMS: 40, Text: "<b> & </b>"},
+	}, 900000))
+	want := "WEBVTT\n" +
+		"X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n" +
+		"\n" +
+		"00:00:01.000 --> 01:01:01.001\n" +
+		"ONE\nTWO\n" +
+		"\n" +
+		"00:00:00.000 --> 00:00:00.040\n" +
+		"&lt;b&gt; &amp; &lt;/b&gt;\n"
+	if got != want {
+		t.Fatalf("WebVTT =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tokuly-live-rtmp-server/pkg/logging"
+)
+
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+type Store struct {
+	mu      sync.RWMutex
+	pairs   []Pair
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	modTime map[string]time.Time
+	stopCh  chan struct{}
+}
+
+func NewStore(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no certificates configured")
+	}
+	s := &Store{
+		pairs:   pairs,
+		modTime: make(map[string]time.Time),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads every certificate pair from disk. The previous set stays in
+// use if any pair fails to load, so a half-written renewal never takes down
+// the listener.
+func (s *Store) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.pairs))
+	byName := make(map[string]*tls.Certificate)
+	modTime := make(map[string]time.Time)
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", pair.CertFile, err)
+		}
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("parse %s: %w", pair.CertFile, err)
+			}
+			cert.Leaf = leaf
+		}
+		loaded := &cert
+		certs = append(certs, loaded)
+		if cert.Leaf != nil {
+			names := cert.Leaf.DNSNames
+			if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+				names = []string{cert.Leaf.Subject.CommonName}
+			}
+			for _, name := range names {
+				name = strings.ToLower(name)
+				if _, ok := byName[name]; !ok {
+					byName[name] = loaded
+				}
+			}
+		}
+		for _, path := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(path); err == nil {
+				modTime[path] = info.ModTime()
+			}
+		}
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.byName = byName
+	s.modTime = modTime
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, fmt.Errorf("no certificates loaded")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := s.byName[name]; ok {
+			return cert, nil
+		}
+		if idx := strings.IndexByte(name, '.'); idx != -1 {
+			if cert, ok := s.byName["*"+name[idx:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+// Watch polls the certificate and key files and reloads the store when any
+// of them changes. Established connections keep their negotiated session.
+func (s *Store) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if s.stopCh != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.stopCh = make(chan struct{})
+	stopCh := s.stopCh
+	s.mu.Unlock()
+
+	log := logging.Default()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+				if err := s.Reload(); err != nil {
+					log.WithError(err).Error("certificate reload error")
+					continue
+				}
+				s.mu.RLock()
+				count := len(s.certs)
+				s.mu.RUnlock()
+				log.WithField("certificates", count).Info("certificates reloaded")
+			}
+		}
+	}()
+}
+
+func (s *Store) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopCh != nil {
+		close(s.stopCh)
+		s.stopCh = nil
+	}
+}
+
+func (s *Store) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, pair := range s.pairs {
+		for _, path := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(s.modTime[path]) {
+				return true
+			}
+		}
+	}
+	return false
+}
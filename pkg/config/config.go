@@ -3,18 +3,26 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	RTMP      RTMPConfig
-	Policy    PolicyConfig
-	HLS       HLSConfig
-	Storage   StorageConfig
-	Limits    LimitsConfig
-	Auth      AuthConfig
-	Archive   ArchiveConfig
-	DebugRTMP bool
+	RTMP       RTMPConfig
+	Policy     PolicyConfig
+	HLS        HLSConfig
+	Storage    StorageConfig
+	Limits     LimitsConfig
+	Auth       AuthConfig
+	Archive    ArchiveConfig
+	Relay      RelayConfig
+	HTTP       HTTPConfig
+	Admin      AdminConfig
+	Transcode  TranscodeConfig
+	Encryption EncryptionConfig
+	Log        LogConfig
+	Webhooks   WebhookConfig
+	DebugRTMP  bool
 }
 
 type RTMPConfig struct {
@@ -22,25 +30,43 @@ type RTMPConfig struct {
 	App          string
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+
+	TLSListenAddr     string
+	TLSCertFiles      []string
+	TLSKeyFiles       []string
+	TLSReloadInterval time.Duration
+
+	// EnablePlay lets RTMP clients play live streams. Players are checked
+	// with the policy's playback authorization, like HTTP-FLV viewers.
+	EnablePlay bool
 }
 
 type PolicyConfig struct {
-	MaxWidth              int
-	MaxHeight             int
-	FirstKeyframeTimeout  time.Duration
-	MaxGOPSeconds         float64
-	AllowNoAudio          bool
-	OnGOPTooLong          string // "reject" or "degraded"
-	RequireAACLC          bool
-	RejectIfVideoNotH264  bool
-	RejectIfAudioNotAAC   bool
-	MaxInspectDuration    time.Duration
-	InitialBitrateWindow  time.Duration
-	InitialBitrateMinimum int64
+	MaxWidth             int
+	MaxHeight            int
+	FirstKeyframeTimeout time.Duration
+	MaxGOPSeconds        float64
+	AllowNoAudio         bool
+	OnGOPTooLong         string // "reject" or "degraded"
+	RequireAACLC         bool
+	// RejectUnknownVideoCodecs refuses video the server cannot parse: legacy
+	// FLV codec IDs other than AVC and unknown enhanced-RTMP FourCCs. When
+	// false such tags are dropped and the stream goes on without them.
+	// Parsed codecs are checked against AllowedVideoCodecs after inspection.
+	RejectUnknownVideoCodecs bool
+	// RejectUnknownAudioCodecs does the same for audio: sound formats other
+	// than AAC and MP3, and unknown FourCCs.
+	RejectUnknownAudioCodecs bool
+	AllowedVideoCodecs       []string
+	AllowedAudioCodecs       []string
+	MaxInspectDuration       time.Duration
+	InitialBitrateWindow     time.Duration
+	InitialBitrateMinimum    int64
 }
 
 type HLSConfig struct {
 	SegmentDuration      time.Duration
+	MaxSegmentOverrun    time.Duration
 	PartDuration         time.Duration
 	PlaylistWindow       time.Duration
 	TargetDuration       time.Duration
@@ -53,9 +79,19 @@ type HLSConfig struct {
 	PlaylistFilename     string
 	SegmentFilenameTmpl  string
 	PartFilenameTmpl     string
+	ByteRangeParts       bool
 	InitFilename         string
 	RewindPlaylistName   string
 	RewindPlaylistWindow time.Duration
+	IFramePlaylistName   string
+	DemuxAudio           bool
+	AudioRenditionName   string
+	ExtractCaptions      bool
+	CaptionsPlaylistName string
+	PDTEverySegment      bool
+	EnableDASH           bool
+	DASHManifestName     string
+	OutputFormat         string
 }
 
 type StorageConfig struct {
@@ -76,6 +112,25 @@ type AuthConfig struct {
 	Version       string
 	AuthTimeout   time.Duration
 	HTTPUserAgent string
+
+	PlaybackAuthURL string
+	// VideoInfoURL and ArchiveStatusURL are sent the inspected video info
+	// and archive outcomes; empty turns the call off.
+	VideoInfoURL     string
+	ArchiveStatusURL string
+
+	// RequestEncoding is "form" or "json" for every call; empty keeps the
+	// encoding the Tokuly API expects for each call.
+	RequestEncoding string
+	// FieldNames renames request fields, e.g. api_key=apiKey.
+	FieldNames map[string]string
+
+	// KeyFile lists stream keys in YAML or JSON. When set, keys are
+	// authorized from it alone, or from it first and then the API when
+	// KeyFileFallback is on.
+	KeyFile               string
+	KeyFileFallback       bool
+	KeyFileReloadInterval time.Duration
 }
 
 type ArchiveConfig struct {
@@ -85,6 +140,7 @@ type ArchiveConfig struct {
 	RecordDirTemplate   string
 	HLSDirTemplate      string
 	RecordFilename      string
+	MetadataFilename    string
 	FFmpegPath          string
 	ReconnectGrace      time.Duration
 	FragmentDuration    time.Duration
@@ -94,6 +150,80 @@ type ArchiveConfig struct {
 	MaxSizeHighBytes    int64
 }
 
+type RelayConfig struct {
+	Enable         bool
+	MaxTargets     int
+	ConnectTimeout time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+}
+
+type HTTPConfig struct {
+	ListenAddr   string
+	AllowOrigin  string
+	WriteTimeout time.Duration
+	HLSPrefix    string
+	RewindPrefix string
+}
+
+// AdminConfig serves the admin API on its own listener. Every request needs
+// "Authorization: Bearer <Token>".
+type AdminConfig struct {
+	ListenAddr string
+	Token      string
+	// MetricsPath serves Prometheus metrics on the admin listener, behind
+	// the token; empty disables them.
+	MetricsPath string
+}
+
+// LogConfig sets the log level ("debug", "info", "warn", "error") and
+// format ("json" or "text").
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// WebhookConfig delivers stream events to HTTP endpoints. Events wait in a
+// per-endpoint outbox under OutboxDir until delivered; past OutboxLimit the
+// oldest are dropped. Bodies are signed with HMAC-SHA256 when Secret is set.
+type WebhookConfig struct {
+	URLs   []string
+	Secret string
+	// Events limits delivery to these event types; empty sends all.
+	Events      []string
+	OutboxDir   string
+	OutboxLimit int
+	Timeout     time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// TranscodeConfig drives the optional ffmpeg ABR ladder. Rendition specs are
+// "<height>p" or "<height>p@<video bitrate>", e.g. "720p@2800k".
+type TranscodeConfig struct {
+	Enable             bool
+	FFmpegPath         string
+	Preset             string
+	Ladder             []string
+	AppLadders         map[string][]string
+	AudioBitrate       int64
+	MasterPlaylistName string
+}
+
+// EncryptionConfig protects HLS output: cbcs SAMPLE-AES for fMP4 and AES-128
+// for TS. KeyURITemplate may use {stream}, {kid} and {period}.
+type EncryptionConfig struct {
+	Enable         bool
+	Provider       string // "file" or "http"
+	KeyDir         string
+	KeyURL         string
+	KeyAPIKey      string
+	KeyURITemplate string
+	KeyFormat      string
+	RotateSegments int
+	KeyTimeout     time.Duration
+}
+
 func DefaultConfig() Config {
 	return Config{
 		RTMP: RTMPConfig{
@@ -101,23 +231,31 @@ func DefaultConfig() Config {
 			App:          "live2",
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 30 * time.Second,
+
+			TLSListenAddr:     "",
+			TLSReloadInterval: 30 * time.Second,
+
+			EnablePlay: false,
 		},
 		Policy: PolicyConfig{
-			MaxWidth:              1920,
-			MaxHeight:             1920,
-			FirstKeyframeTimeout:  2 * time.Second,
-			MaxGOPSeconds:         2.0,
-			AllowNoAudio:          false,
-			OnGOPTooLong:          "degraded",
-			RequireAACLC:          true,
-			RejectIfVideoNotH264:  true,
-			RejectIfAudioNotAAC:   true,
-			MaxInspectDuration:    5 * time.Second,
-			InitialBitrateWindow:  2 * time.Second,
-			InitialBitrateMinimum: 0,
+			MaxWidth:                 1920,
+			MaxHeight:                1920,
+			FirstKeyframeTimeout:     2 * time.Second,
+			MaxGOPSeconds:            2.0,
+			AllowNoAudio:             false,
+			OnGOPTooLong:             "degraded",
+			RequireAACLC:             true,
+			RejectUnknownVideoCodecs: true,
+			RejectUnknownAudioCodecs: true,
+			AllowedVideoCodecs:       []string{"H264", "HEVC", "AV1"},
+			AllowedAudioCodecs:       []string{"AAC", "OPUS", "MP3"},
+			MaxInspectDuration:       5 * time.Second,
+			InitialBitrateWindow:     2 * time.Second,
+			InitialBitrateMinimum:    0,
 		},
 		HLS: HLSConfig{
 			SegmentDuration:      2 * time.Second,
+			MaxSegmentOverrun:    4 * time.Second,
 			PartDuration:         200 * time.Millisecond,
 			PlaylistWindow:       12 * time.Second,
 			TargetDuration:       2 * time.Second,
@@ -133,6 +271,12 @@ func DefaultConfig() Config {
 			InitFilename:         "init.mp4",
 			RewindPlaylistName:   "index.m3u8",
 			RewindPlaylistWindow: 3600 * time.Second,
+			IFramePlaylistName:   "iframes.m3u8",
+			AudioRenditionName:   "audio",
+			CaptionsPlaylistName: "captions.m3u8",
+			EnableDASH:           true,
+			DASHManifestName:     "manifest.mpd",
+			OutputFormat:         "fmp4",
 		},
 		Storage: StorageConfig{
 			RootDir:      "./live-hls",
@@ -144,12 +288,15 @@ func DefaultConfig() Config {
 			MaxBufferedSeconds:   10 * time.Second,
 		},
 		Auth: AuthConfig{
-			AuthURL:       "https://api.tokuly.com/live/checkstream",
-			StreamEndURL:  "https://api.tokuly.com/live/endstream",
-			APIKey:        "",
-			Version:       "tokuly-rtmp-server",
-			AuthTimeout:   3 * time.Second,
-			HTTPUserAgent: "go-rtmp-server/0.1",
+			AuthURL:               "https://api.tokuly.com/live/checkstream",
+			StreamEndURL:          "https://api.tokuly.com/live/endstream",
+			VideoInfoURL:          "https://api.tokuly.com/live/stream/videoinfo",
+			ArchiveStatusURL:      "https://api.tokuly.com/live/stream/archive/status",
+			KeyFileReloadInterval: 5 * time.Second,
+			APIKey:                "",
+			Version:               "tokuly-rtmp-server",
+			AuthTimeout:           3 * time.Second,
+			HTTPUserAgent:         "go-rtmp-server/0.1",
 		},
 		Archive: ArchiveConfig{
 			Enable:              true,
@@ -158,6 +305,7 @@ func DefaultConfig() Config {
 			RecordDirTemplate:   "{streamName}/{startUTC}",
 			HLSDirTemplate:      "{streamName}/{startUTC}",
 			RecordFilename:      "archive.mp4",
+			MetadataFilename:    "metadata.json",
 			FFmpegPath:          "/opt/homebrew/bin/ffmpeg",
 			ReconnectGrace:      30 * time.Second,
 			FragmentDuration:    2 * time.Second,
@@ -166,6 +314,50 @@ func DefaultConfig() Config {
 			MaxDurationLow:      90 * time.Minute,
 			MaxSizeHighBytes:    int64(5) * 1024 * 1024 * 1024,
 		},
+		Relay: RelayConfig{
+			Enable:         true,
+			MaxTargets:     5,
+			ConnectTimeout: 10 * time.Second,
+			MinBackoff:     1 * time.Second,
+			MaxBackoff:     30 * time.Second,
+		},
+		HTTP: HTTPConfig{
+			ListenAddr:   ":8080",
+			AllowOrigin:  "*",
+			WriteTimeout: 10 * time.Second,
+			HLSPrefix:    "/hls/",
+			RewindPrefix: "/rewind/",
+		},
+		Admin: AdminConfig{
+			MetricsPath: "/metrics",
+		},
+		Transcode: TranscodeConfig{
+			Enable:             false,
+			Preset:             "veryfast",
+			Ladder:             []string{"720p@2800k", "480p@1400k", "360p@800k"},
+			AudioBitrate:       128000,
+			MasterPlaylistName: "master.m3u8",
+		},
+		Encryption: EncryptionConfig{
+			Enable:         false,
+			Provider:       "file",
+			KeyDir:         "./keys",
+			KeyURITemplate: "/keys/{stream}/{kid}",
+			KeyFormat:      "identity",
+			RotateSegments: 0,
+			KeyTimeout:     5 * time.Second,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Webhooks: WebhookConfig{
+			OutboxDir:   "./webhook-outbox",
+			OutboxLimit: 10000,
+			Timeout:     10 * time.Second,
+			MinBackoff:  1 * time.Second,
+			MaxBackoff:  5 * time.Minute,
+		},
 		DebugRTMP: false,
 	}
 }
@@ -179,6 +371,21 @@ func Load() Config {
 	if v := os.Getenv("RTMP_APP"); v != "" {
 		cfg.RTMP.App = v
 	}
+	if v := os.Getenv("RTMPS_ADDR"); v != "" {
+		cfg.RTMP.TLSListenAddr = v
+	}
+	if v := os.Getenv("RTMPS_CERT_FILES"); v != "" {
+		cfg.RTMP.TLSCertFiles = parseList(v, cfg.RTMP.TLSCertFiles)
+	}
+	if v := os.Getenv("RTMPS_KEY_FILES"); v != "" {
+		cfg.RTMP.TLSKeyFiles = parseList(v, cfg.RTMP.TLSKeyFiles)
+	}
+	if v := os.Getenv("RTMPS_RELOAD_INTERVAL"); v != "" {
+		cfg.RTMP.TLSReloadInterval = parseDuration(v, cfg.RTMP.TLSReloadInterval)
+	}
+	if v := os.Getenv("RTMP_ENABLE_PLAY"); v != "" {
+		cfg.RTMP.EnablePlay = parseBool(v, cfg.RTMP.EnablePlay)
+	}
 	if v := os.Getenv("ROOT_DIR"); v != "" {
 		cfg.Storage.RootDir = v
 	}
@@ -196,9 +403,30 @@ func Load() Config {
 	if v := os.Getenv("AUTH_URL"); v != "" {
 		cfg.Auth.AuthURL = v
 	}
-	if v := os.Getenv("STREAM_END_URL"); v != "" {
+	if v, ok := os.LookupEnv("STREAM_END_URL"); ok {
 		cfg.Auth.StreamEndURL = v
 	}
+	if v, ok := os.LookupEnv("VIDEO_INFO_URL"); ok {
+		cfg.Auth.VideoInfoURL = v
+	}
+	if v, ok := os.LookupEnv("ARCHIVE_STATUS_URL"); ok {
+		cfg.Auth.ArchiveStatusURL = v
+	}
+	if v := os.Getenv("AUTH_REQUEST_ENCODING"); v != "" {
+		cfg.Auth.RequestEncoding = strings.ToLower(strings.TrimSpace(v))
+	}
+	if v := os.Getenv("AUTH_FIELD_NAMES"); v != "" {
+		cfg.Auth.FieldNames = parseStringMap(v)
+	}
+	if v := os.Getenv("AUTH_KEY_FILE"); v != "" {
+		cfg.Auth.KeyFile = v
+	}
+	if v := os.Getenv("AUTH_KEY_FILE_FALLBACK"); v != "" {
+		cfg.Auth.KeyFileFallback = parseBool(v, cfg.Auth.KeyFileFallback)
+	}
+	if v := os.Getenv("AUTH_KEY_FILE_RELOAD"); v != "" {
+		cfg.Auth.KeyFileReloadInterval = parseDuration(v, cfg.Auth.KeyFileReloadInterval)
+	}
 	if v := os.Getenv("AUTH_API_KEY"); v != "" {
 		cfg.Auth.APIKey = v
 	}
@@ -211,6 +439,9 @@ func Load() Config {
 	if v := os.Getenv("AUTH_USER_AGENT"); v != "" {
 		cfg.Auth.HTTPUserAgent = v
 	}
+	if v := os.Getenv("PLAYBACK_AUTH_URL"); v != "" {
+		cfg.Auth.PlaybackAuthURL = v
+	}
 
 	if v := os.Getenv("MAX_WIDTH"); v != "" {
 		cfg.Policy.MaxWidth = parseInt(v, cfg.Policy.MaxWidth)
@@ -233,11 +464,25 @@ func Load() Config {
 	if v := os.Getenv("REQUIRE_AAC_LC"); v != "" {
 		cfg.Policy.RequireAACLC = parseBool(v, cfg.Policy.RequireAACLC)
 	}
+	// REJECT_IF_VIDEO_NOT_H264 is the old name of REJECT_UNKNOWN_VIDEO_CODECS.
 	if v := os.Getenv("REJECT_IF_VIDEO_NOT_H264"); v != "" {
-		cfg.Policy.RejectIfVideoNotH264 = parseBool(v, cfg.Policy.RejectIfVideoNotH264)
+		cfg.Policy.RejectUnknownVideoCodecs = parseBool(v, cfg.Policy.RejectUnknownVideoCodecs)
+	}
+	if v := os.Getenv("REJECT_UNKNOWN_VIDEO_CODECS"); v != "" {
+		cfg.Policy.RejectUnknownVideoCodecs = parseBool(v, cfg.Policy.RejectUnknownVideoCodecs)
 	}
+	// REJECT_IF_AUDIO_NOT_AAC is the old name of REJECT_UNKNOWN_AUDIO_CODECS.
 	if v := os.Getenv("REJECT_IF_AUDIO_NOT_AAC"); v != "" {
-		cfg.Policy.RejectIfAudioNotAAC = parseBool(v, cfg.Policy.RejectIfAudioNotAAC)
+		cfg.Policy.RejectUnknownAudioCodecs = parseBool(v, cfg.Policy.RejectUnknownAudioCodecs)
+	}
+	if v := os.Getenv("REJECT_UNKNOWN_AUDIO_CODECS"); v != "" {
+		cfg.Policy.RejectUnknownAudioCodecs = parseBool(v, cfg.Policy.RejectUnknownAudioCodecs)
+	}
+	if v := os.Getenv("ALLOWED_VIDEO_CODECS"); v != "" {
+		cfg.Policy.AllowedVideoCodecs = parseList(v, cfg.Policy.AllowedVideoCodecs)
+	}
+	if v := os.Getenv("ALLOWED_AUDIO_CODECS"); v != "" {
+		cfg.Policy.AllowedAudioCodecs = parseList(v, cfg.Policy.AllowedAudioCodecs)
 	}
 	if v := os.Getenv("MAX_INSPECT_DURATION"); v != "" {
 		cfg.Policy.MaxInspectDuration = parseDuration(v, cfg.Policy.MaxInspectDuration)
@@ -252,6 +497,9 @@ func Load() Config {
 	if v := os.Getenv("SEGMENT_DURATION"); v != "" {
 		cfg.HLS.SegmentDuration = parseDuration(v, cfg.HLS.SegmentDuration)
 	}
+	if v := os.Getenv("MAX_SEGMENT_OVERRUN"); v != "" {
+		cfg.HLS.MaxSegmentOverrun = parseDuration(v, cfg.HLS.MaxSegmentOverrun)
+	}
 	if v := os.Getenv("PART_DURATION"); v != "" {
 		cfg.HLS.PartDuration = parseDuration(v, cfg.HLS.PartDuration)
 	}
@@ -270,9 +518,39 @@ func Load() Config {
 	if v := os.Getenv("KEEP_SEGMENTS"); v != "" {
 		cfg.HLS.KeepSegments = parseInt(v, cfg.HLS.KeepSegments)
 	}
+	if v := os.Getenv("PDT_EVERY_SEGMENT"); v != "" {
+		cfg.HLS.PDTEverySegment = parseBool(v, cfg.HLS.PDTEverySegment)
+	}
 	if v := os.Getenv("ENABLE_PARTIAL"); v != "" {
 		cfg.HLS.EnablePartial = parseBool(v, cfg.HLS.EnablePartial)
 	}
+	if v := os.Getenv("HLS_BYTERANGE_PARTS"); v != "" {
+		cfg.HLS.ByteRangeParts = parseBool(v, cfg.HLS.ByteRangeParts)
+	}
+	if v := os.Getenv("ENABLE_DASH"); v != "" {
+		cfg.HLS.EnableDASH = parseBool(v, cfg.HLS.EnableDASH)
+	}
+	if v := os.Getenv("DASH_MANIFEST_NAME"); v != "" {
+		cfg.HLS.DASHManifestName = v
+	}
+	if v, ok := os.LookupEnv("IFRAME_PLAYLIST_NAME"); ok {
+		cfg.HLS.IFramePlaylistName = v
+	}
+	if v := os.Getenv("HLS_DEMUX_AUDIO"); v != "" {
+		cfg.HLS.DemuxAudio = parseBool(v, cfg.HLS.DemuxAudio)
+	}
+	if v := os.Getenv("AUDIO_RENDITION_NAME"); v != "" {
+		cfg.HLS.AudioRenditionName = v
+	}
+	if v := os.Getenv("EXTRACT_CAPTIONS"); v != "" {
+		cfg.HLS.ExtractCaptions = parseBool(v, cfg.HLS.ExtractCaptions)
+	}
+	if v := os.Getenv("CAPTIONS_PLAYLIST_NAME"); v != "" {
+		cfg.HLS.CaptionsPlaylistName = v
+	}
+	if v := os.Getenv("HLS_OUTPUT_FORMAT"); v != "" {
+		cfg.HLS.OutputFormat = strings.ToLower(strings.TrimSpace(v))
+	}
 
 	if v := os.Getenv("MAX_CONCURRENT_STREAMS"); v != "" {
 		cfg.Limits.MaxConcurrentStreams = parseInt(v, cfg.Limits.MaxConcurrentStreams)
@@ -299,6 +577,9 @@ func Load() Config {
 	if v := os.Getenv("ARCHIVE_RECORD_FILENAME"); v != "" {
 		cfg.Archive.RecordFilename = v
 	}
+	if v := os.Getenv("ARCHIVE_METADATA_FILENAME"); v != "" {
+		cfg.Archive.MetadataFilename = v
+	}
 	if v := os.Getenv("ARCHIVE_FFMPEG_PATH"); v != "" {
 		cfg.Archive.FFmpegPath = v
 	}
@@ -321,6 +602,137 @@ func Load() Config {
 		cfg.Archive.MaxSizeHighBytes = parseInt64(v, cfg.Archive.MaxSizeHighBytes)
 	}
 
+	if v := os.Getenv("RELAY_ENABLE"); v != "" {
+		cfg.Relay.Enable = parseBool(v, cfg.Relay.Enable)
+	}
+	if v := os.Getenv("RELAY_MAX_TARGETS"); v != "" {
+		cfg.Relay.MaxTargets = parseInt(v, cfg.Relay.MaxTargets)
+	}
+	if v := os.Getenv("RELAY_CONNECT_TIMEOUT"); v != "" {
+		cfg.Relay.ConnectTimeout = parseDuration(v, cfg.Relay.ConnectTimeout)
+	}
+	if v := os.Getenv("RELAY_MIN_BACKOFF"); v != "" {
+		cfg.Relay.MinBackoff = parseDuration(v, cfg.Relay.MinBackoff)
+	}
+	if v := os.Getenv("RELAY_MAX_BACKOFF"); v != "" {
+		cfg.Relay.MaxBackoff = parseDuration(v, cfg.Relay.MaxBackoff)
+	}
+
+	if v, ok := os.LookupEnv("HTTP_ADDR"); ok {
+		cfg.HTTP.ListenAddr = v
+	}
+	if v, ok := os.LookupEnv("HTTP_ALLOW_ORIGIN"); ok {
+		cfg.HTTP.AllowOrigin = v
+	}
+	if v := os.Getenv("HTTP_WRITE_TIMEOUT"); v != "" {
+		cfg.HTTP.WriteTimeout = parseDuration(v, cfg.HTTP.WriteTimeout)
+	}
+	if v, ok := os.LookupEnv("HTTP_HLS_PREFIX"); ok {
+		cfg.HTTP.HLSPrefix = v
+	}
+	if v, ok := os.LookupEnv("HTTP_REWIND_PREFIX"); ok {
+		cfg.HTTP.RewindPrefix = v
+	}
+
+	if v := os.Getenv("ADMIN_ADDR"); v != "" {
+		cfg.Admin.ListenAddr = v
+	}
+	if v := os.Getenv("ADMIN_TOKEN"); v != "" {
+		cfg.Admin.Token = v
+	}
+	// HTTP_METRICS_PATH is the old name of ADMIN_METRICS_PATH.
+	if v, ok := os.LookupEnv("HTTP_METRICS_PATH"); ok {
+		cfg.Admin.MetricsPath = v
+	}
+	if v, ok := os.LookupEnv("ADMIN_METRICS_PATH"); ok {
+		cfg.Admin.MetricsPath = v
+	}
+
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		cfg.Log.Level = v
+	}
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		cfg.Log.Format = v
+	}
+
+	if v := os.Getenv("WEBHOOK_URLS"); v != "" {
+		cfg.Webhooks.URLs = parseList(v, cfg.Webhooks.URLs)
+	}
+	if v := os.Getenv("WEBHOOK_SECRET"); v != "" {
+		cfg.Webhooks.Secret = v
+	}
+	if v := os.Getenv("WEBHOOK_EVENTS"); v != "" {
+		cfg.Webhooks.Events = parseList(v, cfg.Webhooks.Events)
+	}
+	if v := os.Getenv("WEBHOOK_OUTBOX_DIR"); v != "" {
+		cfg.Webhooks.OutboxDir = v
+	}
+	if v := os.Getenv("WEBHOOK_OUTBOX_LIMIT"); v != "" {
+		cfg.Webhooks.OutboxLimit = parseInt(v, cfg.Webhooks.OutboxLimit)
+	}
+	if v := os.Getenv("WEBHOOK_TIMEOUT"); v != "" {
+		cfg.Webhooks.Timeout = parseDuration(v, cfg.Webhooks.Timeout)
+	}
+	if v := os.Getenv("WEBHOOK_MIN_BACKOFF"); v != "" {
+		cfg.Webhooks.MinBackoff = parseDuration(v, cfg.Webhooks.MinBackoff)
+	}
+	if v := os.Getenv("WEBHOOK_MAX_BACKOFF"); v != "" {
+		cfg.Webhooks.MaxBackoff = parseDuration(v, cfg.Webhooks.MaxBackoff)
+	}
+
+	if v := os.Getenv("TRANSCODE_ENABLE"); v != "" {
+		cfg.Transcode.Enable = parseBool(v, cfg.Transcode.Enable)
+	}
+	if v := os.Getenv("TRANSCODE_FFMPEG_PATH"); v != "" {
+		cfg.Transcode.FFmpegPath = v
+	}
+	if v := os.Getenv("TRANSCODE_PRESET"); v != "" {
+		cfg.Transcode.Preset = v
+	}
+	if v := os.Getenv("TRANSCODE_LADDER"); v != "" {
+		cfg.Transcode.Ladder = parseList(v, cfg.Transcode.Ladder)
+	}
+	if v := os.Getenv("TRANSCODE_APP_LADDERS"); v != "" {
+		cfg.Transcode.AppLadders = parseLadderMap(v)
+	}
+	if v := os.Getenv("TRANSCODE_AUDIO_BITRATE"); v != "" {
+		cfg.Transcode.AudioBitrate = parseInt64(v, cfg.Transcode.AudioBitrate)
+	}
+	if v := os.Getenv("MASTER_PLAYLIST_NAME"); v != "" {
+		cfg.Transcode.MasterPlaylistName = v
+	}
+	if cfg.Transcode.FFmpegPath == "" {
+		cfg.Transcode.FFmpegPath = cfg.Archive.FFmpegPath
+	}
+
+	if v := os.Getenv("ENCRYPTION_ENABLE"); v != "" {
+		cfg.Encryption.Enable = parseBool(v, cfg.Encryption.Enable)
+	}
+	if v := os.Getenv("KEY_PROVIDER"); v != "" {
+		cfg.Encryption.Provider = strings.ToLower(strings.TrimSpace(v))
+	}
+	if v := os.Getenv("KEY_DIR"); v != "" {
+		cfg.Encryption.KeyDir = v
+	}
+	if v := os.Getenv("KEY_URL"); v != "" {
+		cfg.Encryption.KeyURL = v
+	}
+	if v := os.Getenv("KEY_API_KEY"); v != "" {
+		cfg.Encryption.KeyAPIKey = v
+	}
+	if v := os.Getenv("KEY_URI_TEMPLATE"); v != "" {
+		cfg.Encryption.KeyURITemplate = v
+	}
+	if v := os.Getenv("KEY_FORMAT"); v != "" {
+		cfg.Encryption.KeyFormat = v
+	}
+	if v := os.Getenv("KEY_ROTATE_SEGMENTS"); v != "" {
+		cfg.Encryption.RotateSegments = parseInt(v, cfg.Encryption.RotateSegments)
+	}
+	if v := os.Getenv("KEY_TIMEOUT"); v != "" {
+		cfg.Encryption.KeyTimeout = parseDuration(v, cfg.Encryption.KeyTimeout)
+	}
+
 	return cfg
 }
 
@@ -356,6 +768,55 @@ func parseFloat(value string, fallback float64) float64 {
 	return v
 }
 
+func parseList(value string, fallback []string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	if len(out) == 0 {
+		return fallback
+	}
+	return out
+}
+
+// parseLadderMap parses "app=720p@2800k|480p;other=360p" into per-app ladders.
+// An app with an empty ladder disables transcoding for that app.
+func parseLadderMap(value string) map[string][]string {
+	out := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		app, ladder, ok := strings.Cut(entry, "=")
+		app = strings.TrimSpace(app)
+		if !ok || app == "" {
+			continue
+		}
+		specs := []string{}
+		for _, spec := range strings.Split(ladder, "|") {
+			if spec = strings.TrimSpace(spec); spec != "" {
+				specs = append(specs, spec)
+			}
+		}
+		out[app] = specs
+	}
+	return out
+}
+
+// parseStringMap parses "a=b,c=d".
+func parseStringMap(value string) map[string]string {
+	out := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		out[key] = strings.TrimSpace(val)
+	}
+	return out
+}
+
 func parseDuration(value string, fallback time.Duration) time.Duration {
 	v, err := time.ParseDuration(value)
 	if err != nil {
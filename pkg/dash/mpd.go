@@ -0,0 +1,449 @@
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// Media times in the manifest are in milliseconds, the unit the packager
+// cuts segments in. Segment decode times are the same instants in the track
+// timescales, so no presentationTimeOffset arithmetic is lost.
+const timescale = 1000
+
+type Config struct {
+	ManifestName        string
+	InitFilename        string
+	SegmentFilenameTmpl string
+	SegmentDuration     time.Duration
+	KeepSegments        int
+	TargetLatency       time.Duration
+}
+
+// Representation describes the muxed CMAF track set of the init segment.
+type Representation struct {
+	Codecs     string
+	Width      int
+	Height     int
+	SampleRate int
+	HasVideo   bool
+	HasAudio   bool
+}
+
+type segment struct {
+	number     uint64
+	startMS    int64
+	durationMS int64
+	bits       int64
+	period     int
+}
+
+type period struct {
+	id      int
+	startMS int64 // offset from availabilityStartTime
+	ptoMS   int64 // media time at the period start
+	rep     Representation
+}
+
+// ManifestWriter keeps a dynamic MPD for the segments of one stream
+// directory. It mirrors hls.PlaylistManager: the packager adds every
+// finalized segment to both, and prunes both with the same window, so the
+// MPD and the playlist always describe the same files.
+type ManifestWriter struct {
+	cfg       Config
+	storage   *storage.Storage
+	streamID  string
+	ast       time.Time
+	periods   []period
+	segments  []segment
+	rep       Representation
+	newPeriod bool
+}
+
+func New(cfg Config, storage *storage.Storage, streamID string) *ManifestWriter {
+	return &ManifestWriter{cfg: cfg, storage: storage, streamID: streamID}
+}
+
+// SetRepresentation records the tracks of the current init segment. A change
+// after segments were written opens a new Period.
+func (m *ManifestWriter) SetRepresentation(rep Representation) {
+	if len(m.periods) > 0 && rep != m.periods[len(m.periods)-1].rep {
+		m.newPeriod = true
+	}
+	m.rep = rep
+}
+
+// MarkDiscontinuityNext opens a new Period with the next segment, as
+// EXT-X-DISCONTINUITY does in the playlist.
+func (m *ManifestWriter) MarkDiscontinuityNext() {
+	m.newPeriod = true
+}
+
+// AddSegment appends a finalized segment. wall is the wall-clock time of its
+// first sample; it anchors availabilityStartTime and new Periods.
+func (m *ManifestWriter) AddSegment(number uint64, startMS, durationMS, sizeBytes int64, wall time.Time) {
+	if wall.IsZero() {
+		wall = time.Now().Add(-time.Duration(durationMS) * time.Millisecond)
+	}
+	if m.ast.IsZero() {
+		m.ast = wall
+	}
+	if len(m.periods) == 0 || m.newPeriod {
+		id := 0
+		if len(m.periods) > 0 {
+			id = m.periods[len(m.periods)-1].id + 1
+		}
+		startOffset := wall.Sub(m.ast).Milliseconds()
+		if len(m.segments) > 0 {
+			// Periods must not overlap the previous one.
+			last := m.segments[len(m.segments)-1]
+			prev := m.periodByID(last.period)
+			if end := prev.startMS + last.startMS + last.durationMS - prev.ptoMS; startOffset < end {
+				startOffset = end
+			}
+		}
+		m.periods = append(m.periods, period{id: id, startMS: startOffset, ptoMS: startMS, rep: m.rep})
+		m.newPeriod = false
+	}
+	bits := int64(0)
+	if durationMS > 0 {
+		bits = sizeBytes * 8 * 1000 / durationMS
+	}
+	m.segments = append(m.segments, segment{
+		number:     number,
+		startMS:    startMS,
+		durationMS: durationMS,
+		bits:       bits,
+		period:     m.periods[len(m.periods)-1].id,
+	})
+}
+
+// Prune drops segments beyond KeepSegments and Periods left empty. The files
+// are removed by the playlist, which prunes the same segments.
+func (m *ManifestWriter) Prune() {
+	if m.cfg.KeepSegments <= 0 || len(m.segments) <= m.cfg.KeepSegments {
+		return
+	}
+	m.segments = append([]segment(nil), m.segments[len(m.segments)-m.cfg.KeepSegments:]...)
+	first := m.segments[0].period
+	for len(m.periods) > 1 && m.periods[0].id != first {
+		m.periods = m.periods[1:]
+	}
+}
+
+func (m *ManifestWriter) periodByID(id int) period {
+	for _, p := range m.periods {
+		if p.id == id {
+			return p
+		}
+	}
+	return period{}
+}
+
+func (m *ManifestWriter) Render(now time.Time) string {
+	doc := mpdXML{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011,http://dashif.org/guidelines/dash-if-simple",
+		Type:                       "dynamic",
+		PublishTime:                formatTime(now),
+		MinimumUpdatePeriod:        formatDuration(m.cfg.SegmentDuration.Milliseconds()),
+		MinBufferTime:              formatDuration(m.cfg.SegmentDuration.Milliseconds()),
+		SuggestedPresentationDelay: formatDuration(m.cfg.TargetLatency.Milliseconds()),
+		UTCTiming: &utcTimingXML{
+			SchemeIDURI: "urn:mpeg:dash:utc:direct:2014",
+			Value:       formatTime(now),
+		},
+	}
+	ast := m.ast
+	if ast.IsZero() {
+		ast = now
+	}
+	doc.AvailabilityStartTime = formatTime(ast)
+	if m.cfg.TargetLatency > 0 {
+		doc.ServiceDescription = &serviceDescriptionXML{
+			ID: 0,
+			Latency: &latencyXML{
+				Target: m.cfg.TargetLatency.Milliseconds(),
+				Max:    2 * m.cfg.TargetLatency.Milliseconds(),
+			},
+			PlaybackRate: &playbackRateXML{Min: "0.96", Max: "1.04"},
+		}
+	}
+
+	var windowMS, maxSegmentMS int64
+	for _, seg := range m.segments {
+		windowMS += seg.durationMS
+		if seg.durationMS > maxSegmentMS {
+			maxSegmentMS = seg.durationMS
+		}
+	}
+	doc.TimeShiftBufferDepth = formatDuration(windowMS)
+	if maxSegmentMS > 0 {
+		doc.MaxSegmentDuration = formatDuration(maxSegmentMS)
+	}
+
+	media := segmentTemplateMedia(m.cfg.SegmentFilenameTmpl)
+	for _, p := range m.periods {
+		var timeline []sXML
+		var startNumber uint64
+		var peakBits int64
+		nextMS := int64(-1)
+		for _, seg := range m.segments {
+			if seg.period != p.id {
+				continue
+			}
+			if timeline == nil {
+				startNumber = seg.number
+			}
+			s := sXML{D: seg.durationMS}
+			if seg.startMS != nextMS {
+				t := seg.startMS
+				s.T = &t
+			}
+			timeline = append(timeline, s)
+			nextMS = seg.startMS + seg.durationMS
+			if seg.bits > peakBits {
+				peakBits = seg.bits
+			}
+		}
+		if len(timeline) == 0 {
+			continue
+		}
+		contentType, mimeType := "video", "video/mp4"
+		if !p.rep.HasVideo {
+			contentType, mimeType = "audio", "audio/mp4"
+		}
+		rep := representationXML{
+			ID:        "0",
+			Bandwidth: peakBits,
+			Codecs:    p.rep.Codecs,
+		}
+		if p.rep.HasVideo {
+			rep.Width = p.rep.Width
+			rep.Height = p.rep.Height
+		}
+		if p.rep.HasAudio && p.rep.SampleRate > 0 {
+			rep.AudioSamplingRate = p.rep.SampleRate
+		}
+		doc.Periods = append(doc.Periods, periodXML{
+			ID:    strconv.Itoa(p.id),
+			Start: formatDuration(p.startMS),
+			AdaptationSets: []adaptationSetXML{{
+				ID:               0,
+				ContentType:      contentType,
+				MimeType:         mimeType,
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				SegmentTemplate: segmentTemplateXML{
+					Timescale:              timescale,
+					PresentationTimeOffset: p.ptoMS,
+					Initialization:         m.cfg.InitFilename,
+					Media:                  media,
+					StartNumber:            startNumber,
+					Timeline:               segmentTimelineXML{S: timeline},
+				},
+				Representations: []representationXML{rep},
+			}},
+		})
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return xml.Header + string(out) + "\n"
+}
+
+func (m *ManifestWriter) Write() error {
+	return m.WriteTo(m.storage.StreamDir(m.streamID))
+}
+
+func (m *ManifestWriter) WriteTo(dir string) error {
+	return storage.WriteFileAtomic(filepath.Join(dir, m.cfg.ManifestName), []byte(m.Render(time.Now())))
+}
+
+// LoadFromFile restores the timeline of a manifest written before a restart,
+// so the rewind window survives it like the playlist does.
+func (m *ManifestWriter) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var doc mpdXML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	ast, err := time.Parse(time.RFC3339Nano, doc.AvailabilityStartTime)
+	if err != nil {
+		return err
+	}
+	var periods []period
+	var segments []segment
+	for i, px := range doc.Periods {
+		if len(px.AdaptationSets) == 0 || len(px.AdaptationSets[0].Representations) == 0 {
+			continue
+		}
+		as := px.AdaptationSets[0]
+		rx := as.Representations[0]
+		p := period{
+			id:      i,
+			startMS: parseDuration(px.Start),
+			ptoMS:   as.SegmentTemplate.PresentationTimeOffset,
+			rep: Representation{
+				Codecs:     rx.Codecs,
+				Width:      rx.Width,
+				Height:     rx.Height,
+				SampleRate: rx.AudioSamplingRate,
+				HasVideo:   as.ContentType == "video",
+				HasAudio:   rx.AudioSamplingRate > 0,
+			},
+		}
+		if id, err := strconv.Atoi(px.ID); err == nil {
+			p.id = id
+		}
+		number := as.SegmentTemplate.StartNumber
+		nextMS := int64(0)
+		for _, s := range as.SegmentTemplate.Timeline.S {
+			if s.T != nil {
+				nextMS = *s.T
+			}
+			for r := 0; r <= s.R; r++ {
+				segments = append(segments, segment{number: number, startMS: nextMS, durationMS: s.D, bits: rx.Bandwidth, period: p.id})
+				number++
+				nextMS += s.D
+			}
+		}
+		periods = append(periods, p)
+	}
+	m.ast = ast
+	m.periods = periods
+	m.segments = segments
+	m.newPeriod = len(segments) > 0
+	return nil
+}
+
+// segmentTemplateMedia turns a printf pattern such as "seg_%06d.m4s" into
+// the $Number%06d$ form of SegmentTemplate@media.
+func segmentTemplateMedia(tmpl string) string {
+	start := strings.Index(tmpl, "%")
+	if start < 0 {
+		return tmpl
+	}
+	end := strings.IndexByte(tmpl[start:], 'd')
+	if end < 0 {
+		return tmpl
+	}
+	format := tmpl[start : start+end+1]
+	if format == "%d" {
+		return tmpl[:start] + "$Number$" + tmpl[start+end+1:]
+	}
+	return tmpl[:start] + "$Number" + format + "$" + tmpl[start+end+1:]
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func formatDuration(ms int64) string {
+	return fmt.Sprintf("PT%.3fS", float64(ms)/1000)
+}
+
+func parseDuration(value string) int64 {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "PT"), "S")
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(seconds*1000 + 0.5)
+}
+
+type mpdXML struct {
+	XMLName                    xml.Name               `xml:"MPD"`
+	Xmlns                      string                 `xml:"xmlns,attr"`
+	Profiles                   string                 `xml:"profiles,attr"`
+	Type                       string                 `xml:"type,attr"`
+	AvailabilityStartTime      string                 `xml:"availabilityStartTime,attr"`
+	PublishTime                string                 `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string                 `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string                 `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string                 `xml:"timeShiftBufferDepth,attr,omitempty"`
+	SuggestedPresentationDelay string                 `xml:"suggestedPresentationDelay,attr,omitempty"`
+	MaxSegmentDuration         string                 `xml:"maxSegmentDuration,attr,omitempty"`
+	ServiceDescription         *serviceDescriptionXML `xml:"ServiceDescription,omitempty"`
+	Periods                    []periodXML            `xml:"Period"`
+	UTCTiming                  *utcTimingXML          `xml:"UTCTiming,omitempty"`
+}
+
+type serviceDescriptionXML struct {
+	ID           int              `xml:"id,attr"`
+	Latency      *latencyXML      `xml:"Latency,omitempty"`
+	PlaybackRate *playbackRateXML `xml:"PlaybackRate,omitempty"`
+}
+
+type latencyXML struct {
+	Target int64 `xml:"target,attr"`
+	Max    int64 `xml:"max,attr,omitempty"`
+}
+
+type playbackRateXML struct {
+	Min string `xml:"min,attr"`
+	Max string `xml:"max,attr"`
+}
+
+type utcTimingXML struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type periodXML struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []adaptationSetXML `xml:"AdaptationSet"`
+}
+
+type adaptationSetXML struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	SegmentTemplate  segmentTemplateXML  `xml:"SegmentTemplate"`
+	Representations  []representationXML `xml:"Representation"`
+}
+
+type segmentTemplateXML struct {
+	Timescale              int                `xml:"timescale,attr"`
+	PresentationTimeOffset int64              `xml:"presentationTimeOffset,attr"`
+	Initialization         string             `xml:"initialization,attr"`
+	Media                  string             `xml:"media,attr"`
+	StartNumber            uint64             `xml:"startNumber,attr"`
+	Timeline               segmentTimelineXML `xml:"SegmentTimeline"`
+}
+
+type segmentTimelineXML struct {
+	S []sXML `xml:"S"`
+}
+
+type sXML struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+type representationXML struct {
+	ID                string `xml:"id,attr"`
+	Bandwidth         int64  `xml:"bandwidth,attr"`
+	Codecs            string `xml:"codecs,attr,omitempty"`
+	Width             int    `xml:"width,attr,omitempty"`
+	Height            int    `xml:"height,attr,omitempty"`
+	AudioSamplingRate int    `xml:"audioSamplingRate,attr,omitempty"`
+}
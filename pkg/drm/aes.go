@@ -0,0 +1,36 @@
+package drm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+)
+
+// EncryptAES128 encrypts a whole segment with AES-128-CBC and PKCS#7 padding,
+// as HLS METHOD=AES-128 expects.
+func EncryptAES128(data []byte, key Key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("iv must be %d bytes", aes.BlockSize)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+pad)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+// SequenceIV is the IV HLS implies when EXT-X-KEY has no IV attribute: the
+// media sequence number as a 128-bit big-endian integer.
+func SequenceIV(seq uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seq)
+	return iv
+}
@@ -0,0 +1,68 @@
+package drm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptAES128(t *testing.T) {
+	// NIST SP 800-38A F.2.1, CBC-AES128.Encrypt.
+	key := Key{Value: mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c")}
+	iv := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	plaintext := mustHex(t, "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	want := mustHex(t, "7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2")
+
+	out, err := EncryptAES128(plaintext, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A whole block of padding follows block-aligned input.
+	if len(out) != len(plaintext)+aes.BlockSize {
+		t.Fatalf("ciphertext is %d bytes, want %d", len(out), len(plaintext)+aes.BlockSize)
+	}
+	if !bytes.Equal(out[:len(want)], want) {
+		t.Fatalf("ciphertext = %x, want %x", out[:len(want)], want)
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, 188} {
+		data := bytes.Repeat([]byte{0x47}, size)
+		out, err := EncryptAES128(data, key, SequenceIV(7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := aes.NewCipher(key.Value)
+		plain := make([]byte, len(out))
+		cipher.NewCBCDecrypter(block, SequenceIV(7)).CryptBlocks(plain, out)
+		pad := int(plain[len(plain)-1])
+		if pad < 1 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+			t.Fatalf("%d bytes: bad padding %x", size, plain[len(plain)-pad:])
+		}
+		if !bytes.Equal(plain[:len(plain)-pad], data) {
+			t.Fatalf("%d bytes: decrypted %x, want %x", size, plain[:len(plain)-pad], data)
+		}
+	}
+}
+
+func TestEncryptAES128RejectsBadIV(t *testing.T) {
+	if _, err := EncryptAES128([]byte{1}, Key{Value: make([]byte, 16)}, make([]byte, 8)); err == nil {
+		t.Fatal("accepted an 8-byte IV")
+	}
+}
+
+func TestSequenceIV(t *testing.T) {
+	if got, want := SequenceIV(0x0102), mustHex(t, "00000000000000000000000000000102"); !bytes.Equal(got, want) {
+		t.Fatalf("SequenceIV = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package drm
+
+import (
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Protector encrypts every track of a multiplexed fMP4 stream with cbcs under
+// one key. mp4ff's InitProtect and EncryptFragment only handle single-track
+// files.
+type Protector struct {
+	key    Key
+	tracks map[uint32]*trackProtection
+}
+
+type trackProtection struct {
+	tenc *mp4.TencBox
+	// ranges finds the protected ranges of a video sample; nil encrypts the
+	// whole sample, as cbcs does for audio.
+	ranges func(sample []byte) ([]mp4.SubSamplePattern, error)
+}
+
+// ProtectInit turns the sample entries of init into encv/enca entries with a
+// cbcs scheme and returns the Protector for its fragments.
+func ProtectInit(init *mp4.InitSegment, key Key) (*Protector, error) {
+	if len(key.ID) != 16 || len(key.Value) != 16 || len(key.IV) != 16 {
+		return nil, fmt.Errorf("cbcs key, kid and iv must be 16 bytes")
+	}
+	p := &Protector{key: key, tracks: make(map[uint32]*trackProtection)}
+	for _, trak := range init.Moov.Traks {
+		stsd := trak.Mdia.Minf.Stbl.Stsd
+		if len(stsd.Children) != 1 {
+			return nil, fmt.Errorf("track %d: want one sample entry, got %d", trak.Tkhd.TrackID, len(stsd.Children))
+		}
+		tp := &trackProtection{}
+		sinf := &mp4.SinfBox{}
+		switch se := stsd.Children[0].(type) {
+		case *mp4.VisualSampleEntryBox:
+			format := se.Type()
+			var err error
+			switch format {
+			case "avc1", "avc3":
+				tp.ranges, err = avcRanges(se.AvcC)
+			case "hvc1", "hev1":
+				tp.ranges, err = hevcRanges(se.HvcC)
+			default:
+				err = fmt.Errorf("cbcs does not support %s", format)
+			}
+			if err != nil {
+				return nil, err
+			}
+			se.SetType("encv")
+			sinf.AddChild(&mp4.FrmaBox{DataFormat: format})
+			se.AddChild(sinf)
+			tp.tenc = &mp4.TencBox{Version: 1, DefaultCryptByteBlock: 1, DefaultSkipByteBlock: 9,
+				DefaultIsProtected: 1, DefaultKID: mp4.UUID(key.ID), DefaultConstantIV: key.IV}
+		case *mp4.AudioSampleEntryBox:
+			format := se.Type()
+			se.SetType("enca")
+			sinf.AddChild(&mp4.FrmaBox{DataFormat: format})
+			se.AddChild(sinf)
+			tp.tenc = &mp4.TencBox{Version: 1, DefaultIsProtected: 1,
+				DefaultKID: mp4.UUID(key.ID), DefaultConstantIV: key.IV}
+		default:
+			return nil, fmt.Errorf("cbcs does not support sample entry %s", se.Type())
+		}
+		sinf.AddChild(&mp4.SchmBox{SchemeType: "cbcs", SchemeVersion: 0x10000})
+		schi := &mp4.SchiBox{}
+		schi.AddChild(tp.tenc)
+		sinf.AddChild(schi)
+		p.tracks[trak.Tkhd.TrackID] = tp
+	}
+	return p, nil
+}
+
+// EncryptSample encrypts a sample in place and returns its subsample layout
+// for AddSampleEncryption.
+func (p *Protector) EncryptSample(trackID uint32, sample []byte) ([]mp4.SubSamplePattern, error) {
+	tp := p.tracks[trackID]
+	if tp == nil {
+		return nil, fmt.Errorf("track %d not protected", trackID)
+	}
+	var subsamples []mp4.SubSamplePattern
+	if tp.ranges != nil {
+		var err error
+		if subsamples, err = tp.ranges(sample); err != nil {
+			return nil, err
+		}
+	}
+	if err := mp4.EncryptSampleCbcs(sample, p.key.Value, p.key.IV, subsamples, tp.tenc); err != nil {
+		return nil, err
+	}
+	return subsamples, nil
+}
+
+// AddSampleEncryption adds senc, saiz and saio boxes to each track fragment.
+// subsamples holds, per track, what EncryptSample returned for each sample in
+// fragment order.
+func (p *Protector) AddSampleEncryption(frag *mp4.Fragment, subsamples map[uint32][][]mp4.SubSamplePattern) error {
+	saios := make(map[*mp4.TrafBox]*mp4.SaioBox)
+	for _, traf := range frag.Moof.Trafs {
+		samples := subsamples[traf.Tfhd.TrackID]
+		saiz := mp4.NewSaizBox(len(samples))
+		saio := mp4.NewSaioBox()
+		senc := mp4.NewSencBox(0, len(samples))
+		for _, s := range samples {
+			if err := senc.AddSample(mp4.SencSample{SubSamples: s}); err != nil {
+				return err
+			}
+			saiz.AddSampleInfo(nil, s)
+		}
+		if err := traf.AddChild(saiz); err != nil {
+			return err
+		}
+		if err := traf.AddChild(saio); err != nil {
+			return err
+		}
+		if err := traf.AddChild(senc); err != nil {
+			return err
+		}
+		saios[traf] = saio
+	}
+
+	// saio points at the first senc entry, relative to the start of moof.
+	offset := uint64(8)
+	for _, child := range frag.Moof.Children {
+		traf, ok := child.(*mp4.TrafBox)
+		if !ok {
+			offset += child.Size()
+			continue
+		}
+		pos := offset + 8
+		for _, tc := range traf.Children {
+			if tc.Type() == "senc" {
+				saios[traf].SetOffset(int64(pos + 16))
+			}
+			pos += tc.Size()
+		}
+		offset += traf.Size()
+	}
+	return nil
+}
+
+func avcRanges(avcC *mp4.AvcCBox) (func([]byte) ([]mp4.SubSamplePattern, error), error) {
+	if avcC == nil {
+		return nil, fmt.Errorf("avcC missing")
+	}
+	spsMap := make(map[uint32]*avc.SPS)
+	for _, nalu := range avcC.SPSnalus {
+		sps, err := avc.ParseSPSNALUnit(nalu, false)
+		if err != nil {
+			return nil, err
+		}
+		spsMap[sps.ParameterID] = sps
+	}
+	ppsMap := make(map[uint32]*avc.PPS)
+	for _, nalu := range avcC.PPSnalus {
+		pps, err := avc.ParsePPSNALUnit(nalu, spsMap)
+		if err != nil {
+			return nil, err
+		}
+		ppsMap[pps.PicParameterSetID] = pps
+	}
+	return func(sample []byte) ([]mp4.SubSamplePattern, error) {
+		return mp4.GetAVCProtectRanges(spsMap, ppsMap, sample, "cbcs")
+	}, nil
+}
+
+func hevcRanges(hvcC *mp4.HvcCBox) (func([]byte) ([]mp4.SubSamplePattern, error), error) {
+	if hvcC == nil {
+		return nil, fmt.Errorf("hvcC missing")
+	}
+	spsMap := make(map[uint32]*hevc.SPS)
+	ppsMap := make(map[uint32]*hevc.PPS)
+	for _, array := range hvcC.NaluArrays {
+		if array.NaluType() != hevc.NALU_SPS {
+			continue
+		}
+		for _, nalu := range array.Nalus {
+			sps, err := hevc.ParseSPSNALUnit(nalu)
+			if err != nil {
+				return nil, err
+			}
+			spsMap[uint32(sps.SpsID)] = sps
+		}
+	}
+	for _, array := range hvcC.NaluArrays {
+		if array.NaluType() != hevc.NALU_PPS {
+			continue
+		}
+		for _, nalu := range array.Nalus {
+			pps, err := hevc.ParsePPSNALUnit(nalu, spsMap)
+			if err != nil {
+				return nil, err
+			}
+			ppsMap[pps.PicParameterSetID] = pps
+		}
+	}
+	return func(sample []byte) ([]mp4.SubSamplePattern, error) {
+		return mp4.GetHEVCProtectRanges(spsMap, ppsMap, sample, "cbcs")
+	}, nil
+}
@@ -0,0 +1,121 @@
+package drm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileProvider keeps keys as JSON files under Dir/{stream}/{period}.json,
+// generating a random key the first time a period is asked for.
+type FileProvider struct {
+	Dir         string
+	URITemplate string
+}
+
+func (p *FileProvider) Key(ctx context.Context, streamID string, period uint64) (Key, error) {
+	if p.Dir == "" {
+		return Key{}, fmt.Errorf("key dir empty")
+	}
+	path := filepath.Join(p.Dir, streamID, fmt.Sprintf("%d.json", period))
+	key, err := readKeyFile(path)
+	if err == nil {
+		p.fillURI(&key, streamID, period)
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return Key{}, err
+	}
+
+	buf := make([]byte, 48)
+	if _, err := rand.Read(buf); err != nil {
+		return Key{}, err
+	}
+	key = Key{ID: buf[:16], Value: buf[16:32], IV: buf[32:]}
+	data, err := json.Marshal(keyJSON{
+		KID: hex.EncodeToString(key.ID),
+		Key: hex.EncodeToString(key.Value),
+		IV:  hex.EncodeToString(key.IV),
+	})
+	if err != nil {
+		return Key{}, err
+	}
+	if err := writeKeyFile(path, data); err != nil {
+		return Key{}, err
+	}
+	p.fillURI(&key, streamID, period)
+	return key, nil
+}
+
+func (p *FileProvider) fillURI(key *Key, streamID string, period uint64) {
+	if key.URI == "" {
+		key.URI = RenderKeyURI(p.URITemplate, streamID, period, *key)
+	}
+}
+
+// writeKeyFile is storage.WriteFileAtomic with permissions fit for key
+// material.
+func writeKeyFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Lookup returns a stored key of a stream by period number or by key ID in
+// hex. Unlike Key it never generates one.
+func (p *FileProvider) Lookup(streamID, id string) (Key, error) {
+	if p.Dir == "" {
+		return Key{}, fmt.Errorf("key dir empty")
+	}
+	dir := filepath.Join(p.Dir, streamID)
+	if period, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return readKeyFile(filepath.Join(dir, fmt.Sprintf("%d.json", period)))
+	}
+	kid, err := parseHex16(id)
+	if err != nil {
+		return Key{}, os.ErrNotExist
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Key{}, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key, err := readKeyFile(filepath.Join(dir, name))
+		if err == nil && bytes.Equal(key.ID, kid) {
+			return key, nil
+		}
+	}
+	return Key{}, os.ErrNotExist
+}
+
+func readKeyFile(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	var stored keyJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Key{}, fmt.Errorf("key file %s: %w", path, err)
+	}
+	key, err := stored.decode()
+	if err != nil {
+		return Key{}, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return key, nil
+}
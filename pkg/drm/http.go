@@ -0,0 +1,67 @@
+package drm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// HTTPProvider asks a key service for keys. It POSTs stream and period as a
+// form and expects {"kid","key","iv"} in hex, plus an optional "uri" that
+// overrides URITemplate.
+type HTTPProvider struct {
+	URL           string
+	APIKey        string
+	URITemplate   string
+	Timeout       time.Duration
+	HTTPUserAgent string
+}
+
+func (p *HTTPProvider) Key(ctx context.Context, streamID string, period uint64) (Key, error) {
+	if p.URL == "" {
+		return Key{}, fmt.Errorf("key url empty")
+	}
+	form := url.Values{}
+	form.Set("stream", streamID)
+	form.Set("period", strconv.FormatUint(period, 10))
+	if p.APIKey != "" {
+		form.Set("APIkey", p.APIKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return Key{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.HTTPUserAgent != "" {
+		req.Header.Set("User-Agent", p.HTTPUserAgent)
+	}
+
+	client := &http.Client{Timeout: p.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Key{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return Key{}, fmt.Errorf("key status %d", resp.StatusCode)
+	}
+	var decoded keyJSON
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return Key{}, fmt.Errorf("key response: %w", err)
+	}
+	key, err := decoded.decode()
+	if err != nil {
+		return Key{}, fmt.Errorf("key response: %w", err)
+	}
+	if key.URI == "" {
+		key.URI = RenderKeyURI(p.URITemplate, streamID, period, key)
+	}
+	return key, nil
+}
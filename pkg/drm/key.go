@@ -0,0 +1,76 @@
+package drm
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key is one content key. IV is the constant IV for cbcs and the explicit IV
+// for AES-128; URI is where players fetch the key.
+type Key struct {
+	ID    []byte
+	Value []byte
+	IV    []byte
+	URI   string
+}
+
+// KeyID returns the key ID as lowercase hex.
+func (k Key) KeyID() string {
+	return hex.EncodeToString(k.ID)
+}
+
+// KeyProvider returns the key for a stream's key period. Periods start at 0
+// and advance every rotation; asking for the same period again must return
+// the same key.
+type KeyProvider interface {
+	Key(ctx context.Context, streamID string, period uint64) (Key, error)
+}
+
+// RenderKeyURI fills {stream}, {kid} and {period} in a key URI template.
+func RenderKeyURI(tmpl, streamID string, period uint64, key Key) string {
+	out := strings.ReplaceAll(tmpl, "{stream}", streamID)
+	out = strings.ReplaceAll(out, "{kid}", key.KeyID())
+	out = strings.ReplaceAll(out, "{period}", strconv.FormatUint(period, 10))
+	return out
+}
+
+type keyJSON struct {
+	KID string `json:"kid"`
+	Key string `json:"key"`
+	IV  string `json:"iv"`
+	URI string `json:"uri,omitempty"`
+}
+
+func (k keyJSON) decode() (Key, error) {
+	id, err := parseHex16(k.KID)
+	if err != nil {
+		return Key{}, fmt.Errorf("kid: %w", err)
+	}
+	value, err := parseHex16(k.Key)
+	if err != nil {
+		return Key{}, fmt.Errorf("key: %w", err)
+	}
+	iv, err := parseHex16(k.IV)
+	if err != nil {
+		return Key{}, fmt.Errorf("iv: %w", err)
+	}
+	return Key{ID: id, Value: value, IV: iv, URI: k.URI}, nil
+}
+
+// parseHex16 accepts 32 hex digits, optionally as a dashed UUID or with a 0x
+// prefix.
+func parseHex16(value string) ([]byte, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(value), "0x"), "0X")
+	value = strings.ReplaceAll(value, "-", "")
+	out, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != 16 {
+		return nil, fmt.Errorf("want 16 bytes, got %d", len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package drm
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// KeyServer serves the raw 16-byte keys of a FileProvider at
+// Prefix{stream}/{kid} or Prefix{stream}/{period}, the paths a key URI
+// template of that shape renders. {stream} is the packager's stream ID, so
+// renditions add a path segment.
+type KeyServer struct {
+	Prefix      string
+	Provider    *FileProvider
+	AllowOrigin string
+	// Authorize checks the viewer's playback token for a stream; nil
+	// serves every request.
+	Authorize func(ctx context.Context, streamName, token, remoteIP string) bool
+}
+
+// KeyServerPrefix returns the path under which a key URI template puts its
+// keys, when the template is a local path ending in {stream}/{kid} or
+// {stream}/{period}.
+func KeyServerPrefix(tmpl string) (string, bool) {
+	for _, suffix := range []string{"{stream}/{kid}", "{stream}/{period}"} {
+		prefix, ok := strings.CutSuffix(tmpl, suffix)
+		if ok && strings.HasPrefix(prefix, "/") && strings.HasSuffix(prefix, "/") && !strings.Contains(prefix, "{") {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+func (s *KeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.AllowOrigin)
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	streamID, id, ok := s.parsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	streamName, _, _ := strings.Cut(streamID, "/")
+	if s.Authorize != nil && !s.Authorize(r.Context(), streamName, requestToken(r), remoteHost(r)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	key, err := s.Provider.Lookup(streamID, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "key unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	_, _ = w.Write(key.Value)
+}
+
+// parsePath splits {stream}[/{rendition}]/{id} off the prefix.
+func (s *KeyServer) parsePath(urlPath string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, s.Prefix)
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		return "", "", false
+	}
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\\\x00") {
+			return "", "", false
+		}
+	}
+	return strings.Join(parts[:len(parts)-1], "/"), parts[len(parts)-1], true
+}
+
+// requestToken reads the playback token from ?token= or a bearer
+// Authorization header.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
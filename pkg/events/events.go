@@ -0,0 +1,49 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Type names a lifecycle event.
+type Type string
+
+const (
+	PublishStart     Type = "publish_start"
+	Accepted         Type = "accepted"
+	Rejected         Type = "rejected"
+	Degraded         Type = "degraded"
+	CodecChanged     Type = "codec_changed"
+	Discontinuity    Type = "discontinuity"
+	PublishEnd       Type = "publish_end"
+	ArchiveStarted   Type = "archive_started"
+	ArchiveFinalized Type = "archive_finalized"
+	ArchiveFailed    Type = "archive_failed"
+)
+
+// Source identifies the publishing session an event is about. The stream
+// key is only ever sent hashed.
+type Source struct {
+	SessionID     string `json:"session_id,omitempty"`
+	App           string `json:"app,omitempty"`
+	StreamKeyHash string `json:"stream_key_hash,omitempty"`
+	StreamName    string `json:"stream_name,omitempty"`
+}
+
+// Event is the JSON body of a webhook. ID is unique per event and repeats
+// across delivery attempts, so receivers can drop duplicates.
+type Event struct {
+	ID   string    `json:"id"`
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Source
+	Reason string                 `json:"reason,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+func newEventID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,327 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// Delivery headers. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the shared secret; see Sign.
+const (
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	outboxExt = ".json"
+	// quarantineExt marks an outbox entry that could not be read; pending
+	// skips it.
+	quarantineExt = ".failed"
+	// queueSize bounds the events waiting for a worker to write them to
+	// its outbox.
+	queueSize = 256
+)
+
+// errRejected is a response that retrying will not change.
+var errRejected = errors.New("webhook rejected")
+
+// Dispatcher delivers events to the configured webhook endpoints. Each
+// endpoint has its own outbox directory, delivered in order by one worker,
+// so a slow or failing endpoint only holds back its own events. A nil
+// Dispatcher drops every event.
+type Dispatcher struct {
+	cfg     config.WebhookConfig
+	types   map[Type]bool
+	client  *http.Client
+	targets []*target
+
+	mu      sync.Mutex
+	lastSeq int64
+}
+
+type target struct {
+	url   string
+	dir   string
+	log   *logrus.Entry
+	queue chan outboxEntry
+}
+
+type outboxEntry struct {
+	name string
+	body []byte
+}
+
+// NewDispatcher creates the outbox directories of cfg.URLs. It returns nil
+// when no endpoint is configured.
+func NewDispatcher(cfg config.WebhookConfig) (*Dispatcher, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, nil
+	}
+	if cfg.OutboxDir == "" {
+		return nil, fmt.Errorf("webhook outbox dir empty")
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+	d := &Dispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	if len(cfg.Events) > 0 {
+		d.types = make(map[Type]bool)
+		for _, t := range cfg.Events {
+			d.types[Type(t)] = true
+		}
+	}
+	for _, rawURL := range cfg.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("webhook url invalid: %q", rawURL)
+		}
+		sum := sha256.Sum256([]byte(rawURL))
+		dir := filepath.Join(cfg.OutboxDir, hex.EncodeToString(sum[:8]))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		d.targets = append(d.targets, &target{
+			url:   rawURL,
+			dir:   dir,
+			log:   logging.Default().WithField("webhook", u.Host),
+			queue: make(chan outboxEntry, queueSize),
+		})
+	}
+	return d, nil
+}
+
+// Start delivers the events left in the outboxes and those emitted from now on.
+func (d *Dispatcher) Start() {
+	if d == nil {
+		return
+	}
+	for _, t := range d.targets {
+		go d.run(t)
+	}
+}
+
+// Emit queues ev for every endpoint that wants its type. ID and Time are
+// filled in when empty. It never touches the disk: each endpoint's worker
+// writes the event to its outbox, and an event that finds the queue full is
+// dropped.
+func (d *Dispatcher) Emit(ev Event) {
+	if d == nil || (d.types != nil && !d.types[ev.Type]) {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = newEventID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logging.Default().WithError(err).Error("webhook event encode error")
+		return
+	}
+	entry := outboxEntry{name: fmt.Sprintf("%020d%s", d.nextSeq(), outboxExt), body: body}
+	for _, t := range d.targets {
+		select {
+		case t.queue <- entry:
+		default:
+			t.log.WithField("type", ev.Type).Warn("webhook queue full, event dropped")
+		}
+	}
+}
+
+// nextSeq orders outbox entries. It follows the wall clock so entries
+// written after a restart sort after those left from before.
+func (d *Dispatcher) nextSeq() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= d.lastSeq {
+		seq = d.lastSeq + 1
+	}
+	d.lastSeq = seq
+	return seq
+}
+
+// trim drops the oldest entries of an outbox over the limit.
+func (d *Dispatcher) trim(t *target) {
+	if d.cfg.OutboxLimit <= 0 {
+		return
+	}
+	names := t.pending()
+	if len(names) <= d.cfg.OutboxLimit {
+		return
+	}
+	dropped := names[:len(names)-d.cfg.OutboxLimit]
+	for _, name := range dropped {
+		_ = storage.RemoveFile(filepath.Join(t.dir, name))
+	}
+	t.log.WithField("dropped", len(dropped)).Warn("webhook outbox full")
+}
+
+// store writes entry to the outbox along with any other queued events, then
+// trims the outbox.
+func (d *Dispatcher) store(t *target, entry outboxEntry) {
+	for {
+		if err := storage.WriteFileAtomic(filepath.Join(t.dir, entry.name), entry.body); err != nil {
+			t.log.WithError(err).Error("webhook outbox write error")
+		}
+		select {
+		case entry = <-t.queue:
+		default:
+			d.trim(t)
+			return
+		}
+	}
+}
+
+// wait stores the events queued until timeout passes; a nil timeout waits
+// for the next event.
+func (d *Dispatcher) wait(t *target, timeout <-chan time.Time) {
+	for {
+		select {
+		case entry := <-t.queue:
+			d.store(t, entry)
+			if timeout == nil {
+				return
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// quarantine moves an unreadable entry out of the delivery order. It
+// reports whether the entry is gone from the outbox.
+func (t *target) quarantine(name string, err error) bool {
+	log := t.log.WithError(err).WithField("entry", name)
+	path := filepath.Join(t.dir, name)
+	if renameErr := os.Rename(path, path+quarantineExt); renameErr == nil {
+		log.Error("webhook outbox entry unreadable, quarantined")
+		return true
+	}
+	if removeErr := storage.RemoveFile(path); removeErr == nil {
+		log.Error("webhook outbox entry unreadable, dropped")
+		return true
+	}
+	log.Error("webhook outbox entry unreadable")
+	return false
+}
+
+// pending lists the outbox entries, oldest first.
+func (t *target) pending() []string {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, outboxExt) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// run delivers an endpoint's outbox in order. A failed delivery is retried
+// with exponential backoff; a rejected one is dropped.
+func (d *Dispatcher) run(t *target) {
+	backoff := d.cfg.MinBackoff
+	for {
+		select {
+		case entry := <-t.queue:
+			d.store(t, entry)
+		default:
+		}
+		names := t.pending()
+		if len(names) == 0 {
+			d.wait(t, nil)
+			continue
+		}
+		path := filepath.Join(t.dir, names[0])
+		body, err := os.ReadFile(path)
+		if err != nil {
+			if !t.quarantine(names[0], err) {
+				d.wait(t, time.After(backoff))
+				backoff = min(backoff*2, d.cfg.MaxBackoff)
+			}
+			continue
+		}
+		err = d.deliver(t.url, body)
+		if err != nil && !errors.Is(err, errRejected) {
+			t.log.WithError(err).WithField("retry_in", backoff.String()).Warn("webhook delivery failed")
+			d.wait(t, time.After(backoff))
+			backoff = min(backoff*2, d.cfg.MaxBackoff)
+			continue
+		}
+		if err != nil {
+			t.log.WithError(err).Warn("webhook event dropped")
+		}
+		_ = storage.RemoveFile(path)
+		backoff = d.cfg.MinBackoff
+	}
+}
+
+func (d *Dispatcher) deliver(rawURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if d.cfg.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(d.cfg.Secret, timestamp, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("webhook status %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", errRejected, resp.StatusCode)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with
+// secret. Receivers recompute it to check HeaderSignature, and reject old
+// timestamps to stop replays.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
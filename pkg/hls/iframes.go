@@ -0,0 +1,132 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RenderIFrames renders an EXT-X-I-FRAMES-ONLY playlist with one BYTERANGE
+// entry per segment whose keyframe range is known. Players use it to scrub
+// without downloading whole segments.
+func (p *PlaylistManager) RenderIFrames() string {
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", p.iframeVersion()))
+	// An I-frame lasts until the next one, which may be segments later.
+	target := p.targetDuration()
+	for _, seg := range p.segments {
+		if d := int(math.Round(seg.IFrameDuration)); seg.IFrameLength > 0 && d > target {
+			target = d
+		}
+	}
+	if target < p.maxIFrameTarget {
+		target = p.maxIFrameTarget
+	}
+	p.maxIFrameTarget = target
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", target))
+	seq := uint64(0)
+	for _, seg := range p.segments {
+		if seg.Complete && seg.IFrameLength > 0 {
+			seq = seg.Seq
+			break
+		}
+	}
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", seq))
+	b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+
+	currentMap := ""
+	var currentKey Key
+	discontinuity := false
+	for _, seg := range p.segments {
+		// A skipped segment's discontinuity still applies to the next entry.
+		discontinuity = discontinuity || seg.Discontinuity
+		if !seg.Complete || seg.IFrameLength <= 0 {
+			continue
+		}
+		if discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+			discontinuity = false
+		}
+		if uri := p.mapURI(seg); uri != "" && uri != currentMap {
+			b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", uri))
+			currentMap = uri
+		}
+		if seg.Key != currentKey {
+			b.WriteString(seg.Key.tag())
+			b.WriteString("\n")
+			currentKey = seg.Key
+		}
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.IFrameDuration))
+		b.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", seg.IFrameLength, seg.IFrameOffset))
+		b.WriteString(seg.URI)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// iframeVersion: EXT-X-I-FRAMES-ONLY and EXT-X-BYTERANGE need 4, EXT-X-MAP in
+// an I-frame playlist and KEYFORMAT need 5.
+func (p *PlaylistManager) iframeVersion() int {
+	if p.cfg.InitFilename != "" {
+		return 5
+	}
+	for _, seg := range p.segments {
+		if seg.Map != "" || seg.Key.KeyFormat != "" {
+			return 5
+		}
+	}
+	return 4
+}
+
+// loadIFrames restores keyframe ranges from a previous I-frame playlist,
+// matching entries to segments by URI.
+func (p *PlaylistManager) loadIFrames(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := parseIFrames(string(data))
+	for i := range p.segments {
+		if entry, ok := entries[p.segments[i].URI]; ok {
+			p.segments[i].IFrameOffset = entry.IFrameOffset
+			p.segments[i].IFrameLength = entry.IFrameLength
+			p.segments[i].IFrameDuration = entry.IFrameDuration
+		}
+	}
+	return nil
+}
+
+func parseIFrames(content string) map[string]Segment {
+	entries := make(map[string]Segment)
+	var pending Segment
+	for _, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if comma := strings.IndexByte(value, ','); comma != -1 {
+				value = value[:comma]
+			}
+			pending.IFrameDuration, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			value := strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+			length, offset, _ := strings.Cut(value, "@")
+			pending.IFrameLength, _ = strconv.ParseInt(length, 10, 64)
+			pending.IFrameOffset, _ = strconv.ParseInt(offset, 10, 64)
+		case strings.HasPrefix(line, "#"):
+		default:
+			if pending.IFrameLength > 0 {
+				entries[line] = pending
+			}
+			pending = Segment{}
+		}
+	}
+	return entries
+}
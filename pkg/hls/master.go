@@ -0,0 +1,144 @@
+package hls
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// Media types of EXT-X-MEDIA entries.
+const (
+	MediaAudio          = "AUDIO"
+	MediaSubtitles      = "SUBTITLES"
+	MediaClosedCaptions = "CLOSED-CAPTIONS"
+)
+
+// Media is one EXT-X-MEDIA entry of a multivariant playlist. Closed
+// captions have an InstreamID instead of a URI.
+type Media struct {
+	Type       string
+	GroupID    string
+	Name       string
+	Language   string
+	URI        string
+	InstreamID string
+	Channels   int
+	Default    bool
+	Autoselect bool
+}
+
+func (m Media) tag() string {
+	attrs := []string{
+		"TYPE=" + m.Type,
+		fmt.Sprintf("GROUP-ID=\"%s\"", m.GroupID),
+		fmt.Sprintf("NAME=\"%s\"", m.Name),
+	}
+	if m.Language != "" {
+		attrs = append(attrs, fmt.Sprintf("LANGUAGE=\"%s\"", m.Language))
+	}
+	attrs = append(attrs, "DEFAULT="+yesNo(m.Default), "AUTOSELECT="+yesNo(m.Autoselect))
+	if m.InstreamID != "" {
+		attrs = append(attrs, fmt.Sprintf("INSTREAM-ID=\"%s\"", m.InstreamID))
+	}
+	if m.Channels > 0 {
+		attrs = append(attrs, fmt.Sprintf("CHANNELS=\"%d\"", m.Channels))
+	}
+	if m.URI != "" {
+		attrs = append(attrs, fmt.Sprintf("URI=\"%s\"", m.URI))
+	}
+	return "#EXT-X-MEDIA:" + strings.Join(attrs, ",")
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "YES"
+	}
+	return "NO"
+}
+
+// Variant is one EXT-X-STREAM-INF entry of a multivariant playlist.
+// Audio, Subtitles and ClosedCaptions name the GROUP-ID of its EXT-X-MEDIA
+// renditions.
+type Variant struct {
+	URI              string
+	Bandwidth        int64
+	AverageBandwidth int64
+	Codecs           string
+	Width            int
+	Height           int
+	FrameRate        float64
+	Audio            string
+	Subtitles        string
+	ClosedCaptions   string
+}
+
+// IFrameVariant is one EXT-X-I-FRAME-STREAM-INF entry.
+type IFrameVariant struct {
+	URI       string
+	Bandwidth int64
+	Codecs    string
+	Width     int
+	Height    int
+}
+
+// RenderMaster renders a multivariant playlist listing the media renditions,
+// then variants in order, followed by their I-frame playlists.
+func RenderMaster(media []Media, variants []Variant, iframes []IFrameVariant) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, m := range media {
+		b.WriteString(m.tag())
+		b.WriteString("\n")
+	}
+	for _, v := range variants {
+		attrs := []string{fmt.Sprintf("BANDWIDTH=%d", v.Bandwidth)}
+		if v.AverageBandwidth > 0 {
+			attrs = append(attrs, fmt.Sprintf("AVERAGE-BANDWIDTH=%d", v.AverageBandwidth))
+		}
+		if v.Codecs != "" {
+			attrs = append(attrs, fmt.Sprintf("CODECS=\"%s\"", v.Codecs))
+		}
+		if v.Width > 0 && v.Height > 0 {
+			attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", v.Width, v.Height))
+		}
+		if v.FrameRate > 0 {
+			attrs = append(attrs, fmt.Sprintf("FRAME-RATE=%.3f", v.FrameRate))
+		}
+		if v.Audio != "" {
+			attrs = append(attrs, fmt.Sprintf("AUDIO=\"%s\"", v.Audio))
+		}
+		if v.Subtitles != "" {
+			attrs = append(attrs, fmt.Sprintf("SUBTITLES=\"%s\"", v.Subtitles))
+		}
+		if v.ClosedCaptions != "" {
+			attrs = append(attrs, fmt.Sprintf("CLOSED-CAPTIONS=\"%s\"", v.ClosedCaptions))
+		}
+		b.WriteString("#EXT-X-STREAM-INF:")
+		b.WriteString(strings.Join(attrs, ","))
+		b.WriteString("\n")
+		b.WriteString(v.URI)
+		b.WriteString("\n")
+	}
+	for _, v := range iframes {
+		attrs := []string{fmt.Sprintf("BANDWIDTH=%d", v.Bandwidth)}
+		if v.Codecs != "" {
+			attrs = append(attrs, fmt.Sprintf("CODECS=\"%s\"", v.Codecs))
+		}
+		if v.Width > 0 && v.Height > 0 {
+			attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", v.Width, v.Height))
+		}
+		attrs = append(attrs, fmt.Sprintf("URI=\"%s\"", v.URI))
+		b.WriteString("#EXT-X-I-FRAME-STREAM-INF:")
+		b.WriteString(strings.Join(attrs, ","))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func WriteMaster(dir, name string, media []Media, variants []Variant, iframes []IFrameVariant) error {
+	return storage.WriteFileAtomic(filepath.Join(dir, name), []byte(RenderMaster(media, variants, iframes)))
+}
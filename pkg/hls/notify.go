@@ -0,0 +1,103 @@
+package hls
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// updateHub wakes blocking playlist requests when a playlist file is
+// rewritten by a PlaylistManager in this process. It also keeps, per
+// playlist, the parts still being written, so media requests need not read
+// the playlists.
+type updateHub struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+	parts   map[string]map[string]partState // dir -> playlist path -> state
+}
+
+// partState is what a playlist's last write said about its unfinished parts.
+type partState struct {
+	targetDuration int
+	// hinted holds the EXT-X-PRELOAD-HINT URI.
+	hinted map[string]bool
+	// growing holds the segment files that byte-range parts are still
+	// being appended to, including a hinted one.
+	growing map[string]bool
+	updated time.Time
+}
+
+var playlistUpdates = &updateHub{
+	waiters: make(map[string]chan struct{}),
+	parts:   make(map[string]map[string]partState),
+}
+
+func (h *updateHub) wait(path string) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch, ok := h.waiters[path]
+	if !ok {
+		ch = make(chan struct{})
+		h.waiters[path] = ch
+	}
+	return ch
+}
+
+func (h *updateHub) notify(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.waiters[path]; ok {
+		close(ch)
+		delete(h.waiters, path)
+	}
+}
+
+// setParts records the unfinished parts of the playlist at path. A playlist
+// with none is forgotten.
+func (h *updateHub) setParts(path string, state partState) {
+	dir := filepath.Dir(path)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(state.hinted) == 0 && len(state.growing) == 0 {
+		delete(h.parts[dir], path)
+		if len(h.parts[dir]) == 0 {
+			delete(h.parts, dir)
+		}
+		return
+	}
+	if h.parts[dir] == nil {
+		h.parts[dir] = make(map[string]partState)
+	}
+	state.updated = time.Now()
+	h.parts[dir][path] = state
+}
+
+// hinted reports whether a playlist in dir hints name, and that playlist's
+// target duration.
+func (h *updateHub) hinted(dir, name string) (int, bool) {
+	return h.find(dir, func(state partState) bool { return state.hinted[name] })
+}
+
+// growing reports whether a playlist in dir has byte-range parts of name, or
+// hints one, while name is not yet a complete segment, and that playlist's
+// target duration.
+func (h *updateHub) growing(dir, name string) (int, bool) {
+	return h.find(dir, func(state partState) bool { return state.growing[name] })
+}
+
+// find skips, and forgets, playlists not rewritten for three target
+// durations; their writer stopped without finishing them.
+func (h *updateHub) find(dir string, match func(partState) bool) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for path, state := range h.parts[dir] {
+		if time.Since(state.updated) > time.Duration(state.targetDuration*3)*time.Second {
+			delete(h.parts[dir], path)
+			continue
+		}
+		if match(state) {
+			return state.targetDuration, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,643 @@
+package hls
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// skipUntilTargets is CAN-SKIP-UNTIL in target durations; six is the
+// minimum the HLS spec allows.
+const skipUntilTargets = 6
+
+const (
+	blockingPollInterval  = 100 * time.Millisecond
+	defaultTargetDuration = 6
+)
+
+type OriginConfig struct {
+	LivePrefix   string
+	RewindPrefix string
+	AllowOrigin  string
+	InitFilename string
+}
+
+// Origin serves the live and rewind directories over HTTP. Playlist requests
+// with _HLS_msn/_HLS_part block until the requested segment or part exists,
+// and _HLS_skip returns a delta update.
+type Origin struct {
+	cfg     OriginConfig
+	storage *storage.Storage
+}
+
+func NewOrigin(cfg OriginConfig, storage *storage.Storage) *Origin {
+	return &Origin{cfg: cfg, storage: storage}
+}
+
+func (o *Origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.cfg.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", o.cfg.AllowOrigin)
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path, ok := o.resolve(r.URL.Path)
+	if !ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasSuffix(path, ".m3u8") {
+		o.servePlaylist(w, r, path)
+		return
+	}
+	o.serveMedia(w, r, path)
+}
+
+func (o *Origin) resolve(urlPath string) (string, bool) {
+	var root, rest string
+	switch {
+	case o.cfg.LivePrefix != "" && strings.HasPrefix(urlPath, o.cfg.LivePrefix):
+		root = o.storage.RootDir
+		rest = strings.TrimPrefix(urlPath, o.cfg.LivePrefix)
+	case o.cfg.RewindPrefix != "" && strings.HasPrefix(urlPath, o.cfg.RewindPrefix):
+		if !o.storage.EnableRewind {
+			return "", false
+		}
+		root = o.storage.RewindRoot
+		rest = strings.TrimPrefix(urlPath, o.cfg.RewindPrefix)
+	default:
+		return "", false
+	}
+	// {stream}/{file} for the source, {stream}/{rendition}/{file} for
+	// transcoded renditions.
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		return "", false
+	}
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\\\x00") {
+			return "", false
+		}
+	}
+	return filepath.Join(append([]string{root}, parts...)...), true
+}
+
+func (o *Origin) serveMedia(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil && os.IsNotExist(err) && o.waitForHintedPart(r, path) {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.NotFound(w, r)
+		return
+	}
+	if targetDuration, ok := playlistUpdates.growing(filepath.Dir(path), filepath.Base(path)); ok {
+		o.serveGrowing(w, r, f, path, targetDuration)
+		return
+	}
+	w.Header().Set("Content-Type", mediaContentType(path))
+	if filepath.Base(path) == o.cfg.InitFilename || strings.HasSuffix(path, ".mpd") {
+		// The init segment keeps its name across codec changes, and the
+		// DASH manifest is rewritten every segment.
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func (o *Origin) servePlaylist(w http.ResponseWriter, r *http.Request, path string) {
+	query := r.URL.Query()
+	msnValue := query.Get("_HLS_msn")
+	partValue := query.Get("_HLS_part")
+	if partValue != "" && msnValue == "" {
+		http.Error(w, "_HLS_part requires _HLS_msn", http.StatusBadRequest)
+		return
+	}
+	blocking := msnValue != ""
+
+	var content []byte
+	var err error
+	if blocking {
+		msn, err := strconv.ParseUint(msnValue, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if partValue != "" {
+			part, err = strconv.Atoi(partValue)
+			if err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		var status int
+		content, status = o.waitForPlaylist(r, path, msn, part)
+		if status != http.StatusOK {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	} else {
+		content, err = os.ReadFile(path)
+		if err != nil {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	summary := summarizePlaylist(string(content))
+	body := string(content)
+	if skip := query.Get("_HLS_skip"); skip == "YES" || skip == "v2" {
+		body = deltaPlaylist(body, summary.skipUntil)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	if blocking {
+		// Blocking URLs name a specific playlist version, so caches may keep
+		// them until the playlist could no longer be current.
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", summary.targetDuration*skipUntilTargets))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+// waitForPlaylist holds the request until the playlist has segment msn (or
+// part of it), up to three target durations.
+func (o *Origin) waitForPlaylist(r *http.Request, path string, msn uint64, part int) ([]byte, int) {
+	var deadline time.Time
+	for {
+		wake := playlistUpdates.wait(path)
+		content, err := os.ReadFile(path)
+		if err == nil {
+			summary := summarizePlaylist(string(content))
+			if deadline.IsZero() {
+				deadline = time.Now().Add(time.Duration(summary.targetDuration*3) * time.Second)
+			}
+			if summary.hasSegments && msn > summary.lastCompleteSeq+2 {
+				return nil, http.StatusBadRequest
+			}
+			if summary.satisfies(msn, part) {
+				return content, http.StatusOK
+			}
+		} else if deadline.IsZero() {
+			deadline = time.Now().Add(time.Duration(defaultTargetDuration*3) * time.Second)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, http.StatusServiceUnavailable
+		}
+		timer := time.NewTimer(minDuration(remaining, blockingPollInterval))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, http.StatusServiceUnavailable
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// waitForHintedPart holds a request for a part that a playlist in the same
+// directory advertises with EXT-X-PRELOAD-HINT until the part is written. It
+// gives up early if the hint is withdrawn.
+func (o *Origin) waitForHintedPart(r *http.Request, path string) bool {
+	dir := filepath.Dir(path)
+	targetDuration, ok := playlistUpdates.hinted(dir, filepath.Base(path))
+	if !ok {
+		return false
+	}
+	deadline := time.Now().Add(time.Duration(targetDuration*3) * time.Second)
+	for {
+		wake := playlistUpdates.wait(dir)
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		if _, ok := playlistUpdates.hinted(dir, filepath.Base(path)); !ok {
+			return false
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		timer := time.NewTimer(minDuration(remaining, blockingPollInterval))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return false
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// serveGrowing serves a segment that byte-range parts are still being
+// appended to. A bounded range waits until its bytes are written; otherwise
+// the bytes are streamed with chunked transfer as they are written, until the
+// segment is complete. The final length is not known up front, so an
+// open-ended range gets a 206 without Content-Range.
+func (o *Origin) serveGrowing(w http.ResponseWriter, r *http.Request, f *os.File, path string, targetDuration int) {
+	start, end, ok := parseByteRange(r.Header.Get("Range"))
+	if !ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	w.Header().Set("Content-Type", mediaContentType(path))
+	if end >= 0 {
+		if !o.waitForSize(r, f, dir, name, end+1, targetDuration) {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		info, err := f.Stat()
+		if err != nil {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("Range") != "" {
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	offset := start
+	deadline := time.Now().Add(time.Duration(targetDuration*3) * time.Second)
+	for {
+		wake := playlistUpdates.wait(dir)
+		// Checked before reading so that the read after completion gets
+		// the rest of the segment.
+		_, growing := playlistUpdates.growing(dir, name)
+		for {
+			n, err := f.ReadAt(buf, offset)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+				offset += int64(n)
+				deadline = time.Now().Add(time.Duration(targetDuration*3) * time.Second)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !growing {
+			return
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		timer := time.NewTimer(minDuration(remaining, blockingPollInterval))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// waitForSize holds a request until the growing segment has size bytes or is
+// complete, up to three target durations.
+func (o *Origin) waitForSize(r *http.Request, f *os.File, dir, name string, size int64, targetDuration int) bool {
+	deadline := time.Now().Add(time.Duration(targetDuration*3) * time.Second)
+	for {
+		wake := playlistUpdates.wait(dir)
+		info, err := f.Stat()
+		if err != nil {
+			return false
+		}
+		if info.Size() >= size {
+			return true
+		}
+		if _, ok := playlistUpdates.growing(dir, name); !ok {
+			return true
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		timer := time.NewTimer(minDuration(remaining, blockingPollInterval))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return false
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// parseByteRange parses a single "bytes=start-" or "bytes=start-end" range;
+// end is -1 when open. An empty header is the whole file.
+func parseByteRange(header string) (int64, int64, bool) {
+	if header == "" {
+		return 0, -1, true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if strings.TrimSpace(last) == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+type playlistSegment struct {
+	seq      uint64
+	parts    int
+	complete bool
+}
+
+type playlistSummary struct {
+	targetDuration  int
+	skipUntil       float64
+	segments        []playlistSegment
+	hasSegments     bool
+	lastCompleteSeq uint64
+}
+
+func summarizePlaylist(content string) playlistSummary {
+	summary := playlistSummary{targetDuration: defaultTargetDuration}
+	segments, _, err := parsePlaylist(content, false)
+	if err == nil {
+		for _, seg := range segments {
+			summary.segments = append(summary.segments, playlistSegment{seq: seg.Seq, parts: len(seg.Parts), complete: seg.Complete})
+			if seg.Complete {
+				summary.hasSegments = true
+				summary.lastCompleteSeq = seg.Seq
+			}
+		}
+	}
+	for _, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if v, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil && v > 0 {
+				summary.targetDuration = v
+			}
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			if v, ok := attributeValue(strings.TrimPrefix(line, "#EXT-X-SERVER-CONTROL:"), "CAN-SKIP-UNTIL"); ok {
+				summary.skipUntil, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return summary
+}
+
+func (s playlistSummary) satisfies(msn uint64, part int) bool {
+	for _, seg := range s.segments {
+		if seg.seq > msn && (seg.complete || seg.parts > 0) {
+			return true
+		}
+		if seg.seq == msn {
+			if seg.complete {
+				return true
+			}
+			if part >= 0 && seg.parts > part {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deltaPlaylist replaces the segments older than the skip boundary with an
+// EXT-X-SKIP tag. It never skips across a discontinuity.
+func deltaPlaylist(content string, skipUntil float64) string {
+	if skipUntil <= 0 {
+		return content
+	}
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	var header []string
+	var segments [][]string
+	var durations []float64
+	var current []string
+	currentDuration := 0.0
+	inHeader := true
+	for _, line := range lines {
+		if inHeader && isHeaderTag(line) {
+			header = append(header, line)
+			continue
+		}
+		inHeader = false
+		current = append(current, line)
+		if strings.HasPrefix(line, "#EXTINF:") {
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if comma := strings.IndexByte(value, ','); comma != -1 {
+				value = value[:comma]
+			}
+			currentDuration, _ = strconv.ParseFloat(value, 64)
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, current)
+			durations = append(durations, currentDuration)
+			current = nil
+			currentDuration = 0
+		}
+	}
+	tail := current
+
+	total := 0.0
+	for _, d := range durations {
+		total += d
+	}
+	boundary := total - skipUntil
+	skipped := 0
+	elapsed := 0.0
+	for i, seg := range segments {
+		if elapsed+durations[i] > boundary || containsLine(seg, "#EXT-X-DISCONTINUITY") {
+			break
+		}
+		elapsed += durations[i]
+		skipped++
+	}
+	if skipped == 0 {
+		return content
+	}
+
+	b := &strings.Builder{}
+	for _, line := range header {
+		// EXT-X-SKIP requires version 9.
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			line = "#EXT-X-VERSION:9"
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString(fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped))
+	// Keys and init segments set within the skipped segments still apply to
+	// the ones that follow.
+	for _, prefix := range []string{"#EXT-X-MAP:", "#EXT-X-KEY:"} {
+		if hasLinePrefix(segments[skipped], prefix) {
+			continue
+		}
+		for i := skipped - 1; i >= 0; i-- {
+			if line := lastLineWithPrefix(segments[i], prefix); line != "" {
+				b.WriteString(line)
+				b.WriteString("\n")
+				break
+			}
+		}
+	}
+	// EXT-X-DATERANGE tags of skipped segments may only be left out with
+	// CAN-SKIP-DATERANGES, which is not advertised.
+	for _, seg := range segments[:skipped] {
+		for _, line := range seg {
+			if strings.HasPrefix(line, "#EXT-X-DATERANGE:") {
+				b.WriteString(line)
+				b.WriteString("\n")
+			}
+		}
+	}
+	for _, seg := range segments[skipped:] {
+		for _, line := range seg {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+	for _, line := range tail {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func hasLinePrefix(lines []string, prefix string) bool {
+	return lastLineWithPrefix(lines, prefix) != ""
+}
+
+func lastLineWithPrefix(lines []string, prefix string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], prefix) {
+			return lines[i]
+		}
+	}
+	return ""
+}
+
+func isHeaderTag(line string) bool {
+	for _, prefix := range []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:",
+		"#EXT-X-TARGETDURATION:",
+		"#EXT-X-SERVER-CONTROL:",
+		"#EXT-X-PART-INF:",
+		"#EXT-X-MAP:",
+		"#EXT-X-MEDIA-SEQUENCE:",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		"#EXT-X-PLAYLIST-TYPE:",
+	} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
+func attributeValue(attrs, key string) (string, bool) {
+	for _, field := range strings.Split(attrs, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			return strings.Trim(kv[1], "\""), true
+		}
+	}
+	return "", false
+}
+
+func mediaContentType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4s":
+		return "video/mp4"
+	case ".m4a":
+		return "audio/mp4"
+	case ".ts":
+		return "video/mp2t"
+	case ".aac":
+		return "audio/aac"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".vtt":
+		return "text/vtt"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
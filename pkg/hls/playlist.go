@@ -1,12 +1,15 @@
 package hls
 
 import (
+	"encoding/hex"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"tokuly-live-rtmp-server/pkg/storage"
@@ -23,11 +26,20 @@ type Config struct {
 	EnablePartial   bool
 	InitFilename    string
 	PlaylistName    string
+	PDTEverySegment bool
+	// IFramePlaylistName, when set, is written next to the media playlist
+	// as an EXT-X-I-FRAMES-ONLY playlist of each segment's first keyframe.
+	IFramePlaylistName string
 }
 
 type Part struct {
-	URI      string
-	Duration float64
+	URI         string
+	Duration    float64
+	Independent bool
+	// ByteRangeLength is set when the part is a range of its segment file
+	// rather than a file of its own.
+	ByteRangeStart  int64
+	ByteRangeLength int64
 }
 
 type Segment struct {
@@ -38,6 +50,113 @@ type Segment struct {
 	Discontinuity  bool
 	Complete       bool
 	CreationTimeMS int64
+	Key            Key
+	Map            string
+	DateRanges     []DateRange
+	// IFrameLength is zero when the keyframe range is unknown.
+	IFrameOffset   int64
+	IFrameLength   int64
+	IFrameDuration float64
+}
+
+// Key is the EXT-X-KEY in effect for a segment; the zero Key is clear.
+type Key struct {
+	Method    string
+	URI       string
+	IV        string
+	KeyFormat string
+}
+
+func (k Key) tag() string {
+	if k.Method == "" {
+		return "#EXT-X-KEY:METHOD=NONE"
+	}
+	tag := fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\"", k.Method, k.URI)
+	if k.IV != "" {
+		tag += ",IV=" + k.IV
+	}
+	if k.KeyFormat != "" {
+		tag += fmt.Sprintf(",KEYFORMAT=\"%s\",KEYFORMATVERSIONS=\"1\"", k.KeyFormat)
+	}
+	return tag
+}
+
+// DateRange is an EXT-X-DATERANGE, written before the segment it starts in.
+// A range that is closed later is written again, with the same ID and
+// START-DATE, before the segment it ends in.
+type DateRange struct {
+	ID              string
+	Class           string
+	StartMS         int64
+	EndMS           int64
+	PlannedDuration float64
+	SCTE35Out       []byte
+	SCTE35In        []byte
+	// ClientAttrs are X- attributes, written as quoted strings.
+	ClientAttrs map[string]string
+}
+
+func (d DateRange) tag() string {
+	attrs := []string{fmt.Sprintf("ID=\"%s\"", quotedValue(d.ID))}
+	if d.Class != "" {
+		attrs = append(attrs, fmt.Sprintf("CLASS=\"%s\"", quotedValue(d.Class)))
+	}
+	attrs = append(attrs, fmt.Sprintf("START-DATE=\"%s\"", formatProgramDateTime(d.StartMS)))
+	if d.EndMS > 0 {
+		attrs = append(attrs, fmt.Sprintf("END-DATE=\"%s\"", formatProgramDateTime(d.EndMS)))
+	}
+	if d.PlannedDuration > 0 {
+		attrs = append(attrs, fmt.Sprintf("PLANNED-DURATION=%.3f", d.PlannedDuration))
+	}
+	names := make([]string, 0, len(d.ClientAttrs))
+	for name := range d.ClientAttrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, fmt.Sprintf("%s=\"%s\"", name, quotedValue(d.ClientAttrs[name])))
+	}
+	if len(d.SCTE35Out) > 0 {
+		attrs = append(attrs, "SCTE35-OUT=0x"+strings.ToUpper(hex.EncodeToString(d.SCTE35Out)))
+	}
+	if len(d.SCTE35In) > 0 {
+		attrs = append(attrs, "SCTE35-IN=0x"+strings.ToUpper(hex.EncodeToString(d.SCTE35In)))
+	}
+	return "#EXT-X-DATERANGE:" + strings.Join(attrs, ",")
+}
+
+// quotedValue drops what a quoted-string may not hold.
+func quotedValue(s string) string {
+	return strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+}
+
+func parseDateRangeLine(line string) (DateRange, bool) {
+	attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-DATERANGE:"))
+	start, ok := parseProgramDateTime(attrs["START-DATE"])
+	if attrs["ID"] == "" || !ok {
+		return DateRange{}, false
+	}
+	d := DateRange{ID: attrs["ID"], Class: attrs["CLASS"], StartMS: start}
+	d.EndMS, _ = parseProgramDateTime(attrs["END-DATE"])
+	d.PlannedDuration, _ = strconv.ParseFloat(attrs["PLANNED-DURATION"], 64)
+	d.SCTE35Out, _ = hex.DecodeString(strings.TrimPrefix(strings.ToLower(attrs["SCTE35-OUT"]), "0x"))
+	d.SCTE35In, _ = hex.DecodeString(strings.TrimPrefix(strings.ToLower(attrs["SCTE35-IN"]), "0x"))
+	for name, value := range attrs {
+		if strings.HasPrefix(name, "X-") {
+			if d.ClientAttrs == nil {
+				d.ClientAttrs = make(map[string]string)
+			}
+			d.ClientAttrs[name] = value
+		}
+	}
+	return d, true
+}
+
+// Rendition is another playlist of the same stream, reported with
+// EXT-X-RENDITION-REPORT so players can switch without a fresh reload.
+type Rendition struct {
+	URI      string
+	Playlist *PlaylistManager
 }
 
 type PlaylistManager struct {
@@ -46,6 +165,25 @@ type PlaylistManager struct {
 	streamID            string
 	segments            []Segment
 	pendingDiscontinuity bool
+	preloadHint         string
+	preloadHintStart    int64
+	preloadHintRange    bool
+	renditions          []Rendition
+	// maxTargetDuration is the largest EXT-X-TARGETDURATION rendered so
+	// far; the tag may not change during a playlist's lifetime, so it only
+	// ever grows.
+	maxTargetDuration int
+	// maxIFrameTarget does the same for the I-frame playlist.
+	maxIFrameTarget int
+
+	positionMu sync.Mutex
+	position   playlistPosition
+}
+
+type playlistPosition struct {
+	msn  uint64
+	part int
+	ok   bool
 }
 
 func New(cfg Config, storage *storage.Storage, streamID string) *PlaylistManager {
@@ -60,9 +198,101 @@ func (p *PlaylistManager) MarkDiscontinuityNext() {
 	p.pendingDiscontinuity = true
 }
 
-func (p *PlaylistManager) AddPart(segSeq uint64, partURI string, duration time.Duration) {
+// SetPreloadHint sets the URI of the next part for EXT-X-PRELOAD-HINT. An
+// empty URI removes the hint.
+func (p *PlaylistManager) SetPreloadHint(uri string) {
+	p.preloadHint = uri
+	p.preloadHintRange = false
+}
+
+// SetPreloadHintByteRange hints that the next part will be appended to the
+// segment file uri at offset start.
+func (p *PlaylistManager) SetPreloadHintByteRange(uri string, start int64) {
+	p.preloadHint = uri
+	p.preloadHintStart = start
+	p.preloadHintRange = true
+}
+
+func (p *PlaylistManager) SetRenditions(renditions []Rendition) {
+	p.renditions = renditions
+}
+
+// LastPosition returns the media sequence number and part index of the newest
+// media in the last written playlist. part is -1 when the playlist has no
+// parts. It is safe to call from the goroutine writing another rendition.
+func (p *PlaylistManager) LastPosition() (uint64, int, bool) {
+	p.positionMu.Lock()
+	defer p.positionMu.Unlock()
+	return p.position.msn, p.position.part, p.position.ok
+}
+
+func (p *PlaylistManager) currentPosition() playlistPosition {
+	if len(p.segments) == 0 {
+		return playlistPosition{part: -1}
+	}
+	last := p.segments[len(p.segments)-1]
+	if len(last.Parts) > 0 {
+		return playlistPosition{msn: last.Seq, part: len(last.Parts) - 1, ok: true}
+	}
+	return playlistPosition{msn: last.Seq, part: -1, ok: last.Complete}
+}
+
+func (p *PlaylistManager) AddPart(segSeq uint64, partURI string, duration time.Duration, independent bool) {
+	seg := p.ensureSegment(segSeq)
+	seg.Parts = append(seg.Parts, Part{URI: partURI, Duration: duration.Seconds(), Independent: independent})
+	p.updateSegment(seg)
+}
+
+// AddByteRangePart adds a part that was appended to the segment file uri.
+func (p *PlaylistManager) AddByteRangePart(segSeq uint64, uri string, start, length int64, duration time.Duration, independent bool) {
+	seg := p.ensureSegment(segSeq)
+	seg.Parts = append(seg.Parts, Part{
+		URI:             uri,
+		Duration:        duration.Seconds(),
+		Independent:     independent,
+		ByteRangeStart:  start,
+		ByteRangeLength: length,
+	})
+	p.updateSegment(seg)
+}
+
+// SetProgramDateTime sets the wall-clock time of the first sample of a
+// segment, emitted as EXT-X-PROGRAM-DATE-TIME.
+func (p *PlaylistManager) SetProgramDateTime(segSeq uint64, t time.Time) {
+	seg := p.ensureSegment(segSeq)
+	seg.CreationTimeMS = t.UnixMilli()
+	p.updateSegment(seg)
+}
+
+// AddDateRange adds an EXT-X-DATERANGE before a segment.
+func (p *PlaylistManager) AddDateRange(segSeq uint64, d DateRange) {
+	seg := p.ensureSegment(segSeq)
+	seg.DateRanges = append(seg.DateRanges, d)
+	p.updateSegment(seg)
+}
+
+// SetKey sets the key a segment and its parts are encrypted with.
+func (p *PlaylistManager) SetKey(segSeq uint64, key Key) {
+	seg := p.ensureSegment(segSeq)
+	seg.Key = key
+	p.updateSegment(seg)
+}
+
+// SetMap sets the init segment of a segment when it differs from
+// Config.InitFilename, as it does after a key rotation.
+func (p *PlaylistManager) SetMap(segSeq uint64, uri string) {
+	seg := p.ensureSegment(segSeq)
+	seg.Map = uri
+	p.updateSegment(seg)
+}
+
+// SetIFrame records the byte range of a segment that holds its first
+// keyframe and how long that keyframe is shown.
+func (p *PlaylistManager) SetIFrame(segSeq uint64, offset, length int64, duration time.Duration) {
 	seg := p.ensureSegment(segSeq)
-	seg.Parts = append(seg.Parts, Part{URI: partURI, Duration: duration.Seconds()})
+	seg.IFrameOffset = offset
+	seg.IFrameLength = length
+	seg.IFrameDuration = duration.Seconds()
 	p.updateSegment(seg)
 }
 
@@ -111,30 +341,84 @@ func (p *PlaylistManager) Prune() []Segment {
 	return removed
 }
 
+func (p *PlaylistManager) mapURI(seg Segment) string {
+	if seg.Map != "" {
+		return seg.Map
+	}
+	return p.cfg.InitFilename
+}
+
+// Render renders the media playlist. The LL-HLS tags (EXT-X-SERVER-CONTROL,
+// EXT-X-PART, EXT-X-PRELOAD-HINT and EXT-X-RENDITION-REPORT) are only
+// written with partial segments on, and EXT-X-VERSION is the lowest version
+// that covers the tags written.
 func (p *PlaylistManager) Render() string {
+	// Versions needed: 9 for the LL-HLS tags, 6 for EXT-X-MAP, 5 for
+	// KEYFORMAT and 3 for decimal EXTINF durations.
+	version := 3
+	need := func(v int) {
+		if v > version {
+			version = v
+		}
+	}
 	b := &strings.Builder{}
-	b.WriteString("#EXTM3U\n")
-	b.WriteString("#EXT-X-VERSION:9\n")
-	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(p.cfg.TargetDuration.Seconds()))))
-	b.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,HOLD-BACK=%.3f,PART-HOLD-BACK=%.3f\n",
-		p.cfg.HoldBack.Seconds(), p.cfg.PartHoldBack.Seconds()))
+	targetDuration := p.targetDuration()
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
 	if p.cfg.EnablePartial {
+		need(9)
+		b.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.1f,HOLD-BACK=%.3f,PART-HOLD-BACK=%.3f\n",
+			float64(targetDuration*skipUntilTargets), p.cfg.HoldBack.Seconds(), p.cfg.PartHoldBack.Seconds()))
 		b.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", p.cfg.PartDuration.Seconds()))
 	}
-	b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", p.cfg.InitFilename))
+	currentMap := p.cfg.InitFilename
+	if len(p.segments) > 0 {
+		currentMap = p.mapURI(p.segments[0])
+	}
+	if currentMap != "" {
+		need(6)
+		b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", currentMap))
+	}
 	if len(p.segments) > 0 {
 		b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", p.segments[0].Seq))
 	} else {
 		b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
 	}
 
-	for _, seg := range p.segments {
+	var currentKey Key
+	for i, seg := range p.segments {
 		if seg.Discontinuity {
 			b.WriteString("#EXT-X-DISCONTINUITY\n")
 		}
+		if seg.CreationTimeMS > 0 && (i == 0 || seg.Discontinuity || p.cfg.PDTEverySegment) {
+			b.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", formatProgramDateTime(seg.CreationTimeMS)))
+		}
+		for _, d := range seg.DateRanges {
+			b.WriteString(d.tag())
+			b.WriteString("\n")
+		}
+		if uri := p.mapURI(seg); uri != currentMap {
+			need(6)
+			b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", uri))
+			currentMap = uri
+		}
+		if seg.Key != currentKey {
+			if seg.Key.KeyFormat != "" {
+				need(5)
+			}
+			b.WriteString(seg.Key.tag())
+			b.WriteString("\n")
+			currentKey = seg.Key
+		}
 		if p.cfg.EnablePartial {
 			for _, part := range seg.Parts {
-				b.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s\"\n", part.Duration, part.URI))
+				b.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration, part.URI))
+				if part.ByteRangeLength > 0 {
+					b.WriteString(fmt.Sprintf(",BYTERANGE=\"%d@%d\"", part.ByteRangeLength, part.ByteRangeStart))
+				}
+				if part.Independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
 			}
 		}
 		if seg.Complete {
@@ -143,7 +427,62 @@ func (p *PlaylistManager) Render() string {
 			b.WriteString("\n")
 		}
 	}
-	return b.String()
+	if p.cfg.EnablePartial && p.preloadHint != "" {
+		if p.preloadHintRange {
+			b.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\",BYTERANGE-START=%d\n", p.preloadHint, p.preloadHintStart))
+		} else {
+			b.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", p.preloadHint))
+		}
+	}
+	for _, rendition := range p.renditions {
+		if !p.cfg.EnablePartial || rendition.Playlist == nil || rendition.Playlist == p {
+			continue
+		}
+		msn, part, ok := rendition.Playlist.LastPosition()
+		if !ok {
+			continue
+		}
+		if part >= 0 {
+			b.WriteString(fmt.Sprintf("#EXT-X-RENDITION-REPORT:URI=\"%s\",LAST-MSN=%d,LAST-PART=%d\n", rendition.URI, msn, part))
+		} else {
+			b.WriteString(fmt.Sprintf("#EXT-X-RENDITION-REPORT:URI=\"%s\",LAST-MSN=%d\n", rendition.URI, msn))
+		}
+	}
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n", version) + b.String()
+}
+
+// targetDuration is the configured target, raised when keyframe-aligned
+// segments in the window run longer than it.
+func (p *PlaylistManager) targetDuration() int {
+	target := int(math.Ceil(p.cfg.TargetDuration.Seconds()))
+	for _, seg := range p.segments {
+		if !seg.Complete {
+			continue
+		}
+		if d := int(math.Round(seg.Duration)); d > target {
+			target = d
+		}
+	}
+	if target < 1 {
+		target = 1
+	}
+	if target < p.maxTargetDuration {
+		target = p.maxTargetDuration
+	}
+	p.maxTargetDuration = target
+	return target
+}
+
+func formatProgramDateTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func parseProgramDateTime(value string) (int64, bool) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixMilli(), true
 }
 
 func (p *PlaylistManager) Write() error {
@@ -153,7 +492,59 @@ func (p *PlaylistManager) Write() error {
 func (p *PlaylistManager) WriteTo(dir string) error {
 	playlist := p.Render()
 	path := filepath.Join(dir, p.cfg.PlaylistName)
-	return storage.WriteFileAtomic(path, []byte(playlist))
+	if err := storage.WriteFileAtomic(path, []byte(playlist)); err != nil {
+		return err
+	}
+	p.positionMu.Lock()
+	p.position = p.currentPosition()
+	p.positionMu.Unlock()
+	playlistUpdates.setParts(path, p.partState())
+	playlistUpdates.notify(path)
+	if p.cfg.IFramePlaylistName != "" {
+		iframePath := filepath.Join(dir, p.cfg.IFramePlaylistName)
+		if err := storage.WriteFileAtomic(iframePath, []byte(p.RenderIFrames())); err != nil {
+			return err
+		}
+		playlistUpdates.notify(iframePath)
+	}
+	playlistUpdates.notify(dir)
+	return nil
+}
+
+// partState lists the parts Render advertises that are not yet complete.
+func (p *PlaylistManager) partState() partState {
+	state := partState{targetDuration: p.targetDuration()}
+	if !p.cfg.EnablePartial {
+		return state
+	}
+	add := func(m *map[string]bool, name string) {
+		if *m == nil {
+			*m = make(map[string]bool)
+		}
+		(*m)[name] = true
+	}
+	if p.preloadHint != "" {
+		add(&state.hinted, p.preloadHint)
+		if p.preloadHintRange {
+			add(&state.growing, p.preloadHint)
+		}
+	}
+	for _, seg := range p.segments {
+		if seg.Complete {
+			continue
+		}
+		for _, part := range seg.Parts {
+			if part.ByteRangeLength > 0 {
+				add(&state.growing, part.URI)
+			}
+		}
+	}
+	for _, seg := range p.segments {
+		if seg.Complete {
+			delete(state.growing, seg.URI)
+		}
+	}
+	return state
 }
 
 func (p *PlaylistManager) LoadFromFile(path string, dropIncomplete bool) (uint64, bool, error) {
@@ -169,6 +560,11 @@ func (p *PlaylistManager) LoadFromFile(path string, dropIncomplete bool) (uint64
 		return 0, false, err
 	}
 	p.segments = segments
+	if p.cfg.IFramePlaylistName != "" {
+		if err := p.loadIFrames(filepath.Join(filepath.Dir(path), p.cfg.IFramePlaylistName)); err != nil {
+			return 0, false, err
+		}
+	}
 	return lastSeq, len(segments) > 0, nil
 }
 
@@ -182,12 +578,49 @@ func (p *PlaylistManager) RemoveFiles(segments []Segment) error {
 			_ = storage.RemoveFile(filepath.Join(liveDir, seg.URI))
 		}
 		for _, part := range seg.Parts {
+			if part.ByteRangeLength > 0 {
+				continue
+			}
 			_ = storage.RemoveFile(filepath.Join(liveDir, part.URI))
 		}
 	}
+	for _, uri := range p.UnusedMaps(segments) {
+		_ = storage.RemoveFile(filepath.Join(liveDir, uri))
+	}
 	return nil
 }
 
+// UnusedMaps returns the per-segment init segments of removed segments that
+// no remaining segment refers to.
+func (p *PlaylistManager) UnusedMaps(removed []Segment) []string {
+	var unused []string
+	for _, seg := range removed {
+		if seg.Map == "" || seg.Map == p.cfg.InitFilename || containsString(unused, seg.Map) {
+			continue
+		}
+		inUse := false
+		for _, remaining := range p.segments {
+			if p.mapURI(remaining) == seg.Map {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			unused = append(unused, seg.Map)
+		}
+	}
+	return unused
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func parsePlaylist(content string, dropIncomplete bool) ([]Segment, uint64, error) {
 	lines := strings.Split(content, "\n")
 	var segments []Segment
@@ -197,12 +630,25 @@ func parsePlaylist(content string, dropIncomplete bool) ([]Segment, uint64, erro
 	nextSeq := uint64(0)
 	expectURI := false
 	pendingDuration := 0.0
-	nowMS := time.Now().UnixMilli()
+	pendingPDT := int64(0)
+	var currentKey Key
+	currentMap := ""
+	var pendingDateRanges []DateRange
 
 	createSegment := func() int {
 		seg := Segment{
-			Seq:            nextSeq,
-			CreationTimeMS: nowMS,
+			Seq:        nextSeq,
+			Key:        currentKey,
+			Map:        currentMap,
+			DateRanges: pendingDateRanges,
+		}
+		pendingDateRanges = nil
+		// Segments without their own tag continue from the previous one.
+		if pendingPDT > 0 {
+			seg.CreationTimeMS = pendingPDT
+			pendingPDT = 0
+		} else if n := len(segments); n > 0 && segments[n-1].Complete && segments[n-1].CreationTimeMS > 0 {
+			seg.CreationTimeMS = segments[n-1].CreationTimeMS + int64(segments[n-1].Duration*1000)
 		}
 		nextSeq++
 		if pendingDiscontinuity {
@@ -247,6 +693,26 @@ func parsePlaylist(content string, dropIncomplete bool) ([]Segment, uint64, erro
 			pendingDiscontinuity = true
 			continue
 		}
+		if strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:") {
+			if ms, ok := parseProgramDateTime(strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")); ok {
+				pendingPDT = ms
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-DATERANGE:") {
+			if d, ok := parseDateRangeLine(line); ok {
+				pendingDateRanges = append(pendingDateRanges, d)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-KEY:") {
+			currentKey = parseKeyLine(line)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-MAP:") {
+			currentMap = parseAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))["URI"]
+			continue
+		}
 		if strings.HasPrefix(line, "#EXT-X-PART:") {
 			part, ok := parsePartLine(line)
 			if !ok {
@@ -293,6 +759,38 @@ func parsePlaylist(content string, dropIncomplete bool) ([]Segment, uint64, erro
 	return segments, lastSeq, nil
 }
 
+func parseKeyLine(line string) Key {
+	attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+	if attrs["METHOD"] == "NONE" {
+		return Key{}
+	}
+	return Key{Method: attrs["METHOD"], URI: attrs["URI"], IV: attrs["IV"], KeyFormat: attrs["KEYFORMAT"]}
+}
+
+// parseAttributes splits an attribute list, keeping commas inside quoted
+// values, and strips the quotes.
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	inQuotes := false
+	start := 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			if list[i] == '"' {
+				inQuotes = !inQuotes
+			}
+			if list[i] != ',' || inQuotes {
+				continue
+			}
+		}
+		kv := strings.SplitN(strings.TrimSpace(list[start:i]), "=", 2)
+		if len(kv) == 2 {
+			attrs[kv[0]] = strings.Trim(kv[1], "\"")
+		}
+		start = i + 1
+	}
+	return attrs
+}
+
 func parsePartLine(line string) (Part, bool) {
 	attrs := strings.TrimSpace(strings.TrimPrefix(line, "#EXT-X-PART:"))
 	if attrs == "" {
@@ -314,6 +812,12 @@ func parsePartLine(line string) (Part, bool) {
 			}
 		case "URI":
 			part.URI = value
+		case "INDEPENDENT":
+			part.Independent = value == "YES"
+		case "BYTERANGE":
+			length, start, _ := strings.Cut(value, "@")
+			part.ByteRangeLength, _ = strconv.ParseInt(length, 10, 64)
+			part.ByteRangeStart, _ = strconv.ParseInt(start, 10, 64)
 		}
 	}
 	if part.URI == "" {
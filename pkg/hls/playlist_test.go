@@ -0,0 +1,69 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		key     Key
+		version string
+		absent  []string
+	}{
+		{
+			name:    "ts",
+			cfg:     Config{},
+			version: "#EXT-X-VERSION:3",
+			absent:  []string{"#EXT-X-SERVER-CONTROL", "#EXT-X-PART", "#EXT-X-PRELOAD-HINT", "#EXT-X-MAP"},
+		},
+		{
+			name:    "ts aes-128",
+			cfg:     Config{},
+			key:     Key{Method: "AES-128", URI: "https://keys.example/1"},
+			version: "#EXT-X-VERSION:3",
+		},
+		{
+			name:    "fmp4",
+			cfg:     Config{InitFilename: "init.mp4"},
+			version: "#EXT-X-VERSION:6",
+			absent:  []string{"#EXT-X-SERVER-CONTROL", "#EXT-X-PART"},
+		},
+		{
+			name:    "key format",
+			cfg:     Config{},
+			key:     Key{Method: "SAMPLE-AES", URI: "skd://1", KeyFormat: "com.apple.streamingkeydelivery"},
+			version: "#EXT-X-VERSION:5",
+		},
+		{
+			name:    "ll-hls",
+			cfg:     Config{InitFilename: "init.mp4", EnablePartial: true, PartDuration: 200 * time.Millisecond},
+			version: "#EXT-X-VERSION:9",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.TargetDuration = 2 * time.Second
+			p := New(tc.cfg, nil, "studio")
+			p.AddPart(0, "part_0_0", 200*time.Millisecond, true)
+			p.SetKey(0, tc.key)
+			p.FinalizeSegment(0, "seg_0", 2*time.Second)
+			p.SetPreloadHint("part_1_0")
+			out := p.Render()
+			lines := strings.Split(out, "\n")
+			if lines[0] != "#EXTM3U" || lines[1] != tc.version {
+				t.Fatalf("header = %q, want %s:\n%s", lines[:2], tc.version, out)
+			}
+			if strings.Count(out, "#EXT-X-VERSION") != 1 {
+				t.Fatalf("more than one EXT-X-VERSION:\n%s", out)
+			}
+			for _, tag := range tc.absent {
+				if strings.Contains(out, tag) {
+					t.Errorf("playlist has %s:\n%s", tag, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package httpflv
+
+import (
+	"github.com/yutopp/go-flv/tag"
+
+	rtmpsrv "tokuly-live-rtmp-server/pkg/rtmp"
+)
+
+// timestampRebaser shifts tag timestamps so playback starts at zero.
+// Sequence headers and stream metadata are sent at zero.
+type timestampRebaser struct {
+	base    uint32
+	baseSet bool
+}
+
+func (r *timestampRebaser) rebase(t *rtmpsrv.MediaTag) uint32 {
+	if t.Header || (t.Type == tag.TagTypeScriptData && !t.Timed) {
+		return 0
+	}
+	if !r.baseSet {
+		r.base = t.Timestamp
+		r.baseSet = true
+	}
+	if t.Timestamp < r.base {
+		return 0
+	}
+	return t.Timestamp - r.base
+}
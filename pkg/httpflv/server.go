@@ -0,0 +1,171 @@
+package httpflv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/policy"
+	rtmpsrv "tokuly-live-rtmp-server/pkg/rtmp"
+)
+
+const Prefix = "/live/"
+
+// Server serves live sessions as HTTP-FLV and WebSocket-FLV at
+// /live/{streamName}.flv. Requests carrying a WebSocket upgrade get the
+// WebSocket variant on the same path.
+type Server struct {
+	cfg     config.HTTPConfig
+	manager *rtmpsrv.StreamManager
+	policy  policy.Policy
+}
+
+func NewServer(cfg config.HTTPConfig, manager *rtmpsrv.StreamManager, pol policy.Policy) *Server {
+	return &Server{cfg: cfg, manager: manager, policy: pol}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg.AllowOrigin)
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	streamName := streamNameFromPath(r.URL.Path)
+	if streamName == "" {
+		http.NotFound(w, r)
+		return
+	}
+	remoteIP := remoteHost(r)
+	log := logging.FromContext(r.Context()).WithFields(logrus.Fields{logging.FieldStreamName: streamName, "remote_ip": remoteIP})
+	if !s.authorize(logging.NewContext(r.Context(), log), streamName, r.URL.Query().Get("token"), remoteIP) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	session := s.manager.LookupByName(streamName)
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sub, err := session.Subscribe()
+	if err != nil {
+		http.Error(w, "stream not ready", http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Close()
+	hasAudio, hasVideo := session.Tracks()
+
+	if isWebSocketRequest(r) {
+		ws, err := upgradeWebSocket(w, r, s.cfg.AllowOrigin, s.cfg.WriteTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer ws.Close()
+		log = log.WithField("transport", "ws")
+		log.Info("flv play start")
+		s.serveWebSocket(ws, sub, hasAudio, hasVideo)
+		log.Info("flv play end")
+		return
+	}
+
+	log = log.WithField("transport", "http")
+	log.Info("flv play start")
+	s.serveHTTP(w, r, sub, hasAudio, hasVideo)
+	log.Info("flv play end")
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request, sub *rtmpsrv.Subscriber, hasAudio, hasVideo bool) {
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	write := func(data []byte) error {
+		_ = rc.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := write(rtmpsrv.FLVHeader(hasAudio, hasVideo)); err != nil {
+		return
+	}
+	var rebaser timestampRebaser
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case t, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if err := write(rtmpsrv.EncodeFLVTag(t, rebaser.rebase(t))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) serveWebSocket(ws *wsConn, sub *rtmpsrv.Subscriber, hasAudio, hasVideo bool) {
+	if err := ws.WriteBinary(rtmpsrv.FLVHeader(hasAudio, hasVideo)); err != nil {
+		return
+	}
+	var rebaser timestampRebaser
+	for {
+		select {
+		case <-ws.Done():
+			return
+		case t, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if err := ws.WriteBinary(rtmpsrv.EncodeFLVTag(t, rebaser.rebase(t))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) authorize(ctx context.Context, streamName, token, remoteIP string) bool {
+	allowed, err := policy.AllowPlayback(ctx, s.policy, streamName, token, remoteIP)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("playback auth error")
+	}
+	return allowed
+}
+
+func streamNameFromPath(p string) string {
+	if !strings.HasPrefix(p, Prefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(p, Prefix)
+	if !strings.HasSuffix(name, ".flv") || strings.Contains(name, "/") {
+		return ""
+	}
+	name = strings.TrimSuffix(name, ".flv")
+	if name == "" || name == "." || name == ".." || path.Base(name) != name {
+		return ""
+	}
+	return name
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
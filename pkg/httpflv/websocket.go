@@ -0,0 +1,219 @@
+package httpflv
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A minimal server-side RFC 6455 implementation: FLV goes out as binary
+// messages and client frames are only read to notice close and answer pings.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xA
+)
+
+const wsMaxControlPayload = 125
+
+type wsConn struct {
+	conn         net.Conn
+	rw           *bufio.ReadWriter
+	writeTimeout time.Duration
+	writeCh      chan wsFrame
+	done         chan struct{}
+}
+
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, allowOrigin string, writeTimeout time.Duration) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("websocket method not allowed")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("websocket version not supported")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("websocket key missing")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if allowOrigin != "" {
+		resp += "Access-Control-Allow-Origin: " + allowOrigin + "\r\n"
+	}
+	resp += "\r\n"
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := rw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ws := &wsConn{
+		conn:         conn,
+		rw:           rw,
+		writeTimeout: writeTimeout,
+		writeCh:      make(chan wsFrame, 4),
+		done:         make(chan struct{}),
+	}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// Done is closed once the client goes away or sends a close frame.
+func (ws *wsConn) Done() <-chan struct{} {
+	return ws.done
+}
+
+func (ws *wsConn) WriteBinary(payload []byte) error {
+	for {
+		select {
+		case frame := <-ws.writeCh:
+			if err := ws.writeFrame(frame.op, frame.payload); err != nil {
+				return err
+			}
+			if frame.op == wsOpClose {
+				return io.EOF
+			}
+		default:
+			return ws.writeFrame(wsOpBinary, payload)
+		}
+	}
+}
+
+func (ws *wsConn) Close() error {
+	_ = ws.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+	return ws.conn.Close()
+}
+
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	var header [10]byte
+	header[0] = 0x80 | op
+	n := 2
+	switch size := len(payload); {
+	case size <= 125:
+		header[1] = byte(size)
+	case size <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:4], uint16(size))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:10], uint64(size))
+		n = 10
+	}
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout))
+	if _, err := ws.rw.Write(header[:n]); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// readLoop consumes client frames. Control replies are handed to the writer
+// through writeCh so only one goroutine ever writes to the connection.
+func (ws *wsConn) readLoop() {
+	defer close(ws.done)
+	var header [2]byte
+	for {
+		if _, err := io.ReadFull(ws.rw, header[:]); err != nil {
+			return
+		}
+		op := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		size := uint64(header[1] & 0x7F)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+				return
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+				return
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		if !masked {
+			return
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+			return
+		}
+		if op >= wsOpClose {
+			if size > wsMaxControlPayload {
+				return
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(ws.rw, payload); err != nil {
+				return
+			}
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+			switch op {
+			case wsOpClose:
+				ws.queueControl(wsOpClose, payload)
+				return
+			case wsOpPing:
+				ws.queueControl(wsOpPong, payload)
+			}
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, ws.rw, int64(size)); err != nil {
+			return
+		}
+	}
+}
+
+func (ws *wsConn) queueControl(op byte, payload []byte) {
+	select {
+	case ws.writeCh <- wsFrame{op: op, payload: payload}:
+	default:
+	}
+}
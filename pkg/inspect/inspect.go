@@ -4,7 +4,9 @@ import (
 	"time"
 
 	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
 
+	"tokuly-live-rtmp-server/pkg/captions"
 	"tokuly-live-rtmp-server/pkg/util"
 )
 
@@ -24,6 +26,14 @@ type Result struct {
 	GOPSeconds       float64
 	KeyframeReceived bool
 	InitialBitrate   int64
+	AudioBitrate     int64
+	// CEA608 and CEA708 report closed captions in video SEI.
+	CEA608 bool
+	CEA708 bool
+	// VideoConfig and AudioConfig are the parsed decoder configurations,
+	// which also give the tracks' RFC 6381 codec strings.
+	VideoConfig util.VideoConfig
+	AudioConfig util.AudioConfig
 }
 
 type Config struct {
@@ -48,8 +58,9 @@ type Inspector struct {
 	videoFirstTS    int64
 	videoLastTS     int64
 
-	bitrateStartTS int64
-	bitrateBytes   int64
+	bitrateStartTS    int64
+	bitrateBytes      int64
+	bitrateAudioBytes int64
 
 	result Result
 	final  bool
@@ -59,7 +70,21 @@ func New(cfg Config) *Inspector {
 	return &Inspector{cfg: cfg}
 }
 
-func (i *Inspector) OnVideoConfig(cfg util.AVCConfig) {
+func (i *Inspector) OnVideoConfig(cfg util.VideoConfig) {
+	switch cfg.Codec {
+	case util.VideoCodecH264:
+		i.onAVCConfig(cfg.AVC)
+	case util.VideoCodecHEVC:
+		i.onHEVCConfig(cfg.HEVC)
+	case util.VideoCodecAV1:
+		i.onAV1Config(cfg.AV1)
+	}
+	if cfg.Ready() {
+		i.result.VideoConfig = cfg
+	}
+}
+
+func (i *Inspector) onAVCConfig(cfg util.AVCConfig) {
 	if len(cfg.SPS) == 0 || len(cfg.PPS) == 0 {
 		return
 	}
@@ -77,28 +102,71 @@ func (i *Inspector) OnVideoConfig(cfg util.AVCConfig) {
 			}
 		}
 	}
-	i.result.VideoCodec = "H264"
+	i.result.VideoCodec = util.VideoCodecH264
+	i.result.SPS = append([]byte(nil), cfg.SPS[0]...)
+	i.result.PPS = append([]byte(nil), cfg.PPS[0]...)
+	i.videoConfigDone = true
+}
+
+func (i *Inspector) onHEVCConfig(cfg util.HEVCConfig) {
+	if len(cfg.SPS) == 0 || len(cfg.PPS) == 0 {
+		return
+	}
+	parsed, err := hevc.ParseSPSNALUnit(cfg.SPS[0])
+	if err == nil {
+		width, height := parsed.ImageSize()
+		i.result.Width = int(width)
+		i.result.Height = int(height)
+		i.result.Profile = uint32(parsed.ProfileTierLevel.GeneralProfileIDC)
+		i.result.Level = uint32(parsed.ProfileTierLevel.GeneralLevelIDC)
+		if parsed.VUI != nil && parsed.VUI.TimingInfoPresentFlag && parsed.VUI.NumUnitsInTick > 0 {
+			fps := float64(parsed.VUI.TimeScale) / float64(parsed.VUI.NumUnitsInTick)
+			if fps > 0 && i.result.VideoFPS == 0 {
+				i.result.VideoFPS = fps
+			}
+		}
+	}
+	i.result.VideoCodec = util.VideoCodecHEVC
 	i.result.SPS = append([]byte(nil), cfg.SPS[0]...)
 	i.result.PPS = append([]byte(nil), cfg.PPS[0]...)
 	i.videoConfigDone = true
 }
 
-func (i *Inspector) OnAudioConfig(cfg util.AACConfig) {
-	i.result.AudioCodec = "AAC"
-	i.result.ASC = append([]byte(nil), cfg.ASC...)
-	i.result.SampleRate = cfg.SampleRate
-	i.result.Channels = cfg.Channels
+func (i *Inspector) onAV1Config(cfg util.AV1Config) {
+	if len(cfg.Record) == 0 {
+		return
+	}
+	i.result.Width = cfg.Width
+	i.result.Height = cfg.Height
+	i.result.Profile = uint32(cfg.SeqProfile)
+	i.result.Level = uint32(cfg.SeqLevel)
+	i.result.VideoCodec = util.VideoCodecAV1
+	i.result.SPS = nil
+	i.result.PPS = nil
+	i.videoConfigDone = true
+}
+
+func (i *Inspector) OnAudioConfig(cfg util.AudioConfig) {
+	i.result.AudioCodec = cfg.Codec
+	i.result.AudioConfig = cfg
+	i.result.ASC = nil
+	if cfg.Codec == util.AudioCodecAAC {
+		i.result.ASC = append([]byte(nil), cfg.AAC.ASC...)
+	}
+	i.result.SampleRate = cfg.SampleRate()
+	i.result.Channels = cfg.Channels()
 	i.audioConfigDone = true
 }
 
 func (i *Inspector) OnVideoSample(tsMS int64, data []byte, isKey bool) {
 	i.observeStart(tsMS)
-	i.observeBitrate(tsMS, int64(len(data)))
+	i.observeBitrate(tsMS, int64(len(data)), false)
 	if i.videoFrames == 0 {
 		i.videoFirstTS = tsMS
 	}
 	i.videoLastTS = tsMS
 	i.videoFrames++
+	i.observeCaptions(data)
 
 	if isKey {
 		i.result.KeyframeReceived = true
@@ -114,9 +182,30 @@ func (i *Inspector) OnVideoSample(tsMS int64, data []byte, isKey bool) {
 	i.maybeFinalize(tsMS)
 }
 
+// observeCaptions looks for caption SEI until both kinds have been seen.
+// It keeps going after the result is final, since captions often start
+// well after the stream does.
+func (i *Inspector) observeCaptions(data []byte) {
+	if i.result.CEA608 && i.result.CEA708 {
+		return
+	}
+	cc := captions.Extract(i.result.VideoCodec, data)
+	if cc.Has608() {
+		i.result.CEA608 = true
+	}
+	if cc.DTVCC {
+		i.result.CEA708 = true
+	}
+}
+
+// Captions reports the closed captions seen so far.
+func (i *Inspector) Captions() (cea608, cea708 bool) {
+	return i.result.CEA608, i.result.CEA708
+}
+
 func (i *Inspector) OnAudioSample(tsMS int64, data []byte) {
 	i.observeStart(tsMS)
-	i.observeBitrate(tsMS, int64(len(data)))
+	i.observeBitrate(tsMS, int64(len(data)), true)
 	i.maybeFinalize(tsMS)
 }
 
@@ -167,11 +256,14 @@ func (i *Inspector) observeStart(tsMS int64) {
 	i.bitrateStartTS = tsMS
 }
 
-func (i *Inspector) observeBitrate(tsMS int64, bytes int64) {
+func (i *Inspector) observeBitrate(tsMS int64, bytes int64, audio bool) {
 	if !i.started {
 		return
 	}
 	i.bitrateBytes += bytes
+	if audio {
+		i.bitrateAudioBytes += bytes
+	}
 	if i.cfg.BitrateWindow <= 0 {
 		return
 	}
@@ -179,10 +271,12 @@ func (i *Inspector) observeBitrate(tsMS int64, bytes int64) {
 		seconds := float64(tsMS-i.bitrateStartTS) / 1000.0
 		if seconds > 0 {
 			i.result.InitialBitrate = int64(float64(i.bitrateBytes*8) / seconds)
+			i.result.AudioBitrate = int64(float64(i.bitrateAudioBytes*8) / seconds)
 		}
 		// reset window for the next estimation
 		i.bitrateStartTS = tsMS
 		i.bitrateBytes = 0
+		i.bitrateAudioBytes = 0
 	}
 }
 
@@ -0,0 +1,60 @@
+package inspect
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestResultVideoCodecString(t *testing.T) {
+	avcC, err := util.ParseAVCDecoderConfig(mustHex(t, "0164001effe100196764001eacd940a02ff9610000030001000003003c8f162d9601000568ebecb22c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10-bit 1080p, level 4.1 (seq_level_idx 9).
+	av1C, err := util.ParseAV1CodecConfig(mustHex(t, "81094c000a0b0000004aabbfc377ffe701"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  util.VideoConfig
+		want string
+	}{
+		{"h264", util.VideoConfig{Codec: util.VideoCodecH264, AVC: avcC}, "avc1.64001E"},
+		{
+			// Main profile with a non-zero constraint byte.
+			"hevc",
+			util.VideoConfig{Codec: util.VideoCodecHEVC, HEVC: util.HEVCConfig{
+				VPS: [][]byte{{0x40, 0x01}},
+				SPS: [][]byte{mustHex(t, "420101016000000300900000030000030078a0021c801e0596566924caf01680800001f480003a9804")},
+				PPS: [][]byte{{0x44, 0x01}},
+			}},
+			"hvc1.1.6.L120.90",
+		},
+		{"av1", util.VideoConfig{Codec: util.VideoCodecAV1, AV1: av1C}, "av01.0.09M.10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := New(Config{AllowNoAudio: true})
+			i.OnVideoConfig(tc.cfg)
+			i.OnVideoSample(0, nil, true)
+			result, ok := i.Result()
+			if !ok {
+				t.Fatal("no result after config and keyframe")
+			}
+			if got := result.VideoConfig.CodecString(); got != tc.want {
+				t.Fatalf("codec string = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields carried by every line logged for a publishing session.
+const (
+	FieldSessionID     = "session_id"
+	FieldApp           = "app"
+	FieldStreamKeyHash = "stream_key_hash"
+	FieldStreamName    = "stream_name"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Setup configures the process logger with a level such as "debug" or
+// "info" and a format of "json" or "text". Output from the standard log
+// package is routed through it at info level.
+func Setup(level, format string) (*logrus.Logger, error) {
+	logger := logrus.StandardLogger()
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(lvl)
+	switch format {
+	case FormatJSON, "":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case FormatText:
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{logger})
+	return logger, nil
+}
+
+// stdlibWriter logs each line of the standard log package as a message.
+type stdlibWriter struct {
+	logger *logrus.Logger
+}
+
+func (w stdlibWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// Default is the entry used where no logger was passed in.
+func Default() *logrus.Entry {
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+type contextKey struct{}
+
+// NewContext attaches entry to ctx, so calls made on behalf of a session
+// log with its fields.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the entry attached to ctx, or Default.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return Default()
+}
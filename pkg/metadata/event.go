@@ -0,0 +1,144 @@
+// Package metadata turns timed AMF data messages from the broadcaster into
+// the ID3 and SCTE-35 payloads HLS and CMAF carry.
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TypeCuePoint = "onCuePoint"
+	TypeTextData = "onTextData"
+)
+
+// CueType tells ad-break cue points apart from other cue points.
+type CueType int
+
+const (
+	CueNone CueType = iota
+	CueOut
+	CueIn
+)
+
+// Event is one onCuePoint or onTextData message.
+type Event struct {
+	Type string
+	// Name is the cue point name; empty for text.
+	Name string
+	Cue  CueType
+	// Duration is the planned length of a CUE-OUT break, zero if unknown.
+	Duration time.Duration
+	// SCTE35 is the splice_info_section the broadcaster sent with the cue,
+	// if any.
+	SCTE35 []byte
+	// Data is the AMF object as sent.
+	Data map[string]interface{}
+}
+
+// Text returns the text of an onTextData event.
+func (e Event) Text() string {
+	text, _ := e.Data["text"].(string)
+	return text
+}
+
+// FromObject builds an event from the AMF object of a data message named
+// typ. It reports false for other message names.
+func FromObject(typ string, obj map[string]interface{}) (Event, bool) {
+	switch typ {
+	case TypeTextData:
+		return Event{Type: typ, Data: obj}, true
+	case TypeCuePoint:
+	default:
+		return Event{}, false
+	}
+	ev := Event{Type: typ, Data: obj}
+	ev.Name, _ = obj["name"].(string)
+	params := object(obj["parameters"])
+	// Encoders disagree on where ad markers go: some name the cue point
+	// after the splice, others set its type.
+	cueType, _ := obj["type"].(string)
+	ev.Cue = cueTypeOf(ev.Name)
+	if ev.Cue == CueNone {
+		ev.Cue = cueTypeOf(cueType)
+	}
+	if ev.Cue == CueOut {
+		for _, fields := range []map[string]interface{}{params, obj} {
+			if seconds, ok := number(fields["duration"]); ok && seconds > 0 {
+				ev.Duration = time.Duration(seconds * float64(time.Second))
+				break
+			}
+		}
+	}
+	if ev.Cue != CueNone {
+		for _, key := range []string{"scte35", "SCTE35", "cue"} {
+			if section := decodeSection(params[key]); section != nil {
+				ev.SCTE35 = section
+				break
+			}
+		}
+	}
+	return ev, true
+}
+
+func cueTypeOf(name string) CueType {
+	name = strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(name))
+	switch name {
+	case "cueout", "spliceout", "adstart", "adbreakstart":
+		return CueOut
+	case "cuein", "splicein", "adend", "adbreakend":
+		return CueIn
+	default:
+		return CueNone
+	}
+}
+
+// object returns an AMF object or ECMA array as a map; the AMF decoder
+// gives nested ECMA arrays their own map type.
+func object(value interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	out := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		out[iter.Key().String()] = iter.Value().Interface()
+	}
+	return out
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		return parsed, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// decodeSection accepts a splice_info_section in base64 or as 0x-prefixed
+// hex.
+func decodeSection(value interface{}) []byte {
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return nil
+	}
+	if rest, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+		if data, err := hex.DecodeString(rest); err == nil {
+			return data
+		}
+		return nil
+	}
+	if data, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return data
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package metadata
+
+import (
+	"encoding/json"
+)
+
+// ID3SchemeIDURI identifies emsg boxes carrying an ID3 tag.
+const ID3SchemeIDURI = "https://aomedia.org/emsg/ID3"
+
+// ID3 renders the event as an ID3v2.4 tag with one TXXX frame, described by
+// the message name and holding the AMF object as JSON.
+func (e Event) ID3() ([]byte, error) {
+	value, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	frame := []byte{0x03} // UTF-8
+	frame = append(frame, e.Type...)
+	frame = append(frame, 0x00)
+	frame = append(frame, value...)
+
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00}
+	tag = append(tag, syncsafe(10+len(frame))...)
+	tag = append(tag, 'T', 'X', 'X', 'X')
+	tag = append(tag, syncsafe(len(frame))...)
+	tag = append(tag, 0x00, 0x00)
+	return append(tag, frame...), nil
+}
+
+// syncsafe encodes n in four bytes of seven bits each.
+func syncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7F, byte(n>>14) & 0x7F, byte(n>>7) & 0x7F, byte(n) & 0x7F}
+}
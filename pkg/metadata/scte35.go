@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"time"
+
+	"tokuly-live-rtmp-server/pkg/mpegts"
+)
+
+// SpliceInsert builds a splice_info_section with a splice_insert command,
+// for cue points that arrive without one. out marks the start of a break;
+// pts is on the 90 kHz clock and a non-zero duration sets auto_return.
+func SpliceInsert(eventID uint32, out bool, pts uint64, duration time.Duration) []byte {
+	flags := byte(0x40 | 0x08 | 0x07) // program_splice, event_id_compliance, reserved
+	if out {
+		flags |= 0x80
+	}
+	if duration > 0 {
+		flags |= 0x20
+	}
+	cmd := []byte{
+		byte(eventID >> 24), byte(eventID >> 16), byte(eventID >> 8), byte(eventID),
+		0x7F, // splice_event_cancel_indicator 0, reserved
+		flags,
+	}
+	cmd = append(cmd, time33(0xFE, pts)...) // time_specified_flag, reserved
+	if duration > 0 {
+		cmd = append(cmd, time33(0xFE, uint64(duration*90000/time.Second))...) // auto_return, reserved
+	}
+	cmd = append(cmd, 0x00, 0x00, 0x00, 0x00) // unique_program_id, avail_num, avails_expected
+
+	body := []byte{
+		0x00,                         // protocol_version
+		0x00, 0x00, 0x00, 0x00, 0x00, // not encrypted, pts_adjustment 0
+		0x00,                                           // cw_index
+		0xFF, 0xF0 | byte(len(cmd)>>8), byte(len(cmd)), // tier 0xFFF, splice_command_length
+		0x05, // splice_insert
+	}
+	body = append(body, cmd...)
+	body = append(body, 0x00, 0x00) // descriptor_loop_length
+
+	sectionLen := len(body) + 4
+	section := []byte{0xFC, 0x30 | byte(sectionLen>>8), byte(sectionLen)}
+	section = append(section, body...)
+	crc := mpegts.CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// time33 packs a 33-bit value after the seven high bits of lead.
+func time33(lead byte, v uint64) []byte {
+	return []byte{lead | byte(v>>32)&0x01, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "tokuly"
+
+// Stream identifies the series of one stream. The stream key is only ever
+// exposed hashed.
+type Stream struct {
+	App     string
+	KeyHash string
+}
+
+func (s Stream) labels() prometheus.Labels {
+	return prometheus.Labels{"app": s.App, "stream_key_hash": s.KeyHash}
+}
+
+// Reasons the StreamManager refuses a publisher.
+const (
+	RejectDuplicate  = "duplicate"
+	RejectMaxStreams = "max_streams"
+)
+
+// Kinds of packager output.
+const (
+	WriteInit     = "init"
+	WritePart     = "part"
+	WriteSegment  = "segment"
+	WritePlaylist = "playlist"
+)
+
+// Policy calls.
+const (
+	CallAuthorize         = "authorize"
+	CallAuthorizePlayback = "authorize_playback"
+	CallStreamEnd         = "stream_end"
+	CallVideoInfo         = "video_info"
+	CallArchiveStatus     = "archive_status"
+)
+
+// Archive conversion outcomes.
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+var (
+	activeSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Publishing sessions registered with the stream manager.",
+	}, []string{"app"})
+
+	rejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "session_rejections_total",
+		Help:      "Publishers refused by the stream manager.",
+	}, []string{"app", "reason"})
+
+	ingestBitrate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingest_bitrate_bps",
+		Help:      "Audio and video ingest bitrate over the last measurement window.",
+	}, []string{"app", "stream_key_hash"})
+
+	ingestFPS = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingest_fps",
+		Help:      "Video frames per second over the last measurement window.",
+	}, []string{"app", "stream_key_hash"})
+
+	timestampResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "timestamp_resets_total",
+		Help:      "Packager resets caused by a jump in ingest timestamps.",
+	}, []string{"app", "stream_key_hash"})
+
+	writeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "packager_write_seconds",
+		Help:      "Time taken to write a part or segment and its playlists.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"app", "kind"})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Packager output that failed to write.",
+	}, []string{"app", "stream_key_hash", "kind"})
+
+	policySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "policy_request_seconds",
+		Help:      "Latency of policy HTTP calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call"})
+
+	policyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_request_failures_total",
+		Help:      "Policy HTTP calls that failed to complete or got a 5xx response.",
+	}, []string{"call"})
+
+	archiveSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "archive_conversion_seconds",
+		Help:      "Duration of ffmpeg archive conversions.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 3600},
+	}, []string{"app", "outcome"})
+
+	archiveConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "archive_conversions_total",
+		Help:      "Archive conversions by outcome.",
+	}, []string{"app", "stream_key_hash", "outcome"})
+)
+
+func SessionStarted(app string) {
+	activeSessions.WithLabelValues(app).Inc()
+}
+
+func SessionEnded(app string) {
+	activeSessions.WithLabelValues(app).Dec()
+}
+
+func SessionRejected(app, reason string) {
+	rejections.WithLabelValues(app, reason).Inc()
+}
+
+// SetIngest records the ingest rates of a stream.
+func SetIngest(s Stream, bitrate, fps float64) {
+	ingestBitrate.With(s.labels()).Set(bitrate)
+	ingestFPS.With(s.labels()).Set(fps)
+}
+
+// StreamEnded drops the gauges of a stream that stopped publishing.
+// Counters are kept so their totals survive a reconnect.
+func StreamEnded(s Stream) {
+	ingestBitrate.Delete(s.labels())
+	ingestFPS.Delete(s.labels())
+}
+
+func TimestampReset(s Stream) {
+	timestampResets.With(s.labels()).Inc()
+}
+
+// ObserveWrite records a write latency. Histograms are labelled by app only
+// so their series stay bounded.
+func ObserveWrite(s Stream, kind string, seconds float64) {
+	writeSeconds.WithLabelValues(s.App, kind).Observe(seconds)
+}
+
+func StorageError(s Stream, kind string) {
+	storageErrors.WithLabelValues(s.App, s.KeyHash, kind).Inc()
+}
+
+func ObservePolicyCall(call string, seconds float64, failed bool) {
+	policySeconds.WithLabelValues(call).Observe(seconds)
+	if failed {
+		policyFailures.WithLabelValues(call).Inc()
+	}
+}
+
+func ObserveArchiveConversion(s Stream, outcome string, seconds float64) {
+	archiveSeconds.WithLabelValues(s.App, outcome).Observe(seconds)
+	archiveConversions.WithLabelValues(s.App, s.KeyHash, outcome).Inc()
+}
@@ -0,0 +1,75 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/aac"
+)
+
+var startCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// AnnexB converts a sample of 4-byte length-prefixed H.264 NAL units to an
+// Annex-B access unit with a leading AUD. SPS and PPS are inserted before
+// IDR frames that do not carry them in-band.
+func AnnexB(sample []byte, sps, pps [][]byte, isKey bool) ([]byte, error) {
+	var nalus [][]byte
+	hasSPS := false
+	for pos := 0; pos < len(sample); {
+		if pos+4 > len(sample) {
+			return nil, fmt.Errorf("truncated nalu length")
+		}
+		size := int(binary.BigEndian.Uint32(sample[pos:]))
+		pos += 4
+		if size > len(sample)-pos {
+			return nil, fmt.Errorf("nalu length %d exceeds sample", size)
+		}
+		nalu := sample[pos : pos+size]
+		pos += size
+		if size == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case 9:
+			continue
+		case 7:
+			hasSPS = true
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	out := make([]byte, 0, len(sample)+64)
+	out = append(out, startCode...)
+	out = append(out, 0x09, 0xF0)
+	if isKey && !hasSPS {
+		for _, ps := range sps {
+			out = append(out, startCode...)
+			out = append(out, ps...)
+		}
+		for _, ps := range pps {
+			out = append(out, startCode...)
+			out = append(out, ps...)
+		}
+	}
+	for _, nalu := range nalus {
+		out = append(out, startCode...)
+		out = append(out, nalu...)
+	}
+	return out, nil
+}
+
+// ADTS prefixes a raw AAC frame with an ADTS header. HE-AAC is signalled as
+// AAC-LC at the core sample rate, leaving SBR to implicit detection.
+func ADTS(frame []byte, objectType byte, sampleRate, channels int) ([]byte, error) {
+	if objectType == aac.HEAACv1 || objectType == aac.HEAACv2 {
+		objectType = aac.AAClc
+	}
+	if len(frame)+7 > 0x1FFF {
+		return nil, fmt.Errorf("aac frame too large for adts: %d", len(frame))
+	}
+	header, err := aac.NewADTSHeader(sampleRate, byte(channels), objectType, uint16(len(frame)))
+	if err != nil {
+		return nil, err
+	}
+	return append(header.Encode(), frame...), nil
+}
@@ -0,0 +1,91 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/aac"
+)
+
+// lengthPrefixed joins NAL units as a 4-byte length-prefixed sample.
+func lengthPrefixed(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		n := len(nalu)
+		out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// annexB joins NAL units with start codes.
+func annexB(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = append(append(out, startCode...), nalu...)
+	}
+	return out
+}
+
+func TestAnnexB(t *testing.T) {
+	aud := []byte{0x09, 0xF0}
+	sps := []byte{0x67, 0x64, 0x00, 0x1E}
+	pps := []byte{0x68, 0xEB, 0xEC}
+	idr := []byte{0x65, 0x88, 0x84}
+	slice := []byte{0x41, 0x9A, 0x02}
+	for _, tc := range []struct {
+		name   string
+		sample []byte
+		isKey  bool
+		want   []byte
+	}{
+		{name: "idr gets parameter sets", sample: lengthPrefixed(idr), isKey: true, want: annexB(aud, sps, pps, idr)},
+		{name: "in-band parameter sets kept", sample: lengthPrefixed(sps, pps, idr), isKey: true, want: annexB(aud, sps, pps, idr)},
+		{name: "non-idr", sample: lengthPrefixed(slice), want: annexB(aud, slice)},
+		{name: "aud replaced", sample: lengthPrefixed(aud, []byte{}, slice), want: annexB(aud, slice)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AnnexB(tc.sample, [][]byte{sps}, [][]byte{pps}, tc.isKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("AnnexB = %x, want %x", got, tc.want)
+			}
+		})
+	}
+	for _, sample := range [][]byte{{0x00, 0x00, 0x01}, {0x00, 0x00, 0x00, 0x05, 0x65}} {
+		if _, err := AnnexB(sample, nil, nil, true); err == nil {
+			t.Errorf("AnnexB(%x) accepted a truncated sample", sample)
+		}
+	}
+}
+
+func TestADTS(t *testing.T) {
+	frame := bytes.Repeat([]byte{0x21}, 100)
+	for _, tc := range []struct {
+		name       string
+		objectType byte
+		sampleRate int
+		channels   int
+		header     []byte
+	}{
+		// profile 1 (LC), 44.1 kHz, stereo, 107-byte frame.
+		{name: "aac-lc", objectType: aac.AAClc, sampleRate: 44100, channels: 2, header: []byte{0xFF, 0xF1, 0x50, 0x80, 0x0D, 0x7F, 0xFC}},
+		// HE-AAC is signalled as LC at the core rate.
+		{name: "he-aac", objectType: aac.HEAACv1, sampleRate: 24000, channels: 2, header: []byte{0xFF, 0xF1, 0x58, 0x80, 0x0D, 0x7F, 0xFC}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ADTS(frame, tc.objectType, tc.sampleRate, tc.channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[:7], tc.header) || !bytes.Equal(got[7:], frame) {
+				t.Fatalf("ADTS = %x..., want header %x", got[:7], tc.header)
+			}
+		})
+	}
+	if _, err := ADTS(make([]byte, 0x1FFF), aac.AAClc, 44100, 2); err == nil {
+		t.Error("ADTS accepted a frame longer than the header can describe")
+	}
+}
@@ -0,0 +1,233 @@
+package mpegts
+
+import (
+	"bytes"
+)
+
+const (
+	PacketSize = 188
+
+	patPID   = 0x0000
+	pmtPID   = 0x1000
+	VideoPID = 0x0100
+	AudioPID = 0x0101
+
+	StreamTypeH264 = 0x1B
+	StreamTypeAAC  = 0x0F
+	StreamTypeMP3  = 0x03
+	StreamTypeMP2  = 0x04
+
+	// TimestampOffset keeps PES timestamps ahead of the PCR, which is taken
+	// straight from the video DTS.
+	TimestampOffset = 126000
+	timestampMask   = 1<<33 - 1
+)
+
+// Muxer writes MPEG-TS packets for one program with up to one video and one
+// audio elementary stream. Continuity counters carry across calls, so the
+// output of consecutive calls can be concatenated.
+type Muxer struct {
+	videoType  byte
+	audioType  byte
+	continuity map[uint16]byte
+}
+
+// NewMuxer creates a muxer; a zero stream type leaves that stream out of the
+// PMT.
+func NewMuxer(videoType, audioType byte) *Muxer {
+	return &Muxer{
+		videoType:  videoType,
+		audioType:  audioType,
+		continuity: make(map[uint16]byte),
+	}
+}
+
+// WriteTables writes a PAT and a PMT.
+func (m *Muxer) WriteTables(w *bytes.Buffer) {
+	pat := []byte{
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current_next
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xE0 | byte(pmtPID>>8), byte(pmtPID & 0xFF),
+	}
+	m.writeSection(w, patPID, 0x00, pat)
+
+	pcrPID := uint16(VideoPID)
+	if m.videoType == 0 {
+		pcrPID = AudioPID
+	}
+	pmt := []byte{
+		0x00, 0x01, // program_number
+		0xC1,
+		0x00, 0x00,
+		0xE0 | byte(pcrPID>>8), byte(pcrPID & 0xFF),
+		0xF0, 0x00, // program_info_length
+	}
+	if m.videoType != 0 {
+		pmt = append(pmt, m.videoType, 0xE0|byte(VideoPID>>8), byte(VideoPID&0xFF), 0xF0, 0x00)
+	}
+	if m.audioType != 0 {
+		pmt = append(pmt, m.audioType, 0xE0|byte(AudioPID>>8), byte(AudioPID&0xFF), 0xF0, 0x00)
+	}
+	m.writeSection(w, pmtPID, 0x02, pmt)
+}
+
+// WriteVideo writes one access unit in Annex-B form. Timestamps are 90 kHz.
+func (m *Muxer) WriteVideo(w *bytes.Buffer, pts, dts uint64, data []byte, randomAccess bool) {
+	pes := pesHeader(0xE0, pts, dts, 0)
+	m.writePES(w, VideoPID, append(pes, data...), randomAccess, dts, m.videoType != 0)
+}
+
+// WriteAudio writes one or more complete audio frames. Timestamps are 90 kHz.
+func (m *Muxer) WriteAudio(w *bytes.Buffer, pts uint64, data []byte) {
+	pes := pesHeader(0xC0, pts, pts, len(data))
+	m.writePES(w, AudioPID, append(pes, data...), true, pts, m.videoType == 0)
+}
+
+func (m *Muxer) writeSection(w *bytes.Buffer, pid uint16, tableID byte, body []byte) {
+	sectionLen := len(body) + 4
+	section := make([]byte, 0, 3+sectionLen)
+	section = append(section, tableID, 0xB0|byte(sectionLen>>8), byte(sectionLen))
+	section = append(section, body...)
+	crc := CRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	var pkt [PacketSize]byte
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8)&0x1F
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.nextContinuity(pid)
+	pkt[4] = 0x00 // pointer_field
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < PacketSize; i++ {
+		pkt[i] = 0xFF
+	}
+	w.Write(pkt[:])
+}
+
+func (m *Muxer) writePES(w *bytes.Buffer, pid uint16, payload []byte, randomAccess bool, pcr uint64, withPCR bool) {
+	first := true
+	for len(payload) > 0 {
+		var pkt [PacketSize]byte
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1F
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+
+		hasAF := false
+		var af []byte
+		if first && (randomAccess || withPCR) {
+			hasAF = true
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			af = append(af, flags)
+			if withPCR {
+				af[0] |= 0x10
+				base := pcr & timestampMask
+				af = append(af, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base&1)<<7|0x7E, 0x00)
+			}
+		}
+		afLen := 0
+		if hasAF {
+			afLen = 1 + len(af)
+		}
+		if space := PacketSize - 4 - afLen; len(payload) < space {
+			stuffing := space - len(payload)
+			if !hasAF {
+				hasAF = true
+				stuffing--
+				if stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				af = append(af, 0xFF)
+			}
+		}
+
+		offset := 4
+		pkt[3] = 0x10 | m.nextContinuity(pid)
+		if hasAF {
+			pkt[3] |= 0x20
+			pkt[4] = byte(len(af))
+			copy(pkt[5:], af)
+			offset = 5 + len(af)
+		}
+		n := copy(pkt[offset:], payload)
+		payload = payload[n:]
+		w.Write(pkt[:])
+		first = false
+	}
+}
+
+func (m *Muxer) nextContinuity(pid uint16) byte {
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0F
+	return cc
+}
+
+func pesHeader(streamID byte, pts, dts uint64, dataLen int) []byte {
+	pts = (pts + TimestampOffset) & timestampMask
+	dts = (dts + TimestampOffset) & timestampMask
+	headerLen := 5
+	flags := byte(0x80)
+	if pts != dts {
+		headerLen = 10
+		flags = 0xC0
+	}
+	// Video PES packets may exceed the 16-bit length, which 0 leaves
+	// unbounded.
+	packetLen := 0
+	if dataLen > 0 && 3+headerLen+dataLen <= 0xFFFF {
+		packetLen = 3 + headerLen + dataLen
+	}
+	header := []byte{0x00, 0x00, 0x01, streamID, byte(packetLen >> 8), byte(packetLen), 0x80, flags, byte(headerLen)}
+	if pts != dts {
+		header = appendTimestamp(header, 0x3, pts)
+		header = appendTimestamp(header, 0x1, dts)
+	} else {
+		header = appendTimestamp(header, 0x2, pts)
+	}
+	return header
+}
+
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0E|0x01,
+		byte(ts>>22),
+		byte(ts>>14)&0xFE|0x01,
+		byte(ts>>7),
+		byte(ts<<1)&0xFE|0x01,
+	)
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC32 is the CRC of MPEG-2 PSI sections, also used by SCTE-35.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,289 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tsPacket is a parsed transport packet.
+type tsPacket struct {
+	pid          uint16
+	start        bool
+	continuity   byte
+	randomAccess bool
+	pcr          int64 // -1 without a PCR
+	payload      []byte
+}
+
+// pesPacket is a reassembled PES packet.
+type pesPacket struct {
+	pid          uint16
+	streamID     byte
+	pts, dts     uint64
+	data         []byte
+	randomAccess bool
+	pcr          int64
+}
+
+// demux checks the packet layer of a transport stream and returns its
+// packets. Continuity counters must advance by one per PID, across calls
+// if cc is reused.
+func demux(t *testing.T, data []byte, cc map[uint16]byte) []tsPacket {
+	t.Helper()
+	if len(data)%PacketSize != 0 {
+		t.Fatalf("stream is %d bytes, not a multiple of %d", len(data), PacketSize)
+	}
+	var packets []tsPacket
+	for off := 0; off < len(data); off += PacketSize {
+		b := data[off : off+PacketSize]
+		if b[0] != 0x47 {
+			t.Fatalf("packet at %d: sync byte %#x", off, b[0])
+		}
+		pkt := tsPacket{
+			pid:        binary.BigEndian.Uint16(b[1:3]) & 0x1FFF,
+			start:      b[1]&0x40 != 0,
+			continuity: b[3] & 0x0F,
+			pcr:        -1,
+		}
+		if b[3]&0x10 == 0 {
+			t.Fatalf("packet at %d has no payload", off)
+		}
+		if want, ok := cc[pkt.pid]; ok && pkt.continuity != want {
+			t.Fatalf("pid %#x: continuity %d, want %d", pkt.pid, pkt.continuity, want)
+		}
+		cc[pkt.pid] = (pkt.continuity + 1) & 0x0F
+		body := b[4:]
+		if b[3]&0x20 != 0 {
+			afLen := int(body[0])
+			if afLen > len(body)-2 {
+				t.Fatalf("packet at %d: adaptation field of %d bytes leaves no payload", off, afLen)
+			}
+			af := body[1 : 1+afLen]
+			if afLen > 0 {
+				pkt.randomAccess = af[0]&0x40 != 0
+				rest := af[1:]
+				if af[0]&0x10 != 0 {
+					base := uint64(rest[0])<<25 | uint64(rest[1])<<17 | uint64(rest[2])<<9 | uint64(rest[3])<<1 | uint64(rest[4])>>7
+					pkt.pcr = int64(base)
+					rest = rest[6:]
+				}
+				for _, s := range rest {
+					if s != 0xFF {
+						t.Fatalf("packet at %d: stuffing byte %#x", off, s)
+					}
+				}
+			}
+			body = body[1+afLen:]
+		}
+		pkt.payload = body
+		packets = append(packets, pkt)
+	}
+	return packets
+}
+
+// section returns the PSI section of a packet after checking its CRC.
+func section(t *testing.T, pkt tsPacket) []byte {
+	t.Helper()
+	if !pkt.start || pkt.payload[0] != 0 {
+		t.Fatalf("pid %#x: section does not start the packet", pkt.pid)
+	}
+	s := pkt.payload[1:]
+	length := int(binary.BigEndian.Uint16(s[1:3]) & 0x0FFF)
+	s = s[:3+length]
+	if crc := CRC32(s); crc != 0 {
+		t.Fatalf("pid %#x: section CRC residue %#x", pkt.pid, crc)
+	}
+	for _, b := range pkt.payload[1+len(s):] {
+		if b != 0xFF {
+			t.Fatalf("pid %#x: section padding %#x", pkt.pid, b)
+		}
+	}
+	return s
+}
+
+// readTimestamp decodes a PES timestamp, checking its prefix and marker bits.
+func readTimestamp(t *testing.T, b []byte, prefix byte) uint64 {
+	t.Helper()
+	if b[0]>>4 != prefix || b[0]&1 != 1 || b[2]&1 != 1 || b[4]&1 != 1 {
+		t.Fatalf("timestamp %x: bad prefix or marker bits", b[:5])
+	}
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// reassemble joins the packets of each PES and parses its header.
+func reassemble(t *testing.T, packets []tsPacket) []pesPacket {
+	t.Helper()
+	var out []pesPacket
+	open := make(map[uint16]int)
+	for _, pkt := range packets {
+		if pkt.pid == patPID || pkt.pid == pmtPID {
+			continue
+		}
+		if pkt.start {
+			open[pkt.pid] = len(out)
+			out = append(out, pesPacket{pid: pkt.pid, randomAccess: pkt.randomAccess, pcr: pkt.pcr})
+		} else if pkt.randomAccess || pkt.pcr >= 0 {
+			t.Fatalf("pid %#x: adaptation flags on a continuation packet", pkt.pid)
+		}
+		i, ok := open[pkt.pid]
+		if !ok {
+			t.Fatalf("pid %#x: payload before a PES start", pkt.pid)
+		}
+		out[i].data = append(out[i].data, pkt.payload...)
+	}
+	for i := range out {
+		pes := &out[i]
+		h := pes.data
+		if !bytes.HasPrefix(h, []byte{0x00, 0x00, 0x01}) {
+			t.Fatalf("pid %#x: PES start code %x", pes.pid, h[:3])
+		}
+		pes.streamID = h[3]
+		length := int(binary.BigEndian.Uint16(h[4:6]))
+		if length != 0 && length != len(h)-6 {
+			t.Fatalf("pid %#x: PES_packet_length %d, have %d bytes", pes.pid, length, len(h)-6)
+		}
+		switch h[7] & 0xC0 {
+		case 0x80:
+			pes.pts = readTimestamp(t, h[9:], 0x2)
+			pes.dts = pes.pts
+		case 0xC0:
+			pes.pts = readTimestamp(t, h[9:], 0x3)
+			pes.dts = readTimestamp(t, h[14:], 0x1)
+		default:
+			t.Fatalf("pid %#x: PES without PTS", pes.pid)
+		}
+		pes.data = h[9+int(h[8]):]
+	}
+	return out
+}
+
+func TestMuxerTables(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		video     byte
+		audio     byte
+		pcrPID    uint16
+		streamPID []uint16
+	}{
+		{name: "video and audio", video: StreamTypeH264, audio: StreamTypeAAC, pcrPID: VideoPID, streamPID: []uint16{VideoPID, AudioPID}},
+		{name: "audio only", audio: StreamTypeMP3, pcrPID: AudioPID, streamPID: []uint16{AudioPID}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			NewMuxer(tc.video, tc.audio).WriteTables(&buf)
+			packets := demux(t, buf.Bytes(), make(map[uint16]byte))
+			if len(packets) != 2 || packets[0].pid != patPID || packets[1].pid != pmtPID {
+				t.Fatalf("tables = %+v, want a PAT and a PMT", packets)
+			}
+			pat := section(t, packets[0])
+			if pat[0] != 0x00 || binary.BigEndian.Uint16(pat[10:12])&0x1FFF != pmtPID {
+				t.Fatalf("PAT %x does not point at the PMT", pat)
+			}
+			pmt := section(t, packets[1])
+			if pmt[0] != 0x02 {
+				t.Fatalf("PMT table_id %#x", pmt[0])
+			}
+			if pcr := binary.BigEndian.Uint16(pmt[8:10]) & 0x1FFF; pcr != tc.pcrPID {
+				t.Errorf("PCR PID %#x, want %#x", pcr, tc.pcrPID)
+			}
+			var pids []uint16
+			var types []byte
+			for es := pmt[12 : len(pmt)-4]; len(es) >= 5; es = es[5:] {
+				types = append(types, es[0])
+				pids = append(pids, binary.BigEndian.Uint16(es[1:3])&0x1FFF)
+			}
+			if len(pids) != len(tc.streamPID) {
+				t.Fatalf("PMT streams %v, want %v", pids, tc.streamPID)
+			}
+			for i := range pids {
+				if pids[i] != tc.streamPID[i] {
+					t.Errorf("stream %d PID %#x, want %#x", i, pids[i], tc.streamPID[i])
+				}
+			}
+			if types[len(types)-1] != tc.audio {
+				t.Errorf("audio stream type %#x, want %#x", types[len(types)-1], tc.audio)
+			}
+		})
+	}
+}
+
+func TestPESTimestamps(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pts, dts uint64
+		header   []byte
+	}{
+		{
+			// A PTS-only header, the offset cancelled out.
+			name:   "pts only",
+			pts:    timestampMask + 1 - TimestampOffset,
+			dts:    timestampMask + 1 - TimestampOffset,
+			header: []byte{0x00, 0x00, 0x01, 0xE0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01},
+		},
+		{name: "pts and dts", pts: 3003, dts: 0},
+		{name: "33-bit", pts: 1<<32 + 12345, dts: 1<<32 + 9000},
+		{name: "wraps", pts: timestampMask - 1000, dts: timestampMask - 4000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := NewMuxer(StreamTypeH264, 0)
+			m.WriteVideo(&buf, tc.pts, tc.dts, []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}, true)
+			pes := reassemble(t, demux(t, buf.Bytes(), make(map[uint16]byte)))
+			if len(pes) != 1 {
+				t.Fatalf("%d PES packets, want 1", len(pes))
+			}
+			if tc.header != nil {
+				start := bytes.Index(buf.Bytes(), tc.header[:4])
+				got := buf.Bytes()[start : start+len(tc.header)]
+				if !bytes.Equal(got, tc.header) {
+					t.Fatalf("PES header %x, want %x", got, tc.header)
+				}
+			}
+			wantPTS := (tc.pts + TimestampOffset) & timestampMask
+			wantDTS := (tc.dts + TimestampOffset) & timestampMask
+			if pes[0].pts != wantPTS || pes[0].dts != wantDTS {
+				t.Errorf("pts/dts = %d/%d, want %d/%d", pes[0].pts, pes[0].dts, wantPTS, wantDTS)
+			}
+			if pes[0].pcr != int64(tc.dts&timestampMask) {
+				t.Errorf("pcr = %d, want %d", pes[0].pcr, tc.dts&timestampMask)
+			}
+		})
+	}
+}
+
+func TestMuxerPayloadSizes(t *testing.T) {
+	// Sizes around the packet boundaries exercise every stuffing case,
+	// including a one-byte adaptation field with no flags.
+	var sizes []int
+	for n := 1; n <= 3*PacketSize; n++ {
+		sizes = append(sizes, n)
+	}
+	m := NewMuxer(StreamTypeH264, StreamTypeAAC)
+	cc := make(map[uint16]byte)
+	for _, size := range sizes {
+		var buf bytes.Buffer
+		video := bytes.Repeat([]byte{0xAB}, size)
+		audio := bytes.Repeat([]byte{0xCD}, size)
+		m.WriteTables(&buf)
+		m.WriteVideo(&buf, uint64(size)*3000, uint64(size)*3000, video, size%2 == 0)
+		m.WriteAudio(&buf, uint64(size)*3000, audio)
+		pes := reassemble(t, demux(t, buf.Bytes(), cc))
+		if len(pes) != 2 {
+			t.Fatalf("size %d: %d PES packets, want 2", size, len(pes))
+		}
+		if pes[0].pid != VideoPID || pes[0].streamID != 0xE0 || !bytes.Equal(pes[0].data, video) {
+			t.Fatalf("size %d: video PES %+v", size, pes[0])
+		}
+		if pes[0].randomAccess != (size%2 == 0) || pes[0].pcr < 0 {
+			t.Fatalf("size %d: video random access %v, pcr %d", size, pes[0].randomAccess, pes[0].pcr)
+		}
+		if pes[1].pid != AudioPID || pes[1].streamID != 0xC0 || !bytes.Equal(pes[1].data, audio) {
+			t.Fatalf("size %d: audio PES %+v", size, pes[1])
+		}
+		// With video present the PCR is on the video PID only.
+		if pes[1].pcr >= 0 {
+			t.Fatalf("size %d: audio carries a PCR", size)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package packager
+
+import (
+	"path"
+
+	"tokuly-live-rtmp-server/pkg/hls"
+)
+
+// initAudio creates the packager of the demuxed audio rendition. It lives
+// in a subdirectory of the stream, like a transcoded rendition, and the two
+// playlists report on each other.
+func (p *Packager) initAudio() {
+	audioCfg := p.cfg
+	audioCfg.DemuxAudio = false
+	audioCfg.AudioOnly = true
+	audioCfg.Log = p.log.WithField("rendition", p.cfg.AudioRenditionName)
+	// Discontinuities are reported once, by the video packager.
+	audioCfg.OnDiscontinuity = nil
+	p.audio = New(audioCfg, p.storage, path.Join(p.streamID, p.cfg.AudioRenditionName))
+	p.audio.SetRenditions([]hls.Rendition{{URI: "../" + p.cfg.PlaylistName, Playlist: p.playlist}})
+	p.SetRenditions(nil)
+}
+
+// AudioRendition returns the demuxed audio playlist relative to the live
+// playlist, or "" when audio is muxed with video.
+func (p *Packager) AudioRendition() string {
+	if p.audio == nil {
+		return ""
+	}
+	return p.cfg.AudioRenditionName + "/" + p.cfg.PlaylistName
+}
@@ -0,0 +1,99 @@
+package packager
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+
+	"tokuly-live-rtmp-server/pkg/captions"
+	"tokuly-live-rtmp-server/pkg/hls"
+	"tokuly-live-rtmp-server/pkg/metrics"
+	"tokuly-live-rtmp-server/pkg/mpegts"
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// initCaptions sets up the WebVTT subtitle playlists. Caption segments
+// share sequence numbers and boundaries with the media segments, and are
+// named after them with a .vtt extension.
+func (p *Packager) initCaptions(liveCfg hls.Config) {
+	p.captions = captions.NewDecoder()
+	captionsCfg := liveCfg
+	captionsCfg.EnablePartial = false
+	captionsCfg.InitFilename = ""
+	captionsCfg.PlaylistName = p.cfg.CaptionsPlaylistName
+	p.captionsPlaylist = hls.New(captionsCfg, p.storage, p.streamID)
+	if p.rewind != nil {
+		captionsCfg.PlaylistWindow = p.cfg.RewindPlaylistWindow
+		captionsCfg.KeepSegments = int(p.cfg.RewindPlaylistWindow / p.cfg.SegmentDuration)
+		p.rewindCaptions = hls.New(captionsCfg, p.storage, p.streamID)
+	}
+}
+
+func (p *Packager) resumeCaptions() {
+	if p.captionsPlaylist != nil {
+		livePath := filepath.Join(p.storage.StreamDir(p.streamID), p.cfg.CaptionsPlaylistName)
+		if _, _, err := p.captionsPlaylist.LoadFromFile(livePath, true); err != nil {
+			p.log.WithError(err).Warn("resume captions playlist error")
+		}
+	}
+	if p.rewindCaptions != nil {
+		rewindPath := filepath.Join(p.storage.RewindDir(p.streamID), p.cfg.CaptionsPlaylistName)
+		if _, _, err := p.rewindCaptions.LoadFromFile(rewindPath, true); err != nil {
+			p.log.WithError(err).Warn("resume rewind captions playlist error")
+		}
+	}
+}
+
+// addCaptions hands the CC1 pairs of a video sample to the decoder. It runs
+// before the sample is encrypted.
+func (p *Packager) addCaptions(sample mp4.FullSample, dtsMS int64) {
+	cc := captions.Extract(p.videoConfig.Codec, sample.Data)
+	ptsMS := dtsMS + int64(sample.CompositionTimeOffset)*1000/int64(p.videoTS)
+	p.captions.Add(dtsMS, ptsMS, cc.Field1)
+}
+
+// finalizeCaptions writes the WebVTT segment covering the current media
+// segment, empty if no caption was shown, and lists it.
+func (p *Packager) finalizeCaptions() {
+	seg := p.currentSegment
+	cues := p.captions.Cut(seg.startMS + seg.durationMS)
+	offset := uint64(0)
+	if p.tsMuxer != nil {
+		offset = mpegts.TimestampOffset
+	}
+	data := captions.WebVTT(cues, offset)
+	name := withExtension(fmt.Sprintf(p.cfg.SegmentFilenameTmpl, seg.seq), ".vtt")
+	duration := time.Duration(seg.durationMS) * time.Millisecond
+	livePath := filepath.Join(p.storage.StreamDir(p.streamID), name)
+	if err := storage.WriteFileAtomic(livePath, data); err != nil {
+		metrics.StorageError(p.cfg.Metrics, metrics.WriteSegment)
+		p.log.WithError(err).Error("captions segment write error")
+		return
+	}
+	if !seg.wallClock.IsZero() {
+		p.captionsPlaylist.SetProgramDateTime(seg.seq, seg.wallClock)
+	}
+	p.captionsPlaylist.FinalizeSegment(seg.seq, name, duration)
+	_ = p.captionsPlaylist.RemoveFiles(p.captionsPlaylist.Prune())
+	if err := p.captionsPlaylist.Write(); err != nil {
+		metrics.StorageError(p.cfg.Metrics, metrics.WritePlaylist)
+		p.log.WithError(err).Error("captions playlist write error")
+	}
+	if p.rewindCaptions == nil {
+		return
+	}
+	rewindDir := p.storage.RewindDir(p.streamID)
+	_ = storage.CopyOrLink(livePath, filepath.Join(rewindDir, name))
+	if !seg.wallClock.IsZero() {
+		p.rewindCaptions.SetProgramDateTime(seg.seq, seg.wallClock)
+	}
+	p.rewindCaptions.FinalizeSegment(seg.seq, name, duration)
+	for _, removed := range p.rewindCaptions.Prune() {
+		if removed.URI != "" {
+			_ = storage.RemoveFile(filepath.Join(rewindDir, removed.URI))
+		}
+	}
+	_ = p.rewindCaptions.WriteTo(rewindDir)
+}
@@ -0,0 +1,182 @@
+package packager
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/drm"
+	"tokuly-live-rtmp-server/pkg/hls"
+)
+
+// keyPeriodFor maps a segment to its key period; segments are numbered from 1.
+func (p *Packager) keyPeriodFor(seq uint64) uint64 {
+	if p.cfg.KeyRotateSegments <= 0 || seq == 0 {
+		return 0
+	}
+	return (seq - 1) / uint64(p.cfg.KeyRotateSegments)
+}
+
+// keyPrefetch is a key fetched in the background ahead of its period.
+// key and err are set before done is closed.
+type keyPrefetch struct {
+	period uint64
+	done   chan struct{}
+	key    drm.Key
+	err    error
+}
+
+// fetchKey loads the key of period and starts using it. It blocks, so it is
+// only used for the first key, when there is nothing to encrypt with yet.
+func (p *Packager) fetchKey(period uint64) error {
+	if p.hasKey && p.keyPeriod == period {
+		return nil
+	}
+	key, err := p.loadKey(period)
+	if err != nil {
+		return fmt.Errorf("key period %d: %w", period, err)
+	}
+	p.useKey(key, period)
+	return nil
+}
+
+func (p *Packager) loadKey(period uint64) (drm.Key, error) {
+	ctx := context.Background()
+	if p.cfg.KeyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.KeyTimeout)
+		defer cancel()
+	}
+	return p.cfg.KeyProvider.Key(ctx, p.streamID, period)
+}
+
+func (p *Packager) useKey(key drm.Key, period uint64) {
+	p.key = key
+	p.keyPeriod = period
+	p.hasKey = true
+	p.log.WithFields(logrus.Fields{"period": period, "kid": key.KeyID()}).Info("encryption key")
+	if p.cfg.OnKey != nil {
+		p.cfg.OnKey(key)
+	}
+}
+
+// prefetchKey starts fetching the key of period unless it is already being
+// fetched or was fetched.
+func (p *Packager) prefetchKey(period uint64) {
+	if p.prefetch != nil && p.prefetch.period == period {
+		return
+	}
+	prefetch := &keyPrefetch{period: period, done: make(chan struct{})}
+	p.prefetch = prefetch
+	go func() {
+		defer close(prefetch.done)
+		prefetch.key, prefetch.err = p.loadKey(period)
+	}()
+}
+
+// rotatedKey returns the prefetched key for period and the period it
+// belongs to, once it is ready. A key that arrived late for an earlier
+// period is still newer than the current one and is used. A failed fetch is
+// started again for the next segment.
+func (p *Packager) rotatedKey(period uint64) (drm.Key, uint64, bool) {
+	prefetch := p.prefetch
+	if prefetch == nil || prefetch.period > period || prefetch.period <= p.keyPeriod {
+		p.prefetchKey(period)
+		return drm.Key{}, 0, false
+	}
+	select {
+	case <-prefetch.done:
+	default:
+		p.log.WithField("period", prefetch.period).Warn("encryption key not ready, keeping current key")
+		return drm.Key{}, 0, false
+	}
+	if prefetch.err != nil {
+		p.log.WithError(prefetch.err).WithField("period", prefetch.period).Warn("encryption key fetch failed, keeping current key")
+		p.prefetch = nil
+		p.prefetchKey(period)
+		return drm.Key{}, 0, false
+	}
+	return prefetch.key, prefetch.period, true
+}
+
+// applyKey rotates the key when seq opens a new key period and tags the
+// segment with its key and, for rotated fMP4 keys, its init segment. The
+// next period's key is fetched in the background, so rotation never waits
+// on the key provider; until it arrives the current key stays in use.
+func (p *Packager) applyKey(seq uint64) error {
+	if p.cfg.KeyProvider == nil {
+		return nil
+	}
+	period := p.keyPeriodFor(seq)
+	rotate := false
+	if !p.hasKey {
+		if err := p.fetchKey(period); err != nil {
+			return err
+		}
+		rotate = true
+	} else if period != p.keyPeriod {
+		if key, keyPeriod, ok := p.rotatedKey(period); ok {
+			p.useKey(key, keyPeriod)
+			rotate = true
+		}
+	}
+	if rotate && p.cfg.SegmentFormat != FormatTS {
+		if err := p.writeInit(); err != nil {
+			return err
+		}
+	}
+	if p.cfg.KeyRotateSegments > 0 && p.keyPeriod == period {
+		p.prefetchKey(period + 1)
+	}
+	key := p.hlsKey()
+	p.playlist.SetKey(seq, key)
+	if p.rewind != nil {
+		p.rewind.SetKey(seq, key)
+	}
+	if p.initName != "" && p.initName != p.cfg.InitFilename {
+		p.playlist.SetMap(seq, p.initName)
+		if p.rewind != nil {
+			p.rewind.SetMap(seq, p.initName)
+		}
+	}
+	return nil
+}
+
+// hlsKey describes the current key for EXT-X-KEY. AES-128 leaves the IV to
+// the media sequence number, which is what encryptTS uses.
+func (p *Packager) hlsKey() hls.Key {
+	if p.cfg.SegmentFormat == FormatTS {
+		return hls.Key{Method: "AES-128", URI: p.key.URI}
+	}
+	return hls.Key{
+		Method:    "SAMPLE-AES",
+		URI:       p.key.URI,
+		IV:        "0x" + hex.EncodeToString(p.key.IV),
+		KeyFormat: p.cfg.KeyFormat,
+	}
+}
+
+// encryptSamples encrypts the samples of a part in place and returns their
+// subsample layout per track.
+func (p *Packager) encryptSamples(samples []trackSample) (map[uint32][][]mp4.SubSamplePattern, error) {
+	subsamples := make(map[uint32][][]mp4.SubSamplePattern)
+	for _, s := range samples {
+		layout, err := p.protector.EncryptSample(s.trackID, s.sample.Data)
+		if err != nil {
+			return nil, err
+		}
+		subsamples[s.trackID] = append(subsamples[s.trackID], layout)
+	}
+	return subsamples, nil
+}
+
+// encryptTS encrypts a TS segment as a whole.
+func (p *Packager) encryptTS(data []byte, seq uint64) ([]byte, error) {
+	if !p.hasKey || p.cfg.SegmentFormat != FormatTS {
+		return data, nil
+	}
+	return drm.EncryptAES128(data, p.key, drm.SequenceIV(seq))
+}
@@ -0,0 +1,130 @@
+package packager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/drm"
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// testKeyProvider returns a key per period whose ID is the period. Fetches
+// of a period in block wait until it is closed; fail holds the number of
+// fetches of a period that fail before one succeeds.
+type testKeyProvider struct {
+	mu    sync.Mutex
+	block map[uint64]chan struct{}
+	fail  map[uint64]int
+}
+
+func (kp *testKeyProvider) Key(ctx context.Context, streamID string, period uint64) (drm.Key, error) {
+	kp.mu.Lock()
+	gate := kp.block[period]
+	failing := kp.fail[period] > 0
+	if failing {
+		kp.fail[period]--
+	}
+	kp.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return drm.Key{}, ctx.Err()
+		}
+	}
+	if failing {
+		return drm.Key{}, errors.New("key server unavailable")
+	}
+	return drm.Key{ID: []byte{byte(period)}, Value: make([]byte, 16), URI: fmt.Sprintf("https://keys.example/%d", period)}, nil
+}
+
+func newKeyTestPackager(t *testing.T, kp drm.KeyProvider) *Packager {
+	t.Helper()
+	root := t.TempDir()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(Config{
+		SegmentDuration:   2 * time.Second,
+		PlaylistName:      "index.m3u8",
+		SegmentFormat:     FormatTS,
+		KeyProvider:       kp,
+		KeyRotateSegments: 2,
+		Log:               logrus.NewEntry(logger),
+	}, storage.New(filepath.Join(root, "live"), filepath.Join(root, "rewind"), false), "studio")
+}
+
+// waitPrefetch waits for the background key fetch in flight.
+func waitPrefetch(t *testing.T, p *Packager) {
+	t.Helper()
+	if p.prefetch == nil {
+		t.Fatal("no key prefetch in flight")
+	}
+	select {
+	case <-p.prefetch.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("key prefetch did not finish")
+	}
+}
+
+// keyStep applies the key for segment seq, after waiting for the key
+// prefetch if wait is set, and expects the key of period.
+type keyStep struct {
+	seq    uint64
+	wait   bool
+	period uint64
+}
+
+func TestApplyKeyRotation(t *testing.T) {
+	gate := make(chan struct{})
+	for _, tc := range []struct {
+		name  string
+		kp    *testKeyProvider
+		steps []keyStep
+		// release is closed before the first wait.
+		release chan struct{}
+	}{
+		{
+			name:  "rotates at the period boundary",
+			kp:    &testKeyProvider{},
+			steps: []keyStep{{1, false, 0}, {2, true, 0}, {3, true, 1}, {4, false, 1}, {5, true, 2}},
+		},
+		{
+			name:    "slow provider keeps the current key",
+			kp:      &testKeyProvider{block: map[uint64]chan struct{}{1: gate}},
+			steps:   []keyStep{{1, false, 0}, {2, false, 0}, {3, false, 0}, {4, true, 1}},
+			release: gate,
+		},
+		{
+			name:  "failing provider keeps the current key",
+			kp:    &testKeyProvider{fail: map[uint64]int{1: 1}},
+			steps: []keyStep{{1, false, 0}, {3, true, 0}, {4, true, 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newKeyTestPackager(t, tc.kp)
+			for _, step := range tc.steps {
+				if step.wait {
+					if tc.release != nil {
+						close(tc.release)
+						tc.release = nil
+					}
+					waitPrefetch(t, p)
+				}
+				if err := p.applyKey(step.seq); err != nil {
+					t.Fatalf("segment %d: %v", step.seq, err)
+				}
+				if p.keyPeriod != step.period || p.key.ID[0] != byte(step.period) {
+					t.Fatalf("segment %d uses key %d of period %d, want period %d", step.seq, p.key.ID[0], p.keyPeriod, step.period)
+				}
+			}
+		})
+	}
+}
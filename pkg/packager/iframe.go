@@ -0,0 +1,65 @@
+package packager
+
+import (
+	"crypto/aes"
+	"time"
+)
+
+type iframeEntry struct {
+	seq     uint64
+	offset  int64
+	length  int64
+	startMS int64
+}
+
+// firstKeyframe returns the index of the first video sync sample, or -1.
+func (p *Packager) firstKeyframe(samples []trackSample) int {
+	for i, s := range samples {
+		if s.trackID == p.videoID && s.sample.IsSync() {
+			return i
+		}
+	}
+	return -1
+}
+
+// fragmentKeyframeEnd returns the offset just past sample idx in an encoded
+// fragment of fragSize bytes. The mdat ends the fragment and holds the
+// samples in the order they were added.
+func fragmentKeyframeEnd(samples []trackSample, idx int, fragSize int) int {
+	mdatData, before := 0, 0
+	for i, s := range samples {
+		mdatData += len(s.sample.Data)
+		if i <= idx {
+			before += len(s.sample.Data)
+		}
+	}
+	return fragSize - mdatData + before
+}
+
+// setIFrame hands the keyframe range of the current segment to the rewind
+// playlist. Its duration runs to the end of the segment until the next
+// keyframe shows up, which then corrects it. An AES-128 segment only decrypts from its first byte, so the
+// range must start there; it is rounded up to whole blocks plus a spare one
+// so a player stripping PKCS#7 padding cannot cut into the keyframe.
+func (p *Packager) setIFrame(segSize int64) {
+	seg := p.currentSegment
+	if seg.iframeLength == 0 {
+		return
+	}
+	offset, length := seg.iframeOffset, seg.iframeLength
+	if p.hasKey && p.cfg.SegmentFormat == FormatTS {
+		if offset != 0 {
+			return
+		}
+		length = ((length+aes.BlockSize-1)/aes.BlockSize + 1) * aes.BlockSize
+	}
+	if rest := segSize - offset; length > rest {
+		length = rest
+	}
+	if prev := p.lastIFrame; prev.length > 0 {
+		p.rewind.SetIFrame(prev.seq, prev.offset, prev.length, time.Duration(seg.iframeStartMS-prev.startMS)*time.Millisecond)
+	}
+	duration := time.Duration(seg.startMS+seg.durationMS-seg.iframeStartMS) * time.Millisecond
+	p.rewind.SetIFrame(seg.seq, offset, length, duration)
+	p.lastIFrame = iframeEntry{seq: seg.seq, offset: offset, length: length, startMS: seg.iframeStartMS}
+}
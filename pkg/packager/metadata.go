@@ -0,0 +1,111 @@
+package packager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+
+	"tokuly-live-rtmp-server/pkg/hls"
+	"tokuly-live-rtmp-server/pkg/metadata"
+)
+
+const (
+	cuePointClass = "com.tokuly.cuepoint"
+	textDataClass = "com.tokuly.textdata"
+)
+
+// AddTimedMetadata carries an onCuePoint or onTextData event into the next
+// fMP4 fragment as an ID3 emsg and into the playlists as EXT-X-DATERANGE.
+// Ad-break cues become SCTE-35 CUE-OUT/CUE-IN date ranges.
+func (p *Packager) AddTimedMetadata(tsMS int64, ev metadata.Event) error {
+	if !p.initWritten {
+		return nil
+	}
+	if p.tsMuxer == nil {
+		tag, err := ev.ID3()
+		if err != nil {
+			return err
+		}
+		duration := uint32(0)
+		if ev.Cue == metadata.CueOut && ev.Duration > 0 {
+			duration = msToTimescale(ev.Duration.Milliseconds(), p.videoTS)
+		}
+		p.pendingEmsgs = append(p.pendingEmsgs, &mp4.EmsgBox{
+			Version:          1,
+			TimeScale:        p.videoTS,
+			PresentationTime: msToTimescale64(tsMS, p.videoTS),
+			EventDuration:    duration,
+			ID:               p.emsgID,
+			SchemeIDURI:      metadata.ID3SchemeIDURI,
+			MessageData:      tag,
+		})
+		p.emsgID++
+	}
+	d := p.dateRange(tsMS, ev)
+	if p.currentSegment == nil {
+		p.pendingDateRanges = append(p.pendingDateRanges, d)
+		return nil
+	}
+	p.addDateRange(d)
+	return nil
+}
+
+func (p *Packager) addDateRange(d hls.DateRange) {
+	p.currentSegment.dateRanges = append(p.currentSegment.dateRanges, d)
+	p.playlist.AddDateRange(p.currentSegment.seq, d)
+}
+
+func (p *Packager) dateRange(tsMS int64, ev metadata.Event) hls.DateRange {
+	start := p.wallClock(tsMS)
+	pts := msToTimescale64(tsMS, 90000)
+	switch ev.Cue {
+	case metadata.CueOut:
+		eventID := uint32(start.Unix())
+		d := hls.DateRange{
+			ID:              fmt.Sprintf("splice-%d", eventID),
+			StartMS:         start.UnixMilli(),
+			PlannedDuration: ev.Duration.Seconds(),
+			SCTE35Out:       ev.SCTE35,
+		}
+		if len(d.SCTE35Out) == 0 {
+			d.SCTE35Out = metadata.SpliceInsert(eventID, true, pts, ev.Duration)
+		}
+		p.openCue = &d
+		p.openCueEventID = eventID
+		return d
+	case metadata.CueIn:
+		eventID := uint32(start.Unix())
+		d := hls.DateRange{ID: fmt.Sprintf("splice-%d", eventID), StartMS: start.UnixMilli()}
+		if p.openCue != nil {
+			eventID = p.openCueEventID
+			d = hls.DateRange{ID: p.openCue.ID, StartMS: p.openCue.StartMS, EndMS: start.UnixMilli()}
+			p.openCue = nil
+		}
+		d.SCTE35In = ev.SCTE35
+		if len(d.SCTE35In) == 0 {
+			d.SCTE35In = metadata.SpliceInsert(eventID, false, pts, 0)
+		}
+		return d
+	}
+	d := hls.DateRange{StartMS: start.UnixMilli(), ClientAttrs: make(map[string]string)}
+	if ev.Type == metadata.TypeTextData {
+		d.ID = fmt.Sprintf("text-%d", start.UnixMilli())
+		d.Class = textDataClass
+		d.ClientAttrs["X-TEXT"] = ev.Text()
+	} else {
+		d.ID = fmt.Sprintf("cue-%d", start.UnixMilli())
+		d.Class = cuePointClass
+		d.ClientAttrs["X-NAME"] = ev.Name
+	}
+	return d
+}
+
+// wallClock maps an RTMP timestamp to the wall clock, or returns now before
+// the clock base is known.
+func (p *Packager) wallClock(tsMS int64) time.Time {
+	if p.clockBaseWall.IsZero() {
+		return time.Now()
+	}
+	return p.clockBaseWall.Add(time.Duration(tsMS-p.clockBaseTSMS) * time.Millisecond)
+}
@@ -3,20 +3,34 @@ package packager
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"math"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/sirupsen/logrus"
 
+	"tokuly-live-rtmp-server/pkg/captions"
+	"tokuly-live-rtmp-server/pkg/dash"
+	"tokuly-live-rtmp-server/pkg/drm"
 	"tokuly-live-rtmp-server/pkg/hls"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metrics"
+	"tokuly-live-rtmp-server/pkg/mpegts"
 	"tokuly-live-rtmp-server/pkg/storage"
 	"tokuly-live-rtmp-server/pkg/util"
 )
 
+const (
+	FormatFMP4 = "fmp4"
+	FormatTS   = "ts"
+)
+
 type Config struct {
 	SegmentDuration     time.Duration
+	MaxSegmentOverrun   time.Duration
 	PartDuration        time.Duration
 	PlaylistWindow      time.Duration
 	TargetDuration      time.Duration
@@ -27,34 +41,85 @@ type Config struct {
 	InitFilename        string
 	SegmentFilenameTmpl string
 	PartFilenameTmpl    string
+	// ByteRangeParts appends parts to the growing segment file and lists
+	// them with BYTERANGE instead of writing a file per part.
+	ByteRangeParts      bool
 	PlaylistName        string
 	RewindPlaylistName  string
+	IFramePlaylistName  string
+	// CaptionsPlaylistName, when set, lists WebVTT segments holding the
+	// CEA-608 CC1 captions found in video SEI.
+	CaptionsPlaylistName string
+	// DemuxAudio moves audio out of the media segments into an audio-only
+	// rendition in the AudioRenditionName subdirectory, with its own init
+	// segment and playlist.
+	DemuxAudio          bool
+	AudioRenditionName  string
+	// AudioOnly ignores video; segments are cut on duration alone.
+	AudioOnly           bool
 	EnablePartial       bool
+	PDTEverySegment     bool
+	EnableDASH          bool
+	DASHManifestName    string
+	SegmentFormat       string
+	// KeyProvider enables encryption: cbcs SAMPLE-AES for fMP4, AES-128
+	// for TS. A new key is used every KeyRotateSegments segments.
+	KeyProvider       drm.KeyProvider
+	KeyRotateSegments int
+	KeyFormat         string
+	KeyTimeout        time.Duration
+	// OnKey is called with each key the packager starts using.
+	OnKey func(drm.Key)
+	// Metrics labels the packager's metrics.
+	Metrics metrics.Stream
+	// Log is the session's logger; nil logs without session fields.
+	Log *logrus.Entry
+	// OnDiscontinuity is called with the reason each time the output is
+	// restarted with a discontinuity.
+	OnDiscontinuity func(reason string)
 }
 
+// Reasons passed to Config.OnDiscontinuity.
+const (
+	DiscontinuityTimestampJump = "timestamp_jump"
+	DiscontinuityVideoConfig   = "video_config"
+	DiscontinuityAudioConfig   = "audio_config"
+)
+
 type Packager struct {
 	cfg       Config
+	log       *logrus.Entry
 	storage   *storage.Storage
 	streamID  string
 	playlist  *hls.PlaylistManager
 	rewind    *hls.PlaylistManager
+	dash       *dash.ManifestWriter
+	rewindDash *dash.ManifestWriter
 	videoID   uint32
 	audioID   uint32
 	videoTS   uint32
 	audioTS   uint32
-	avcConfig util.AVCConfig
-	aacConfig util.AACConfig
+	videoConfig util.VideoConfig
+	audioConfig util.AudioConfig
+	tsMuxer     *mpegts.Muxer
+
+	key         drm.Key
+	keyPeriod   uint64
+	hasKey      bool
+	prefetch    *keyPrefetch
+	protector   *drm.Protector
+	initName    string
 
 	initWritten bool
 
 	started        bool
 	startTSMS      int64
-	segmentOffset  uint64
 	lastSegmentSeq uint64
 	fragmentSeq    uint32
 
 	partDurationMS    int64
 	segmentDurationMS int64
+	maxOverrunMS      int64
 
 	currentPart    *partBuilder
 	currentSegment *segmentBuilder
@@ -63,6 +128,24 @@ type Packager struct {
 	audioState trackState
 
 	pendingDiscontinuity bool
+	lastIFrame           iframeEntry
+
+	// Timed metadata waiting for the next fragment or segment.
+	pendingEmsgs      []*mp4.EmsgBox
+	pendingDateRanges []hls.DateRange
+	emsgID            uint32
+	openCue           *hls.DateRange
+	openCueEventID    uint32
+
+	captions         *captions.Decoder
+	captionsPlaylist *hls.PlaylistManager
+	rewindCaptions   *hls.PlaylistManager
+
+	// audio packages the demuxed audio rendition.
+	audio *Packager
+
+	clockBaseTSMS int64
+	clockBaseWall time.Time
 }
 
 type pendingSample struct {
@@ -89,60 +172,131 @@ type trackSample struct {
 }
 
 type partBuilder struct {
-	segSeq   uint64
-	partIdx  int
-	startMS  int64
-	endMS    int64
-	samples  []trackSample
-	duration time.Duration
+	segSeq      uint64
+	partIdx     int
+	startMS     int64
+	endMS       int64
+	samples     []trackSample
+	hasVideo    bool
+	independent bool
 }
 
 type segmentBuilder struct {
 	seq        uint64
 	startMS    int64
+	wallClock  time.Time
 	buffer     bytes.Buffer
 	parts      []string
 	durationMS int64
+	// size counts the bytes of the segment so far; with byte-range parts
+	// they go straight to file instead of buffer.
+	size int64
+	file *os.File
+
+	dateRanges []hls.DateRange
+
+	// The byte range from the start of the part holding the first keyframe
+	// to the end of that keyframe, for the rewind I-frame playlist.
+	iframeOffset  int64
+	iframeLength  int64
+	iframeStartMS int64
 }
 
 func New(cfg Config, storage *storage.Storage, streamID string) *Packager {
+	if cfg.SegmentFormat == FormatTS {
+		// TS segments are self-initializing and have no DASH equivalent.
+		// They are for players without LL-HLS, so the playlist is a plain
+		// one of whole segments and parts are never written on their own.
+		cfg.InitFilename = ""
+		cfg.EnableDASH = false
+		cfg.EnablePartial = false
+		cfg.ByteRangeParts = false
+		cfg.SegmentFilenameTmpl = withExtension(cfg.SegmentFilenameTmpl, ".ts")
+		cfg.PartFilenameTmpl = withExtension(cfg.PartFilenameTmpl, ".ts")
+		cfg.DemuxAudio = false
+	}
+	if cfg.DemuxAudio || cfg.AudioOnly {
+		// DASH would need an adaptation set per track.
+		cfg.EnableDASH = false
+	}
+	if cfg.AudioOnly {
+		cfg.IFramePlaylistName = ""
+		cfg.CaptionsPlaylistName = ""
+	}
+	if cfg.KeyProvider != nil {
+		// DASH would need ContentProtection and a Period per key.
+		cfg.EnableDASH = false
+	}
+	// Segments run up to MaxSegmentOverrun past SegmentDuration waiting for
+	// a keyframe. Declaring that from the start keeps EXT-X-TARGETDURATION
+	// from changing when a long segment arrives.
+	targetDuration := max(cfg.TargetDuration, cfg.SegmentDuration+cfg.MaxSegmentOverrun)
 	liveCfg := hls.Config{
 		SegmentDuration: cfg.SegmentDuration,
 		PartDuration:    cfg.PartDuration,
 		PlaylistWindow:  cfg.PlaylistWindow,
-		TargetDuration:  cfg.TargetDuration,
+		TargetDuration:  targetDuration,
 		HoldBack:        cfg.HoldBack,
 		PartHoldBack:    cfg.PartHoldBack,
 		KeepSegments:    cfg.KeepSegments,
 		EnablePartial:   cfg.EnablePartial,
 		InitFilename:    cfg.InitFilename,
 		PlaylistName:    cfg.PlaylistName,
+		PDTEverySegment: cfg.PDTEverySegment,
 	}
 	p := &Packager{
 		cfg:              cfg,
+		log:              cfg.Log,
 		storage:          storage,
 		streamID:         streamID,
 		playlist:         hls.New(liveCfg, storage, streamID),
 		partDurationMS:   int64(cfg.PartDuration / time.Millisecond),
 		segmentDurationMS: int64(cfg.SegmentDuration / time.Millisecond),
+		maxOverrunMS:     int64(cfg.MaxSegmentOverrun / time.Millisecond),
 		videoTS:          90000,
 	}
+	if p.log == nil {
+		p.log = logging.Default()
+	}
 	p.videoState.sampleIsVideo = true
 	if storage.EnableRewind {
 		rewindCfg := hls.Config{
-			SegmentDuration: cfg.SegmentDuration,
-			PartDuration:    cfg.PartDuration,
-			PlaylistWindow:  cfg.RewindPlaylistWindow,
-			TargetDuration:  cfg.TargetDuration,
-			HoldBack:        cfg.HoldBack,
-			PartHoldBack:    cfg.PartHoldBack,
-			KeepSegments:    int(cfg.RewindPlaylistWindow / cfg.SegmentDuration),
-			EnablePartial:   false,
-			InitFilename:    cfg.InitFilename,
-			PlaylistName:    cfg.RewindPlaylistName,
+			SegmentDuration:    cfg.SegmentDuration,
+			PartDuration:       cfg.PartDuration,
+			PlaylistWindow:     cfg.RewindPlaylistWindow,
+			TargetDuration:     targetDuration,
+			HoldBack:           cfg.HoldBack,
+			PartHoldBack:       cfg.PartHoldBack,
+			KeepSegments:       int(cfg.RewindPlaylistWindow / cfg.SegmentDuration),
+			EnablePartial:      false,
+			InitFilename:       cfg.InitFilename,
+			PlaylistName:       cfg.RewindPlaylistName,
+			PDTEverySegment:    cfg.PDTEverySegment,
+			IFramePlaylistName: cfg.IFramePlaylistName,
 		}
 		p.rewind = hls.New(rewindCfg, storage, streamID)
 	}
+	if cfg.CaptionsPlaylistName != "" {
+		p.initCaptions(liveCfg)
+	}
+	if cfg.DemuxAudio {
+		p.initAudio()
+	}
+	if cfg.EnableDASH {
+		dashCfg := dash.Config{
+			ManifestName:        cfg.DASHManifestName,
+			InitFilename:        cfg.InitFilename,
+			SegmentFilenameTmpl: cfg.SegmentFilenameTmpl,
+			SegmentDuration:     cfg.SegmentDuration,
+			KeepSegments:        cfg.KeepSegments,
+			TargetLatency:       cfg.HoldBack,
+		}
+		p.dash = dash.New(dashCfg, storage, streamID)
+		if p.rewind != nil {
+			dashCfg.KeepSegments = int(cfg.RewindPlaylistWindow / cfg.SegmentDuration)
+			p.rewindDash = dash.New(dashCfg, storage, streamID)
+		}
+	}
 	p.resumeFromExisting()
 	return p
 }
@@ -151,71 +305,133 @@ func (p *Packager) resumeFromExisting() {
 	livePath := filepath.Join(p.storage.StreamDir(p.streamID), p.cfg.PlaylistName)
 	lastSeq, hasSegments, err := p.playlist.LoadFromFile(livePath, true)
 	if err != nil {
-		log.Printf("resume live playlist error: %v", err)
+		p.log.WithError(err).Warn("resume live playlist error")
 	}
 	if p.rewind != nil {
 		rewindPath := filepath.Join(p.storage.RewindDir(p.streamID), p.cfg.RewindPlaylistName)
 		rewindLast, rewindHas, err := p.rewind.LoadFromFile(rewindPath, true)
 		if err != nil {
-			log.Printf("resume rewind playlist error: %v", err)
+			p.log.WithError(err).Warn("resume rewind playlist error")
 		}
 		if !hasSegments && rewindHas {
 			lastSeq = rewindLast
 			hasSegments = true
 		}
 	}
+	p.resumeCaptions()
+	if p.dash != nil {
+		if err := p.dash.LoadFromFile(filepath.Join(p.storage.StreamDir(p.streamID), p.cfg.DASHManifestName)); err != nil {
+			p.log.WithError(err).Warn("resume live manifest error")
+		}
+	}
+	if p.rewindDash != nil {
+		if err := p.rewindDash.LoadFromFile(filepath.Join(p.storage.RewindDir(p.streamID), p.cfg.DASHManifestName)); err != nil {
+			p.log.WithError(err).Warn("resume rewind manifest error")
+		}
+	}
 	if hasSegments {
-		p.segmentOffset = lastSeq
 		p.lastSegmentSeq = lastSeq
 		p.pendingDiscontinuity = true
 	}
 }
 
-func (p *Packager) UpdateVideoConfig(cfg util.AVCConfig) error {
-	if p.initWritten && !util.EqualAVCConfig(p.avcConfig, cfg) {
-		p.reset(false)
+func (p *Packager) UpdateVideoConfig(cfg util.VideoConfig) error {
+	if p.cfg.AudioOnly {
+		return nil
 	}
-	p.avcConfig = cfg
+	if p.initWritten && !util.EqualVideoConfig(p.videoConfig, cfg) {
+		p.reset(DiscontinuityVideoConfig, false)
+	}
+	p.videoConfig = cfg
 	p.videoState.sampleIsVideo = true
 	return p.maybeWriteInit()
 }
 
-func (p *Packager) UpdateAudioConfig(cfg util.AACConfig) error {
-	if p.initWritten && ((p.aacConfig.SampleRate != 0 && p.aacConfig.SampleRate != cfg.SampleRate) || p.audioID == 0) {
-		p.reset(false)
+func (p *Packager) UpdateAudioConfig(cfg util.AudioConfig) error {
+	if p.audio != nil {
+		return p.audio.UpdateAudioConfig(cfg)
+	}
+	if p.initWritten && (p.audioID == 0 || (p.audioConfig.Codec != "" && !util.EqualAudioConfig(p.audioConfig, cfg))) {
+		p.reset(DiscontinuityAudioConfig, false)
 	}
-	p.aacConfig = cfg
-	p.audioTS = uint32(cfg.SampleRate)
-	p.audioState.defaultDurMS = int64(math.Round(1024.0 * 1000.0 / float64(cfg.SampleRate)))
+	p.audioConfig = cfg
+	p.audioTS = uint32(cfg.SampleRate())
+	p.audioState.defaultDurMS = int64(math.Round(float64(cfg.FrameSamples()) * 1000.0 / float64(cfg.SampleRate())))
 	if p.audioState.defaultDurMS == 0 {
 		p.audioState.defaultDurMS = 20
 	}
 	return p.maybeWriteInit()
 }
 
+// SetClockBase maps an RTMP timestamp to the wall clock so segments can
+// carry EXT-X-PROGRAM-DATE-TIME.
+func (p *Packager) SetClockBase(tsMS int64, wall time.Time) {
+	p.clockBaseTSMS = tsMS
+	p.clockBaseWall = wall
+	if p.audio != nil {
+		p.audio.SetClockBase(tsMS, wall)
+	}
+}
+
+// Playlist returns the live playlist, for rendition reports of other
+// renditions of the same stream.
+func (p *Packager) Playlist() *hls.PlaylistManager {
+	return p.playlist
+}
+
+// SetRenditions lists the other renditions of the stream, with URIs relative
+// to this packager's live playlist.
+func (p *Packager) SetRenditions(renditions []hls.Rendition) {
+	if p.audio != nil {
+		renditions = append(renditions, hls.Rendition{URI: p.AudioRendition(), Playlist: p.audio.Playlist()})
+	}
+	p.playlist.SetRenditions(renditions)
+}
+
 func (p *Packager) AddVideoSample(tsMS int64, ctsMS int64, data []byte, isKey bool) error {
+	if p.cfg.AudioOnly {
+		return nil
+	}
 	return p.addSample(true, pendingSample{dtsMS: tsMS, ctsMS: ctsMS, data: data, isKey: isKey})
 }
 
 func (p *Packager) AddAudioSample(tsMS int64, data []byte) error {
+	if p.audio != nil {
+		return p.audio.AddAudioSample(tsMS, data)
+	}
 	return p.addSample(false, pendingSample{dtsMS: tsMS, ctsMS: 0, data: data, isKey: false})
 }
 
 func (p *Packager) Flush() error {
+	if p.audio != nil {
+		if err := p.audio.Flush(); err != nil {
+			return err
+		}
+	}
 	if err := p.flushTrack(&p.videoState); err != nil {
 		return err
 	}
 	if err := p.flushTrack(&p.audioState); err != nil {
 		return err
 	}
-	return p.finalizeSegment()
+	if err := p.finalizePart(true); err != nil {
+		return err
+	}
+	p.playlist.SetPreloadHint("")
+	if err := p.finalizeSegment(); err != nil {
+		return err
+	}
+	if !p.initWritten {
+		return nil
+	}
+	return p.playlist.Write()
 }
 
 func (p *Packager) addSample(isVideo bool, sample pendingSample) error {
 	if !p.initWritten {
 		return nil
 	}
-	if !isVideo && p.aacConfig.SampleRate == 0 {
+	if !isVideo && p.audioConfig.SampleRate() == 0 {
 		return nil
 	}
 	p.ensureStart(sample.dtsMS)
@@ -253,7 +469,9 @@ func (p *Packager) ingestSample(state *trackState, sample pendingSample) (*track
 	}
 	if state.hasStarted && state.lastDTSMS != 0 {
 		if absInt64(sample.dtsMS-state.lastDTSMS) > 5000 {
-			p.reset(true)
+			metrics.TimestampReset(p.cfg.Metrics)
+			p.SetClockBase(sample.dtsMS, time.Now())
+			p.reset(DiscontinuityTimestampJump, true)
 			state.pending = nil
 			state.hasStarted = false
 			state.lastDTSMS = 0
@@ -304,149 +522,297 @@ func (p *Packager) flushTrack(state *trackState) error {
 }
 
 func (p *Packager) appendToPart(ts trackSample) error {
-	partIdx, segSeq, partStartMS := p.computePartIndex(ts.sample.DecodeTime, ts.trackID == p.videoID)
-	partEndMS := partStartMS + p.partDurationMS
+	isVideo := ts.trackID == p.videoID
+	timescale := p.audioTS
+	if isVideo {
+		timescale = p.videoTS
+	}
+	startMS := timescaleToMS(ts.sample.DecodeTime, timescale)
+	endMS := startMS + timescaleToMS(uint64(ts.sample.Dur), timescale)
+	// Every audio frame is a sync sample, so audio-only segments may be
+	// cut anywhere.
+	isKey := (isVideo && ts.sample.IsSync()) || p.cfg.AudioOnly
 
-	if p.currentPart == nil || partIdx != p.currentPart.partIdx || segSeq != p.currentPart.segSeq {
-		if err := p.finalizePart(); err != nil {
+	if p.currentSegment != nil {
+		elapsedMS := startMS - p.currentSegment.startMS
+		// Cut at the first keyframe after the target duration, or anywhere
+		// once the overrun budget is spent.
+		if elapsedMS >= p.segmentDurationMS && (isKey || elapsedMS >= p.segmentDurationMS+p.maxOverrunMS) {
+			if err := p.finalizePart(true); err != nil {
+				return err
+			}
+			if err := p.finalizeSegment(); err != nil {
+				return err
+			}
+		}
+	}
+	if p.currentSegment == nil {
+		if err := p.startSegment(startMS); err != nil {
 			return err
 		}
-		p.currentPart = &partBuilder{
-			segSeq:  segSeq,
-			partIdx: partIdx,
-			startMS: partStartMS,
-			endMS:   partEndMS,
+	}
+	if p.currentPart != nil && len(p.currentPart.samples) > 0 && endMS > p.currentPart.startMS+p.partDurationMS {
+		if err := p.finalizePart(false); err != nil {
+			return err
 		}
 	}
-	p.currentPart.samples = append(p.currentPart.samples, ts)
-	return nil
-}
-
-func (p *Packager) computePartIndex(decodeTime uint64, isVideo bool) (int, uint64, int64) {
-	var tsMS int64
-	if isVideo {
-		tsMS = timescaleToMS(decodeTime, p.videoTS)
-	} else {
-		tsMS = timescaleToMS(decodeTime, p.audioTS)
+	if p.currentPart == nil {
+		p.currentPart = &partBuilder{
+			segSeq:      p.currentSegment.seq,
+			partIdx:     len(p.currentSegment.parts),
+			startMS:     startMS,
+			endMS:       endMS,
+			independent: p.cfg.AudioOnly,
+		}
 	}
-	rel := tsMS - p.startTSMS
-	if rel < 0 {
-		rel = 0
+	if isVideo && p.captions != nil {
+		p.addCaptions(ts.sample, startMS)
 	}
-	partsPerSeg := int(p.segmentDurationMS / p.partDurationMS)
-	if partsPerSeg <= 0 {
-		partsPerSeg = 1
+	if isVideo && !p.currentPart.hasVideo {
+		p.currentPart.hasVideo = true
+		p.currentPart.independent = isKey
 	}
-	globalPartIdx := int(rel / p.partDurationMS)
-	segIdx := int(rel / p.segmentDurationMS)
-	segSeq := uint64(segIdx) + 1 + p.segmentOffset
-	segStartMS := p.startTSMS + int64(segIdx)*p.segmentDurationMS
-	partIdx := globalPartIdx - segIdx*partsPerSeg
-	if partIdx < 0 {
-		partIdx = 0
+	if endMS > p.currentPart.endMS {
+		p.currentPart.endMS = endMS
 	}
-	partStartMS := segStartMS + int64(partIdx)*p.partDurationMS
-	return partIdx, segSeq, partStartMS
+	p.currentPart.samples = append(p.currentPart.samples, ts)
+	return nil
 }
 
-func (p *Packager) finalizePart() error {
-	if p.currentPart == nil || len(p.currentPart.samples) == 0 {
+// finalizePart writes the current part. segmentEnding tells it the next part
+// opens a new segment, which decides the preload hint.
+func (p *Packager) finalizePart(segmentEnding bool) error {
+	if p.currentPart == nil || len(p.currentPart.samples) == 0 || p.currentSegment == nil {
 		p.currentPart = nil
 		return nil
 	}
 	segSeq := p.currentPart.segSeq
-	if err := p.ensureSegmentBuilder(segSeq, p.currentPart.startMS); err != nil {
-		return err
-	}
+	start := time.Now()
 
-	frag, err := p.createFragment(uint32(p.fragmentSeq+1), p.currentPart.samples)
-	if err != nil {
-		return err
-	}
 	var buf bytes.Buffer
-	if err := frag.Encode(&buf); err != nil {
-		return err
+	keyIdx := p.firstKeyframe(p.currentPart.samples)
+	keyEnd := -1
+	if p.tsMuxer != nil {
+		var err error
+		if keyEnd, err = p.writeTSPart(&buf, p.currentPart.samples); err != nil {
+			return err
+		}
+	} else {
+		var subsamples map[uint32][][]mp4.SubSamplePattern
+		if p.protector != nil {
+			var err error
+			if subsamples, err = p.encryptSamples(p.currentPart.samples); err != nil {
+				return err
+			}
+		}
+		frag, err := p.createFragment(uint32(p.fragmentSeq+1), p.currentPart.samples)
+		if err != nil {
+			return err
+		}
+		for _, emsg := range p.pendingEmsgs {
+			frag.AddEmsg(emsg)
+		}
+		p.pendingEmsgs = nil
+		if p.protector != nil {
+			if err := p.protector.AddSampleEncryption(frag, subsamples); err != nil {
+				return err
+			}
+		}
+		if err := frag.Encode(&buf); err != nil {
+			return err
+		}
+		if keyIdx >= 0 {
+			keyEnd = fragmentKeyframeEnd(p.currentPart.samples, keyIdx, buf.Len())
+		}
 	}
-	partName := fmt.Sprintf(p.cfg.PartFilenameTmpl, segSeq, p.currentPart.partIdx)
-	partPath := filepath.Join(p.storage.StreamDir(p.streamID), partName)
-	if err := storage.WriteFileAtomic(partPath, buf.Bytes()); err != nil {
-		return err
+	partDuration := time.Duration(p.currentPart.endMS-p.currentPart.startMS) * time.Millisecond
+	partStart := p.currentSegment.size
+	var partName string
+	if p.cfg.ByteRangeParts {
+		partName = fmt.Sprintf(p.cfg.SegmentFilenameTmpl, segSeq)
+		if err := p.appendToSegment(partName, buf.Bytes()); err != nil {
+			return p.storageError(metrics.WritePart, err)
+		}
+		p.playlist.AddByteRangePart(segSeq, partName, partStart, int64(buf.Len()), partDuration, p.currentPart.independent)
+	} else {
+		partName = fmt.Sprintf(p.cfg.PartFilenameTmpl, segSeq, p.currentPart.partIdx)
+		if p.cfg.EnablePartial {
+			partPath := filepath.Join(p.storage.StreamDir(p.streamID), partName)
+			if err := storage.WriteFileAtomic(partPath, buf.Bytes()); err != nil {
+				return p.storageError(metrics.WritePart, err)
+			}
+		}
+		p.playlist.AddPart(segSeq, partName, partDuration, p.currentPart.independent)
+		p.currentSegment.buffer.Write(buf.Bytes())
 	}
-
-	p.playlist.AddPart(segSeq, partName, time.Duration(p.partDurationMS)*time.Millisecond)
 	p.currentSegment.parts = append(p.currentSegment.parts, partName)
-	p.currentSegment.buffer.Write(buf.Bytes())
-	p.currentSegment.durationMS += p.partDurationMS
+	if keyIdx >= 0 && keyEnd > 0 && p.currentSegment.iframeLength == 0 {
+		p.currentSegment.iframeOffset = partStart
+		p.currentSegment.iframeLength = int64(keyEnd)
+		p.currentSegment.iframeStartMS = timescaleToMS(p.currentPart.samples[keyIdx].sample.DecodeTime, p.videoTS)
+	}
+	p.currentSegment.size += int64(buf.Len())
+	if d := p.currentPart.endMS - p.currentSegment.startMS; d > p.currentSegment.durationMS {
+		p.currentSegment.durationMS = d
+	}
 	p.fragmentSeq++
 
-	if p.rewind != nil {
-		// No parts for rewind
+	// A forced cut is certain once the overrun budget runs out; keyframe
+	// cuts are not known in advance, so the hint assumes the segment goes on.
+	nextSeq, nextPart := segSeq, p.currentPart.partIdx+1
+	if segmentEnding || p.currentPart.endMS+p.partDurationMS > p.currentSegment.startMS+p.segmentDurationMS+p.maxOverrunMS {
+		nextSeq, nextPart = segSeq+1, 0
+	}
+	if p.cfg.ByteRangeParts {
+		nextStart := p.currentSegment.size
+		if nextSeq != segSeq {
+			nextStart = 0
+		}
+		p.playlist.SetPreloadHintByteRange(fmt.Sprintf(p.cfg.SegmentFilenameTmpl, nextSeq), nextStart)
+	} else {
+		p.playlist.SetPreloadHint(fmt.Sprintf(p.cfg.PartFilenameTmpl, nextSeq, nextPart))
+	}
+
+	p.currentPart = nil
+	if err := p.playlist.Write(); err != nil {
+		return p.storageError(metrics.WritePlaylist, err)
 	}
+	metrics.ObserveWrite(p.cfg.Metrics, metrics.WritePart, time.Since(start).Seconds())
+	return nil
+}
+
+// storageError counts a failed write of kind and passes err on.
+func (p *Packager) storageError(kind string, err error) error {
+	metrics.StorageError(p.cfg.Metrics, kind)
+	return err
+}
 
-	if p.currentPart.endMS >= p.currentSegment.startMS+p.segmentDurationMS {
-		if err := p.finalizeSegment(); err != nil {
+// appendToSegment appends a part to the segment file, which is created by
+// its first part and keeps its final name while it grows.
+func (p *Packager) appendToSegment(segName string, data []byte) error {
+	if p.currentSegment.file == nil {
+		f, err := storage.CreateFile(filepath.Join(p.storage.StreamDir(p.streamID), segName))
+		if err != nil {
 			return err
 		}
+		p.currentSegment.file = f
 	}
-
-	p.currentPart = nil
-	return p.playlist.Write()
+	_, err := p.currentSegment.file.Write(data)
+	return err
 }
 
 func (p *Packager) finalizeSegment() error {
-	if p.currentSegment == nil || p.currentSegment.buffer.Len() == 0 {
+	if p.currentSegment == nil || p.currentSegment.size == 0 {
 		return nil
 	}
+	start := time.Now()
 	segName := fmt.Sprintf(p.cfg.SegmentFilenameTmpl, p.currentSegment.seq)
 	segPath := filepath.Join(p.storage.StreamDir(p.streamID), segName)
-	if err := storage.WriteFileAtomic(segPath, p.currentSegment.buffer.Bytes()); err != nil {
-		return err
+	segSize := p.currentSegment.size
+	fileSize := segSize
+	if p.currentSegment.file != nil {
+		err := p.currentSegment.file.Close()
+		p.currentSegment.file = nil
+		if err != nil {
+			return p.storageError(metrics.WriteSegment, err)
+		}
+	} else {
+		segData, err := p.encryptTS(p.currentSegment.buffer.Bytes(), p.currentSegment.seq)
+		if err != nil {
+			return err
+		}
+		if err := storage.WriteFileAtomic(segPath, segData); err != nil {
+			return p.storageError(metrics.WriteSegment, err)
+		}
+		fileSize = int64(len(segData))
 	}
 	p.playlist.FinalizeSegment(p.currentSegment.seq, segName, time.Duration(p.currentSegment.durationMS)*time.Millisecond)
+	if p.dash != nil {
+		p.dash.AddSegment(p.currentSegment.seq, p.currentSegment.startMS, p.currentSegment.durationMS, segSize, p.currentSegment.wallClock)
+		p.dash.Prune()
+		if err := p.dash.Write(); err != nil {
+			metrics.StorageError(p.cfg.Metrics, metrics.WritePlaylist)
+			p.log.WithError(err).Error("dash manifest write error")
+		}
+	}
 	if p.rewind != nil {
 		rewindDir := p.storage.RewindDir(p.streamID)
 		rewindPath := filepath.Join(rewindDir, segName)
 		_ = storage.CopyOrLink(segPath, rewindPath)
+		if !p.currentSegment.wallClock.IsZero() {
+			p.rewind.SetProgramDateTime(p.currentSegment.seq, p.currentSegment.wallClock)
+		}
+		for _, d := range p.currentSegment.dateRanges {
+			p.rewind.AddDateRange(p.currentSegment.seq, d)
+		}
 		p.rewind.FinalizeSegment(p.currentSegment.seq, segName, time.Duration(p.currentSegment.durationMS)*time.Millisecond)
+		p.setIFrame(fileSize)
 		removedRewind := p.rewind.Prune()
 		for _, seg := range removedRewind {
 			if seg.URI != "" {
 				_ = storage.RemoveFile(filepath.Join(rewindDir, seg.URI))
 			}
 		}
+		for _, uri := range p.rewind.UnusedMaps(removedRewind) {
+			_ = storage.RemoveFile(filepath.Join(rewindDir, uri))
+		}
 		_ = p.rewind.WriteTo(rewindDir)
+		if p.rewindDash != nil {
+			p.rewindDash.AddSegment(p.currentSegment.seq, p.currentSegment.startMS, p.currentSegment.durationMS, segSize, p.currentSegment.wallClock)
+			p.rewindDash.Prune()
+			_ = p.rewindDash.WriteTo(rewindDir)
+		}
+	}
+	if p.captions != nil {
+		p.finalizeCaptions()
 	}
 	removed := p.playlist.Prune()
 	_ = p.playlist.RemoveFiles(removed)
 	if err := p.playlist.Write(); err != nil {
-		return err
+		return p.storageError(metrics.WritePlaylist, err)
 	}
+	metrics.ObserveWrite(p.cfg.Metrics, metrics.WriteSegment, time.Since(start).Seconds())
 	p.lastSegmentSeq = p.currentSegment.seq
 	p.currentSegment = nil
 	return nil
 }
 
-func (p *Packager) ensureSegmentBuilder(segSeq uint64, startMS int64) error {
-	if p.currentSegment != nil && p.currentSegment.seq == segSeq {
-		return nil
-	}
-	if p.currentSegment != nil {
-		if err := p.finalizeSegment(); err != nil {
-			return err
-		}
+func (p *Packager) startSegment(startMS int64) error {
+	seq := p.lastSegmentSeq + 1
+	if err := p.applyKey(seq); err != nil {
+		return err
 	}
-	segStartMS := startMS - (startMS-p.startTSMS)%p.segmentDurationMS
 	p.currentSegment = &segmentBuilder{
-		seq:     segSeq,
-		startMS: segStartMS,
+		seq:     seq,
+		startMS: startMS,
+	}
+	if !p.clockBaseWall.IsZero() {
+		p.currentSegment.wallClock = p.clockBaseWall.Add(time.Duration(startMS-p.clockBaseTSMS) * time.Millisecond)
+		p.playlist.SetProgramDateTime(p.currentSegment.seq, p.currentSegment.wallClock)
 	}
 	if p.pendingDiscontinuity {
 		p.playlist.MarkDiscontinuityNext()
 		if p.rewind != nil {
 			p.rewind.MarkDiscontinuityNext()
 		}
+		if p.dash != nil {
+			p.dash.MarkDiscontinuityNext()
+		}
+		if p.rewindDash != nil {
+			p.rewindDash.MarkDiscontinuityNext()
+		}
+		if p.captionsPlaylist != nil {
+			p.captionsPlaylist.MarkDiscontinuityNext()
+		}
+		if p.rewindCaptions != nil {
+			p.rewindCaptions.MarkDiscontinuityNext()
+		}
 		p.pendingDiscontinuity = false
 	}
+	for _, d := range p.pendingDateRanges {
+		p.addDateRange(d)
+	}
+	p.pendingDateRanges = nil
 	return nil
 }
 
@@ -481,54 +847,107 @@ func addEmptyTrack(initSeg *mp4.InitSegment, timeScale uint32, mediaType, langua
 }
 
 func (p *Packager) maybeWriteInit() error {
-	if len(p.avcConfig.SPS) == 0 || len(p.avcConfig.PPS) == 0 {
+	if p.cfg.AudioOnly {
+		if p.audioConfig.SampleRate() == 0 {
+			return nil
+		}
+	} else if !p.videoConfig.Ready() {
 		return nil
 	}
 	if p.initWritten {
 		return nil
 	}
-	init := mp4.CreateEmptyInit()
-	videoTrak := addEmptyTrack(init, p.videoTS, "video", "und")
-	if err := videoTrak.SetAVCDescriptor("avc1", p.avcConfig.SPS, p.avcConfig.PPS, true); err != nil {
+	if p.cfg.SegmentFormat == FormatTS {
+		return p.initTS()
+	}
+	if p.cfg.KeyProvider != nil && !p.hasKey {
+		if err := p.fetchKey(p.keyPeriodFor(p.lastSegmentSeq + 1)); err != nil {
+			return err
+		}
+	}
+	if err := p.writeInit(); err != nil {
 		return err
 	}
-	p.videoID = videoTrak.Tkhd.TrackID
-	p.videoState.trackID = p.videoID
-	p.videoState.timescale = p.videoTS
-	p.videoState.defaultDurMS = 33
-	if p.aacConfig.SampleRate > 0 {
-		p.audioTS = uint32(p.aacConfig.SampleRate)
+	if p.rewind != nil {
+		rewindDir := p.storage.RewindDir(p.streamID)
+		_ = p.rewind.WriteTo(rewindDir)
+	}
+	p.initWritten = true
+	if p.dash != nil {
+		rep := p.representation()
+		p.dash.SetRepresentation(rep)
+		if p.rewindDash != nil {
+			p.rewindDash.SetRepresentation(rep)
+		}
+	}
+	return p.playlist.Write()
+}
+
+// writeInit writes the init segment for the current codec configs and key.
+// With key rotation every init gets its own name, taken from the segment
+// that will first use it, so a cached copy is never stale.
+func (p *Packager) writeInit() error {
+	init := mp4.CreateEmptyInit()
+	if !p.cfg.AudioOnly {
+		videoTrak := addEmptyTrack(init, p.videoTS, "video", "und")
+		if err := util.SetVideoDescriptor(videoTrak, p.videoConfig); err != nil {
+			return err
+		}
+		p.videoID = videoTrak.Tkhd.TrackID
+		p.videoState.trackID = p.videoID
+		p.videoState.timescale = p.videoTS
+		p.videoState.defaultDurMS = 33
+	}
+	if p.audioConfig.SampleRate() > 0 {
+		p.audioTS = uint32(p.audioConfig.SampleRate())
 		audioTrak := addEmptyTrack(init, p.audioTS, "audio", "und")
-		esds := mp4.CreateEsdsBox(p.aacConfig.ASC)
-		channels := p.aacConfig.Channels
-		if channels == 0 {
-			channels = 2
+		if err := util.AddAudioDescriptor(audioTrak, p.audioConfig); err != nil {
+			return err
 		}
-		mp4a := mp4.CreateAudioSampleEntryBox("mp4a", uint16(channels), 16, uint16(p.aacConfig.SampleRate), esds)
-		audioTrak.Mdia.Minf.Stbl.Stsd.AddChild(mp4a)
 		p.audioID = audioTrak.Tkhd.TrackID
 		p.audioState.trackID = p.audioID
 		p.audioState.timescale = p.audioTS
 	}
+	p.protector = nil
+	if p.hasKey {
+		protector, err := drm.ProtectInit(init, p.key)
+		if err != nil {
+			return err
+		}
+		p.protector = protector
+	}
 
 	var buf bytes.Buffer
 	if err := init.Encode(&buf); err != nil {
 		return err
 	}
-	livePath := filepath.Join(p.storage.StreamDir(p.streamID), p.cfg.InitFilename)
+	p.initName = p.cfg.InitFilename
+	if p.hasKey && p.cfg.KeyRotateSegments > 0 {
+		p.initName = fmt.Sprintf("%s_%06d%s", strings.TrimSuffix(p.cfg.InitFilename, filepath.Ext(p.cfg.InitFilename)),
+			p.lastSegmentSeq+1, filepath.Ext(p.cfg.InitFilename))
+	}
+	livePath := filepath.Join(p.storage.StreamDir(p.streamID), p.initName)
 	if err := storage.WriteFileAtomic(livePath, buf.Bytes()); err != nil {
-		return err
+		return p.storageError(metrics.WriteInit, err)
 	}
 	if p.storage.EnableRewind {
-		rewindPath := filepath.Join(p.storage.RewindDir(p.streamID), p.cfg.InitFilename)
+		rewindPath := filepath.Join(p.storage.RewindDir(p.streamID), p.initName)
 		_ = storage.WriteFileAtomic(rewindPath, buf.Bytes())
-		if p.rewind != nil {
-			rewindDir := p.storage.RewindDir(p.streamID)
-			_ = p.rewind.WriteTo(rewindDir)
+	}
+	return nil
+}
+
+func (p *Packager) representation() dash.Representation {
+	rep := dash.Representation{Codecs: p.videoConfig.CodecString(), HasVideo: true}
+	rep.Width, rep.Height = p.videoConfig.Dimensions()
+	if p.audioID != 0 {
+		if codec := p.audioConfig.CodecString(); codec != "" {
+			rep.Codecs += "," + codec
 		}
+		rep.HasAudio = true
+		rep.SampleRate = int(p.audioTS)
 	}
-	p.initWritten = true
-	return p.playlist.Write()
+	return rep
 }
 
 func (p *Packager) ensureStart(tsMS int64) {
@@ -539,24 +958,34 @@ func (p *Packager) ensureStart(tsMS int64) {
 	p.startTSMS = tsMS
 }
 
-func (p *Packager) reset(reinit bool) {
-	_ = p.finalizePart()
+func (p *Packager) reset(reason string, reinit bool) {
+	_ = p.finalizePart(true)
 	_ = p.finalizeSegment()
 	p.pendingDiscontinuity = true
-	p.segmentOffset = p.lastSegmentSeq
 	p.startTSMS = 0
 	p.started = false
 	p.currentPart = nil
 	p.currentSegment = nil
+	p.playlist.SetPreloadHint("")
 	p.videoState.pending = nil
 	p.audioState.pending = nil
 	p.initWritten = false
 	p.videoID = 0
 	p.audioID = 0
 	p.fragmentSeq = 0
+	p.tsMuxer = nil
+	p.protector = nil
+	p.lastIFrame = iframeEntry{}
+	p.pendingEmsgs = nil
+	if p.captions != nil {
+		p.captions.Reset()
+	}
 	if reinit {
 		_ = p.maybeWriteInit()
 	}
+	if p.cfg.OnDiscontinuity != nil {
+		p.cfg.OnDiscontinuity(reason)
+	}
 }
 
 func buildFullSample(state *trackState, sample pendingSample, durMS int64) mp4.FullSample {
@@ -607,6 +1036,10 @@ func timescaleToMS(value uint64, timescale uint32) int64 {
 	return int64(value*1000) / int64(timescale)
 }
 
+func withExtension(tmpl, ext string) string {
+	return strings.TrimSuffix(tmpl, filepath.Ext(tmpl)) + ext
+}
+
 func maxInt64(a, b int64) int64 {
 	if a > b {
 		return a
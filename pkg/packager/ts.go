@@ -0,0 +1,83 @@
+package packager
+
+import (
+	"bytes"
+	"fmt"
+
+	"tokuly-live-rtmp-server/pkg/mpegts"
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+// initTS prepares the TS muxer in place of an init segment. Track IDs and
+// timescales mirror the fMP4 layout so the sample path is shared.
+func (p *Packager) initTS() error {
+	if p.videoConfig.Codec != util.VideoCodecH264 {
+		return fmt.Errorf("ts output does not support video codec %s", p.videoConfig.Codec)
+	}
+	audioType := byte(0)
+	if p.audioConfig.SampleRate() > 0 {
+		switch p.audioConfig.Codec {
+		case util.AudioCodecAAC:
+			audioType = mpegts.StreamTypeAAC
+		case util.AudioCodecMP3:
+			audioType = mpegts.StreamTypeMP3
+			if p.audioConfig.SampleRate() < 32000 {
+				audioType = mpegts.StreamTypeMP2
+			}
+		default:
+			return fmt.Errorf("ts output does not support audio codec %s", p.audioConfig.Codec)
+		}
+	}
+	p.tsMuxer = mpegts.NewMuxer(mpegts.StreamTypeH264, audioType)
+	p.videoID = 1
+	p.videoState.trackID = p.videoID
+	p.videoState.timescale = p.videoTS
+	p.videoState.defaultDurMS = 33
+	if audioType != 0 {
+		p.audioTS = uint32(p.audioConfig.SampleRate())
+		p.audioID = 2
+		p.audioState.trackID = p.audioID
+		p.audioState.timescale = p.audioTS
+	}
+	if p.rewind != nil {
+		_ = p.rewind.WriteTo(p.storage.RewindDir(p.streamID))
+	}
+	p.initWritten = true
+	return p.playlist.Write()
+}
+
+// writeTSPart muxes the samples of one part. Every part opens with PAT/PMT so
+// it can be decoded on its own; segments are the concatenation of parts. It
+// returns the offset just past the first keyframe, or -1 if there is none.
+func (p *Packager) writeTSPart(buf *bytes.Buffer, samples []trackSample) (int, error) {
+	keyEnd := -1
+	p.tsMuxer.WriteTables(buf)
+	for _, s := range samples {
+		if s.trackID == p.videoID {
+			dts := s.sample.DecodeTime * 90000 / uint64(p.videoTS)
+			pts := uint64(int64(dts) + int64(s.sample.CompositionTimeOffset)*90000/int64(p.videoTS))
+			isKey := s.sample.IsSync()
+			data, err := mpegts.AnnexB(s.sample.Data, p.videoConfig.AVC.SPS, p.videoConfig.AVC.PPS, isKey)
+			if err != nil {
+				return -1, err
+			}
+			p.tsMuxer.WriteVideo(buf, pts, dts, data, isKey)
+			if isKey && keyEnd < 0 {
+				keyEnd = buf.Len()
+			}
+			continue
+		}
+		pts := s.sample.DecodeTime * 90000 / uint64(p.audioTS)
+		data := s.sample.Data
+		if p.audioConfig.Codec == util.AudioCodecAAC {
+			aac := p.audioConfig.AAC
+			var err error
+			data, err = mpegts.ADTS(data, aac.ObjectType, aac.SampleRate, aac.Channels)
+			if err != nil {
+				return -1, err
+			}
+		}
+		p.tsMuxer.WriteAudio(buf, pts, data)
+	}
+	return keyEnd, nil
+}
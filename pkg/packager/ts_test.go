@@ -0,0 +1,136 @@
+package packager
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/sirupsen/logrus"
+
+	"tokuly-live-rtmp-server/pkg/mpegts"
+	"tokuly-live-rtmp-server/pkg/storage"
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+// tsAccessUnits returns the payload of each PES on pid in a TS part, in
+// order, and checks that the part opens with a PAT.
+func tsAccessUnits(t *testing.T, data []byte, pid uint16) [][]byte {
+	t.Helper()
+	if len(data)%mpegts.PacketSize != 0 {
+		t.Fatalf("part is %d bytes, not a multiple of %d", len(data), mpegts.PacketSize)
+	}
+	if data[0] != 0x47 || data[1]&0x1F != 0 || data[2] != 0 {
+		t.Fatalf("part does not open with a PAT: %x", data[:4])
+	}
+	var units [][]byte
+	for off := 0; off < len(data); off += mpegts.PacketSize {
+		pkt := data[off : off+mpegts.PacketSize]
+		if uint16(pkt[1]&0x1F)<<8|uint16(pkt[2]) != pid {
+			continue
+		}
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		if pkt[1]&0x40 != 0 {
+			// Skip the PES header.
+			units = append(units, nil)
+			payload = payload[9+int(payload[8]):]
+		}
+		units[len(units)-1] = append(units[len(units)-1], payload...)
+	}
+	return units
+}
+
+// nalTypes lists the H.264 NAL unit types of an Annex-B access unit.
+func nalTypes(au []byte) []byte {
+	var types []byte
+	for _, nalu := range bytes.Split(au, []byte{0x00, 0x00, 0x00, 0x01})[1:] {
+		types = append(types, nalu[0]&0x1F)
+	}
+	return types
+}
+
+func TestWriteTSPart(t *testing.T) {
+	avcC, _ := hex.DecodeString("0164001effe100196764001eacd940a02ff9610000030001000003003c8f162d9601000568ebecb22c")
+	video, err := util.ParseVideoConfig(util.VideoCodecH264, avcC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asc, err := util.ParseAudioSpecificConfig([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	p := New(Config{
+		SegmentDuration: 2 * time.Second,
+		PlaylistName:    "index.m3u8",
+		SegmentFormat:   FormatTS,
+		Log:             logrus.NewEntry(logger),
+	}, storage.New(filepath.Join(root, "live"), filepath.Join(root, "rewind"), false), "studio")
+	p.videoConfig = video
+	p.audioConfig = util.AudioConfig{Codec: util.AudioCodecAAC, AAC: asc}
+	if err := p.initTS(); err != nil {
+		t.Fatal(err)
+	}
+
+	idr := []byte{0x00, 0x00, 0x00, 0x03, 0x65, 0x88, 0x84}
+	slice := []byte{0x00, 0x00, 0x00, 0x03, 0x41, 0x9A, 0x02}
+	videoSample := func(dts uint64, cto int32, data []byte, key bool) trackSample {
+		flags := mp4.NonSyncSampleFlags
+		if key {
+			flags = mp4.SyncSampleFlags
+		}
+		return trackSample{trackID: p.videoID, sample: mp4.FullSample{
+			Sample:     mp4.Sample{Flags: flags, CompositionTimeOffset: cto},
+			DecodeTime: dts,
+			Data:       data,
+		}}
+	}
+	audioSample := trackSample{trackID: p.audioID, sample: mp4.FullSample{DecodeTime: 0, Data: []byte{0x21, 0x10}}}
+
+	for part, samples := range [][]trackSample{
+		{videoSample(0, 3000, idr, true), audioSample, videoSample(3000, 3000, slice, false)},
+		{videoSample(6000, 0, slice, false), videoSample(9000, 0, idr, true)},
+	} {
+		var buf bytes.Buffer
+		keyEnd, err := p.writeTSPart(&buf, samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyEnd <= 0 || keyEnd%mpegts.PacketSize != 0 {
+			t.Errorf("part %d: key end %d, want a packet boundary after the keyframe", part, keyEnd)
+		}
+		units := tsAccessUnits(t, buf.Bytes(), mpegts.VideoPID)
+		var want [][]byte
+		for _, s := range samples {
+			if s.trackID != p.videoID {
+				continue
+			}
+			// Every IDR carries SPS and PPS after the AUD.
+			types := []byte{9, 1}
+			if s.sample.IsSync() {
+				types = []byte{9, 7, 8, 5}
+			}
+			want = append(want, types)
+		}
+		if len(units) != len(want) {
+			t.Fatalf("part %d: %d video access units, want %d", part, len(units), len(want))
+		}
+		for i := range units {
+			if got := nalTypes(units[i]); !bytes.Equal(got, want[i]) {
+				t.Errorf("part %d access unit %d: NAL types %v, want %v", part, i, got, want[i])
+			}
+		}
+		audio := tsAccessUnits(t, buf.Bytes(), mpegts.AudioPID)
+		if part == 0 && (len(audio) != 1 || len(audio[0]) != 9 || audio[0][0] != 0xFF || audio[0][1]&0xF0 != 0xF0) {
+			t.Errorf("part %d: audio %x, want one ADTS frame", part, audio)
+		}
+	}
+}
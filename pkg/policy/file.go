@@ -0,0 +1,300 @@
+package policy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"tokuly-live-rtmp-server/pkg/inspect"
+	"tokuly-live-rtmp-server/pkg/logging"
+)
+
+// KeyEntry is a stream key of a key file. Empty fields do not restrict the
+// key.
+type KeyEntry struct {
+	StreamName  string `json:"stream_name" yaml:"stream_name"`
+	AllowRewind *bool  `json:"allow_rewind" yaml:"allow_rewind"`
+	// App is the only RTMP app the key may publish to.
+	App string `json:"app" yaml:"app"`
+	// AllowedIPs lists the addresses or CIDR ranges the key may publish from.
+	AllowedIPs []string  `json:"allowed_ips" yaml:"allowed_ips"`
+	Expires    time.Time `json:"expires" yaml:"expires"`
+}
+
+// keyFile is the layout of a key file:
+//
+//	keys:
+//	  <stream key>:
+//	    stream_name: studio
+//	    app: live
+//	    allowed_ips: [10.0.0.0/8]
+//	    expires: 2030-01-01T00:00:00Z
+type keyFile struct {
+	Keys map[string]KeyEntry `json:"keys" yaml:"keys"`
+}
+
+type fileKey struct {
+	entry    KeyEntry
+	prefixes []netip.Prefix
+}
+
+// FilePolicy authorizes the stream keys listed in a YAML or JSON file, for
+// deployments without the Tokuly API. A file ending in .json is read as
+// JSON, anything else as YAML. It sends no notifications.
+type FilePolicy struct {
+	Path   string
+	Config Config
+
+	mu      sync.RWMutex
+	keys    map[string]fileKey
+	modTime time.Time
+	stopCh  chan struct{}
+}
+
+func NewFilePolicy(path string, cfg Config) (*FilePolicy, error) {
+	if path == "" {
+		return nil, fmt.Errorf("key file path empty")
+	}
+	p := &FilePolicy{Path: path, Config: cfg}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the key file. The previous keys stay in use if the file
+// fails to load, so a half-written edit never locks every publisher out.
+func (p *FilePolicy) Reload() error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	var file keyFile
+	if strings.EqualFold(filepath.Ext(p.Path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", p.Path, err)
+	}
+	keys := make(map[string]fileKey, len(file.Keys))
+	for streamKey, entry := range file.Keys {
+		key := fileKey{entry: entry}
+		for _, allowed := range entry.AllowedIPs {
+			prefix, err := parsePrefix(allowed)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", maskKey(streamKey), err)
+			}
+			key.prefixes = append(key.prefixes, prefix)
+		}
+		keys[streamKey] = key
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.modTime = info.ModTime()
+	p.mu.Unlock()
+	return nil
+}
+
+// Watch polls the key file and reloads it when it changes.
+func (p *FilePolicy) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	p.mu.Lock()
+	if p.stopCh != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.stopCh = make(chan struct{})
+	stopCh := p.stopCh
+	p.mu.Unlock()
+
+	log := logging.Default().WithField("key_file", p.Path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if !p.changed() {
+					continue
+				}
+				if err := p.Reload(); err != nil {
+					log.WithError(err).Error("key file reload error")
+					continue
+				}
+				p.mu.RLock()
+				count := len(p.keys)
+				p.mu.RUnlock()
+				log.WithField("keys", count).Info("key file reloaded")
+			}
+		}
+	}()
+}
+
+func (p *FilePolicy) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopCh != nil {
+		close(p.stopCh)
+		p.stopCh = nil
+	}
+}
+
+func (p *FilePolicy) changed() bool {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !info.ModTime().Equal(p.modTime)
+}
+
+// Has reports whether the file lists streamKey.
+func (p *FilePolicy) Has(streamKey string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.keys[streamKey]
+	return ok
+}
+
+func (p *FilePolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAgent, app string) (Result, error) {
+	p.mu.RLock()
+	key, ok := p.keys[streamKey]
+	p.mu.RUnlock()
+	if !ok {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "key unknown"}, nil
+	}
+	entry := key.entry
+	if !entry.Expires.IsZero() && time.Now().After(entry.Expires) {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyExpired, Message: "key expired"}, nil
+	}
+	if entry.App != "" && entry.App != app {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "app not allowed"}, nil
+	}
+	if len(key.prefixes) > 0 && !containsAddr(key.prefixes, remoteIP) {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "address not allowed"}, nil
+	}
+	return Result{Decision: DecisionAccept, StreamName: entry.StreamName, AllowRewind: entry.AllowRewind}, nil
+}
+
+func (p *FilePolicy) Evaluate(ctx context.Context, result inspect.Result) Result {
+	return p.Config.Evaluate(result)
+}
+
+func (p *FilePolicy) NotifyStreamEnd(ctx context.Context, streamKey string) error {
+	return nil
+}
+
+func (p *FilePolicy) NotifyVideoInfo(ctx context.Context, streamKey string, result inspect.Result) error {
+	return nil
+}
+
+func (p *FilePolicy) NotifyArchiveStatus(ctx context.Context, streamKey string, status bool) error {
+	return nil
+}
+
+// CompositePolicy authorizes the keys listed in File and hands every other
+// key to Fallback. Inspection and notifications go to Fallback, except
+// notifications about file keys, which Fallback never authorized.
+type CompositePolicy struct {
+	File     *FilePolicy
+	Fallback Policy
+}
+
+func (p *CompositePolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAgent, app string) (Result, error) {
+	if p.File.Has(streamKey) {
+		return p.File.Authorize(ctx, streamKey, remoteIP, userAgent, app)
+	}
+	return p.Fallback.Authorize(ctx, streamKey, remoteIP, userAgent, app)
+}
+
+func (p *CompositePolicy) AuthorizePlayback(ctx context.Context, streamName, token, remoteIP string) (Result, error) {
+	if authorizer, ok := p.Fallback.(PlaybackAuthorizer); ok {
+		return authorizer.AuthorizePlayback(ctx, streamName, token, remoteIP)
+	}
+	return Result{Decision: DecisionAccept}, nil
+}
+
+func (p *CompositePolicy) Evaluate(ctx context.Context, result inspect.Result) Result {
+	return p.Fallback.Evaluate(ctx, result)
+}
+
+func (p *CompositePolicy) NotifyStreamEnd(ctx context.Context, streamKey string) error {
+	if p.File.Has(streamKey) {
+		return nil
+	}
+	return p.Fallback.NotifyStreamEnd(ctx, streamKey)
+}
+
+func (p *CompositePolicy) NotifyVideoInfo(ctx context.Context, streamKey string, result inspect.Result) error {
+	if p.File.Has(streamKey) {
+		return nil
+	}
+	return p.Fallback.NotifyVideoInfo(ctx, streamKey, result)
+}
+
+func (p *CompositePolicy) NotifyArchiveStatus(ctx context.Context, streamKey string, status bool) error {
+	if p.File.Has(streamKey) {
+		return nil
+	}
+	return p.Fallback.NotifyArchiveStatus(ctx, streamKey, status)
+}
+
+// parsePrefix accepts an address or a CIDR range.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, remoteIP string) bool {
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskKey keeps stream keys out of error messages. It matches the
+// stream_key_hash logged for sessions.
+func maskKey(streamKey string) string {
+	sum := sha256.Sum256([]byte(streamKey))
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,205 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tokuly-live-rtmp-server/pkg/inspect"
+)
+
+func writeKeyFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePolicyAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, path, `keys:
+  open:
+    stream_name: studio
+    allow_rewind: false
+  expired:
+    expires: 2001-01-01T00:00:00Z
+  later:
+    expires: 2999-01-01T00:00:00Z
+  app-only:
+    app: live
+  office:
+    allowed_ips: [10.0.0.0/8, 192.0.2.7, "2001:db8::/32"]
+`)
+	p, err := NewFilePolicy(path, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRewind := false
+	for _, tc := range []struct {
+		name     string
+		key      string
+		remoteIP string
+		app      string
+		want     Result
+	}{
+		{name: "unknown key", key: "nope", want: Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "key unknown"}},
+		{name: "stream name", key: "open", want: Result{Decision: DecisionAccept, StreamName: "studio", AllowRewind: &noRewind}},
+		{name: "expired", key: "expired", want: Result{Decision: DecisionReject, Reason: ReasonKeyExpired, Message: "key expired"}},
+		{name: "not yet expired", key: "later", want: Result{Decision: DecisionAccept}},
+		{name: "app allowed", key: "app-only", app: "live", want: Result{Decision: DecisionAccept}},
+		{name: "app not allowed", key: "app-only", app: "backup", want: Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "app not allowed"}},
+		{name: "ip in range", key: "office", remoteIP: "10.1.2.3", want: Result{Decision: DecisionAccept}},
+		{name: "single ip", key: "office", remoteIP: "192.0.2.7", want: Result{Decision: DecisionAccept}},
+		{name: "mapped ipv4", key: "office", remoteIP: "::ffff:10.1.2.3", want: Result{Decision: DecisionAccept}},
+		{name: "ipv6 in range", key: "office", remoteIP: "2001:db8::1", want: Result{Decision: DecisionAccept}},
+		{name: "ip not allowed", key: "office", remoteIP: "192.0.2.8", want: Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "address not allowed"}},
+		{name: "no ip", key: "office", want: Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "address not allowed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := p.Authorize(context.Background(), tc.key, tc.remoteIP, "", tc.app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Authorize = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilePolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(t, path, `{"keys": {"first": {"stream_name": "one"}}}`)
+	p, err := NewFilePolicy(path, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     bool
+		has     []string
+		missing []string
+	}{
+		{name: "replaces keys", content: `{"keys": {"second": {}}}`, has: []string{"second"}, missing: []string{"first"}},
+		{name: "bad json keeps keys", content: `{"keys": {"third": `, err: true, has: []string{"second"}, missing: []string{"third"}},
+		{name: "bad range keeps keys", content: `{"keys": {"third": {"allowed_ips": ["10.0.0.0/99"]}}}`, err: true, has: []string{"second"}, missing: []string{"third"}},
+		{name: "empty file", content: `{}`, missing: []string{"second"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writeKeyFile(t, path, tc.content)
+			if err := p.Reload(); (err != nil) != tc.err {
+				t.Fatalf("Reload error = %v, want error %v", err, tc.err)
+			}
+			for _, key := range tc.has {
+				if !p.Has(key) {
+					t.Errorf("key %s missing", key)
+				}
+			}
+			for _, key := range tc.missing {
+				if p.Has(key) {
+					t.Errorf("key %s still listed", key)
+				}
+			}
+		})
+	}
+}
+
+func TestFilePolicyWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, path, "keys:\n  first: {}\n")
+	p, err := NewFilePolicy(path, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Watch(10 * time.Millisecond)
+	defer p.Stop()
+
+	writeKeyFile(t, path, "keys:\n  second: {}\n")
+	// Modification times can be coarse; make the change visible.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Has("second") {
+		if time.Now().After(deadline) {
+			t.Fatal("key file change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Has("first") {
+		t.Fatal("removed key still listed")
+	}
+}
+
+// countingPolicy accepts every key and counts the notifications it gets.
+type countingPolicy struct {
+	authorized, streamEnds, videoInfos, archiveStatuses int
+}
+
+func (c *countingPolicy) Authorize(context.Context, string, string, string, string) (Result, error) {
+	c.authorized++
+	return Result{Decision: DecisionAccept}, nil
+}
+
+func (c *countingPolicy) Evaluate(context.Context, inspect.Result) Result {
+	return Result{Decision: DecisionAccept}
+}
+
+func (c *countingPolicy) NotifyStreamEnd(context.Context, string) error {
+	c.streamEnds++
+	return nil
+}
+
+func (c *countingPolicy) NotifyVideoInfo(context.Context, string, inspect.Result) error {
+	c.videoInfos++
+	return nil
+}
+
+func (c *countingPolicy) NotifyArchiveStatus(context.Context, string, bool) error {
+	c.archiveStatuses++
+	return nil
+}
+
+func TestCompositePolicyRouting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, path, "keys:\n  local:\n    app: live\n")
+	file, err := NewFilePolicy(path, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		key  string
+		want countingPolicy
+	}{
+		// The file decides for its own keys and the fallback never hears
+		// of them.
+		{key: "local"},
+		{key: "remote", want: countingPolicy{authorized: 1, streamEnds: 1, videoInfos: 1, archiveStatuses: 1}},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			fallback := &countingPolicy{}
+			p := &CompositePolicy{File: file, Fallback: fallback}
+			ctx := context.Background()
+			if result, err := p.Authorize(ctx, tc.key, "", "", "live"); err != nil || result.Decision != DecisionAccept {
+				t.Fatalf("Authorize = %+v, %v", result, err)
+			}
+			if err := p.NotifyVideoInfo(ctx, tc.key, inspect.Result{Width: 1280, Height: 720}); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.NotifyArchiveStatus(ctx, tc.key, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.NotifyStreamEnd(ctx, tc.key); err != nil {
+				t.Fatal(err)
+			}
+			if *fallback != tc.want {
+				t.Fatalf("fallback calls = %+v, want %+v", *fallback, tc.want)
+			}
+		})
+	}
+}
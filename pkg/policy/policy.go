@@ -9,9 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"tokuly-live-rtmp-server/pkg/inspect"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metrics"
 )
 
 type Decision int
@@ -29,6 +34,7 @@ const (
 	ReasonGOPTooLong        = "GOP_TOO_LONG"
 	ReasonNoKeyframeTimeout = "NO_KEYFRAME_TIMEOUT"
 	ReasonAudioUnsupported  = "AUDIO_UNSUPPORTED"
+	ReasonKeyExpired        = "KEY_EXPIRED"
 )
 
 type Result struct {
@@ -37,6 +43,14 @@ type Result struct {
 	Message  string
 	StreamName string
 	AllowRewind *bool
+	RelayTargets []string
+	// Ladder overrides the transcoding ladder when non-nil; an empty ladder
+	// disables transcoding for the stream.
+	Ladder []string
+	// OutputFormat overrides the HLS segment format ("fmp4" or "ts").
+	OutputFormat string
+	// Encrypt overrides whether the stream's HLS output is encrypted.
+	Encrypt *bool
 }
 
 type Policy interface {
@@ -47,20 +61,47 @@ type Policy interface {
 	NotifyArchiveStatus(ctx context.Context, streamKey string, status bool) error
 }
 
+// PlaybackAuthorizer is an optional extension of Policy for checking viewer
+// tokens on playback endpoints.
+type PlaybackAuthorizer interface {
+	AuthorizePlayback(ctx context.Context, streamName, token, remoteIP string) (Result, error)
+}
+
+// AllowPlayback checks a viewer's token with pol when it is a
+// PlaybackAuthorizer; other policies allow all playback.
+func AllowPlayback(ctx context.Context, pol Policy, streamName, token, remoteIP string) (bool, error) {
+	authorizer, ok := pol.(PlaybackAuthorizer)
+	if !ok {
+		return true, nil
+	}
+	result, err := authorizer.AuthorizePlayback(ctx, streamName, token, remoteIP)
+	if err != nil {
+		return false, err
+	}
+	return result.Decision != DecisionReject, nil
+}
+
 type HTTPPolicy struct {
 	AuthURL       string
+	PlaybackAuthURL string
 	StreamEndURL  string
+	// VideoInfoURL and ArchiveStatusURL receive the inspected video info
+	// and archive outcomes. An empty URL turns its call off.
+	VideoInfoURL     string
+	ArchiveStatusURL string
 	APIKey        string
 	Version       string
 	Timeout       time.Duration
 	HTTPUserAgent string
 	DebugSkip     bool
+	// Encoder overrides the encoding of every request; nil keeps the
+	// encoding the Tokuly API expects for each call.
+	Encoder RequestEncoder
+	// FieldNames renames request fields, keyed by their Field* name.
+	FieldNames map[string]string
 	Config        Config
 }
 
-const videoInfoURL = "https://api.tokuly.com/live/stream/videoinfo"
-const archiveStatusURL = "https://api.tokuly.com/live/stream/archive/status"
-
 type Config struct {
 	MaxWidth             int
 	MaxHeight            int
@@ -69,8 +110,8 @@ type Config struct {
 	AllowNoAudio         bool
 	OnGOPTooLong         string
 	RequireAACLC         bool
-	RejectIfVideoNotH264 bool
-	RejectIfAudioNotAAC  bool
+	AllowedVideoCodecs   []string
+	AllowedAudioCodecs   []string
 }
 
 func (p *HTTPPolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAgent, app string) (Result, error) {
@@ -81,24 +122,10 @@ func (p *HTTPPolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAge
 	if err != nil {
 		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "auth url invalid"}, err
 	}
-	form := url.Values{}
-	form.Set("key", streamKey)
-	if p.APIKey != "" {
-		form.Set("APIkey", p.APIKey)
-	}
-	if p.Version != "" {
-		form.Set("version", p.Version)
-	}
-	bodyString := form.Encode()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), bytes.NewBufferString(bodyString))
+	req, err := p.newRequest(ctx, metrics.CallAuthorize, reqURL.String(), Fields{FieldStreamKey: streamKey})
 	if err != nil {
 		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "auth request failed"}, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if p.HTTPUserAgent != "" {
-		req.Header.Set("User-Agent", p.HTTPUserAgent)
-	}
 	if remoteIP != "" {
 		req.Header.Set("X-Forwarded-For", remoteIP)
 	}
@@ -109,8 +136,7 @@ func (p *HTTPPolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAge
 		req.Header.Set("X-RTMP-App", app)
 	}
 
-	client := &http.Client{Timeout: p.Timeout}
-	resp, err := client.Do(req)
+	resp, err := p.do(metrics.CallAuthorize, req)
 	if err != nil {
 		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "auth request error"}, err
 	}
@@ -125,30 +151,60 @@ func (p *HTTPPolicy) Authorize(ctx context.Context, streamKey, remoteIP, userAge
 	if err != nil {
 		return Result{Decision: DecisionAccept, Message: "auth response parse error"}, nil
 	}
-	return Result{Decision: DecisionAccept, StreamName: authResp.StreamName, AllowRewind: authResp.AllowRewind}, nil
+	return Result{Decision: DecisionAccept, StreamName: authResp.StreamName, AllowRewind: authResp.AllowRewind, RelayTargets: authResp.RelayTargets, Ladder: authResp.Ladder, OutputFormat: authResp.OutputFormat, Encrypt: authResp.Encrypt}, nil
+}
+
+func (p *HTTPPolicy) AuthorizePlayback(ctx context.Context, streamName, token, remoteIP string) (Result, error) {
+	if p.DebugSkip || p.PlaybackAuthURL == "" {
+		return Result{Decision: DecisionAccept}, nil
+	}
+	if token == "" {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "token required"}, nil
+	}
+	req, err := p.newRequest(ctx, metrics.CallAuthorizePlayback, p.PlaybackAuthURL, Fields{FieldStreamName: streamName, FieldToken: token})
+	if err != nil {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "playback auth request failed"}, err
+	}
+	if remoteIP != "" {
+		req.Header.Set("X-Forwarded-For", remoteIP)
+	}
+	resp, err := p.do(metrics.CallAuthorizePlayback, req)
+	if err != nil {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: "playback auth request error"}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Result{Decision: DecisionReject, Reason: ReasonKeyInvalid, Message: fmt.Sprintf("playback auth status %d", resp.StatusCode)}, nil
+	}
+	return Result{Decision: DecisionAccept, StreamName: streamName}, nil
 }
 
 func (p *HTTPPolicy) Evaluate(ctx context.Context, result inspect.Result) Result {
-	if p.Config.RejectIfVideoNotH264 && result.VideoCodec != "H264" {
+	return p.Config.Evaluate(result)
+}
+
+// Evaluate checks an inspected stream against the limits.
+func (c Config) Evaluate(result inspect.Result) Result {
+	if len(c.AllowedVideoCodecs) > 0 && !containsCodec(c.AllowedVideoCodecs, result.VideoCodec) {
 		return Result{Decision: DecisionReject, Reason: ReasonCodecUnsupported, Message: "video codec not supported"}
 	}
 	if result.Width > 0 && result.Height > 0 {
-		if result.Width > p.Config.MaxWidth || result.Height > p.Config.MaxHeight {
+		if result.Width > c.MaxWidth || result.Height > c.MaxHeight {
 			return Result{Decision: DecisionReject, Reason: ReasonResolutionTooBig, Message: "resolution too large"}
 		}
 	}
 	if !result.KeyframeReceived {
 		return Result{Decision: DecisionReject, Reason: ReasonNoKeyframeTimeout, Message: "first keyframe timeout"}
 	}
-	if result.AudioCodec == "" && !p.Config.AllowNoAudio {
+	if result.AudioCodec == "" && !c.AllowNoAudio {
 		return Result{Decision: DecisionReject, Reason: ReasonAudioUnsupported, Message: "audio required"}
 	}
-	if p.Config.RejectIfAudioNotAAC && result.AudioCodec != "" && result.AudioCodec != "AAC" {
+	if result.AudioCodec != "" && len(c.AllowedAudioCodecs) > 0 && !containsCodec(c.AllowedAudioCodecs, result.AudioCodec) {
 		return Result{Decision: DecisionReject, Reason: ReasonAudioUnsupported, Message: "audio codec not supported"}
 	}
-	if p.Config.MaxGOPSeconds > 0 && result.GOPSeconds > 0 {
-		if result.GOPSeconds > p.Config.MaxGOPSeconds {
-			if p.Config.OnGOPTooLong == "reject" {
+	if c.MaxGOPSeconds > 0 && result.GOPSeconds > 0 {
+		if result.GOPSeconds > c.MaxGOPSeconds {
+			if c.OnGOPTooLong == "reject" {
 				return Result{Decision: DecisionReject, Reason: ReasonGOPTooLong, Message: "gop too long"}
 			}
 			return Result{Decision: DecisionDegraded, Reason: ReasonGOPTooLong, Message: "gop too long"}
@@ -165,26 +221,11 @@ func (p *HTTPPolicy) NotifyStreamEnd(ctx context.Context, streamKey string) erro
 	if err != nil {
 		return err
 	}
-	form := url.Values{}
-	form.Set("key", streamKey)
-	if p.APIKey != "" {
-		form.Set("APIkey", p.APIKey)
-	}
-	if p.Version != "" {
-		form.Set("version", p.Version)
-	}
-	bodyString := form.Encode()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), bytes.NewBufferString(bodyString))
+	req, err := p.newRequest(ctx, metrics.CallStreamEnd, reqURL.String(), Fields{FieldStreamKey: streamKey})
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if p.HTTPUserAgent != "" {
-		req.Header.Set("User-Agent", p.HTTPUserAgent)
-	}
-	client := &http.Client{Timeout: p.Timeout}
-	resp, err := client.Do(req)
+	resp, err := p.do(metrics.CallStreamEnd, req)
 	if err != nil {
 		return err
 	}
@@ -193,30 +234,19 @@ func (p *HTTPPolicy) NotifyStreamEnd(ctx context.Context, streamKey string) erro
 }
 
 func (p *HTTPPolicy) NotifyVideoInfo(ctx context.Context, streamKey string, result inspect.Result) error {
-	if p.DebugSkip || p.APIKey == "" {
+	if p.DebugSkip || p.VideoInfoURL == "" {
 		return nil
 	}
-	payload := map[string]string{
-		"name":      streamKey,
-		"size_w":    strconv.Itoa(result.Width),
-		"size_h":    strconv.Itoa(result.Height),
-		"video_fps": formatFPS(result.VideoFPS),
-		"key":       p.APIKey,
-	}
-	body, err := json.Marshal(payload)
+	req, err := p.newRequest(ctx, metrics.CallVideoInfo, p.VideoInfoURL, Fields{
+		FieldStreamName: streamKey,
+		FieldWidth:      strconv.Itoa(result.Width),
+		FieldHeight:     strconv.Itoa(result.Height),
+		FieldFPS:        formatFPS(result.VideoFPS),
+	})
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, videoInfoURL, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	if p.HTTPUserAgent != "" {
-		req.Header.Set("User-Agent", p.HTTPUserAgent)
-	}
-	client := &http.Client{Timeout: p.Timeout}
-	resp, err := client.Do(req)
+	resp, err := p.do(metrics.CallVideoInfo, req)
 	if err != nil {
 		return err
 	}
@@ -228,28 +258,14 @@ func (p *HTTPPolicy) NotifyVideoInfo(ctx context.Context, streamKey string, resu
 }
 
 func (p *HTTPPolicy) NotifyArchiveStatus(ctx context.Context, streamKey string, status bool) error {
-	if p.DebugSkip || p.APIKey == "" {
+	if p.DebugSkip || p.ArchiveStatusURL == "" {
 		return nil
 	}
-	payload := map[string]interface{}{
-		"name":   streamKey,
-		"status": status,
-		"key":    p.APIKey,
-	}
-	body, err := json.Marshal(payload)
+	req, err := p.newRequest(ctx, metrics.CallArchiveStatus, p.ArchiveStatusURL, Fields{FieldStreamName: streamKey, FieldStatus: status})
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, archiveStatusURL, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	if p.HTTPUserAgent != "" {
-		req.Header.Set("User-Agent", p.HTTPUserAgent)
-	}
-	client := &http.Client{Timeout: p.Timeout}
-	resp, err := client.Do(req)
+	resp, err := p.do(metrics.CallArchiveStatus, req)
 	if err != nil {
 		return err
 	}
@@ -260,6 +276,38 @@ func (p *HTTPPolicy) NotifyArchiveStatus(ctx context.Context, streamKey string,
 	return nil
 }
 
+// do sends a request to the API and records its latency. Transport errors
+// and 5xx responses count as failures; other statuses are answers. It logs
+// with the logger in the request context, so calls made for a session carry
+// its fields.
+func (p *HTTPPolicy) do(call string, req *http.Request) (*http.Response, error) {
+	client := &http.Client{Timeout: p.Timeout}
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	failed := err != nil || resp.StatusCode >= 500
+	metrics.ObservePolicyCall(call, elapsed.Seconds(), failed)
+	entry := logging.FromContext(req.Context()).WithFields(logrus.Fields{"call": call, "duration_ms": elapsed.Milliseconds()})
+	switch {
+	case err != nil:
+		entry.WithError(err).Warn("policy request failed")
+	case failed:
+		entry.WithField("status", resp.StatusCode).Warn("policy request failed")
+	default:
+		entry.WithField("status", resp.StatusCode).Debug("policy request")
+	}
+	return resp, err
+}
+
+func containsCodec(list []string, codec string) bool {
+	for _, allowed := range list {
+		if strings.EqualFold(strings.TrimSpace(allowed), codec) {
+			return true
+		}
+	}
+	return false
+}
+
 func formatFPS(value float64) string {
 	if value <= 0 {
 		return "0"
@@ -268,8 +316,12 @@ func formatFPS(value float64) string {
 }
 
 type authResponse struct {
-	StreamName  string
-	AllowRewind *bool
+	StreamName   string
+	AllowRewind  *bool
+	RelayTargets []string
+	Ladder       []string
+	OutputFormat string
+	Encrypt      *bool
 }
 
 func parseAuthResponse(data []byte) (authResponse, error) {
@@ -291,9 +343,44 @@ func parseAuthResponse(data []byte) (authResponse, error) {
 			resp.AllowRewind = &allow
 		}
 	}
+	if value, ok := raw["relay_targets"]; ok {
+		resp.RelayTargets = parseStringList(value)
+	}
+	if value, ok := raw["ladder"]; ok && value != nil {
+		resp.Ladder = append([]string{}, parseStringList(value)...)
+	}
+	if value, ok := raw["output_format"]; ok {
+		if format, ok := value.(string); ok {
+			resp.OutputFormat = strings.ToLower(strings.TrimSpace(format))
+		}
+	}
+	if value, ok := raw["encrypt"]; ok {
+		if encrypt, ok := parseBoolValue(value); ok {
+			resp.Encrypt = &encrypt
+		}
+	}
 	return resp, nil
 }
 
+func parseStringList(value interface{}) []string {
+	var out []string
+	switch v := value.(type) {
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+				out = append(out, strings.TrimSpace(s))
+			}
+		}
+	}
+	return out
+}
+
 func parseBoolValue(value interface{}) (bool, bool) {
 	switch v := value.(type) {
 	case bool:
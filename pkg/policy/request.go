@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"tokuly-live-rtmp-server/pkg/metrics"
+)
+
+// Request encodings accepted by NewEncoder.
+const (
+	EncodingForm = "form"
+	EncodingJSON = "json"
+)
+
+// Logical names of the fields sent to the API. HTTPPolicy.FieldNames maps
+// them to the names an API expects.
+const (
+	FieldStreamKey  = "stream_key"
+	FieldStreamName = "stream_name"
+	FieldAPIKey     = "api_key"
+	FieldVersion    = "version"
+	FieldToken      = "token"
+	FieldWidth      = "width"
+	FieldHeight     = "height"
+	FieldFPS        = "fps"
+	FieldStatus     = "status"
+)
+
+// Fields are the values of an API request keyed by field name.
+type Fields map[string]interface{}
+
+// RequestEncoder encodes the fields of an API request as its body.
+type RequestEncoder interface {
+	ContentType() string
+	Encode(fields Fields) ([]byte, error)
+}
+
+// FormEncoder sends fields as application/x-www-form-urlencoded.
+type FormEncoder struct{}
+
+func (FormEncoder) ContentType() string {
+	return "application/x-www-form-urlencoded"
+}
+
+func (FormEncoder) Encode(fields Fields) ([]byte, error) {
+	form := url.Values{}
+	for name, value := range fields {
+		form.Set(name, fmt.Sprint(value))
+	}
+	return []byte(form.Encode()), nil
+}
+
+// JSONEncoder sends fields as a JSON object.
+type JSONEncoder struct{}
+
+func (JSONEncoder) ContentType() string {
+	return "application/json"
+}
+
+func (JSONEncoder) Encode(fields Fields) ([]byte, error) {
+	return json.Marshal(map[string]interface{}(fields))
+}
+
+// NewEncoder returns the encoder of an encoding name. An empty name returns
+// nil, which keeps the encoding each call has always used.
+func NewEncoder(encoding string) (RequestEncoder, error) {
+	switch encoding {
+	case "":
+		return nil, nil
+	case EncodingForm:
+		return FormEncoder{}, nil
+	case EncodingJSON:
+		return JSONEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown request encoding %q", encoding)
+	}
+}
+
+// apiCall is how the Tokuly API expects a call: its encoding, the names of
+// its fields and whether it takes the version. FieldNames and Encoder
+// override the first two.
+type apiCall struct {
+	encoder RequestEncoder
+	names   map[string]string
+	version bool
+}
+
+var apiCalls = map[string]apiCall{
+	metrics.CallAuthorize: {
+		encoder: FormEncoder{},
+		names:   map[string]string{FieldStreamKey: "key", FieldAPIKey: "APIkey"},
+		version: true,
+	},
+	metrics.CallStreamEnd: {
+		encoder: FormEncoder{},
+		names:   map[string]string{FieldStreamKey: "key", FieldAPIKey: "APIkey"},
+		version: true,
+	},
+	metrics.CallAuthorizePlayback: {
+		encoder: FormEncoder{},
+		names:   map[string]string{FieldStreamName: "name", FieldAPIKey: "APIkey"},
+		version: true,
+	},
+	metrics.CallVideoInfo: {
+		encoder: JSONEncoder{},
+		names: map[string]string{
+			FieldStreamName: "name",
+			FieldWidth:      "size_w",
+			FieldHeight:     "size_h",
+			FieldFPS:        "video_fps",
+			FieldAPIKey:     "key",
+		},
+	},
+	metrics.CallArchiveStatus: {
+		encoder: JSONEncoder{},
+		names:   map[string]string{FieldStreamName: "name", FieldAPIKey: "key"},
+	},
+}
+
+// newRequest builds a POST of fields for call. The API key and version are
+// added when configured.
+func (p *HTTPPolicy) newRequest(ctx context.Context, call, rawURL string, fields Fields) (*http.Request, error) {
+	spec := apiCalls[call]
+	if p.APIKey != "" {
+		fields[FieldAPIKey] = p.APIKey
+	}
+	if p.Version != "" && spec.version {
+		fields[FieldVersion] = p.Version
+	}
+	encoder := p.Encoder
+	if encoder == nil {
+		encoder = spec.encoder
+	}
+	wire := make(Fields, len(fields))
+	for name, value := range fields {
+		wireName := p.FieldNames[name]
+		if wireName == "" {
+			wireName = spec.names[name]
+		}
+		if wireName == "" {
+			wireName = name
+		}
+		wire[wireName] = value
+	}
+	body, err := encoder.Encode(wire)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", encoder.ContentType())
+	if p.HTTPUserAgent != "" {
+		req.Header.Set("User-Agent", p.HTTPUserAgent)
+	}
+	return req, nil
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"tokuly-live-rtmp-server/pkg/inspect"
+)
+
+type recordedRequest struct {
+	contentType string
+	body        []byte
+}
+
+// recordingAPI answers every call with 200 and records the requests by path.
+func recordingAPI(t *testing.T) (*httptest.Server, func(path string) recordedRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := make(map[string]recordedRequest)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+		}
+		mu.Lock()
+		requests[r.URL.Path] = recordedRequest{contentType: r.Header.Get("Content-Type"), body: body}
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, func(path string) recordedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		req, ok := requests[path]
+		if !ok {
+			t.Fatalf("no request to %s", path)
+		}
+		return req
+	}
+}
+
+// decodeBody returns the fields of a request body as strings, whatever its
+// encoding.
+func decodeBody(t *testing.T, req recordedRequest) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	switch req.contentType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(req.body))
+		if err != nil {
+			t.Fatalf("parse form %q: %v", req.body, err)
+		}
+		for name := range values {
+			fields[name] = values.Get(name)
+		}
+	case "application/json":
+		var values map[string]interface{}
+		if err := json.Unmarshal(req.body, &values); err != nil {
+			t.Fatalf("parse json %q: %v", req.body, err)
+		}
+		for name, value := range values {
+			raw, _ := json.Marshal(value)
+			if s, ok := value.(string); ok {
+				fields[name] = s
+			} else {
+				fields[name] = string(raw)
+			}
+		}
+	default:
+		t.Fatalf("unexpected content type %q", req.contentType)
+	}
+	return fields
+}
+
+func TestHTTPPolicyRequestEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		encoding    string
+		contentType string
+	}{
+		{encoding: EncodingForm, contentType: "application/x-www-form-urlencoded"},
+		{encoding: EncodingJSON, contentType: "application/json"},
+	} {
+		t.Run(tc.encoding, func(t *testing.T) {
+			server, request := recordingAPI(t)
+			encoder, err := NewEncoder(tc.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &HTTPPolicy{
+				AuthURL:          server.URL + "/auth",
+				VideoInfoURL:     server.URL + "/video",
+				ArchiveStatusURL: server.URL + "/archive",
+				APIKey:           "secret",
+				Version:          "2",
+				Encoder:          encoder,
+				FieldNames: map[string]string{
+					FieldStreamKey:  "publish_key",
+					FieldStreamName: "channel",
+					FieldAPIKey:     "api_token",
+					FieldWidth:      "w",
+				},
+			}
+			ctx := context.Background()
+
+			result, err := p.Authorize(ctx, "key-1", "10.0.0.1", "OBS", "live")
+			if err != nil || result.Decision != DecisionAccept {
+				t.Fatalf("Authorize = %+v, %v", result, err)
+			}
+			if err := p.NotifyVideoInfo(ctx, "studio", inspect.Result{Width: 1280, Height: 720, VideoFPS: 29.97}); err != nil {
+				t.Fatalf("NotifyVideoInfo: %v", err)
+			}
+			if err := p.NotifyArchiveStatus(ctx, "studio", true); err != nil {
+				t.Fatalf("NotifyArchiveStatus: %v", err)
+			}
+
+			for _, want := range []struct {
+				path   string
+				fields map[string]string
+			}{
+				{"/auth", map[string]string{"publish_key": "key-1", "api_token": "secret", "version": "2"}},
+				// Fields without a FieldNames entry keep the API's names.
+				{"/video", map[string]string{"channel": "studio", "w": "1280", "size_h": "720", "video_fps": "29.97", "api_token": "secret"}},
+				{"/archive", map[string]string{"channel": "studio", "status": "true", "api_token": "secret"}},
+			} {
+				req := request(want.path)
+				if req.contentType != tc.contentType {
+					t.Errorf("%s content type = %q, want %q", want.path, req.contentType, tc.contentType)
+				}
+				if got := decodeBody(t, req); !reflect.DeepEqual(got, want.fields) {
+					t.Errorf("%s body = %v, want %v", want.path, got, want.fields)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPPolicyDefaultEncoding(t *testing.T) {
+	server, request := recordingAPI(t)
+	p := &HTTPPolicy{AuthURL: server.URL + "/auth", VideoInfoURL: server.URL + "/video", APIKey: "secret"}
+	ctx := context.Background()
+	if _, err := p.Authorize(ctx, "key-1", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.NotifyVideoInfo(ctx, "studio", inspect.Result{Width: 640, Height: 360}); err != nil {
+		t.Fatal(err)
+	}
+	if got := request("/auth").contentType; got != "application/x-www-form-urlencoded" {
+		t.Errorf("auth content type = %q", got)
+	}
+	if got := decodeBody(t, request("/auth")); !reflect.DeepEqual(got, map[string]string{"key": "key-1", "APIkey": "secret"}) {
+		t.Errorf("auth body = %v", got)
+	}
+	if got := request("/video").contentType; got != "application/json" {
+		t.Errorf("video content type = %q", got)
+	}
+}
@@ -0,0 +1,264 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/yutopp/go-flv/tag"
+
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+const (
+	subscriberQueueSize = 1024
+	maxCachedGOPTags    = 4096
+)
+
+type MediaTag struct {
+	Type      tag.TagType
+	Timestamp uint32
+	Payload   []byte
+	Header    bool
+	Keyframe  bool
+	// Timed marks script data that belongs to its position in the stream,
+	// such as onCuePoint and onTextData, as opposed to onMetaData.
+	Timed bool
+}
+
+// Broadcaster fans out the publisher's FLV tags to live subscribers. It keeps
+// the latest sequence headers, metadata and the current GOP so a subscriber
+// can start decoding immediately.
+type Broadcaster struct {
+	mu          sync.Mutex
+	started     bool
+	closed      bool
+	metadata    *MediaTag
+	videoHeader *MediaTag
+	audioHeader *MediaTag
+	gop         []*MediaTag
+	gopValid    bool
+	hasAudio    bool
+	hasVideo    bool
+	subs        map[*Subscriber]struct{}
+}
+
+type Subscriber struct {
+	b       *Broadcaster
+	ch      chan *MediaTag
+	waitKey bool
+	closed  bool
+	ended   bool
+	// headers holds the metadata, video and audio header last queued to
+	// the subscriber, so a resume at a keyframe only sends what changed.
+	headers [3]*MediaTag
+}
+
+// headerSlot returns the index of t in Subscriber.headers, or -1 for media.
+func headerSlot(t *MediaTag) int {
+	switch {
+	case t.Type == tag.TagTypeScriptData && !t.Timed:
+		return 0
+	case t.Type == tag.TagTypeVideo && t.Header:
+		return 1
+	case t.Type == tag.TagTypeAudio && t.Header:
+		return 2
+	default:
+		return -1
+	}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[*Subscriber]struct{})}
+}
+
+// Start opens the broadcaster to subscribers once the stream is accepted.
+func (b *Broadcaster) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = true
+}
+
+func (b *Broadcaster) Publish(t *MediaTag) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.hasAudio = b.hasAudio || t.Type == tag.TagTypeAudio
+	b.hasVideo = b.hasVideo || t.Type == tag.TagTypeVideo
+	switch {
+	case t.Type == tag.TagTypeScriptData && !t.Timed:
+		b.metadata = t
+	case t.Type == tag.TagTypeVideo && t.Header:
+		b.videoHeader = t
+	case t.Type == tag.TagTypeAudio && t.Header:
+		b.audioHeader = t
+	case t.Type == tag.TagTypeVideo && t.Keyframe:
+		b.gop = append(b.gop[:0], t)
+		b.gopValid = true
+	case b.gopValid:
+		if len(b.gop) >= maxCachedGOPTags {
+			b.gop = nil
+			b.gopValid = false
+		} else {
+			b.gop = append(b.gop, t)
+		}
+	}
+	for sub := range b.subs {
+		b.deliverLocked(sub, t)
+	}
+}
+
+func (b *Broadcaster) deliverLocked(sub *Subscriber, t *MediaTag) {
+	if sub.waitKey {
+		if t.Type != tag.TagTypeVideo || !t.Keyframe {
+			return
+		}
+		if !b.sendHeadersLocked(sub) {
+			return
+		}
+		sub.waitKey = false
+	}
+	select {
+	case sub.ch <- t:
+		if slot := headerSlot(t); slot >= 0 {
+			sub.headers[slot] = t
+		}
+	default:
+		// Queue is full: drop the rest of this GOP and resume at the next
+		// keyframe instead of blocking the publisher.
+		sub.waitKey = true
+	}
+}
+
+func (b *Broadcaster) sendHeadersLocked(sub *Subscriber) bool {
+	for slot, h := range [...]*MediaTag{b.metadata, b.videoHeader, b.audioHeader} {
+		if h == nil || sub.headers[slot] == h {
+			continue
+		}
+		select {
+		case sub.ch <- h:
+			sub.headers[slot] = h
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Broadcaster) Subscribe() (*Subscriber, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("stream ended")
+	}
+	if !b.started {
+		return nil, fmt.Errorf("stream not ready")
+	}
+	sub := &Subscriber{
+		b:  b,
+		ch: make(chan *MediaTag, subscriberQueueSize),
+	}
+	b.sendHeadersLocked(sub)
+	if b.gopValid && len(b.gop) < subscriberQueueSize-3 {
+		for _, t := range b.gop {
+			sub.ch <- t
+		}
+	} else {
+		sub.waitKey = true
+	}
+	b.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		sub.ended = true
+		sub.closed = true
+		close(sub.ch)
+	}
+	b.subs = nil
+	b.gop = nil
+}
+
+// Tracks reports which media types the publisher has sent so far.
+func (b *Broadcaster) Tracks() (hasAudio, hasVideo bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hasAudio, b.hasVideo
+}
+
+func (b *Broadcaster) SubscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func (s *Subscriber) C() <-chan *MediaTag {
+	return s.ch
+}
+
+// Ended reports whether the subscription finished because the publisher went
+// away, as opposed to the subscriber closing it.
+func (s *Subscriber) Ended() bool {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.ended
+}
+
+func (s *Subscriber) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.b.subs, s)
+	close(s.ch)
+}
+
+func NewVideoTag(timestamp uint32, payload []byte) *MediaTag {
+	t := &MediaTag{Type: tag.TagTypeVideo, Timestamp: timestamp, Payload: payload}
+	if len(payload) == 0 {
+		return t
+	}
+	if util.IsExVideoHeader(payload[0]) {
+		t.Keyframe = (payload[0]>>4)&0x07 == util.ExVideoFrameKey
+		t.Header = util.ExVideoPacketType(payload[0]&0x0f) == util.ExVideoPacketSequenceStart
+		return t
+	}
+	t.Keyframe = tag.FrameType(payload[0]>>4) == tag.FrameTypeKeyFrame
+	t.Header = tag.CodecID(payload[0]&0x0f) == tag.CodecIDAVC && len(payload) > 1 && tag.AVCPacketType(payload[1]) == tag.AVCPacketTypeSequenceHeader
+	return t
+}
+
+func NewAudioTag(timestamp uint32, payload []byte) *MediaTag {
+	t := &MediaTag{Type: tag.TagTypeAudio, Timestamp: timestamp, Payload: payload}
+	if len(payload) == 0 {
+		return t
+	}
+	if util.IsExAudioHeader(payload[0]) {
+		t.Header = util.ExAudioPacketType(payload[0]&0x0f) == util.ExAudioPacketSequenceStart
+		return t
+	}
+	t.Header = tag.SoundFormat(payload[0]>>4) == tag.SoundFormatAAC && len(payload) > 1 && tag.AACPacketType(payload[1]) == tag.AACPacketTypeSequenceHeader
+	return t
+}
+
+func NewMetadataTag(timestamp uint32, payload []byte) *MediaTag {
+	return &MediaTag{Type: tag.TagTypeScriptData, Timestamp: timestamp, Payload: payload}
+}
+
+// NewScriptTag returns a script data tag, timed unless it is onMetaData.
+func NewScriptTag(timestamp uint32, payload []byte) *MediaTag {
+	t := NewMetadataTag(timestamp, payload)
+	name, _, ok := splitScriptName(payload)
+	t.Timed = ok && name != "onMetaData"
+	return t
+}
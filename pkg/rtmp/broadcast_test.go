@@ -0,0 +1,48 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func scriptPayload(name string) []byte {
+	payload := []byte{0x02, 0x00, byte(len(name))}
+	return append(append(payload, name...), 0x05)
+}
+
+func TestBroadcasterCachesOnlyOnMetaData(t *testing.T) {
+	meta := NewScriptTag(0, scriptPayload("onMetaData"))
+	cue := NewScriptTag(80, scriptPayload("onCuePoint"))
+	if meta.Timed || !cue.Timed {
+		t.Fatalf("timed = %v/%v, want false/true", meta.Timed, cue.Timed)
+	}
+
+	b := NewBroadcaster()
+	b.Start()
+	b.Publish(meta)
+	b.Publish(NewVideoTag(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00}))
+	key := NewVideoTag(40, []byte{0x17, 0x01, 0x00, 0x00, 0x00})
+	b.Publish(key)
+	b.Publish(cue)
+
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	var got [][]byte
+	for len(sub.C()) > 0 {
+		got = append(got, (<-sub.C()).Payload)
+	}
+	// The cue point is replayed with the GOP it belongs to, not as the
+	// stream's metadata.
+	want := [][]byte{meta.Payload, {0x17, 0x00, 0x00, 0x00, 0x00}, key.Payload, cue.Payload}
+	if len(got) != len(want) {
+		t.Fatalf("subscriber got %d tags, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("tag %d = %x, want %x", i, got[i], want[i])
+		}
+	}
+}
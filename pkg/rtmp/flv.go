@@ -0,0 +1,86 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/yutopp/go-flv/tag"
+)
+
+const (
+	flvHeaderSize    = 9
+	flvTagHeaderSize = 11
+)
+
+// FLVHeader returns the FLV file header followed by PreviousTagSize0.
+func FLVHeader(hasAudio, hasVideo bool) []byte {
+	buf := make([]byte, flvHeaderSize+4)
+	copy(buf, "FLV")
+	buf[3] = 1
+	if hasAudio {
+		buf[4] |= 0x04
+	}
+	if hasVideo {
+		buf[4] |= 0x01
+	}
+	binary.BigEndian.PutUint32(buf[5:9], flvHeaderSize)
+	return buf
+}
+
+// EncodeFLVTag serializes one FLV tag including its trailing PreviousTagSize.
+func EncodeFLVTag(t *MediaTag, timestamp uint32) []byte {
+	size := len(t.Payload)
+	buf := make([]byte, flvTagHeaderSize+size+4)
+	buf[0] = byte(t.Type)
+	buf[1] = byte(size >> 16)
+	buf[2] = byte(size >> 8)
+	buf[3] = byte(size)
+	buf[4] = byte(timestamp >> 16)
+	buf[5] = byte(timestamp >> 8)
+	buf[6] = byte(timestamp)
+	buf[7] = byte(timestamp >> 24)
+	copy(buf[flvTagHeaderSize:], t.Payload)
+	binary.BigEndian.PutUint32(buf[flvTagHeaderSize+size:], uint32(flvTagHeaderSize+size))
+	return buf
+}
+
+// readFLVHeader consumes the FLV file header and PreviousTagSize0.
+func readFLVHeader(r io.Reader) error {
+	buf := make([]byte, flvHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if string(buf[:3]) != "FLV" {
+		return fmt.Errorf("not an flv stream")
+	}
+	skip := int64(binary.BigEndian.Uint32(buf[5:9])) - flvHeaderSize + 4
+	if skip < 4 {
+		return fmt.Errorf("invalid flv header size")
+	}
+	_, err := io.CopyN(io.Discard, r, skip)
+	return err
+}
+
+// readFLVTag reads one FLV tag and its trailing PreviousTagSize.
+func readFLVTag(r io.Reader) (*MediaTag, error) {
+	head := make([]byte, flvTagHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	size := int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+	timestamp := uint32(head[7])<<24 | uint32(head[4])<<16 | uint32(head[5])<<8 | uint32(head[6])
+	payload := make([]byte, size+4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	payload = payload[:size]
+	switch tag.TagType(head[0]) {
+	case tag.TagTypeAudio:
+		return NewAudioTag(timestamp, payload), nil
+	case tag.TagTypeVideo:
+		return NewVideoTag(timestamp, payload), nil
+	default:
+		return NewScriptTag(timestamp, payload), nil
+	}
+}
@@ -5,18 +5,22 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/url"
 	"path/filepath"
 	"strings"
 
 	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/sirupsen/logrus"
 	"github.com/yutopp/go-flv/tag"
 	"github.com/yutopp/go-rtmp"
 	rtmpmsg "github.com/yutopp/go-rtmp/message"
 
 	"tokuly-live-rtmp-server/pkg/archive"
 	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/events"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metadata"
 	"tokuly-live-rtmp-server/pkg/policy"
 	"tokuly-live-rtmp-server/pkg/storage"
 	"tokuly-live-rtmp-server/pkg/util"
@@ -30,23 +34,34 @@ type Handler struct {
 	storage *storage.Storage
 	manager *StreamManager
 	archiveManager *archive.Manager
+	events  *events.Dispatcher
 
-	conn      net.Conn
+	conn      *playConn
+	log       *logrus.Entry
 	app       string
+	tcURL     string
 	userAgent string
 	remoteIP  string
 	streamKey string
 	streamName string
 	session   *Session
+
+	audioConfig util.AudioConfig
+
+	rtmpConn *rtmp.Conn
+	player   *Subscriber
+	playName string
 }
 
-func NewHandler(cfg config.Config, pol policy.Policy, storage *storage.Storage, manager *StreamManager, archiveManager *archive.Manager, conn net.Conn) *Handler {
+func NewHandler(cfg config.Config, pol policy.Policy, storage *storage.Storage, manager *StreamManager, archiveManager *archive.Manager, dispatcher *events.Dispatcher, conn net.Conn, log *logrus.Entry) *Handler {
 	remoteIP := ""
+	var pc *playConn
 	if conn != nil {
 		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 		if err == nil {
 			remoteIP = host
 		}
+		pc = &playConn{Conn: conn}
 	}
 	return &Handler{
 		cfg:     cfg,
@@ -54,17 +69,31 @@ func NewHandler(cfg config.Config, pol policy.Policy, storage *storage.Storage,
 		storage: storage,
 		manager: manager,
 		archiveManager: archiveManager,
-		conn:    conn,
+		events:  dispatcher,
+		conn:    pc,
+		log:     log.WithField("remote_ip", remoteIP),
 		remoteIP: remoteIP,
 	}
 }
 
+// Conn is the connection the RTMP server should serve h on. It is the conn
+// given to NewHandler, watched so players start after NetStream.Play.Start.
+func (h *Handler) Conn() io.ReadWriteCloser {
+	if h.conn == nil {
+		return nil
+	}
+	return h.conn
+}
+
 func (h *Handler) OnServe(conn *rtmp.Conn) {
+	h.rtmpConn = conn
 }
 
 func (h *Handler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) error {
 	h.app = cmd.Command.App
+	h.tcURL = cmd.Command.TCURL
 	h.userAgent = cmd.Command.FlashVer
+	h.log = h.log.WithField(logging.FieldApp, h.app)
 	if err := h.validateApp(); err != nil {
 		return err
 	}
@@ -82,9 +111,20 @@ func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpms
 	if h.session != nil {
 		return fmt.Errorf("already publishing")
 	}
+	if h.player != nil {
+		return fmt.Errorf("already playing")
+	}
 
-	authResult, err := h.policy.Authorize(context.Background(), streamKey, h.remoteIP, h.userAgent, h.app)
+	sessionID := newSessionID()
+	authLog := h.log.WithFields(logrus.Fields{logging.FieldSessionID: sessionID, logging.FieldStreamKeyHash: maskStreamKey(streamKey)})
+	authResult, err := h.policy.Authorize(logging.NewContext(context.Background(), authLog), streamKey, h.remoteIP, h.userAgent, h.app)
+	source := events.Source{SessionID: sessionID, App: h.app, StreamKeyHash: maskStreamKey(streamKey)}
 	if err != nil || authResult.Decision == policy.DecisionReject {
+		reason := authResult.Reason
+		if reason == "" {
+			reason = policy.ReasonKeyInvalid
+		}
+		h.emitRejected(source, reason)
 		return fmt.Errorf("authorization failed")
 	}
 
@@ -98,8 +138,10 @@ func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpms
 	if h.cfg.DebugRTMP {
 		streamName = "rtmp-test"
 	}
+	source.StreamName = streamName
 	if h.archiveManager != nil {
 		if err := h.archiveManager.CanPublish(streamName); err != nil {
+			h.emitRejected(source, err.Error())
 			return err
 		}
 	}
@@ -107,14 +149,88 @@ func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpms
 	if authResult.AllowRewind != nil {
 		enableRewind = enableRewind && *authResult.AllowRewind
 	}
-	session := NewSession(h.cfg, h.policy, h.storage, h.archiveManager, streamKey, streamName, h.app, h.remoteIP, h.userAgent, enableRewind)
+	sessionCfg := h.cfg
+	if authResult.OutputFormat != "" {
+		sessionCfg.HLS.OutputFormat = authResult.OutputFormat
+	}
+	if authResult.Encrypt != nil {
+		sessionCfg.Encryption.Enable = *authResult.Encrypt
+	}
+	session := NewSession(sessionCfg, h.policy, h.storage, h.archiveManager, h.events, sessionID, streamKey, streamName, h.app, h.remoteIP, h.userAgent, enableRewind, h.log)
+	session.SetRelayTargets(authResult.RelayTargets)
+	session.SetLadder(authResult.Ladder)
+	if h.conn != nil {
+		conn := h.conn
+		session.SetDisconnect(func() {
+			_ = conn.Close()
+		})
+	}
 	if err := h.manager.Register(session); err != nil {
+		session.log.WithError(err).Warn("publish refused")
+		h.emitRejected(source, err.Error())
 		return fmt.Errorf("stream already active")
 	}
 	h.streamKey = streamKey
 	h.streamName = streamName
 	h.session = session
-	log.Printf("publish start: stream_key_hash=%s app=%s remote=%s", maskStreamKey(streamKey), h.app, h.remoteIP)
+	h.audioConfig = util.AudioConfig{}
+	session.log.Info("publish start")
+	session.emit(events.PublishStart, "", map[string]interface{}{"remote_ip": h.remoteIP, "user_agent": h.userAgent})
+	return nil
+}
+
+// emitRejected reports a publish refused before its session started.
+func (h *Handler) emitRejected(source events.Source, reason string) {
+	h.events.Emit(events.Event{Type: events.Rejected, Source: source, Reason: reason})
+}
+
+func (h *Handler) OnPlay(ctx *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPlay) error {
+	if !h.cfg.RTMP.EnablePlay {
+		return fmt.Errorf("play not allowed")
+	}
+	if err := h.validateApp(); err != nil {
+		return err
+	}
+	if h.session != nil {
+		return fmt.Errorf("already publishing")
+	}
+	if h.player != nil {
+		return fmt.Errorf("already playing")
+	}
+	streamName := sanitizeStreamID(cmd.StreamName)
+	if streamName == "" {
+		return fmt.Errorf("play name empty")
+	}
+	token := playToken(cmd.StreamName, h.tcURL)
+	playLog := h.log.WithField(logging.FieldStreamName, streamName)
+	allowed, err := policy.AllowPlayback(logging.NewContext(context.Background(), playLog), h.policy, streamName, token, h.remoteIP)
+	if err != nil {
+		playLog.WithError(err).Warn("playback auth error")
+	}
+	if !allowed {
+		return fmt.Errorf("play not authorized")
+	}
+	session := h.manager.LookupByName(streamName)
+	if session == nil {
+		return fmt.Errorf("stream not found")
+	}
+	if err := writeStreamBegin(h.rtmpConn, ctx.StreamID); err != nil {
+		return err
+	}
+	sub, err := session.Subscribe()
+	if err != nil {
+		return err
+	}
+	h.player = sub
+	h.playName = streamName
+	h.log.WithField(logging.FieldStreamName, streamName).Info("play start")
+	// go-rtmp answers with NetStream.Play.Start after OnPlay returns, on the
+	// goroutine that reads the connection; media must not go out before it.
+	var started <-chan struct{}
+	if h.conn != nil {
+		started = h.conn.nextRead()
+	}
+	go h.servePlayer(h.rtmpConn, sub, ctx.StreamID, started)
 	return nil
 }
 
@@ -122,15 +238,59 @@ func (h *Handler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDat
 	if h.session == nil || len(data.Payload) == 0 {
 		return nil
 	}
-	var script tag.ScriptData
-	if err := tag.DecodeScriptData(bytes.NewReader(data.Payload), &script); err != nil {
+	return h.handleScriptData(timestamp, data.Payload)
+}
+
+// Most encoders send onCuePoint and onTextData as bare data messages rather
+// than through @setDataFrame. go-rtmp drops data messages it has no decoder
+// for before a handler sees them, so decode these into a
+// NetStreamSetDataFrame that reaches OnSetDataFrame.
+func init() {
+	for _, name := range []string{metadata.TypeCuePoint, metadata.TypeTextData} {
+		rtmpmsg.DataBodyDecoders[name] = bareDataFrameDecoder(name)
+	}
+}
+
+func bareDataFrameDecoder(name string) rtmpmsg.BodyDecoderFunc {
+	return func(r io.Reader, _ rtmpmsg.AMFDecoder, v *rtmpmsg.AMFConvertible) error {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		payload := []byte{0x02, byte(len(name) >> 8), byte(len(name))} // AMF0 string
+		payload = append(payload, name...)
+		*v = &rtmpmsg.NetStreamSetDataFrame{Payload: append(payload, body...)}
 		return nil
 	}
-	meta, ok := script.Objects["onMetaData"]
-	if !ok {
+}
+
+// handleScriptData handles the AMF0 script data of an FLV script tag and
+// forwards the tag to players if it was understood.
+func (h *Handler) handleScriptData(timestamp uint32, payload []byte) error {
+	var script tag.ScriptData
+	if err := tag.DecodeScriptData(bytes.NewReader(payload), &script); err != nil {
 		return nil
 	}
-	h.session.HandleMetadata(map[string]interface{}(meta))
+	handled := false
+	if meta, ok := script.Objects["onMetaData"]; ok {
+		h.session.HandleMetadata(map[string]interface{}(meta))
+		handled = true
+	}
+	for _, name := range []string{metadata.TypeCuePoint, metadata.TypeTextData} {
+		obj, ok := script.Objects[name]
+		if !ok {
+			continue
+		}
+		if ev, ok := metadata.FromObject(name, map[string]interface{}(obj)); ok {
+			if err := h.session.HandleTimedMetadata(int64(timestamp), ev); err != nil {
+				return err
+			}
+			handled = true
+		}
+	}
+	if handled {
+		h.session.PublishTag(NewScriptTag(timestamp, payload))
+	}
 	return nil
 }
 
@@ -138,12 +298,27 @@ func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
 	if h.session == nil {
 		return nil
 	}
+	raw, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	if err := h.handleAudio(timestamp, raw); err != nil {
+		return err
+	}
+	h.session.PublishTag(NewAudioTag(timestamp, raw))
+	return nil
+}
+
+func (h *Handler) handleAudio(timestamp uint32, raw []byte) error {
+	if len(raw) > 0 && util.IsExAudioHeader(raw[0]) {
+		return h.onExAudio(timestamp, raw)
+	}
 	var audio tag.AudioData
-	if err := tag.DecodeAudioData(payload, &audio); err != nil {
+	if err := tag.DecodeAudioData(bytes.NewReader(raw), &audio); err != nil {
 		return err
 	}
-	if audio.SoundFormat != tag.SoundFormatAAC {
-		if h.cfg.Policy.RejectIfAudioNotAAC {
+	if audio.SoundFormat != tag.SoundFormatAAC && audio.SoundFormat != tag.SoundFormatMP3 && audio.SoundFormat != tag.SoundFormatMP3_8kHz {
+		if h.cfg.Policy.RejectUnknownAudioCodecs {
 			return fmt.Errorf("audio codec not supported")
 		}
 		return nil
@@ -152,6 +327,9 @@ func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
 	if _, err := io.Copy(body, audio.Data); err != nil {
 		return err
 	}
+	if audio.SoundFormat != tag.SoundFormatAAC {
+		return h.handleMP3Frame(timestamp, body.Bytes())
+	}
 
 	switch audio.AACPacketType {
 	case tag.AACPacketTypeSequenceHeader:
@@ -159,7 +337,7 @@ func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
 		if err != nil {
 			return err
 		}
-		return h.session.HandleAudioConfig(cfg)
+		return h.updateAudioConfig(util.AudioConfig{Codec: util.AudioCodecAAC, AAC: cfg})
 	case tag.AACPacketTypeRaw:
 		return h.session.HandleAudioSample(int64(timestamp), body.Bytes())
 	default:
@@ -167,16 +345,103 @@ func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
 	}
 }
 
+func (h *Handler) onExAudio(timestamp uint32, raw []byte) error {
+	audio, err := util.ParseExAudioTag(raw)
+	if err != nil {
+		return err
+	}
+	codec := util.AudioCodecFromFourCC(audio.FourCC)
+	if codec == "" {
+		if h.cfg.Policy.RejectUnknownAudioCodecs {
+			return fmt.Errorf("audio codec not supported")
+		}
+		return nil
+	}
+
+	switch audio.PacketType {
+	case util.ExAudioPacketSequenceStart:
+		switch codec {
+		case util.AudioCodecAAC:
+			cfg, err := util.ParseAudioSpecificConfig(audio.Data)
+			if err != nil {
+				return err
+			}
+			return h.updateAudioConfig(util.AudioConfig{Codec: codec, AAC: cfg})
+		case util.AudioCodecOpus:
+			cfg, err := util.ParseOpusHead(audio.Data)
+			if err != nil {
+				return err
+			}
+			return h.updateAudioConfig(util.AudioConfig{Codec: codec, Opus: cfg})
+		default:
+			return nil
+		}
+	case util.ExAudioPacketCodedFrames:
+		if len(audio.Data) == 0 {
+			return nil
+		}
+		switch codec {
+		case util.AudioCodecMP3:
+			return h.handleMP3Frame(timestamp, audio.Data)
+		case util.AudioCodecOpus:
+			if h.audioConfig.Codec != util.AudioCodecOpus {
+				if err := h.updateAudioConfig(util.AudioConfig{Codec: codec, Opus: util.DefaultOpusConfig(audio.Data)}); err != nil {
+					return err
+				}
+			}
+		}
+		return h.session.HandleAudioSample(int64(timestamp), audio.Data)
+	default:
+		return nil
+	}
+}
+
+// handleMP3Frame derives the audio config from each frame header, since MP3
+// over RTMP has no sequence header.
+func (h *Handler) handleMP3Frame(timestamp uint32, frame []byte) error {
+	mp3, err := util.ParseMP3FrameHeader(frame)
+	if err != nil {
+		return err
+	}
+	cfg := util.AudioConfig{Codec: util.AudioCodecMP3, MP3: mp3}
+	if !util.EqualAudioConfig(h.audioConfig, cfg) {
+		if err := h.updateAudioConfig(cfg); err != nil {
+			return err
+		}
+	}
+	return h.session.HandleAudioSample(int64(timestamp), frame)
+}
+
+func (h *Handler) updateAudioConfig(cfg util.AudioConfig) error {
+	h.audioConfig = cfg
+	return h.session.HandleAudioConfig(cfg)
+}
+
 func (h *Handler) OnVideo(timestamp uint32, payload io.Reader) error {
 	if h.session == nil {
 		return nil
 	}
+	raw, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	if err := h.handleVideo(timestamp, raw); err != nil {
+		return err
+	}
+	h.session.PublishTag(NewVideoTag(timestamp, raw))
+	return nil
+}
+
+func (h *Handler) handleVideo(timestamp uint32, raw []byte) error {
+	if len(raw) > 0 && util.IsExVideoHeader(raw[0]) {
+		return h.onExVideo(timestamp, raw)
+	}
 	var video tag.VideoData
-	if err := tag.DecodeVideoData(payload, &video); err != nil {
+	if err := tag.DecodeVideoData(bytes.NewReader(raw), &video); err != nil {
 		return err
 	}
 	if video.CodecID != tag.CodecIDAVC {
-		if h.cfg.Policy.RejectIfVideoNotH264 {
+		if h.cfg.Policy.RejectUnknownVideoCodecs {
 			return fmt.Errorf("video codec not supported")
 		}
 		return nil
@@ -188,7 +453,7 @@ func (h *Handler) OnVideo(timestamp uint32, payload io.Reader) error {
 
 	switch video.AVCPacketType {
 	case tag.AVCPacketTypeSequenceHeader:
-		cfg, err := util.ParseAVCDecoderConfig(body.Bytes())
+		cfg, err := util.ParseVideoConfig(util.VideoCodecH264, body.Bytes())
 		if err != nil {
 			return err
 		}
@@ -202,7 +467,42 @@ func (h *Handler) OnVideo(timestamp uint32, payload io.Reader) error {
 	}
 }
 
+func (h *Handler) onExVideo(timestamp uint32, raw []byte) error {
+	video, err := util.ParseExVideoTag(raw)
+	if err != nil {
+		return err
+	}
+	codec := util.VideoCodecFromFourCC(video.FourCC)
+	if codec == "" {
+		if h.cfg.Policy.RejectUnknownVideoCodecs {
+			return fmt.Errorf("video codec not supported")
+		}
+		return nil
+	}
+	if video.FrameType == util.ExVideoFrameCommand {
+		return nil
+	}
+
+	switch video.PacketType {
+	case util.ExVideoPacketSequenceStart:
+		cfg, err := util.ParseVideoConfig(codec, video.Data)
+		if err != nil {
+			return err
+		}
+		return h.session.HandleVideoConfig(cfg)
+	case util.ExVideoPacketCodedFrames, util.ExVideoPacketCodedFramesX:
+		if len(video.Data) == 0 {
+			return nil
+		}
+		isKey := video.FrameType == util.ExVideoFrameKey || util.IsKeyframeSample(codec, video.Data)
+		return h.session.HandleVideoSample(int64(timestamp), int64(video.CompositionTime), video.Data, isKey)
+	default:
+		return nil
+	}
+}
+
 func (h *Handler) OnDeleteStream(timestamp uint32, cmd *rtmpmsg.NetStreamDeleteStream) error {
+	h.stopPlayer()
 	if h.session != nil {
 		h.session.Close(context.Background())
 		h.manager.Remove(h.streamKey, h.streamName)
@@ -212,6 +512,7 @@ func (h *Handler) OnDeleteStream(timestamp uint32, cmd *rtmpmsg.NetStreamDeleteS
 }
 
 func (h *Handler) OnClose() {
+	h.stopPlayer()
 	if h.session != nil {
 		h.session.Close(context.Background())
 		h.manager.Remove(h.streamKey, h.streamName)
@@ -219,6 +520,13 @@ func (h *Handler) OnClose() {
 	}
 }
 
+func (h *Handler) stopPlayer() {
+	if h.player != nil {
+		h.player.Close()
+		h.player = nil
+	}
+}
+
 func sanitizeStreamKey(name string) string {
 	name = strings.TrimSpace(name)
 	name = strings.Trim(name, "/")
@@ -265,6 +573,25 @@ func normalizeApp(name string) string {
 	return name
 }
 
+// playToken reads the playback token from the query of the play name
+// ("name?token=..."), falling back to the query of the connect tcUrl.
+func playToken(playName, tcURL string) string {
+	for _, raw := range []string{playName, tcURL} {
+		_, query, ok := strings.Cut(raw, "?")
+		if !ok {
+			continue
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			continue
+		}
+		if token := values.Get("token"); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
 func sanitizeStreamID(name string) string {
 	name = strings.TrimSpace(name)
 	name = strings.Trim(name, "/")
@@ -0,0 +1,151 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/inspect"
+	"tokuly-live-rtmp-server/pkg/policy"
+	"tokuly-live-rtmp-server/pkg/storage"
+)
+
+// acceptPolicy accepts every key and stream.
+type acceptPolicy struct{}
+
+func (acceptPolicy) Authorize(context.Context, string, string, string, string) (policy.Result, error) {
+	return policy.Result{Decision: policy.DecisionAccept}, nil
+}
+
+func (acceptPolicy) Evaluate(context.Context, inspect.Result) policy.Result {
+	return policy.Result{Decision: policy.DecisionAccept}
+}
+
+func (acceptPolicy) NotifyStreamEnd(context.Context, string) error { return nil }
+
+func (acceptPolicy) NotifyVideoInfo(context.Context, string, inspect.Result) error { return nil }
+
+func (acceptPolicy) NotifyArchiveStatus(context.Context, string, bool) error { return nil }
+
+// startIngestServer serves publishers with Handler, writing HLS below root.
+// Cleanup waits for the sessions to end, so nothing writes to root after.
+func startIngestServer(t *testing.T, cfg config.Config, root string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	st := storage.New(filepath.Join(root, "live"), filepath.Join(root, "rewind"), false)
+	manager := NewStreamManager(0, st, 0)
+	srv := rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
+			h := NewHandler(cfg, acceptPolicy{}, st, manager, nil, nil, conn, logrus.NewEntry(logger))
+			return h.Conn(), &rtmp.ConnConfig{Handler: h, Logger: logger}
+		},
+	})
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(manager.Sessions()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// amf0Object encodes string properties as an AMF0 object.
+func amf0Object(props ...string) []byte {
+	buf := []byte{0x03}
+	for i := 0; i+1 < len(props); i += 2 {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(props[i])))
+		buf = append(buf, props[i]...)
+		buf = append(buf, 0x02)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(props[i+1])))
+		buf = append(buf, props[i+1]...)
+	}
+	return append(buf, 0x00, 0x00, 0x09)
+}
+
+func TestBareCuePointReachesPackager(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Policy.AllowNoAudio = true
+	cfg.HLS.EnableDASH = false
+	root := t.TempDir()
+	addr := startIngestServer(t, cfg, root)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client, err := rtmp.Dial("rtmp", addr, &rtmp.ConnConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{App: cfg.RTMP.App, TCURL: "rtmp://" + addr + "/" + cfg.RTMP.App},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.CreateStream(nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: "studio", PublishingType: "live"}); err != nil {
+		t.Fatal(err)
+	}
+
+	avcC, _ := hex.DecodeString("0164001effe100196764001eacd940a02ff9610000030001000003003c8f162d9601000568ebecb22c")
+	writeVideo := func(ts uint32, payload []byte) {
+		t.Helper()
+		if err := stream.Write(7, ts, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVideo(0, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcC...))
+	idr := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x65, 0x88, 0x84, 0x00}
+	writeVideo(0, idr)
+	// A bare onCuePoint, without @setDataFrame, as encoders send it.
+	if err := stream.Write(5, 500, &rtmpmsg.DataMessage{
+		Name:     "onCuePoint",
+		Encoding: rtmpmsg.EncodingTypeAMF0,
+		Body:     bytes.NewReader(amf0Object("name", "ad-marker", "type", "event")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(1000); ts <= 6000; ts += 1000 {
+		writeVideo(ts, idr)
+	}
+
+	playlist := filepath.Join(root, "live", "studio", cfg.HLS.PlaylistFilename)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(playlist)
+		if strings.Contains(string(data), "#EXT-X-DATERANGE") {
+			if !strings.Contains(string(data), "ad-marker") {
+				t.Fatalf("date range without the cue point name:\n%s", data)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cue point never reached the playlist:\n%s", data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
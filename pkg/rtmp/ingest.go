@@ -0,0 +1,72 @@
+package rtmp
+
+import (
+	"tokuly-live-rtmp-server/pkg/metrics"
+)
+
+const ingestMeterWindowMS = 5000
+
+// ingestMeter measures the ingest bitrate and frame rate over a sliding
+// window of stream time, and publishes them as gauges once per window.
+type ingestMeter struct {
+	stream      metrics.Stream
+	samples     []meterSample
+	bytes       int64
+	frames      int64
+	publishedMS int64
+}
+
+type meterSample struct {
+	tsMS  int64
+	size  int64
+	video bool
+}
+
+func (m *ingestMeter) observe(tsMS int64, size int, video bool) {
+	if n := len(m.samples); n > 0 && tsMS < m.samples[n-1].tsMS {
+		// A timestamp going backwards restarts the window.
+		m.samples = m.samples[:0]
+		m.bytes = 0
+		m.frames = 0
+	}
+	if len(m.samples) == 0 {
+		m.publishedMS = tsMS
+	}
+	m.samples = append(m.samples, meterSample{tsMS: tsMS, size: int64(size), video: video})
+	m.bytes += int64(size)
+	if video {
+		m.frames++
+	}
+	drop := 0
+	for drop < len(m.samples) && tsMS-m.samples[drop].tsMS > ingestMeterWindowMS {
+		m.bytes -= m.samples[drop].size
+		if m.samples[drop].video {
+			m.frames--
+		}
+		drop++
+	}
+	m.samples = append(m.samples[:0], m.samples[drop:]...)
+	if tsMS-m.publishedMS < ingestMeterWindowMS {
+		return
+	}
+	seconds := m.seconds()
+	metrics.SetIngest(m.stream, float64(m.bytes*8)/seconds, float64(m.frames)/seconds)
+	m.publishedMS = tsMS
+}
+
+// bitrate is the ingest bitrate over the window in bits per second, 0 until
+// a second of stream has been seen.
+func (m *ingestMeter) bitrate() int64 {
+	seconds := m.seconds()
+	if seconds < 1 {
+		return 0
+	}
+	return int64(float64(m.bytes*8) / seconds)
+}
+
+func (m *ingestMeter) seconds() float64 {
+	if len(m.samples) < 2 {
+		return 0
+	}
+	return float64(m.samples[len(m.samples)-1].tsMS-m.samples[0].tsMS) / 1000
+}
@@ -1,6 +1,7 @@
 package rtmp
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 )
@@ -12,3 +13,11 @@ func maskStreamKey(streamKey string) string {
 	sum := sha256.Sum256([]byte(streamKey))
 	return hex.EncodeToString(sum[:4])
 }
+
+// newSessionID identifies one publish in the logs, telling reconnects of the
+// same stream key apart.
+func newSessionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -2,10 +2,11 @@ package rtmp
 
 import (
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metrics"
 	"tokuly-live-rtmp-server/pkg/storage"
 )
 
@@ -32,12 +33,15 @@ func (m *StreamManager) Register(session *Session) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, ok := m.sessions[session.StreamKey]; ok {
+		metrics.SessionRejected(session.App, metrics.RejectDuplicate)
 		return fmt.Errorf("stream key already publishing")
 	}
 	if m.max > 0 && len(m.sessions) >= m.max {
+		metrics.SessionRejected(session.App, metrics.RejectMaxStreams)
 		return fmt.Errorf("max concurrent streams reached")
 	}
 	m.sessions[session.StreamKey] = session
+	metrics.SessionStarted(session.App)
 	if timer, ok := m.cleanupTimers[session.StreamKey]; ok {
 		timer.Stop()
 		delete(m.cleanupTimers, session.StreamKey)
@@ -45,6 +49,31 @@ func (m *StreamManager) Register(session *Session) error {
 	return nil
 }
 
+func (m *StreamManager) LookupByName(streamName string) *Session {
+	if streamName == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.StreamName == streamName {
+			return session
+		}
+	}
+	return nil
+}
+
+// Sessions returns the sessions publishing now.
+func (m *StreamManager) Sessions() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
 func (m *StreamManager) Remove(streamKey, streamID string) {
 	if streamKey == "" {
 		return
@@ -54,7 +83,10 @@ func (m *StreamManager) Remove(streamKey, streamID string) {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.sessions, streamKey)
+	if session, ok := m.sessions[streamKey]; ok {
+		metrics.SessionEnded(session.App)
+		delete(m.sessions, streamKey)
+	}
 	if m.cleanupDelay > 0 && m.storage != nil {
 		if timer, ok := m.cleanupTimers[streamKey]; ok {
 			timer.Stop()
@@ -82,6 +114,6 @@ func (m *StreamManager) cleanupIfInactive(streamKey, streamID string) {
 		return
 	}
 	if err := m.storage.RemoveStreamDirs(streamID); err != nil {
-		log.Printf("cleanup error: stream_key_hash=%s err=%v", maskStreamKey(streamKey), err)
+		logging.Default().WithField(logging.FieldStreamKeyHash, maskStreamKey(streamKey)).WithError(err).Warn("cleanup error")
 	}
 }
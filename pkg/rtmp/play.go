@@ -0,0 +1,138 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"tokuly-live-rtmp-server/pkg/logging"
+)
+
+const (
+	playControlChunkStreamID = 2
+	playDataChunkStreamID    = 5
+	playAudioChunkStreamID   = 6
+	playVideoChunkStreamID   = 7
+)
+
+// playConn is the net.Conn of an RTMP connection. go-rtmp reads the
+// connection only between messages, so a read after OnPlay means the play
+// command, and the NetStream.Play.Start it is answered with, are done.
+type playConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	readers []chan struct{}
+}
+
+func (c *playConn) Read(p []byte) (int, error) {
+	c.release()
+	return c.Conn.Read(p)
+}
+
+// Close releases waiting players too; their writes then fail.
+func (c *playConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *playConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.readers {
+		close(ch)
+	}
+	c.readers = nil
+}
+
+// nextRead returns a channel closed when the connection is next read.
+func (c *playConn) nextRead() <-chan struct{} {
+	ch := make(chan struct{})
+	c.mu.Lock()
+	c.readers = append(c.readers, ch)
+	c.mu.Unlock()
+	return ch
+}
+
+// writeStreamBegin tells the player the stream is ready, ahead of
+// NetStream.Play.Start.
+func writeStreamBegin(conn *rtmp.Conn, streamID uint32) error {
+	if conn == nil {
+		return nil
+	}
+	return conn.Write(context.Background(), playControlChunkStreamID, 0, &rtmp.ChunkMessage{
+		Message: &rtmpmsg.UserCtrl{Event: &rtmpmsg.UserCtrlEventStreamBegin{StreamID: streamID}},
+	})
+}
+
+func (h *Handler) servePlayer(conn *rtmp.Conn, sub *Subscriber, streamID uint32, started <-chan struct{}) {
+	ctx := context.Background()
+	log := h.log.WithField(logging.FieldStreamName, h.playName)
+	if started != nil {
+		<-started
+	}
+	for t := range sub.C() {
+		if err := writePlayerTag(ctx, conn, streamID, t); err != nil {
+			log.WithError(err).Warn("play write error")
+			sub.Close()
+			break
+		}
+	}
+	if !sub.Ended() {
+		return
+	}
+	log.Info("play end")
+	_ = conn.Write(ctx, playControlChunkStreamID, 0, &rtmp.ChunkMessage{
+		Message: &rtmpmsg.UserCtrl{Event: &rtmpmsg.UserCtrlEventStreamEOF{StreamID: streamID}},
+	})
+	_ = conn.Close()
+}
+
+func writePlayerTag(ctx context.Context, conn *rtmp.Conn, streamID uint32, t *MediaTag) error {
+	switch t.Type {
+	case tag.TagTypeAudio:
+		return conn.Write(ctx, playAudioChunkStreamID, t.Timestamp, &rtmp.ChunkMessage{
+			StreamID: streamID,
+			Message:  &rtmpmsg.AudioMessage{Payload: bytes.NewReader(t.Payload)},
+		})
+	case tag.TagTypeVideo:
+		return conn.Write(ctx, playVideoChunkStreamID, t.Timestamp, &rtmp.ChunkMessage{
+			StreamID: streamID,
+			Message:  &rtmpmsg.VideoMessage{Payload: bytes.NewReader(t.Payload)},
+		})
+	case tag.TagTypeScriptData:
+		name, body, ok := splitScriptName(t.Payload)
+		if !ok {
+			return nil
+		}
+		return conn.Write(ctx, playDataChunkStreamID, t.Timestamp, &rtmp.ChunkMessage{
+			StreamID: streamID,
+			Message: &rtmpmsg.DataMessage{
+				Name:     name,
+				Encoding: rtmpmsg.EncodingTypeAMF0,
+				Body:     bytes.NewReader(body),
+			},
+		})
+	default:
+		return nil
+	}
+}
+
+// splitScriptName separates the leading AMF0 string of a script tag (e.g.
+// "onMetaData") from the values that follow it.
+func splitScriptName(payload []byte) (string, []byte, bool) {
+	if len(payload) < 3 || payload[0] != 0x02 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(payload[1:3]))
+	if len(payload) < 3+n {
+		return "", nil, false
+	}
+	return string(payload[3 : 3+n]), payload[3+n:], true
+}
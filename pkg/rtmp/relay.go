@@ -0,0 +1,372 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"tokuly-live-rtmp-server/pkg/config"
+)
+
+type RelayState string
+
+const (
+	RelayStateConnecting RelayState = "connecting"
+	RelayStateLive       RelayState = "live"
+	RelayStateBackoff    RelayState = "backoff"
+	RelayStateStopped    RelayState = "stopped"
+)
+
+const (
+	relayChunkSize          = 4096
+	relayDataChunkStreamID  = 5
+	relayAudioChunkStreamID = 6
+	relayVideoChunkStreamID = 7
+
+	// defaultRelayBackoff replaces a MinBackoff that would retry a failing
+	// target in a busy loop.
+	defaultRelayBackoff = time.Second
+)
+
+type RelayStatus struct {
+	Target    string     `json:"target"`
+	State     RelayState `json:"state"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	Since     time.Time  `json:"since"`
+}
+
+// Relay pushes a session's stream to one external RTMP target. It reads from
+// its own broadcaster subscription, so a slow target only drops its own GOPs.
+type Relay struct {
+	target      string
+	log         *logrus.Entry
+	cfg         config.RelayConfig
+	broadcaster *Broadcaster
+
+	mu     sync.Mutex
+	status RelayStatus
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+type relayTarget struct {
+	scheme string
+	addr   string
+	host   string
+	app    string
+	name   string
+	tcURL  string
+}
+
+func NewRelay(cfg config.RelayConfig, broadcaster *Broadcaster, log *logrus.Entry, target string) (*Relay, error) {
+	if _, err := parseRelayTarget(target); err != nil {
+		return nil, err
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultRelayBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+	return &Relay{
+		target:      target,
+		log:         log.WithField("target", maskRelayTarget(target)),
+		cfg:         cfg,
+		broadcaster: broadcaster,
+		status:      RelayStatus{Target: maskRelayTarget(target), State: RelayStateConnecting, Since: time.Now()},
+		stopCh:      make(chan struct{}),
+	}, nil
+}
+
+func (r *Relay) Start() {
+	go r.run()
+}
+
+func (r *Relay) Stop() {
+	r.once.Do(func() {
+		close(r.stopCh)
+	})
+}
+
+func (r *Relay) Status() RelayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func (r *Relay) setState(state RelayState, err error) {
+	r.mu.Lock()
+	prev := r.status.State
+	r.status.State = state
+	r.status.Since = time.Now()
+	if state == RelayStateConnecting {
+		r.status.Attempts++
+	}
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	r.mu.Unlock()
+	if prev == state {
+		return
+	}
+	if err != nil {
+		r.log.WithError(err).Warnf("relay %s", state)
+		return
+	}
+	r.log.Infof("relay %s", state)
+}
+
+func (r *Relay) run() {
+	backoff := r.cfg.MinBackoff
+	for {
+		if r.stopped() {
+			r.setState(RelayStateStopped, nil)
+			return
+		}
+		r.setState(RelayStateConnecting, nil)
+		client, stream, err := r.connect()
+		if err == nil {
+			var sub *Subscriber
+			sub, err = r.broadcaster.Subscribe()
+			if err != nil {
+				_ = client.Close()
+				r.setState(RelayStateStopped, err)
+				return
+			}
+			r.setState(RelayStateLive, nil)
+			start := time.Now()
+			err = r.pump(stream, sub)
+			_ = client.DeleteStream(&rtmpmsg.NetStreamDeleteStream{StreamID: stream.StreamID()})
+			_ = client.Close()
+			if err == nil {
+				r.setState(RelayStateStopped, nil)
+				return
+			}
+			if time.Since(start) > r.cfg.MaxBackoff {
+				backoff = r.cfg.MinBackoff
+			}
+		}
+		r.setState(RelayStateBackoff, err)
+		select {
+		case <-r.stopCh:
+			r.setState(RelayStateStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > r.cfg.MaxBackoff {
+			backoff = r.cfg.MaxBackoff
+		}
+	}
+}
+
+func (r *Relay) stopped() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// connect dials, connects and publishes. go-rtmp has no timeouts for the
+// handshake or the connect transaction, so the whole sequence is bounded here.
+func (r *Relay) connect() (*rtmp.ClientConn, *rtmp.Stream, error) {
+	target, err := parseRelayTarget(r.target)
+	if err != nil {
+		return nil, nil, err
+	}
+	type result struct {
+		client *rtmp.ClientConn
+		stream *rtmp.Stream
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, stream, err := dialRelay(target, r.cfg.ConnectTimeout)
+		done <- result{client: client, stream: stream, err: err}
+	}()
+	timer := time.NewTimer(r.cfg.ConnectTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.client, res.stream, res.err
+	case <-timer.C:
+	case <-r.stopCh:
+	}
+	go func() {
+		if res := <-done; res.client != nil {
+			_ = res.client.Close()
+		}
+	}()
+	if r.stopped() {
+		return nil, nil, fmt.Errorf("relay stopped")
+	}
+	return nil, nil, fmt.Errorf("connect timeout")
+}
+
+func dialRelay(target relayTarget, timeout time.Duration) (*rtmp.ClientConn, *rtmp.Stream, error) {
+	connCfg := &rtmp.ConnConfig{Logger: relayLogger}
+	var client *rtmp.ClientConn
+	var err error
+	if target.scheme == "rtmps" {
+		client, err = rtmp.DialWithTLSDialer(&tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: timeout},
+			Config:    &tls.Config{ServerName: target.host},
+		}, "rtmps", target.addr, connCfg)
+	} else {
+		client, err = rtmp.DialWithDialer(&net.Dialer{Timeout: timeout}, "rtmp", target.addr, connCfg)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := client.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{
+			App:      target.app,
+			Type:     "nonprivate",
+			FlashVer: "FMLE/3.0 (compatible; tokuly-relay)",
+			TCURL:    target.tcURL,
+		},
+	}); err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	stream, err := client.CreateStream(nil, relayChunkSize)
+	if err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{
+		PublishingName: target.name,
+		PublishingType: "live",
+	}); err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	return client, stream, nil
+}
+
+// pump forwards tags until the publisher ends (nil) or the target fails.
+// Timestamps are rebased so every connection starts near zero.
+func (r *Relay) pump(stream *rtmp.Stream, sub *Subscriber) error {
+	defer sub.Close()
+	var base uint32
+	baseSet := false
+	for {
+		select {
+		case <-r.stopCh:
+			return nil
+		case t, ok := <-sub.C():
+			if !ok {
+				return nil
+			}
+			ts := uint32(0)
+			if !t.Header && (t.Type != tag.TagTypeScriptData || t.Timed) {
+				if !baseSet {
+					base = t.Timestamp
+					baseSet = true
+				}
+				if t.Timestamp > base {
+					ts = t.Timestamp - base
+				}
+			}
+			if err := writeRelayTag(stream, ts, t); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeRelayTag(stream *rtmp.Stream, ts uint32, t *MediaTag) error {
+	switch t.Type {
+	case tag.TagTypeAudio:
+		return stream.Write(relayAudioChunkStreamID, ts, &rtmpmsg.AudioMessage{Payload: bytes.NewReader(t.Payload)})
+	case tag.TagTypeVideo:
+		return stream.Write(relayVideoChunkStreamID, ts, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(t.Payload)})
+	case tag.TagTypeScriptData:
+		if t.Timed {
+			// Cue points and text go out bare, as encoders send them.
+			name, body, ok := splitScriptName(t.Payload)
+			if !ok {
+				return nil
+			}
+			return stream.Write(relayDataChunkStreamID, ts, &rtmpmsg.DataMessage{
+				Name:     name,
+				Encoding: rtmpmsg.EncodingTypeAMF0,
+				Body:     bytes.NewReader(body),
+			})
+		}
+		return stream.Write(relayDataChunkStreamID, ts, &rtmpmsg.DataMessage{
+			Name:     "@setDataFrame",
+			Encoding: rtmpmsg.EncodingTypeAMF0,
+			Body:     bytes.NewReader(t.Payload),
+		})
+	default:
+		return nil
+	}
+}
+
+var relayLogger = func() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	return logger
+}()
+
+func parseRelayTarget(raw string) (relayTarget, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return relayTarget{}, err
+	}
+	if u.Scheme != "rtmp" && u.Scheme != "rtmps" {
+		return relayTarget{}, fmt.Errorf("relay target scheme not supported: %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return relayTarget{}, fmt.Errorf("relay target host empty")
+	}
+	path := strings.Trim(u.Path, "/")
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || idx == len(path)-1 {
+		return relayTarget{}, fmt.Errorf("relay target needs app and stream name")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "1935"
+		if u.Scheme == "rtmps" {
+			port = "443"
+		}
+	}
+	name := path[idx+1:]
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	app := path[:idx]
+	return relayTarget{
+		scheme: u.Scheme,
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		host:   u.Hostname(),
+		app:    app,
+		name:   name,
+		tcURL:  fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, app),
+	}, nil
+}
+
+// maskRelayTarget drops the stream name, which is usually the target's
+// secret key.
+func maskRelayTarget(raw string) string {
+	target, err := parseRelayTarget(raw)
+	if err != nil {
+		return "invalid"
+	}
+	return target.tcURL
+}
@@ -0,0 +1,189 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"tokuly-live-rtmp-server/pkg/config"
+)
+
+// relayReceiver is the RTMP server side of a relay target. It records what
+// each publishing connection received.
+type relayReceiver struct {
+	rtmp.DefaultHandler
+
+	conn    net.Conn
+	publish chan string
+	video   chan []byte
+	meta    chan []byte
+}
+
+func (h *relayReceiver) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) error {
+	h.publish <- cmd.PublishingName
+	return nil
+}
+
+func (h *relayReceiver) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
+	h.meta <- data.Payload
+	return nil
+}
+
+func (h *relayReceiver) OnVideo(timestamp uint32, payload io.Reader) error {
+	data, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	h.video <- data
+	return nil
+}
+
+type relayServer struct {
+	addr  string
+	conns chan *relayReceiver
+}
+
+func startRelayServer(t *testing.T) *relayServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := &relayServer{addr: listener.Addr().String(), conns: make(chan *relayReceiver, 4)}
+	srv := rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
+			h := &relayReceiver{
+				conn:    conn,
+				publish: make(chan string, 1),
+				video:   make(chan []byte, 64),
+				meta:    make(chan []byte, 4),
+			}
+			s.conns <- h
+			return conn, &rtmp.ConnConfig{Handler: h, Logger: logger}
+		},
+	})
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	return s
+}
+
+func (s *relayServer) accept(t *testing.T) *relayReceiver {
+	t.Helper()
+	select {
+	case h := <-s.conns:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not connect")
+		return nil
+	}
+}
+
+// expectHeaders waits for the publish, the metadata and the video sequence
+// header, which a relay sends first on every connection.
+func (h *relayReceiver) expectHeaders(t *testing.T, name string, meta, header []byte) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	select {
+	case got := <-h.publish:
+		if got != name {
+			t.Fatalf("published %q, want %q", got, name)
+		}
+	case <-timeout:
+		t.Fatal("relay did not publish")
+	}
+	select {
+	case got := <-h.meta:
+		if !bytes.Equal(got, meta) {
+			t.Fatalf("metadata %x, want %x", got, meta)
+		}
+	case <-timeout:
+		t.Fatal("relay did not forward metadata")
+	}
+	select {
+	case got := <-h.video:
+		if !bytes.Equal(got, header) {
+			t.Fatalf("first video %x, want sequence header %x", got, header)
+		}
+	case <-timeout:
+		t.Fatal("relay did not forward the video header")
+	}
+}
+
+func TestRelayReconnectsAndForwardsHeaders(t *testing.T) {
+	server := startRelayServer(t)
+
+	meta := []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a', 0x05}
+	header := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64, 0x00, 0x1f}
+	b := NewBroadcaster()
+	b.Start()
+	b.Publish(NewMetadataTag(0, meta))
+	b.Publish(NewVideoTag(0, header))
+	b.Publish(NewVideoTag(0, []byte{0x17, 0x01, 0x00, 0x00, 0x00}))
+
+	cfg := config.RelayConfig{ConnectTimeout: 5 * time.Second, MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	relay, err := NewRelay(cfg, b, logrus.NewEntry(log), "rtmp://"+server.addr+"/live/target-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.Start()
+	defer relay.Stop()
+
+	first := server.accept(t)
+	first.expectHeaders(t, "target-key", meta, header)
+
+	// Drop the connection; the relay notices on its next write.
+	_ = first.conn.Close()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ts := uint32(40)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				b.Publish(NewVideoTag(ts, []byte{0x27, 0x01, 0x00, 0x00, 0x00}))
+				ts += 40
+			}
+		}
+	}()
+	second := server.accept(t)
+	second.expectHeaders(t, "target-key", meta, header)
+	close(stop)
+	wg.Wait()
+
+	status := relay.Status()
+	if status.Attempts < 2 {
+		t.Fatalf("attempts = %d, want a reconnect", status.Attempts)
+	}
+	if status.State != RelayStateLive {
+		t.Fatalf("state = %s, want %s", status.State, RelayStateLive)
+	}
+}
+
+func TestNewRelayClampsBackoff(t *testing.T) {
+	relay, err := NewRelay(config.RelayConfig{}, NewBroadcaster(), logrus.NewEntry(logrus.New()), "rtmp://127.0.0.1/live/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.cfg.MinBackoff != defaultRelayBackoff || relay.cfg.MaxBackoff != defaultRelayBackoff {
+		t.Fatalf("backoff = %s..%s, want %s", relay.cfg.MinBackoff, relay.cfg.MaxBackoff, defaultRelayBackoff)
+	}
+}
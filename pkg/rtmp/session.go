@@ -3,13 +3,23 @@ package rtmp
 import (
 	"context"
 	"fmt"
-	"log"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"tokuly-live-rtmp-server/pkg/archive"
 	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/drm"
+	"tokuly-live-rtmp-server/pkg/events"
+	"tokuly-live-rtmp-server/pkg/hls"
 	"tokuly-live-rtmp-server/pkg/inspect"
+	"tokuly-live-rtmp-server/pkg/logging"
+	"tokuly-live-rtmp-server/pkg/metadata"
+	"tokuly-live-rtmp-server/pkg/metrics"
 	"tokuly-live-rtmp-server/pkg/packager"
 	"tokuly-live-rtmp-server/pkg/policy"
 	"tokuly-live-rtmp-server/pkg/storage"
@@ -17,6 +27,7 @@ import (
 )
 
 type Session struct {
+	ID        string
 	StreamKey string
 	StreamName string
 	App       string
@@ -26,19 +37,66 @@ type Session struct {
 	cfg     config.Config
 	policy  policy.Policy
 	storage *storage.Storage
+	log     *logrus.Entry
+	events  *events.Dispatcher
 
 	archiveManager  *archive.Manager
 	archiveRecorder *archive.Recorder
 
 	inspector *inspect.Inspector
 	packager  *packager.Packager
+	broadcaster *Broadcaster
+	relayTargets []string
+	relays       []*Relay
+	relayMu      sync.Mutex
+	ladder       []string
+	transcoder   *Transcoder
+	masterResult inspect.Result
 	accepted  bool
 	closed    bool
 	videoInfoSent bool
+	clockBaseSet  bool
+	clockBaseTS   int64
+	clockBaseWall time.Time
+	// videoConfig and audioConfig are the last configs received, to report
+	// codec changes.
+	videoConfig util.VideoConfig
+	audioConfig util.AudioConfig
 
 	buffer         []ingestSample
 	bufferStartMS  int64
 	maxBufferDurMS int64
+
+	meter ingestMeter
+
+	startedAt  time.Time
+	disconnect func()
+	// stats is a copy of the inspection for readers on other goroutines.
+	statsMu       sync.Mutex
+	stats         inspect.Result
+	statsAccepted bool
+	statsBitrate  int64
+}
+
+// SessionInfo describes a live session for the admin API.
+type SessionInfo struct {
+	SessionID     string        `json:"session_id"`
+	StreamName    string        `json:"stream_name"`
+	StreamKeyHash string        `json:"stream_key_hash"`
+	App           string        `json:"app"`
+	RemoteIP      string        `json:"remote_ip"`
+	UserAgent     string        `json:"user_agent"`
+	StartedAt     time.Time     `json:"started_at"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Accepted      bool          `json:"accepted"`
+	VideoCodec    string        `json:"video_codec"`
+	AudioCodec    string        `json:"audio_codec"`
+	Width         int           `json:"width"`
+	Height        int           `json:"height"`
+	FPS           float64       `json:"fps"`
+	BitrateBps    int64         `json:"bitrate_bps"`
+	Archive       string        `json:"archive"`
+	Relays        []RelayStatus `json:"relays,omitempty"`
 }
 
 type ingestSample struct {
@@ -47,11 +105,14 @@ type ingestSample struct {
 	ctsMS  int64
 	data   []byte
 	isKey  bool
-	avcCfg util.AVCConfig
-	aacCfg util.AACConfig
+	videoCfg util.VideoConfig
+	audioCfg util.AudioConfig
+	event    metadata.Event
 }
 
-func NewSession(cfg config.Config, policy policy.Policy, storage *storage.Storage, archiveManager *archive.Manager, streamKey, streamName, app, remoteIP, userAgent string, enableRewind bool) *Session {
+// NewSession creates a publishing session. Its logger adds the session
+// fields to log.
+func NewSession(cfg config.Config, policy policy.Policy, storage *storage.Storage, archiveManager *archive.Manager, dispatcher *events.Dispatcher, sessionID, streamKey, streamName, app, remoteIP, userAgent string, enableRewind bool, log *logrus.Entry) *Session {
 	if streamName == "" {
 		streamName = streamKey
 	}
@@ -67,24 +128,8 @@ func NewSession(cfg config.Config, policy policy.Policy, storage *storage.Storag
 		AllowNoAudio:         cfg.Policy.AllowNoAudio,
 		BitrateWindow:        cfg.Policy.InitialBitrateWindow,
 	})
-	pkg := packager.New(packager.Config{
-		SegmentDuration:      cfg.HLS.SegmentDuration,
-		PartDuration:         cfg.HLS.PartDuration,
-		PlaylistWindow:       cfg.HLS.PlaylistWindow,
-		TargetDuration:       cfg.HLS.TargetDuration,
-		HoldBack:             cfg.HLS.HoldBack,
-		PartHoldBack:         cfg.HLS.PartHoldBack,
-		KeepSegments:         cfg.HLS.KeepSegments,
-		RewindPlaylistWindow: cfg.HLS.RewindPlaylistWindow,
-		InitFilename:         cfg.HLS.InitFilename,
-		SegmentFilenameTmpl:  cfg.HLS.SegmentFilenameTmpl,
-		PartFilenameTmpl:     cfg.HLS.PartFilenameTmpl,
-		PlaylistName:         cfg.HLS.PlaylistFilename,
-		RewindPlaylistName:   cfg.HLS.RewindPlaylistName,
-		EnablePartial:        cfg.HLS.EnablePartial,
-	}, sessionStorage, streamName)
-
-	return &Session{
+	s := &Session{
+		ID:              sessionID,
 		StreamKey:       streamKey,
 		StreamName:      streamName,
 		App:             app,
@@ -94,18 +139,150 @@ func NewSession(cfg config.Config, policy policy.Policy, storage *storage.Storag
 		policy:          policy,
 		storage:         sessionStorage,
 		archiveManager:  archiveManager,
+		events:          dispatcher,
 		inspector:       inspector,
-		packager:        pkg,
+		broadcaster:     NewBroadcaster(),
 		maxBufferDurMS:  int64(cfg.Limits.MaxBufferedSeconds / time.Millisecond),
 		bufferStartMS:   0,
 		buffer:          nil,
 		accepted:        false,
 		closed:          false,
+		startedAt:       time.Now(),
+		log: log.WithFields(logrus.Fields{
+			logging.FieldSessionID:     sessionID,
+			logging.FieldApp:           app,
+			logging.FieldStreamKeyHash: maskStreamKey(streamKey),
+			logging.FieldStreamName:    streamName,
+		}),
+	}
+	s.meter.stream = s.metricsStream()
+	s.packager = s.newPackager(streamName)
+	return s
+}
+
+// newPackager creates the packager for the source or a rendition. Keys it
+// starts using are recorded in the archive metadata.
+func (s *Session) newPackager(streamID string) *packager.Packager {
+	pkgCfg := packagerConfig(s.cfg)
+	pkgCfg.Metrics = s.metricsStream()
+	pkgCfg.Log = s.log
+	if streamID != s.StreamName {
+		// Renditions share the source's subtitle playlist and keep their
+		// audio muxed.
+		pkgCfg.CaptionsPlaylistName = ""
+		pkgCfg.DemuxAudio = false
+		pkgCfg.Log = s.log.WithField("rendition", path.Base(streamID))
+	} else {
+		pkgCfg.OnDiscontinuity = func(reason string) {
+			s.emit(events.Discontinuity, reason, nil)
+		}
+	}
+	if pkgCfg.KeyProvider != nil && s.archiveManager != nil {
+		pkgCfg.OnKey = func(key drm.Key) {
+			s.archiveManager.RecordKeyID(s.StreamName, key.KeyID())
+		}
+	}
+	return packager.New(pkgCfg, s.storage, streamID)
+}
+
+// context carries the session's logger to policy calls.
+func (s *Session) context() context.Context {
+	return logging.NewContext(context.Background(), s.log)
+}
+
+// metricsStream labels the session's metrics.
+func (s *Session) metricsStream() metrics.Stream {
+	return metrics.Stream{App: s.App, KeyHash: maskStreamKey(s.StreamKey)}
+}
+
+// eventSource identifies the session in webhook events.
+func (s *Session) eventSource() events.Source {
+	return events.Source{
+		SessionID:     s.ID,
+		App:           s.App,
+		StreamKeyHash: maskStreamKey(s.StreamKey),
+		StreamName:    s.StreamName,
+	}
+}
+
+func (s *Session) emit(typ events.Type, reason string, data map[string]interface{}) {
+	s.events.Emit(events.Event{
+		Type:   typ,
+		Source: s.eventSource(),
+		Reason: reason,
+		Data:   data,
+	})
+}
+
+func packagerConfig(cfg config.Config) packager.Config {
+	return packager.Config{
+		SegmentDuration:      cfg.HLS.SegmentDuration,
+		MaxSegmentOverrun:    cfg.HLS.MaxSegmentOverrun,
+		PartDuration:         cfg.HLS.PartDuration,
+		PlaylistWindow:       cfg.HLS.PlaylistWindow,
+		TargetDuration:       cfg.HLS.TargetDuration,
+		HoldBack:             cfg.HLS.HoldBack,
+		PartHoldBack:         cfg.HLS.PartHoldBack,
+		KeepSegments:         cfg.HLS.KeepSegments,
+		RewindPlaylistWindow: cfg.HLS.RewindPlaylistWindow,
+		InitFilename:         cfg.HLS.InitFilename,
+		SegmentFilenameTmpl:  cfg.HLS.SegmentFilenameTmpl,
+		PartFilenameTmpl:     cfg.HLS.PartFilenameTmpl,
+		ByteRangeParts:       cfg.HLS.ByteRangeParts,
+		PlaylistName:         cfg.HLS.PlaylistFilename,
+		RewindPlaylistName:   cfg.HLS.RewindPlaylistName,
+		IFramePlaylistName:   cfg.HLS.IFramePlaylistName,
+		CaptionsPlaylistName: captionsPlaylistName(cfg),
+		DemuxAudio:           cfg.HLS.DemuxAudio,
+		AudioRenditionName:   cfg.HLS.AudioRenditionName,
+		EnablePartial:        cfg.HLS.EnablePartial,
+		PDTEverySegment:      cfg.HLS.PDTEverySegment,
+		EnableDASH:           cfg.HLS.EnableDASH,
+		DASHManifestName:     cfg.HLS.DASHManifestName,
+		SegmentFormat:        cfg.HLS.OutputFormat,
+		KeyProvider:          keyProvider(cfg),
+		KeyRotateSegments:    cfg.Encryption.RotateSegments,
+		KeyFormat:            cfg.Encryption.KeyFormat,
+		KeyTimeout:           cfg.Encryption.KeyTimeout,
+	}
+}
+
+// captionsPlaylistName is the WebVTT subtitle playlist, or "" when caption
+// extraction is off.
+func captionsPlaylistName(cfg config.Config) string {
+	if !cfg.HLS.ExtractCaptions {
+		return ""
 	}
+	return cfg.HLS.CaptionsPlaylistName
 }
 
-func (s *Session) HandleVideoConfig(cfg util.AVCConfig) error {
+func keyProvider(cfg config.Config) drm.KeyProvider {
+	if !cfg.Encryption.Enable {
+		return nil
+	}
+	switch cfg.Encryption.Provider {
+	case "http":
+		return &drm.HTTPProvider{
+			URL:           cfg.Encryption.KeyURL,
+			APIKey:        cfg.Encryption.KeyAPIKey,
+			URITemplate:   cfg.Encryption.KeyURITemplate,
+			Timeout:       cfg.Encryption.KeyTimeout,
+			HTTPUserAgent: cfg.Auth.HTTPUserAgent,
+		}
+	default:
+		return &drm.FileProvider{
+			Dir:         cfg.Encryption.KeyDir,
+			URITemplate: cfg.Encryption.KeyURITemplate,
+		}
+	}
+}
+
+func (s *Session) HandleVideoConfig(cfg util.VideoConfig) error {
 	s.inspector.OnVideoConfig(cfg)
+	if s.videoConfig.Codec != "" && !util.EqualVideoConfig(s.videoConfig, cfg) {
+		s.emit(events.CodecChanged, "", map[string]interface{}{"track": "video", "from": s.videoConfig.Codec, "to": cfg.Codec})
+	}
+	s.videoConfig = cfg
 	if s.accepted {
 		if s.archiveRecorder != nil {
 			if err := s.archiveRecorder.UpdateVideoConfig(cfg); err != nil {
@@ -114,11 +291,15 @@ func (s *Session) HandleVideoConfig(cfg util.AVCConfig) error {
 		}
 		return s.packager.UpdateVideoConfig(cfg)
 	}
-	return s.bufferSample(ingestSample{kind: "video-config", avcCfg: cfg})
+	return s.bufferSample(ingestSample{kind: "video-config", videoCfg: cfg})
 }
 
-func (s *Session) HandleAudioConfig(cfg util.AACConfig) error {
+func (s *Session) HandleAudioConfig(cfg util.AudioConfig) error {
 	s.inspector.OnAudioConfig(cfg)
+	if s.audioConfig.Codec != "" && !util.EqualAudioConfig(s.audioConfig, cfg) {
+		s.emit(events.CodecChanged, "", map[string]interface{}{"track": "audio", "from": s.audioConfig.Codec, "to": cfg.Codec})
+	}
+	s.audioConfig = cfg
 	if s.accepted {
 		if s.archiveRecorder != nil {
 			if err := s.archiveRecorder.UpdateAudioConfig(cfg); err != nil {
@@ -127,16 +308,20 @@ func (s *Session) HandleAudioConfig(cfg util.AACConfig) error {
 		}
 		return s.packager.UpdateAudioConfig(cfg)
 	}
-	return s.bufferSample(ingestSample{kind: "audio-config", aacCfg: cfg})
+	return s.bufferSample(ingestSample{kind: "audio-config", audioCfg: cfg})
 }
 
 func (s *Session) HandleVideoSample(tsMS int64, ctsMS int64, data []byte, isKey bool) error {
+	s.markClockBase(tsMS)
+	s.meter.observe(tsMS, len(data), true)
 	s.inspector.OnVideoSample(tsMS, data, isKey)
 	s.inspector.FinalizeIfTimeout(tsMS)
 	s.tryNotifyVideoInfo()
 	if err := s.maybeDecide(tsMS); err != nil {
 		return err
 	}
+	s.announceCaptions()
+	s.updateStats()
 	if s.accepted {
 		if s.archiveRecorder != nil {
 			if err := s.archiveRecorder.AddVideoSample(tsMS, ctsMS, data, isKey); err != nil {
@@ -149,12 +334,15 @@ func (s *Session) HandleVideoSample(tsMS int64, ctsMS int64, data []byte, isKey
 }
 
 func (s *Session) HandleAudioSample(tsMS int64, data []byte) error {
+	s.markClockBase(tsMS)
+	s.meter.observe(tsMS, len(data), false)
 	s.inspector.OnAudioSample(tsMS, data)
 	s.inspector.FinalizeIfTimeout(tsMS)
 	s.tryNotifyVideoInfo()
 	if err := s.maybeDecide(tsMS); err != nil {
 		return err
 	}
+	s.updateStats()
 	if s.accepted {
 		if s.archiveRecorder != nil {
 			if err := s.archiveRecorder.AddAudioSample(tsMS, data); err != nil {
@@ -166,6 +354,73 @@ func (s *Session) HandleAudioSample(tsMS int64, data []byte) error {
 	return s.bufferSample(ingestSample{kind: "audio", tsMS: tsMS, data: data})
 }
 
+// SetDisconnect sets how the admin API drops the publisher's connection.
+func (s *Session) SetDisconnect(disconnect func()) {
+	s.disconnect = disconnect
+}
+
+// Disconnect drops the publisher. The session closes as the connection
+// goes away.
+func (s *Session) Disconnect() {
+	if s.disconnect != nil {
+		s.disconnect()
+	}
+}
+
+func (s *Session) updateStats() {
+	result, ok := s.inspector.Result()
+	s.statsMu.Lock()
+	if ok {
+		s.stats = result
+		s.statsAccepted = s.accepted
+	}
+	s.statsBitrate = s.meter.bitrate()
+	s.statsMu.Unlock()
+}
+
+// Info describes the session; it is safe to call from any goroutine.
+func (s *Session) Info() SessionInfo {
+	s.statsMu.Lock()
+	stats, accepted, bitrate := s.stats, s.statsAccepted, s.statsBitrate
+	s.statsMu.Unlock()
+	info := SessionInfo{
+		SessionID:     s.ID,
+		StreamName:    s.StreamName,
+		StreamKeyHash: maskStreamKey(s.StreamKey),
+		App:           s.App,
+		RemoteIP:      s.RemoteIP,
+		UserAgent:     s.UserAgent,
+		StartedAt:     s.startedAt,
+		UptimeSeconds: time.Since(s.startedAt).Seconds(),
+		Accepted:      accepted,
+		VideoCodec:    stats.VideoCodec,
+		AudioCodec:    stats.AudioCodec,
+		Width:         stats.Width,
+		Height:        stats.Height,
+		FPS:           stats.VideoFPS,
+		BitrateBps:    bitrate,
+	}
+	if s.archiveManager != nil {
+		info.Archive = s.archiveManager.State(s.StreamName)
+	}
+	if relays := s.RelayStatuses(); len(relays) > 0 {
+		info.Relays = relays
+	}
+	return info
+}
+
+// markClockBase ties the first RTMP timestamp to the wall clock at ingest,
+// before any buffering, for EXT-X-PROGRAM-DATE-TIME.
+func (s *Session) markClockBase(tsMS int64) {
+	if s.clockBaseSet {
+		return
+	}
+	s.clockBaseSet = true
+	s.clockBaseTS = tsMS
+	s.clockBaseWall = time.Now()
+	s.packager.SetClockBase(s.clockBaseTS, s.clockBaseWall)
+}
+
 func (s *Session) HandleMetadata(meta map[string]interface{}) {
 	if meta == nil {
 		return
@@ -176,22 +431,270 @@ func (s *Session) HandleMetadata(meta map[string]interface{}) {
 	s.tryNotifyVideoInfo()
 }
 
+// HandleTimedMetadata packages an onCuePoint or onTextData event with the
+// media around it.
+func (s *Session) HandleTimedMetadata(tsMS int64, ev metadata.Event) error {
+	if s.accepted {
+		return s.packager.AddTimedMetadata(tsMS, ev)
+	}
+	return s.bufferSample(ingestSample{kind: "metadata", tsMS: tsMS, event: ev})
+}
+
+// PublishTag forwards the raw FLV tag to RTMP players of this session.
+func (s *Session) PublishTag(t *MediaTag) {
+	s.broadcaster.Publish(t)
+}
+
+func (s *Session) Subscribe() (*Subscriber, error) {
+	return s.broadcaster.Subscribe()
+}
+
+func (s *Session) Tracks() (hasAudio, hasVideo bool) {
+	return s.broadcaster.Tracks()
+}
+
+// SetRelayTargets records the external RTMP targets from the auth response.
+// Relays start once the stream is accepted.
+func (s *Session) SetRelayTargets(targets []string) {
+	s.relayTargets = targets
+}
+
+func (s *Session) RelayStatuses() []RelayStatus {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+	statuses := make([]RelayStatus, 0, len(s.relays))
+	for _, relay := range s.relays {
+		statuses = append(statuses, relay.Status())
+	}
+	return statuses
+}
+
+func (s *Session) startRelays() {
+	if !s.cfg.Relay.Enable || len(s.relayTargets) == 0 {
+		return
+	}
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+	for _, target := range s.relayTargets {
+		if s.cfg.Relay.MaxTargets > 0 && len(s.relays) >= s.cfg.Relay.MaxTargets {
+			s.log.WithField("max", s.cfg.Relay.MaxTargets).Warn("relay targets truncated")
+			break
+		}
+		relay, err := NewRelay(s.cfg.Relay, s.broadcaster, s.log, target)
+		if err != nil {
+			s.log.WithError(err).Warn("relay target invalid")
+			continue
+		}
+		s.relays = append(s.relays, relay)
+		relay.Start()
+	}
+}
+
+// SetLadder overrides the transcoding ladder from the auth response. nil keeps
+// the per-app or default ladder.
+func (s *Session) SetLadder(ladder []string) {
+	s.ladder = ladder
+}
+
+func (s *Session) transcodeLadder() []string {
+	if s.ladder != nil {
+		return s.ladder
+	}
+	if ladder, ok := s.cfg.Transcode.AppLadders[s.App]; ok {
+		return ladder
+	}
+	return s.cfg.Transcode.Ladder
+}
+
+func (s *Session) startTranscode(result inspect.Result) {
+	if !s.cfg.Transcode.Enable || s.transcoder != nil {
+		return
+	}
+	specs := s.transcodeLadder()
+	if len(specs) == 0 {
+		return
+	}
+	ladder, err := ParseLadder(specs)
+	if err != nil {
+		s.log.WithError(err).Warn("transcode ladder invalid")
+		return
+	}
+	transcoder := NewTranscoder(s.cfg.Transcode, s.broadcaster, s.StreamName, s.log, result, ladder, func(streamID string) *packager.Packager {
+		return s.newPackager(streamID)
+	})
+	if transcoder == nil {
+		return
+	}
+	s.transcoder = transcoder
+	transcoder.LinkRenditions(s.packager, s.cfg.HLS.PlaylistFilename)
+	transcoder.SetClockBase(s.clockBaseTS, s.clockBaseWall)
+	transcoder.Start()
+}
+
+// writeMasterPlaylists lists the source and any renditions in master.m3u8.
+// The live master is only needed with renditions, demuxed audio or
+// captions; the rewind master is also written for the I-frame playlists.
+func (s *Session) writeMasterPlaylists(result inspect.Result) {
+	s.masterResult = result
+	playlistName := s.cfg.HLS.PlaylistFilename
+	iframeName := s.cfg.HLS.IFramePlaylistName
+	audioURI := s.packager.AudioRendition()
+	if result.AudioCodec == "" {
+		audioURI = ""
+	}
+	var media []hls.Media
+	if audioURI != "" {
+		media = append(media, hls.Media{Type: hls.MediaAudio, GroupID: "audio", Name: "Main", URI: audioURI, Channels: result.Channels, Default: true, Autoselect: true})
+	}
+	media = append(media, s.captionMedia(result)...)
+	if s.transcoder == nil && len(media) == 0 && (!s.storage.EnableRewind || iframeName == "") {
+		return
+	}
+	var variants []hls.Variant
+	if result.InitialBitrate > 0 {
+		codecs := result.VideoConfig.CodecString()
+		if audio := result.AudioConfig.CodecString(); audio != "" {
+			codecs += "," + audio
+		}
+		variants = append(variants, hls.Variant{
+			URI:       playlistName,
+			Bandwidth: result.InitialBitrate,
+			Codecs:    codecs,
+			Width:     result.Width,
+			Height:    result.Height,
+			FrameRate: result.VideoFPS,
+		})
+		if audioURI != "" {
+			variants[0].Audio = "audio"
+		}
+	} else {
+		s.log.Warn("master playlist: source bitrate unknown, omitting source")
+	}
+	if s.transcoder != nil {
+		variants = append(variants, s.transcoder.Variants(playlistName)...)
+	}
+	for i := range variants {
+		for _, m := range media {
+			switch m.Type {
+			case hls.MediaSubtitles:
+				variants[i].Subtitles = m.GroupID
+			case hls.MediaClosedCaptions:
+				variants[i].ClosedCaptions = m.GroupID
+			}
+		}
+	}
+	iframes := iframeVariants(variants, playlistName, iframeName)
+	if audioURI != "" {
+		// The audio rendition doubles as a low-bandwidth fallback.
+		if result.AudioBitrate > 0 {
+			variants = append(variants, hls.Variant{
+				URI:       audioURI,
+				Bandwidth: result.AudioBitrate,
+				Codecs:    result.AudioConfig.CodecString(),
+			})
+		} else {
+			s.log.Warn("master playlist: audio bitrate unknown, omitting audio-only variant")
+		}
+	}
+	masterName := s.cfg.Transcode.MasterPlaylistName
+	if s.transcoder != nil || len(media) > 0 {
+		if err := hls.WriteMaster(s.storage.StreamDir(s.StreamName), masterName, media, variants, nil); err != nil {
+			s.log.WithError(err).Error("master playlist write error")
+		}
+	}
+	if s.storage.EnableRewind {
+		if err := hls.WriteMaster(s.storage.RewindDir(s.StreamName), masterName, media, variants, iframes); err != nil {
+			s.log.WithError(err).Error("master playlist write error")
+		}
+	}
+}
+
+// captionMedia declares the closed captions carried in the video, and the
+// WebVTT rendition extracted from CC1 when extraction is on.
+func (s *Session) captionMedia(result inspect.Result) []hls.Media {
+	var media []hls.Media
+	if result.CEA608 {
+		media = append(media, hls.Media{Type: hls.MediaClosedCaptions, GroupID: "cc", Name: "CC1", InstreamID: "CC1", Default: true, Autoselect: true})
+	}
+	if result.CEA708 {
+		media = append(media, hls.Media{Type: hls.MediaClosedCaptions, GroupID: "cc", Name: "SERVICE1", InstreamID: "SERVICE1", Default: !result.CEA608, Autoselect: true})
+	}
+	if name := captionsPlaylistName(s.cfg); name != "" && result.CEA608 {
+		media = append(media, hls.Media{Type: hls.MediaSubtitles, GroupID: "subs", Name: "CC1", URI: name, Autoselect: true})
+	}
+	return media
+}
+
+// announceCaptions rewrites the master playlists when captions show up
+// after the stream was accepted.
+func (s *Session) announceCaptions() {
+	if !s.accepted {
+		return
+	}
+	cea608, cea708 := s.inspector.Captions()
+	if cea608 == s.masterResult.CEA608 && cea708 == s.masterResult.CEA708 {
+		return
+	}
+	result := s.masterResult
+	result.CEA608, result.CEA708 = cea608, cea708
+	s.writeMasterPlaylists(result)
+}
+
+// iframeVariants pairs each variant with the I-frame playlist next to it.
+// The variant's peak bandwidth bounds the I-frame stream's: segments open
+// on a keyframe, so each I-frame range is a prefix of a segment that lasts
+// as long as the I-frame is shown.
+func iframeVariants(variants []hls.Variant, playlistName, iframeName string) []hls.IFrameVariant {
+	if iframeName == "" {
+		return nil
+	}
+	var iframes []hls.IFrameVariant
+	for _, v := range variants {
+		videoCodec, _, _ := strings.Cut(v.Codecs, ",")
+		iframes = append(iframes, hls.IFrameVariant{
+			URI:       strings.TrimSuffix(v.URI, playlistName) + iframeName,
+			Bandwidth: v.Bandwidth,
+			Codecs:    videoCodec,
+			Width:     v.Width,
+			Height:    v.Height,
+		})
+	}
+	return iframes
+}
+
+func (s *Session) stopRelays() {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+	for _, relay := range s.relays {
+		relay.Stop()
+	}
+}
+
 func (s *Session) Close(ctx context.Context) {
 	if s.closed {
 		return
 	}
 	s.closed = true
+	metrics.StreamEnded(s.meter.stream)
+	s.stopRelays()
+	if s.transcoder != nil {
+		s.transcoder.Stop()
+	}
+	s.broadcaster.Close()
 	if s.accepted {
 		if err := s.packager.Flush(); err != nil {
-			log.Printf("packager flush error: %v", err)
+			s.log.WithError(err).Error("packager flush error")
 		}
 	}
 	if s.archiveManager != nil {
 		s.archiveManager.EndSession(s.StreamName)
 	}
-	if err := s.policy.NotifyStreamEnd(ctx, s.StreamKey); err != nil {
-		log.Printf("stream end notify error: %v", err)
+	if err := s.policy.NotifyStreamEnd(logging.NewContext(ctx, s.log), s.StreamKey); err != nil {
+		s.log.WithError(err).Warn("stream end notify error")
 	}
+	uptime := time.Since(s.startedAt).Seconds()
+	s.log.WithField("uptime_seconds", uptime).Info("publish end")
+	s.emit(events.PublishEnd, "", map[string]interface{}{"uptime_seconds": uptime, "accepted": s.accepted})
 }
 
 func (s *Session) maybeDecide(tsMS int64) error {
@@ -202,14 +705,24 @@ func (s *Session) maybeDecide(tsMS int64) error {
 	if !ok {
 		return nil
 	}
-	decision := s.policy.Evaluate(context.Background(), res)
+	decision := s.policy.Evaluate(s.context(), res)
 	switch decision.Decision {
 	case policy.DecisionReject:
-		log.Printf("stream rejected: stream_key_hash=%s reason=%s", maskStreamKey(s.StreamKey), decision.Reason)
+		s.log.WithField("reason", decision.Reason).Warn("stream rejected")
+		s.emit(events.Rejected, decision.Reason, resultData(res))
 		return fmt.Errorf("rejected: %s", decision.Reason)
 	case policy.DecisionAccept, policy.DecisionDegraded:
-		log.Printf("stream accepted: stream_key_hash=%s decision=%d", maskStreamKey(s.StreamKey), decision.Decision)
+		s.log.WithField("decision", decision.Decision).Info("stream accepted")
+		if decision.Decision == policy.DecisionDegraded {
+			s.emit(events.Degraded, decision.Reason, resultData(res))
+		} else {
+			s.emit(events.Accepted, "", resultData(res))
+		}
 		s.accepted = true
+		s.broadcaster.Start()
+		s.startRelays()
+		s.startTranscode(res)
+		s.writeMasterPlaylists(res)
 		if err := s.startArchive(res); err != nil {
 			return err
 		}
@@ -231,8 +744,8 @@ func (s *Session) tryNotifyVideoInfo() {
 		return
 	}
 	s.videoInfoSent = true
-	if err := s.policy.NotifyVideoInfo(context.Background(), s.StreamName, result); err != nil {
-		log.Printf("video info notify error: %v", err)
+	if err := s.policy.NotifyVideoInfo(s.context(), s.StreamName, result); err != nil {
+		s.log.WithError(err).Warn("video info notify error")
 	}
 }
 
@@ -240,7 +753,11 @@ func (s *Session) startArchive(result inspect.Result) error {
 	if s.archiveManager == nil || s.archiveRecorder != nil {
 		return nil
 	}
-	recorder, err := s.archiveManager.Start(s.StreamName, result.InitialBitrate)
+	recorder, err := s.archiveManager.Start(s.StreamName, result.InitialBitrate, archive.Publisher{
+		Metrics: s.metricsStream(),
+		Log:     s.log,
+		Event:   s.eventSource(),
+	})
 	if err != nil {
 		return err
 	}
@@ -248,6 +765,19 @@ func (s *Session) startArchive(result inspect.Result) error {
 	return nil
 }
 
+// resultData describes the inspected stream in accepted, degraded and
+// rejected events.
+func resultData(res inspect.Result) map[string]interface{} {
+	return map[string]interface{}{
+		"video_codec": res.VideoCodec,
+		"audio_codec": res.AudioCodec,
+		"width":       res.Width,
+		"height":      res.Height,
+		"fps":         res.VideoFPS,
+		"bitrate_bps": res.InitialBitrate,
+	}
+}
+
 func (s *Session) bufferSample(sample ingestSample) error {
 	if sample.kind == "video" || sample.kind == "audio" {
 		if s.bufferStartMS == 0 {
@@ -266,20 +796,20 @@ func (s *Session) flushBuffer() error {
 		switch sample.kind {
 		case "video-config":
 			if s.archiveRecorder != nil {
-				if err := s.archiveRecorder.UpdateVideoConfig(sample.avcCfg); err != nil {
+				if err := s.archiveRecorder.UpdateVideoConfig(sample.videoCfg); err != nil {
 					return err
 				}
 			}
-			if err := s.packager.UpdateVideoConfig(sample.avcCfg); err != nil {
+			if err := s.packager.UpdateVideoConfig(sample.videoCfg); err != nil {
 				return err
 			}
 		case "audio-config":
 			if s.archiveRecorder != nil {
-				if err := s.archiveRecorder.UpdateAudioConfig(sample.aacCfg); err != nil {
+				if err := s.archiveRecorder.UpdateAudioConfig(sample.audioCfg); err != nil {
 					return err
 				}
 			}
-			if err := s.packager.UpdateAudioConfig(sample.aacCfg); err != nil {
+			if err := s.packager.UpdateAudioConfig(sample.audioCfg); err != nil {
 				return err
 			}
 		case "video":
@@ -300,6 +830,10 @@ func (s *Session) flushBuffer() error {
 			if err := s.packager.AddAudioSample(sample.tsMS, sample.data); err != nil {
 				return err
 			}
+		case "metadata":
+			if err := s.packager.AddTimedMetadata(sample.tsMS, sample.event); err != nil {
+				return err
+			}
 		}
 	}
 	s.buffer = nil
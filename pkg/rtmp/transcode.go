@@ -0,0 +1,451 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yutopp/go-flv/tag"
+
+	"tokuly-live-rtmp-server/pkg/config"
+	"tokuly-live-rtmp-server/pkg/hls"
+	"tokuly-live-rtmp-server/pkg/inspect"
+	"tokuly-live-rtmp-server/pkg/packager"
+	"tokuly-live-rtmp-server/pkg/util"
+)
+
+const (
+	// Renditions are encoded as H.264 Main@4.0 so CODECS is known before
+	// ffmpeg produces its first sequence header.
+	transcodeVideoProfile = "main"
+	transcodeVideoLevel   = "4.0"
+	transcodeVideoCodecs  = "avc1.4d4028"
+	transcodeAudioCodecs  = "mp4a.40.2"
+
+	transcodeStopTimeout = 5 * time.Second
+	transcodeStderrLimit = 4096
+)
+
+// TranscodeRendition is one step of the ABR ladder.
+type TranscodeRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int64
+}
+
+// ParseLadder parses rendition specs such as "720p@2800k" or "480p".
+func ParseLadder(specs []string) ([]TranscodeRendition, error) {
+	var out []TranscodeRendition
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		rendition, err := parseRendition(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[rendition.Name] {
+			continue
+		}
+		seen[rendition.Name] = true
+		out = append(out, rendition)
+	}
+	return out, nil
+}
+
+func parseRendition(spec string) (TranscodeRendition, error) {
+	name, bitrate, hasBitrate := strings.Cut(strings.TrimSpace(spec), "@")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, "p") {
+		return TranscodeRendition{}, fmt.Errorf("invalid rendition %q", spec)
+	}
+	height, err := strconv.Atoi(strings.TrimSuffix(name, "p"))
+	if err != nil || height <= 0 || height%2 != 0 {
+		return TranscodeRendition{}, fmt.Errorf("invalid rendition height %q", spec)
+	}
+	rendition := TranscodeRendition{Name: name, Height: height}
+	if hasBitrate {
+		rendition.VideoBitrate, err = parseBitrate(bitrate)
+		if err != nil {
+			return TranscodeRendition{}, fmt.Errorf("invalid rendition bitrate %q", spec)
+		}
+	} else {
+		// Roughly 2.8 Mbps at 720p, scaling with the pixel count.
+		rendition.VideoBitrate = int64(height) * int64(height) * 11 / 2
+	}
+	return rendition, nil
+}
+
+func parseBitrate(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"):
+		scale = 1000
+		value = strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		scale = 1000000
+		value = strings.TrimSuffix(value, "m")
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid bitrate")
+	}
+	return int64(v * scale), nil
+}
+
+// Transcoder runs one ffmpeg process per rendition. Each process reads the
+// session's FLV from its own broadcaster subscription and its output is
+// packaged into {stream}/{rendition} by a separate Packager. Timestamps are
+// kept (-copyts) and keyframes follow the source, so segments line up with
+// the source rendition.
+type Transcoder struct {
+	cfg         config.TranscodeConfig
+	broadcaster *Broadcaster
+	log         *logrus.Entry
+	source      inspect.Result
+	workers     []*transcodeWorker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stopCh chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+type transcodeWorker struct {
+	rendition TranscodeRendition
+	width     int
+	packager  *packager.Packager
+}
+
+// NewTranscoder drops renditions that would upscale the source and returns
+// nil when none remain. newPackager creates the packager for a rendition
+// directory below the stream.
+func NewTranscoder(cfg config.TranscodeConfig, broadcaster *Broadcaster, streamName string, log *logrus.Entry, source inspect.Result, ladder []TranscodeRendition, newPackager func(streamID string) *packager.Packager) *Transcoder {
+	if source.Width <= 0 || source.Height <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Transcoder{
+		cfg:         cfg,
+		broadcaster: broadcaster,
+		log:         log,
+		source:      source,
+		ctx:         ctx,
+		cancel:      cancel,
+		stopCh:      make(chan struct{}),
+	}
+	for _, rendition := range ladder {
+		if rendition.Height >= source.Height {
+			continue
+		}
+		width := int(math.Round(float64(source.Width)*float64(rendition.Height)/float64(source.Height)/2)) * 2
+		t.workers = append(t.workers, &transcodeWorker{
+			rendition: rendition,
+			width:     width,
+			packager:  newPackager(path.Join(streamName, rendition.Name)),
+		})
+	}
+	if len(t.workers) == 0 {
+		cancel()
+		return nil
+	}
+	return t
+}
+
+// LinkRenditions sets rendition reports between the source packager, whose
+// playlist is named playlistName, and every transcoded rendition.
+func (t *Transcoder) LinkRenditions(source *packager.Packager, playlistName string) {
+	var fromSource []hls.Rendition
+	for _, w := range t.workers {
+		fromSource = append(fromSource, hls.Rendition{URI: w.rendition.Name + "/" + playlistName, Playlist: w.packager.Playlist()})
+	}
+	source.SetRenditions(fromSource)
+	for _, w := range t.workers {
+		renditions := []hls.Rendition{{URI: "../" + playlistName, Playlist: source.Playlist()}}
+		for _, other := range t.workers {
+			if other == w {
+				continue
+			}
+			renditions = append(renditions, hls.Rendition{URI: "../" + other.rendition.Name + "/" + playlistName, Playlist: other.packager.Playlist()})
+		}
+		w.packager.SetRenditions(renditions)
+	}
+}
+
+// Variants lists the transcoded renditions for the master playlist.
+func (t *Transcoder) Variants(playlistName string) []hls.Variant {
+	hasAudio := t.source.AudioCodec != ""
+	codecs := transcodeVideoCodecs
+	if hasAudio {
+		codecs += "," + transcodeAudioCodecs
+	}
+	var variants []hls.Variant
+	for _, w := range t.workers {
+		average := w.rendition.VideoBitrate
+		if hasAudio {
+			average += t.cfg.AudioBitrate
+		}
+		variants = append(variants, hls.Variant{
+			URI:              w.rendition.Name + "/" + playlistName,
+			Bandwidth:        average * 11 / 10,
+			AverageBandwidth: average,
+			Codecs:           codecs,
+			Width:            w.width,
+			Height:           w.rendition.Height,
+			FrameRate:        t.source.VideoFPS,
+		})
+	}
+	return variants
+}
+
+// SetClockBase forwards the session's ingest clock so renditions carry the
+// same EXT-X-PROGRAM-DATE-TIME as the source. Call before Start.
+func (t *Transcoder) SetClockBase(tsMS int64, wall time.Time) {
+	for _, w := range t.workers {
+		w.packager.SetClockBase(tsMS, wall)
+	}
+}
+
+func (t *Transcoder) Start() {
+	for _, w := range t.workers {
+		t.wg.Add(1)
+		go t.run(w)
+	}
+	go func() {
+		t.wg.Wait()
+		t.cancel()
+	}()
+}
+
+// Stop closes ffmpeg's input so it can drain, and kills it if it has not
+// exited within transcodeStopTimeout.
+func (t *Transcoder) Stop() {
+	t.once.Do(func() {
+		close(t.stopCh)
+		time.AfterFunc(transcodeStopTimeout, t.cancel)
+	})
+}
+
+func (t *Transcoder) run(w *transcodeWorker) {
+	defer t.wg.Done()
+	log := t.log.WithField("rendition", w.rendition.Name)
+	sub, err := t.broadcaster.Subscribe()
+	if err != nil {
+		log.WithError(err).Error("transcode subscribe error")
+		return
+	}
+	defer sub.Close()
+
+	cmd := exec.CommandContext(t.ctx, t.cfg.FFmpegPath, t.ffmpegArgs(w)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.WithError(err).Error("transcode start error")
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.WithError(err).Error("transcode start error")
+		return
+	}
+	stderr := &limitedBuffer{limit: transcodeStderrLimit}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Error("transcode start error")
+		return
+	}
+	log.Info("transcode started")
+
+	go t.feed(stdin, sub)
+	readErr := t.readOutput(w, stdout)
+	if readErr != nil {
+		// Unblock ffmpeg and the feeder; the rendition is not restarted.
+		_ = cmd.Process.Kill()
+	}
+	sub.Close()
+	waitErr := cmd.Wait()
+	if err := w.packager.Flush(); err != nil {
+		log.WithError(err).Error("transcode flush error")
+	}
+	switch {
+	case readErr != nil:
+		log.WithError(readErr).Error("transcode error")
+	case waitErr != nil && t.ctx.Err() == nil:
+		log.WithError(waitErr).WithField("output", strings.TrimSpace(stderr.String())).Error("transcode error")
+	default:
+		log.Info("transcode stopped")
+	}
+}
+
+// feed writes the subscription to ffmpeg's stdin as an FLV stream and closes
+// stdin when the stream ends or the transcoder stops.
+func (t *Transcoder) feed(stdin io.WriteCloser, sub *Subscriber) {
+	defer stdin.Close()
+	hasAudio, hasVideo := t.broadcaster.Tracks()
+	w := bufio.NewWriter(stdin)
+	if _, err := w.Write(FLVHeader(hasAudio, hasVideo)); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-t.stopCh:
+			_ = w.Flush()
+			return
+		case mt, ok := <-sub.C():
+			if !ok {
+				_ = w.Flush()
+				return
+			}
+			if _, err := w.Write(EncodeFLVTag(mt, mt.Timestamp)); err != nil {
+				return
+			}
+			if len(sub.C()) == 0 {
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Transcoder) readOutput(w *transcodeWorker, stdout io.Reader) error {
+	r := bufio.NewReader(stdout)
+	if err := readFLVHeader(r); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	for {
+		mt, err := readFLVTag(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		if err := packageTranscodedTag(w.packager, mt); err != nil {
+			return err
+		}
+	}
+}
+
+// packageTranscodedTag handles the legacy AVC/AAC tags ffmpeg's FLV muxer
+// produces.
+func packageTranscodedTag(p *packager.Packager, mt *MediaTag) error {
+	switch mt.Type {
+	case tag.TagTypeVideo:
+		var video tag.VideoData
+		if err := tag.DecodeVideoData(bytes.NewReader(mt.Payload), &video); err != nil {
+			return err
+		}
+		if video.CodecID != tag.CodecIDAVC {
+			return nil
+		}
+		body, err := io.ReadAll(video.Data)
+		if err != nil {
+			return err
+		}
+		switch video.AVCPacketType {
+		case tag.AVCPacketTypeSequenceHeader:
+			cfg, err := util.ParseVideoConfig(util.VideoCodecH264, body)
+			if err != nil {
+				return err
+			}
+			return p.UpdateVideoConfig(cfg)
+		case tag.AVCPacketTypeNALU:
+			return p.AddVideoSample(int64(mt.Timestamp), int64(video.CompositionTime), body, video.FrameType == tag.FrameTypeKeyFrame)
+		}
+	case tag.TagTypeAudio:
+		var audio tag.AudioData
+		if err := tag.DecodeAudioData(bytes.NewReader(mt.Payload), &audio); err != nil {
+			return err
+		}
+		if audio.SoundFormat != tag.SoundFormatAAC {
+			return nil
+		}
+		body, err := io.ReadAll(audio.Data)
+		if err != nil {
+			return err
+		}
+		switch audio.AACPacketType {
+		case tag.AACPacketTypeSequenceHeader:
+			cfg, err := util.ParseAudioSpecificConfig(body)
+			if err != nil {
+				return err
+			}
+			return p.UpdateAudioConfig(util.AudioConfig{Codec: util.AudioCodecAAC, AAC: cfg})
+		case tag.AACPacketTypeRaw:
+			return p.AddAudioSample(int64(mt.Timestamp), body)
+		}
+	}
+	return nil
+}
+
+func (t *Transcoder) ffmpegArgs(w *transcodeWorker) []string {
+	bitrate := strconv.FormatInt(w.rendition.VideoBitrate, 10)
+	bufsize := strconv.FormatInt(w.rendition.VideoBitrate*2, 10)
+	return []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-fflags", "nobuffer",
+		"-f", "flv",
+		"-i", "pipe:0",
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-copyts",
+		"-c:v", "libx264",
+		"-preset", t.cfg.Preset,
+		"-tune", "zerolatency",
+		"-profile:v", transcodeVideoProfile,
+		"-level:v", transcodeVideoLevel,
+		"-pix_fmt", "yuv420p",
+		"-vf", fmt.Sprintf("scale=%d:%d", w.width, w.rendition.Height),
+		"-b:v", bitrate,
+		"-maxrate", bitrate,
+		"-bufsize", bufsize,
+		"-force_key_frames", "source",
+		"-sc_threshold", "0",
+		"-c:a", "aac",
+		"-b:a", strconv.FormatInt(t.cfg.AudioBitrate, 10),
+		"-flvflags", "no_duration_filesize",
+		"-f", "flv",
+		"pipe:1",
+	}
+}
+
+// limitedBuffer keeps the first limit bytes of ffmpeg's stderr for logging.
+type limitedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -79,6 +79,15 @@ func WriteFileAtomicReader(path string, r io.Reader) error {
 	return os.Rename(tmp, path)
 }
 
+// CreateFile creates or truncates path for writing in place, for files that
+// readers may open while they grow.
+func CreateFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
 func RemoveFile(path string) error {
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
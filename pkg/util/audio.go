@@ -0,0 +1,72 @@
+package util
+
+import "bytes"
+
+const (
+	AudioCodecAAC  = "AAC"
+	AudioCodecOpus = "OPUS"
+	AudioCodecMP3  = "MP3"
+)
+
+type AudioConfig struct {
+	Codec string
+	AAC   AACConfig
+	Opus  OpusConfig
+	MP3   MP3Config
+}
+
+func (c AudioConfig) SampleRate() int {
+	switch c.Codec {
+	case AudioCodecAAC:
+		return c.AAC.SampleRate
+	case AudioCodecOpus:
+		return opusSampleRate
+	case AudioCodecMP3:
+		return c.MP3.SampleRate
+	default:
+		return 0
+	}
+}
+
+func (c AudioConfig) Channels() int {
+	switch c.Codec {
+	case AudioCodecAAC:
+		return c.AAC.Channels
+	case AudioCodecOpus:
+		return c.Opus.Channels
+	case AudioCodecMP3:
+		return c.MP3.Channels
+	default:
+		return 0
+	}
+}
+
+// FrameSamples is the nominal number of samples per coded frame, used as the
+// default sample duration before timestamps are known.
+func (c AudioConfig) FrameSamples() int {
+	switch c.Codec {
+	case AudioCodecOpus:
+		return 960
+	case AudioCodecMP3:
+		return c.MP3.SamplesPerFrame
+	default:
+		return 1024
+	}
+}
+
+func EqualAudioConfig(a, b AudioConfig) bool {
+	if a.Codec != b.Codec {
+		return false
+	}
+	switch a.Codec {
+	case AudioCodecAAC:
+		return a.AAC.SampleRate == b.AAC.SampleRate && a.AAC.Channels == b.AAC.Channels &&
+			a.AAC.ObjectType == b.AAC.ObjectType && bytes.Equal(a.AAC.ASC, b.AAC.ASC)
+	case AudioCodecOpus:
+		return EqualOpusConfig(a.Opus, b.Opus)
+	case AudioCodecMP3:
+		return EqualMP3Config(a.MP3, b.MP3)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,217 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/av1"
+	"github.com/Eyevinn/mp4ff/bits"
+)
+
+const av1OBUSequenceHeader = 1
+
+type AV1Config struct {
+	Record     []byte
+	SeqProfile byte
+	SeqLevel   byte
+	SeqTier    byte
+	BitDepth   int
+	Width      int
+	Height     int
+}
+
+func ParseAV1CodecConfig(data []byte) (AV1Config, error) {
+	cfg := AV1Config{}
+	rec, err := av1.DecodeAV1CodecConfRec(data)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Record = append([]byte(nil), data...)
+	seqHeader := findAV1OBU(rec.ConfigOBUs, av1OBUSequenceHeader)
+	if seqHeader == nil {
+		return cfg, fmt.Errorf("av1 config missing sequence header")
+	}
+	// The sequence header is what the decoder uses; the copies of its
+	// fields in the record are not always kept in sync by encoders.
+	h, err := parseAV1SequenceHeader(seqHeader)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SeqProfile = h.profile
+	cfg.SeqLevel = h.level
+	cfg.SeqTier = h.tier
+	cfg.BitDepth = h.bitDepth
+	cfg.Width = h.width
+	cfg.Height = h.height
+	return cfg, nil
+}
+
+func EqualAV1Config(a, b AV1Config) bool {
+	return bytes.Equal(a.Record, b.Record)
+}
+
+// findAV1OBU returns the payload of the first OBU of the given type in a
+// low overhead bitstream, as stored in configOBUs and in samples.
+func findAV1OBU(data []byte, obuType byte) []byte {
+	offset := 0
+	for offset < len(data) {
+		header := data[offset]
+		typ := (header >> 3) & 0x0f
+		hasExtension := header&0x04 != 0
+		hasSize := header&0x02 != 0
+		offset++
+		if hasExtension {
+			offset++
+		}
+		if offset > len(data) {
+			return nil
+		}
+		size := len(data) - offset
+		if hasSize {
+			value, n := readLEB128(data[offset:])
+			if n == 0 {
+				return nil
+			}
+			offset += n
+			size = int(value)
+		}
+		if size < 0 || offset+size > len(data) {
+			return nil
+		}
+		if typ == obuType {
+			return data[offset : offset+size]
+		}
+		offset += size
+	}
+	return nil
+}
+
+func readLEB128(data []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// av1SequenceHeader holds the fields of sequence_header_obu() that describe
+// the stream.
+type av1SequenceHeader struct {
+	profile  byte
+	level    byte
+	tier     byte
+	bitDepth int
+	width    int
+	height   int
+}
+
+// parseAV1SequenceHeader reads sequence_header_obu() up to the bit depth in
+// color_config() (AV1 spec sections 5.5.1 and 5.5.2). Level and tier are
+// those of operating point 0.
+func parseAV1SequenceHeader(payload []byte) (av1SequenceHeader, error) {
+	var h av1SequenceHeader
+	r := bits.NewReader(bytes.NewReader(payload))
+	h.profile = byte(r.Read(3))
+	r.Read(1) // still_picture
+	reduced := r.ReadFlag()
+	if reduced {
+		h.level = byte(r.Read(5))
+	} else {
+		decoderModelInfo := false
+		bufferDelayLen := 0
+		if r.ReadFlag() { // timing_info_present_flag
+			r.Read(32)        // num_units_in_display_tick
+			r.Read(32)        // time_scale
+			if r.ReadFlag() { // equal_picture_interval
+				leadingZeros := 0
+				for !r.ReadFlag() && leadingZeros < 32 {
+					leadingZeros++
+				}
+				if leadingZeros < 32 {
+					r.Read(leadingZeros)
+				}
+			}
+			decoderModelInfo = r.ReadFlag()
+			if decoderModelInfo {
+				bufferDelayLen = int(r.Read(5)) + 1
+				r.Read(32) // num_units_in_decoding_tick
+				r.Read(5)  // buffer_removal_time_length_minus_1
+				r.Read(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.ReadFlag()
+		opCount := int(r.Read(5)) + 1
+		for i := 0; i < opCount; i++ {
+			r.Read(12) // operating_point_idc
+			level := byte(r.Read(5))
+			tier := byte(0)
+			if level > 7 {
+				tier = byte(r.Read(1))
+			}
+			if i == 0 {
+				h.level, h.tier = level, tier
+			}
+			if decoderModelInfo && r.ReadFlag() {
+				r.Read(bufferDelayLen) // decoder_buffer_delay
+				r.Read(bufferDelayLen) // encoder_buffer_delay
+				r.Read(1)              // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.ReadFlag() {
+				r.Read(4)
+			}
+		}
+	}
+	widthBits := int(r.Read(4)) + 1
+	heightBits := int(r.Read(4)) + 1
+	h.width = int(r.Read(widthBits)) + 1
+	h.height = int(r.Read(heightBits)) + 1
+	frameIDNumbers := false
+	if !reduced {
+		frameIDNumbers = r.ReadFlag()
+	}
+	if frameIDNumbers {
+		r.Read(4) // delta_frame_id_length_minus_2
+		r.Read(3) // additional_frame_id_length_minus_1
+	}
+	r.Read(1) // use_128x128_superblock
+	r.Read(1) // enable_filter_intra
+	r.Read(1) // enable_intra_edge_filter
+	if !reduced {
+		r.Read(1) // enable_interintra_compound
+		r.Read(1) // enable_masked_compound
+		r.Read(1) // enable_warped_motion
+		r.Read(1) // enable_dual_filter
+		orderHint := r.ReadFlag()
+		if orderHint {
+			r.Read(1) // enable_jnt_comp
+			r.Read(1) // enable_ref_frame_mvs
+		}
+		forceScreenContentTools := uint(2)
+		if !r.ReadFlag() { // seq_choose_screen_content_tools
+			forceScreenContentTools = r.Read(1)
+		}
+		if forceScreenContentTools > 0 && !r.ReadFlag() { // seq_choose_integer_mv
+			r.Read(1) // seq_force_integer_mv
+		}
+		if orderHint {
+			r.Read(3) // order_hint_bits_minus_1
+		}
+	}
+	r.Read(1) // enable_superres
+	r.Read(1) // enable_cdef
+	r.Read(1) // enable_restoration
+	h.bitDepth = 8
+	if r.ReadFlag() { // high_bitdepth
+		h.bitDepth = 10
+		if h.profile == 2 && r.ReadFlag() { // twelve_bit
+			h.bitDepth = 12
+		}
+	}
+	if err := r.AccError(); err != nil {
+		return h, fmt.Errorf("av1 sequence header: %w", err)
+	}
+	return h, nil
+}
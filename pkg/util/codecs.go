@@ -0,0 +1,93 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+)
+
+// CodecString returns the RFC 6381 codec identifier written into the sample
+// entry, or "" when the config is not ready.
+func (c VideoConfig) CodecString() string {
+	switch c.Codec {
+	case VideoCodecH264:
+		if len(c.AVC.SPS) == 0 {
+			return ""
+		}
+		sps, err := avc.ParseSPSNALUnit(c.AVC.SPS[0], false)
+		if err != nil {
+			return fmt.Sprintf("avc1.%02X%02X%02X", c.AVC.Profile, c.AVC.Compatibility, c.AVC.Level)
+		}
+		return avc.CodecString("avc1", sps)
+	case VideoCodecHEVC:
+		if len(c.HEVC.SPS) == 0 {
+			return ""
+		}
+		sps, err := hevc.ParseSPSNALUnit(c.HEVC.SPS[0])
+		if err != nil {
+			return ""
+		}
+		return hevc.CodecString("hvc1", sps)
+	case VideoCodecAV1:
+		tier := "M"
+		if c.AV1.SeqTier != 0 {
+			tier = "H"
+		}
+		bitDepth := c.AV1.BitDepth
+		if bitDepth == 0 {
+			bitDepth = 8
+		}
+		return fmt.Sprintf("av01.%d.%02d%s.%02d", c.AV1.SeqProfile, c.AV1.SeqLevel, tier, bitDepth)
+	default:
+		return ""
+	}
+}
+
+// Dimensions returns the coded picture size, or zeros when unknown.
+func (c VideoConfig) Dimensions() (int, int) {
+	switch c.Codec {
+	case VideoCodecH264:
+		if len(c.AVC.SPS) == 0 {
+			return 0, 0
+		}
+		sps, err := avc.ParseSPSNALUnit(c.AVC.SPS[0], false)
+		if err != nil {
+			return 0, 0
+		}
+		return int(sps.Width), int(sps.Height)
+	case VideoCodecHEVC:
+		if len(c.HEVC.SPS) == 0 {
+			return 0, 0
+		}
+		sps, err := hevc.ParseSPSNALUnit(c.HEVC.SPS[0])
+		if err != nil {
+			return 0, 0
+		}
+		width, height := sps.ImageSize()
+		return int(width), int(height)
+	case VideoCodecAV1:
+		return c.AV1.Width, c.AV1.Height
+	default:
+		return 0, 0
+	}
+}
+
+// CodecString returns the RFC 6381 codec identifier written into the sample
+// entry, or "" when there is no audio.
+func (c AudioConfig) CodecString() string {
+	switch c.Codec {
+	case AudioCodecAAC:
+		objectType := c.AAC.ObjectType
+		if objectType == 0 {
+			objectType = 2
+		}
+		return fmt.Sprintf("mp4a.40.%d", objectType)
+	case AudioCodecOpus:
+		return "opus"
+	case AudioCodecMP3:
+		return fmt.Sprintf("mp4a.%02X", MP3ObjectType(c.MP3))
+	default:
+		return ""
+	}
+}
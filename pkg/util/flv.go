@@ -0,0 +1,146 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Enhanced RTMP (veovera enhanced-rtmp v1) extended tag headers.
+
+const (
+	FourCCAVC  = "avc1"
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+)
+
+type ExVideoPacketType byte
+
+const (
+	ExVideoPacketSequenceStart        ExVideoPacketType = 0
+	ExVideoPacketCodedFrames          ExVideoPacketType = 1
+	ExVideoPacketSequenceEnd          ExVideoPacketType = 2
+	ExVideoPacketCodedFramesX         ExVideoPacketType = 3
+	ExVideoPacketMetadata             ExVideoPacketType = 4
+	ExVideoPacketMPEG2TSSequenceStart ExVideoPacketType = 5
+	ExVideoPacketMultitrack           ExVideoPacketType = 6
+)
+
+const (
+	ExVideoFrameKey     byte = 1
+	ExVideoFrameCommand byte = 5
+)
+
+type ExVideoTag struct {
+	FrameType       byte
+	PacketType      ExVideoPacketType
+	FourCC          string
+	CompositionTime int32
+	Data            []byte
+}
+
+func IsExVideoHeader(first byte) bool {
+	return first&0x80 != 0
+}
+
+func ParseExVideoTag(data []byte) (ExVideoTag, error) {
+	tag := ExVideoTag{}
+	if len(data) < 5 {
+		return tag, fmt.Errorf("ex video tag too short")
+	}
+	if !IsExVideoHeader(data[0]) {
+		return tag, fmt.Errorf("not an ex video tag")
+	}
+	tag.FrameType = (data[0] >> 4) & 0x07
+	tag.PacketType = ExVideoPacketType(data[0] & 0x0f)
+	if tag.PacketType == ExVideoPacketMultitrack {
+		return tag, fmt.Errorf("multitrack video not supported")
+	}
+	tag.FourCC = string(data[1:5])
+	body := data[5:]
+	if tag.PacketType == ExVideoPacketCodedFrames && tag.FourCC != FourCCAV1 {
+		if len(body) < 3 {
+			return tag, fmt.Errorf("ex video tag missing composition time")
+		}
+		tag.CompositionTime = readSI24(body[:3])
+		body = body[3:]
+	}
+	tag.Data = body
+	return tag, nil
+}
+
+func VideoCodecFromFourCC(fourCC string) string {
+	switch fourCC {
+	case FourCCAVC:
+		return VideoCodecH264
+	case FourCCHEVC:
+		return VideoCodecHEVC
+	case FourCCAV1:
+		return VideoCodecAV1
+	default:
+		return ""
+	}
+}
+
+func readSI24(b []byte) int32 {
+	var buf [4]byte
+	copy(buf[0:3], b)
+	return int32(binary.BigEndian.Uint32(buf[:])) >> 8
+}
+
+const (
+	FourCCAAC  = "mp4a"
+	FourCCOpus = "Opus"
+	FourCCMP3  = ".mp3"
+)
+
+const exAudioSoundFormat = 9
+
+type ExAudioPacketType byte
+
+const (
+	ExAudioPacketSequenceStart      ExAudioPacketType = 0
+	ExAudioPacketCodedFrames        ExAudioPacketType = 1
+	ExAudioPacketSequenceEnd        ExAudioPacketType = 2
+	ExAudioPacketMultichannelConfig ExAudioPacketType = 4
+	ExAudioPacketMultitrack         ExAudioPacketType = 5
+)
+
+type ExAudioTag struct {
+	PacketType ExAudioPacketType
+	FourCC     string
+	Data       []byte
+}
+
+func IsExAudioHeader(first byte) bool {
+	return first>>4 == exAudioSoundFormat
+}
+
+func ParseExAudioTag(data []byte) (ExAudioTag, error) {
+	tag := ExAudioTag{}
+	if len(data) < 5 {
+		return tag, fmt.Errorf("ex audio tag too short")
+	}
+	if !IsExAudioHeader(data[0]) {
+		return tag, fmt.Errorf("not an ex audio tag")
+	}
+	tag.PacketType = ExAudioPacketType(data[0] & 0x0f)
+	if tag.PacketType == ExAudioPacketMultitrack {
+		return tag, fmt.Errorf("multitrack audio not supported")
+	}
+	tag.FourCC = string(data[1:5])
+	tag.Data = data[5:]
+	return tag, nil
+}
+
+func AudioCodecFromFourCC(fourCC string) string {
+	switch fourCC {
+	case FourCCAAC:
+		return AudioCodecAAC
+	case FourCCOpus:
+		return AudioCodecOpus
+	case FourCCMP3:
+		return AudioCodecMP3
+	default:
+		return ""
+	}
+}
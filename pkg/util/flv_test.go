@@ -0,0 +1,61 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseExVideoTag(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want ExVideoTag
+		err  bool
+	}{
+		{
+			name: "hevc sequence start",
+			data: []byte{0x90, 'h', 'v', 'c', '1', 0x01, 0x02},
+			want: ExVideoTag{FrameType: ExVideoFrameKey, PacketType: ExVideoPacketSequenceStart, FourCC: FourCCHEVC, Data: []byte{0x01, 0x02}},
+		},
+		{
+			name: "hevc coded frames",
+			data: []byte{0xa1, 'h', 'v', 'c', '1', 0xff, 0xff, 0xd8, 0x00, 0x00, 0x00, 0x01},
+			want: ExVideoTag{FrameType: 2, PacketType: ExVideoPacketCodedFrames, FourCC: FourCCHEVC, CompositionTime: -40, Data: []byte{0x00, 0x00, 0x00, 0x01}},
+		},
+		{
+			name: "hevc coded frames x",
+			data: []byte{0x93, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x01},
+			want: ExVideoTag{FrameType: ExVideoFrameKey, PacketType: ExVideoPacketCodedFramesX, FourCC: FourCCHEVC, Data: []byte{0x00, 0x00, 0x00, 0x01}},
+		},
+		{
+			// AV1 coded frames carry no composition time.
+			name: "av1 coded frames",
+			data: []byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00},
+			want: ExVideoTag{FrameType: ExVideoFrameKey, PacketType: ExVideoPacketCodedFrames, FourCC: FourCCAV1, Data: []byte{0x12, 0x00}},
+		},
+		{name: "legacy header", data: []byte{0x17, 0x00, 0x00, 0x00, 0x00}, err: true},
+		{name: "multitrack", data: []byte{0x96, 'h', 'v', 'c', '1', 0x00}, err: true},
+		{name: "truncated fourcc", data: []byte{0x90, 'h', 'v', 'c'}, err: true},
+		{name: "truncated composition time", data: []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseExVideoTag(tc.data)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("parsed %x as %+v", tc.data, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FrameType != tc.want.FrameType || got.PacketType != tc.want.PacketType || got.FourCC != tc.want.FourCC ||
+				got.CompositionTime != tc.want.CompositionTime || !bytes.Equal(got.Data, tc.want.Data) {
+				t.Errorf("tag = %+v, want %+v", got, tc.want)
+			}
+			if VideoCodecFromFourCC(got.FourCC) == "" {
+				t.Errorf("no codec for fourcc %q", got.FourCC)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/hevc"
+)
+
+type HEVCConfig struct {
+	Record     []byte
+	Profile    byte
+	Level      byte
+	LengthSize int
+	VPS        [][]byte
+	SPS        [][]byte
+	PPS        [][]byte
+}
+
+func ParseHEVCDecoderConfig(data []byte) (HEVCConfig, error) {
+	cfg := HEVCConfig{}
+	if len(data) < 23 {
+		return cfg, fmt.Errorf("hevc config too short")
+	}
+	rec, err := hevc.DecodeHEVCDecConfRec(data)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Record = append([]byte(nil), data...)
+	cfg.Profile = rec.GeneralProfileIDC
+	cfg.Level = rec.GeneralLevelIDC
+	cfg.LengthSize = int(rec.LengthSizeMinusOne) + 1
+	if cfg.LengthSize != 4 {
+		return cfg, fmt.Errorf("unsupported nalu length size %d", cfg.LengthSize)
+	}
+	for _, nalu := range rec.GetNalusForType(hevc.NALU_VPS) {
+		cfg.VPS = append(cfg.VPS, append([]byte(nil), nalu...))
+	}
+	for _, nalu := range rec.GetNalusForType(hevc.NALU_SPS) {
+		cfg.SPS = append(cfg.SPS, append([]byte(nil), nalu...))
+	}
+	for _, nalu := range rec.GetNalusForType(hevc.NALU_PPS) {
+		cfg.PPS = append(cfg.PPS, append([]byte(nil), nalu...))
+	}
+	if len(cfg.VPS) == 0 || len(cfg.SPS) == 0 || len(cfg.PPS) == 0 {
+		return cfg, fmt.Errorf("hevc config missing parameter sets")
+	}
+	return cfg, nil
+}
+
+func EqualHEVCConfig(a, b HEVCConfig) bool {
+	return bytes.Equal(a.Record, b.Record)
+}
@@ -0,0 +1,77 @@
+package util
+
+import "fmt"
+
+const (
+	MPEGVersion1  = 1
+	MPEGVersion2  = 2
+	MPEGVersion25 = 25
+)
+
+type MP3Config struct {
+	Version         int
+	Layer           int
+	SampleRate      int
+	Channels        int
+	SamplesPerFrame int
+}
+
+var mp3SampleRates = map[int][3]int{
+	MPEGVersion1:  {44100, 48000, 32000},
+	MPEGVersion2:  {22050, 24000, 16000},
+	MPEGVersion25: {11025, 12000, 8000},
+}
+
+// ParseMP3FrameHeader reads the 4-byte MPEG audio frame header at the start
+// of an FLV MP3 audio tag body.
+func ParseMP3FrameHeader(data []byte) (MP3Config, error) {
+	cfg := MP3Config{}
+	if len(data) < 4 {
+		return cfg, fmt.Errorf("mp3 frame too short")
+	}
+	if data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+		return cfg, fmt.Errorf("mp3 frame sync missing")
+	}
+	switch (data[1] >> 3) & 0x03 {
+	case 0:
+		cfg.Version = MPEGVersion25
+	case 2:
+		cfg.Version = MPEGVersion2
+	case 3:
+		cfg.Version = MPEGVersion1
+	default:
+		return cfg, fmt.Errorf("mp3 reserved version")
+	}
+	switch (data[1] >> 1) & 0x03 {
+	case 1:
+		cfg.Layer = 3
+	case 2:
+		cfg.Layer = 2
+	case 3:
+		cfg.Layer = 1
+	default:
+		return cfg, fmt.Errorf("mp3 reserved layer")
+	}
+	rateIdx := (data[2] >> 2) & 0x03
+	if rateIdx == 3 {
+		return cfg, fmt.Errorf("mp3 reserved sample rate")
+	}
+	cfg.SampleRate = mp3SampleRates[cfg.Version][rateIdx]
+	cfg.Channels = 2
+	if (data[3]>>6)&0x03 == 3 {
+		cfg.Channels = 1
+	}
+	switch {
+	case cfg.Layer == 1:
+		cfg.SamplesPerFrame = 384
+	case cfg.Layer == 3 && cfg.Version != MPEGVersion1:
+		cfg.SamplesPerFrame = 576
+	default:
+		cfg.SamplesPerFrame = 1152
+	}
+	return cfg, nil
+}
+
+func EqualMP3Config(a, b MP3Config) bool {
+	return a == b
+}
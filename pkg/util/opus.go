@@ -0,0 +1,69 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const opusSampleRate = 48000
+
+type OpusConfig struct {
+	Head            []byte
+	Channels        int
+	PreSkip         uint16
+	InputSampleRate uint32
+	OutputGain      int16
+	MappingFamily   byte
+	StreamCount     byte
+	CoupledCount    byte
+	ChannelMapping  []byte
+}
+
+// ParseOpusHead parses the Opus identification header (RFC 7845 section 5.1)
+// carried in an Enhanced RTMP "Opus" sequence start.
+func ParseOpusHead(data []byte) (OpusConfig, error) {
+	cfg := OpusConfig{}
+	if len(data) < 19 {
+		return cfg, fmt.Errorf("opus head too short")
+	}
+	if !bytes.Equal(data[0:8], []byte("OpusHead")) {
+		return cfg, fmt.Errorf("opus head magic missing")
+	}
+	if data[8]>>4 != 0 {
+		return cfg, fmt.Errorf("unsupported opus head version %d", data[8])
+	}
+	cfg.Head = append([]byte(nil), data...)
+	cfg.Channels = int(data[9])
+	cfg.PreSkip = binary.LittleEndian.Uint16(data[10:12])
+	cfg.InputSampleRate = binary.LittleEndian.Uint32(data[12:16])
+	cfg.OutputGain = int16(binary.LittleEndian.Uint16(data[16:18]))
+	cfg.MappingFamily = data[18]
+	if cfg.Channels == 0 {
+		return cfg, fmt.Errorf("opus head channel count zero")
+	}
+	if cfg.MappingFamily != 0 {
+		if len(data) < 21+cfg.Channels {
+			return cfg, fmt.Errorf("opus head channel mapping too short")
+		}
+		cfg.StreamCount = data[19]
+		cfg.CoupledCount = data[20]
+		cfg.ChannelMapping = append([]byte(nil), data[21:21+cfg.Channels]...)
+	}
+	return cfg, nil
+}
+
+// DefaultOpusConfig derives a mapping family 0 config from the TOC byte of a
+// packet, for publishers that send coded frames without a sequence start.
+func DefaultOpusConfig(packet []byte) OpusConfig {
+	channels := 2
+	if len(packet) > 0 && packet[0]&0x04 == 0 {
+		channels = 1
+	}
+	return OpusConfig{Channels: channels, InputSampleRate: opusSampleRate}
+}
+
+func EqualOpusConfig(a, b OpusConfig) bool {
+	return a.Channels == b.Channels && a.PreSkip == b.PreSkip && a.MappingFamily == b.MappingFamily &&
+		bytes.Equal(a.ChannelMapping, b.ChannelMapping)
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/av1"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+func SetVideoDescriptor(trak *mp4.TrakBox, cfg VideoConfig) error {
+	switch cfg.Codec {
+	case VideoCodecH264:
+		return trak.SetAVCDescriptor("avc1", cfg.AVC.SPS, cfg.AVC.PPS, true)
+	case VideoCodecHEVC:
+		return trak.SetHEVCDescriptor("hvc1", cfg.HEVC.VPS, cfg.HEVC.SPS, cfg.HEVC.PPS, nil, true)
+	case VideoCodecAV1:
+		rec, err := av1.DecodeAV1CodecConfRec(cfg.AV1.Record)
+		if err != nil {
+			return err
+		}
+		width, height := uint16(cfg.AV1.Width), uint16(cfg.AV1.Height)
+		trak.Tkhd.Width = mp4.Fixed32(uint32(width) << 16)
+		trak.Tkhd.Height = mp4.Fixed32(uint32(height) << 16)
+		av01 := mp4.CreateVisualSampleEntryBox("av01", width, height, &mp4.Av1CBox{CodecConfRec: rec})
+		trak.Mdia.Minf.Stbl.Stsd.AddChild(av01)
+		return nil
+	default:
+		return fmt.Errorf("unsupported video codec %q", cfg.Codec)
+	}
+}
+
+func AddAudioDescriptor(trak *mp4.TrakBox, cfg AudioConfig) error {
+	channels := cfg.Channels()
+	if channels == 0 {
+		channels = 2
+	}
+	stsd := trak.Mdia.Minf.Stbl.Stsd
+	switch cfg.Codec {
+	case AudioCodecAAC:
+		esds := mp4.CreateEsdsBox(cfg.AAC.ASC)
+		stsd.AddChild(mp4.CreateAudioSampleEntryBox("mp4a", uint16(channels), 16, uint16(cfg.SampleRate()), esds))
+	case AudioCodecOpus:
+		dops := &mp4.DopsBox{
+			Version:              0,
+			OutputChannelCount:   byte(channels),
+			PreSkip:              cfg.Opus.PreSkip,
+			InputSampleRate:      cfg.Opus.InputSampleRate,
+			OutputGain:           cfg.Opus.OutputGain,
+			ChannelMappingFamily: cfg.Opus.MappingFamily,
+			StreamCount:          cfg.Opus.StreamCount,
+			CoupledCount:         cfg.Opus.CoupledCount,
+			ChannelMapping:       cfg.Opus.ChannelMapping,
+		}
+		stsd.AddChild(mp4.CreateAudioSampleEntryBox("Opus", uint16(channels), 16, uint16(cfg.SampleRate()), dops))
+	case AudioCodecMP3:
+		esds := mp4.CreateEsdsBox(nil)
+		esds.DecConfigDescriptor.ObjectType = MP3ObjectType(cfg.MP3)
+		esds.DecConfigDescriptor.DecSpecificInfo = nil
+		stsd.AddChild(mp4.CreateAudioSampleEntryBox("mp4a", uint16(channels), 16, uint16(cfg.SampleRate()), esds))
+	default:
+		return fmt.Errorf("unsupported audio codec %q", cfg.Codec)
+	}
+	return nil
+}
+
+// MP3ObjectType returns the MPEG-4 objectTypeIndication for an MP3 stream:
+// 0x6B for MPEG-1 audio and 0x69 for the MPEG-2 low sampling rate extension.
+func MP3ObjectType(cfg MP3Config) byte {
+	if cfg.Version == MPEGVersion1 {
+		return 0x6B
+	}
+	return 0x69
+}
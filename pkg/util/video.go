@@ -0,0 +1,74 @@
+package util
+
+import (
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/hevc"
+)
+
+const (
+	VideoCodecH264 = "H264"
+	VideoCodecHEVC = "HEVC"
+	VideoCodecAV1  = "AV1"
+)
+
+type VideoConfig struct {
+	Codec string
+	AVC   AVCConfig
+	HEVC  HEVCConfig
+	AV1   AV1Config
+}
+
+func (c VideoConfig) Ready() bool {
+	switch c.Codec {
+	case VideoCodecH264:
+		return len(c.AVC.SPS) > 0 && len(c.AVC.PPS) > 0
+	case VideoCodecHEVC:
+		return len(c.HEVC.VPS) > 0 && len(c.HEVC.SPS) > 0 && len(c.HEVC.PPS) > 0
+	case VideoCodecAV1:
+		return len(c.AV1.Record) > 0
+	default:
+		return false
+	}
+}
+
+func EqualVideoConfig(a, b VideoConfig) bool {
+	if a.Codec != b.Codec {
+		return false
+	}
+	switch a.Codec {
+	case VideoCodecH264:
+		return EqualAVCConfig(a.AVC, b.AVC)
+	case VideoCodecHEVC:
+		return EqualHEVCConfig(a.HEVC, b.HEVC)
+	case VideoCodecAV1:
+		return EqualAV1Config(a.AV1, b.AV1)
+	default:
+		return true
+	}
+}
+
+func ParseVideoConfig(codec string, data []byte) (VideoConfig, error) {
+	cfg := VideoConfig{Codec: codec}
+	var err error
+	switch codec {
+	case VideoCodecHEVC:
+		cfg.HEVC, err = ParseHEVCDecoderConfig(data)
+	case VideoCodecAV1:
+		cfg.AV1, err = ParseAV1CodecConfig(data)
+	default:
+		cfg.Codec = VideoCodecH264
+		cfg.AVC, err = ParseAVCDecoderConfig(data)
+	}
+	return cfg, err
+}
+
+func IsKeyframeSample(codec string, data []byte) bool {
+	switch codec {
+	case VideoCodecH264:
+		return avc.IsIDRSample(data)
+	case VideoCodecHEVC:
+		return hevc.IsRAPSample(data)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// av1CFixture is the av1C box payload of a 1920x1080 10-bit Main stream.
+const av1CFixture = "81094c000a0b0000004aabbfc377ffe701"
+
+// hvcCFixture is the hvcC box payload of a 3840x2160 Main 10 stream.
+const hvcCFixture = "010200000020b000000000009c00000001020200000f03a00001001840010c01ffff022000000300b0000003000003009c15c090a100010025420101022000000300b0000003000003009ca001e020021c4d8815ee4595602d4244024020a2000100094401c02864b8d05324"
+
+func TestParseVideoConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		codec         string
+		data          string
+		codecString   string
+		width, height int
+	}{
+		{name: "hevc", codec: VideoCodecHEVC, data: hvcCFixture, codecString: "hvc1.2.4.L156.B0", width: 3840, height: 2160},
+		{name: "av1", codec: VideoCodecAV1, data: av1CFixture, codecString: "av01.0.09M.10", width: 1920, height: 1080},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ParseVideoConfig(tc.codec, mustHex(t, tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cfg.Ready() {
+				t.Fatalf("config not ready: %+v", cfg)
+			}
+			if got := cfg.CodecString(); got != tc.codecString {
+				t.Errorf("codec string = %q, want %q", got, tc.codecString)
+			}
+			if w, h := cfg.Dimensions(); w != tc.width || h != tc.height {
+				t.Errorf("dimensions = %dx%d, want %dx%d", w, h, tc.width, tc.height)
+			}
+		})
+	}
+}
+
+func TestParseVideoConfigTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		codec string
+		data  string
+	}{
+		{name: "hevc header", codec: VideoCodecHEVC, data: hvcCFixture[:44]},
+		{name: "hevc parameter sets", codec: VideoCodecHEVC, data: hvcCFixture[:80]},
+		{name: "av1 record", codec: VideoCodecAV1, data: av1CFixture[:6]},
+		{name: "av1 sequence header", codec: VideoCodecAV1, data: av1CFixture[:20]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if cfg, err := ParseVideoConfig(tc.codec, mustHex(t, tc.data)); err == nil {
+				t.Fatalf("parsed truncated config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestParseHEVCDecoderConfig(t *testing.T) {
+	cfg, err := ParseHEVCDecoderConfig(mustHex(t, hvcCFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profile != 2 || cfg.Level != 156 || cfg.LengthSize != 4 {
+		t.Errorf("profile/level/length = %d/%d/%d, want 2/156/4", cfg.Profile, cfg.Level, cfg.LengthSize)
+	}
+	if len(cfg.VPS) != 1 || len(cfg.SPS) != 1 || len(cfg.PPS) != 1 {
+		t.Errorf("parameter sets = %d/%d/%d, want one of each", len(cfg.VPS), len(cfg.SPS), len(cfg.PPS))
+	}
+}
+
+func TestParseAV1SequenceHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    av1SequenceHeader
+	}{
+		{
+			name:    "operating points",
+			payload: "0000004aabbfc377ffe701",
+			want:    av1SequenceHeader{profile: 0, level: 9, tier: 0, bitDepth: 10, width: 1920, height: 1080},
+		},
+		{
+			// Profile 2, 12-bit, reduced_still_picture_header.
+			name:    "reduced still picture",
+			payload: "5a2a67fd9e06",
+			want:    av1SequenceHeader{profile: 2, level: 8, tier: 0, bitDepth: 12, width: 1280, height: 720},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := mustHex(t, tc.payload)
+			got, err := parseAV1SequenceHeader(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("header = %+v, want %+v", got, tc.want)
+			}
+			if _, err := parseAV1SequenceHeader(payload[:3]); err == nil {
+				t.Error("parsed a truncated sequence header")
+			}
+		})
+	}
+}